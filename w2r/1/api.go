@@ -0,0 +1,725 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// mimeNDJSON is the media type of streamed visitor lists.
+const mimeNDJSON = "application/x-ndjson"
+
+// apiVersion renders the resources of one version of the visitor API.
+// All versions share the handlers below; a new version only has to
+// describe how its representation differs.
+type apiVersion struct {
+	Name       string // e.g. "v1", also accepted as the API-Version header
+	Deprecated time.Time
+	Sunset     time.Time
+	Successor  string // path of the resource that replaces a deprecated version
+
+	// Paginate reports whether lists are paged when the request does not
+	// ask for a page.
+	Paginate bool
+
+	Visitor func(v *visitorResource) interface{}
+	Error   func(e *apiError) interface{}
+	Created func(c *gin.Context, v *visitorResource)
+	List    func(c *gin.Context, l *visitorList)
+}
+
+// fail writes an error response.
+func (v *apiVersion) fail(c *gin.Context, status int, code, message string) {
+	c.JSON(status, v.Error(&apiError{status, code, message}))
+}
+
+// apiV1 is the current version. Visitors are plain objects without CouchDB
+// internals; errors carry a code in addition to the message.
+var apiV1 = &apiVersion{
+	Name:     "v1",
+	Paginate: true,
+	Visitor: func(v *visitorResource) interface{} {
+		return v1Visitor(v)
+	},
+	Error: func(e *apiError) interface{} {
+		return gin.H{"error": e.Message, "code": e.Code}
+	},
+	Created: func(c *gin.Context, v *visitorResource) {
+		c.Header("Location", basePath(c, "visitors")+"visitors/"+v.ID)
+		c.Header("Content-Language", v.Locale)
+		c.Header("ETag", revETag(v.Rev))
+		c.JSON(http.StatusCreated, v1Visitor(v))
+	},
+	List: func(c *gin.Context, l *visitorList) {
+		visitors := make([]gin.H, len(l.Visitors))
+		for i := range l.Visitors {
+			visitors[i] = v1Visitor(&l.Visitors[i])
+		}
+		c.Header("X-Total-Count", strconv.Itoa(l.Total))
+		c.JSON(http.StatusOK, gin.H{"visitors": visitors, "total": l.Total, "page": l.Page, "per_page": l.PerPage})
+	},
+}
+
+func v1Visitor(v *visitorResource) gin.H {
+	h := gin.H{"id": v.ID, "name": html.EscapeString(v.Name)}
+	if v.Locale != "" {
+		h["locale"] = v.Locale
+	}
+	if !v.Created.IsZero() {
+		h["created_at"] = v.Created.UTC().Format(createdLayout)
+	}
+	if len(v.Tags) > 0 {
+		h["tags"] = v.Tags
+	}
+	if !v.Deleted.IsZero() {
+		h["deleted_at"] = v.Deleted.UTC().Format(createdLayout)
+	}
+	if v.Greeting != "" {
+		h["greeting"] = html.EscapeString(v.Greeting)
+	}
+	return h
+}
+
+// legacyAPI adapts the handlers to the unversioned /api/visitors routes,
+// which return raw _all_docs rows and plain text greetings.
+var legacyAPI = &apiVersion{
+	Name:       "legacy",
+	Deprecated: time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+	Sunset:     time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+	Successor:  "/api/v1/visitors",
+	Visitor: func(v *visitorResource) interface{} {
+		return legacyRow(v)["doc"]
+	},
+	Error: func(e *apiError) interface{} {
+		return gin.H{"error": e.Message}
+	},
+	Created: func(c *gin.Context, v *visitorResource) {
+		if c.ContentType() == gin.MIMEPOSTForm {
+			base := basePath(c, "api/visitors")
+			setFlash(c, base, v.Greeting)
+			c.Redirect(http.StatusSeeOther, base)
+			return
+		}
+		c.Header("Content-Language", v.Locale)
+		c.String(http.StatusOK, "%s", html.EscapeString(v.Greeting))
+	},
+	List: func(c *gin.Context, l *visitorList) {
+		if l.Offline {
+			c.JSON(http.StatusOK, gin.H{})
+			return
+		}
+		rows := make([]gin.H, len(l.Visitors))
+		for i := range l.Visitors {
+			rows[i] = legacyRow(&l.Visitors[i])
+		}
+		c.Header("X-Total-Count", strconv.Itoa(l.Total))
+		c.JSON(http.StatusOK, rows)
+	},
+}
+
+// legacyRow rebuilds the _all_docs row of a visitor.
+func legacyRow(v *visitorResource) gin.H {
+	doc := gin.H{"_id": v.ID, "_rev": v.Rev, "name": html.EscapeString(v.Name)}
+	if v.Locale != "" {
+		doc["locale"] = v.Locale
+	}
+	if !v.Created.IsZero() {
+		doc["created_at"] = v.Created.UTC().Format(createdLayout)
+	}
+	if len(v.Tags) > 0 {
+		doc["tags"] = v.Tags
+	}
+	return gin.H{"id": v.ID, "key": v.ID, "value": gin.H{"rev": v.Rev}, "doc": doc}
+}
+
+// apiVersions lists the versions that clients can ask for with the
+// API-Version header or an Accept media type. The route groups pin a
+// version; /api/visitors defaults to legacyAPI.
+var apiVersions = []*apiVersion{apiV1}
+
+var versionMediaType = regexp.MustCompile(`^application/vnd\.visitors\.(v[0-9]+)\+json$`)
+
+// requestedAPIVersion returns the version that the client asked for with
+// the API-Version header, e.g. "1" or "v1", or with an Accept media type
+// like application/vnd.visitors.v1+json.
+func requestedAPIVersion(c *gin.Context) (*apiVersion, bool) {
+	name := strings.ToLower(c.Request.Header.Get("API-Version"))
+	if name != "" && !strings.HasPrefix(name, "v") {
+		name = "v" + name
+	}
+	if name == "" {
+		for _, part := range strings.Split(c.Request.Header.Get("Accept"), ",") {
+			mediaType := strings.TrimSpace(strings.Split(part, ";")[0])
+			if m := versionMediaType.FindStringSubmatch(mediaType); m != nil {
+				name = m[1]
+				break
+			}
+		}
+	}
+	for _, v := range apiVersions {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// pinAPIVersion selects the version of a route group.
+func pinAPIVersion(v *apiVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("apiVersion", v)
+		c.Next()
+	}
+}
+
+// apiVersionOf returns the version that renders the response to c and
+// sets the version headers.
+func apiVersionOf(c *gin.Context) *apiVersion {
+	pinned, _ := c.Get("apiVersion")
+	v, ok := pinned.(*apiVersion)
+	if !ok {
+		v = legacyAPI
+	}
+	if requested, ok := requestedAPIVersion(c); ok && v == legacyAPI {
+		v = requested
+	}
+	c.Header("API-Version", v.Name)
+	c.Writer.Header().Add("Vary", "API-Version")
+	if !v.Deprecated.IsZero() {
+		c.Header("Deprecation", "@"+strconv.FormatInt(v.Deprecated.Unix(), 10))
+		c.Header("Sunset", v.Sunset.Format(http.TimeFormat))
+		successor := v.Successor
+		if tenant := c.Param("tenant"); tenant != "" {
+			successor = "/t/" + tenant + successor
+		}
+		c.Header("Link", "<"+successor+`>; rel="successor-version"`)
+	}
+	return v
+}
+
+// visitorsAPI holds the HTTP handlers of the visitor API.
+type visitorsAPI struct {
+	visitors *visitorService
+	keyTTL   time.Duration // retention of Idempotency-Key responses
+	suggest  *suggestIndex // of the single guestbook, nil in tenant mode
+}
+
+// register adds the handlers of version v to g.
+func (a *visitorsAPI) register(g *gin.RouterGroup, v *apiVersion) {
+	g.Use(pinAPIVersion(v))
+	g.GET("/visitors", a.List)
+	g.POST("/visitors", a.Create)
+	g.POST("/visitors/search", a.Search)
+	//gin can not route /visitors/suggest next to /visitors/:id, so the
+	//:id route serves the suggestions. Ids are generated by the store and
+	//never "suggest".
+	g.GET("/visitors/:id", func(c *gin.Context) {
+		if c.Param("id") == "suggest" {
+			a.Suggest(c)
+			return
+		}
+		a.Get(c)
+	})
+	g.PUT("/visitors/:id", a.Update)
+	g.DELETE("/visitors/:id", a.Delete)
+	g.GET("/visitors/:id/history", a.History)
+	g.GET("/visitors/:id/history/:rev", a.Version)
+	g.PUT("/visitors/:id/restore", a.Restore)
+	g.GET("/trash", a.Trash)
+	g.POST("/trash/:id/restore", a.Undelete)
+	g.DELETE("/trash/:id", a.Purge)
+	g.GET("/stats", a.Stats)
+}
+
+// requestTimeoutFromEnv returns the deadline of visitor requests,
+// REQUEST_TIMEOUT.
+func requestTimeoutFromEnv() time.Duration {
+	d := 30 * time.Second
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			log.Printf("ignoring invalid REQUEST_TIMEOUT %q", v)
+		} else {
+			d = parsed
+		}
+	}
+	return d
+}
+
+// withTimeout sets a deadline on the request context, which the handlers
+// pass to the database, so that its requests are aborted when it passes
+// or the client disconnects. NDJSON streams have no deadline. 0 turns
+// the deadline off.
+func withTimeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d <= 0 || strings.Contains(c.Request.Header.Get("Accept"), mimeNDJSON) {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// failWith writes the response for an error of the visitor service.
+func (v *apiVersion) failWith(c *gin.Context, err error) {
+	e := asAPIError(err)
+	c.JSON(e.Status, v.Error(e))
+}
+
+/**
+ * GET /api/v1/visitors?page=1&per_page=20
+ * Lists the visitors of the database. With Accept: application/x-ndjson
+ * all visitors are streamed instead, one JSON object per line.
+ * GET /api/v1/visitors?q=ann returns the first per_page visitors with a
+ * name word starting with each word of q.
+ * The ETag changes with the update sequence of the database, so polling
+ * clients can send If-None-Match and get 304 Not Modified.
+ */
+func (a *visitorsAPI) List(c *gin.Context) {
+	v := apiVersionOf(c)
+	store := visitorStore(c)
+	if store != nil && a.listNotModified(c, v, store) {
+		return
+	}
+	if store != nil && strings.Contains(c.Request.Header.Get("Accept"), mimeNDJSON) {
+		a.stream(c, v, store)
+		return
+	}
+	page, perPage, paged := pageParams(c)
+	if q := c.Query("q"); q != "" {
+		l, err := a.visitors.Search(c.Request.Context(), store, q, perPage)
+		if err != nil {
+			v.failWith(c, err)
+			return
+		}
+		v.List(c, l)
+		return
+	}
+	if !paged && !v.Paginate {
+		perPage = 0
+	}
+	l, err := a.visitors.List(c.Request.Context(), store, page, perPage)
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	v.List(c, l)
+}
+
+/**
+ * POST /api/v1/visitors
+ * { "name": "Bob", "lang": "de", "tags": ["speaker"] }
+ * Greets and stores a visitor. The optional lang field overrides
+ * Accept-Language negotiation. With an Idempotency-Key header, retries
+ * of the request get the first response instead of creating another
+ * visitor.
+ */
+func (a *visitorsAPI) Create(c *gin.Context) {
+	v := apiVersionOf(c)
+	if key := c.Request.Header.Get("Idempotency-Key"); key != "" {
+		a.idempotent(c, v, key, opCreateVisitor, func() { a.create(c, v) })
+		return
+	}
+	a.create(c, v)
+}
+
+func (a *visitorsAPI) create(c *gin.Context, v *apiVersion) {
+	var req struct {
+		Name string   `json:"name" form:"name"`
+		Lang string   `json:"lang" form:"lang"`
+		Tags []string `json:"tags" form:"tags"`
+	}
+	if err := binding.Default(c.Request.Method, c.ContentType()).Bind(c.Request, &req); err != nil {
+		v.fail(c, http.StatusBadRequest, codeInvalidRequest, "invalid body: "+err.Error())
+		return
+	}
+	var tenant *Tenant
+	if t, ok := c.Get("tenant"); ok {
+		tenant = t.(*Tenant)
+	}
+	visitor, err := a.visitors.Create(c.Request.Context(), visitorStore(c), tenant, req.Name, req.Tags, req.Lang, c.Request.Header.Get("Accept-Language"))
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	v.Created(c, visitor)
+}
+
+/**
+ * POST /api/v1/visitors/search
+ * { "name_prefix": "an", "created_after": "2026-10-01", "tags": ["speaker"],
+ *   "locales": ["de", "fr"], "limit": 20 }
+ * Returns the visitors that match every given condition, and a bookmark
+ * to send along for the next page. The conditions are validated and
+ * translated to a database query by the server.
+ */
+func (a *visitorsAPI) Search(c *gin.Context) {
+	v := apiVersionOf(c)
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSearchBody+1))
+	if err != nil || len(body) > maxSearchBody {
+		v.fail(c, http.StatusBadRequest, codeInvalidRequest, "invalid body")
+		return
+	}
+	f, bookmark, limit, err := parseVisitorSearch(body)
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	visitors, next, err := a.visitors.Find(c.Request.Context(), visitorStore(c), f, bookmark, limit)
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	out := make([]interface{}, len(visitors))
+	for i := range visitors {
+		out[i] = v.Visitor(&visitors[i])
+	}
+	resp := gin.H{"visitors": out}
+	if next != "" {
+		resp["bookmark"] = next
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/**
+ * GET /api/visitors/suggest?q=anan&limit=10
+ * GET /api/v1/visitors/suggest?q=anan&limit=10
+ * Returns the visitors whose names best match q for typeahead, tolerating
+ * typos, from the in-memory index of the guestbook. The last word of q
+ * may be incomplete. Until the index is built, and in tenant mode, the
+ * visitors with a name word starting with each word of q are returned.
+ */
+func (a *visitorsAPI) Suggest(c *gin.Context) {
+	//The route is new, so only its errors use the version headers.
+	q := strings.TrimSpace(c.Query("q"))
+	if utf8.RuneCountInString(q) > maxSuggestQuery {
+		apiVersionOf(c).fail(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("q must be at most %d characters", maxSuggestQuery))
+		return
+	}
+	limit := defaultSuggestions
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxSuggestions {
+		limit = maxSuggestions
+	}
+	suggestions := []gin.H{}
+	if a.suggest != nil && a.suggest.Ready() {
+		for _, s := range a.suggest.Suggest(q, limit) {
+			h := gin.H{"id": s.ID, "name": html.EscapeString(s.Name), "score": math.Round(s.Score*1000) / 1000}
+			if s.Locale != "" {
+				h["locale"] = s.Locale
+			}
+			suggestions = append(suggestions, h)
+		}
+		c.JSON(http.StatusOK, gin.H{"suggestions": suggestions})
+		return
+	}
+	if q != "" {
+		l, err := a.visitors.Search(c.Request.Context(), visitorStore(c), q, limit)
+		if err != nil {
+			apiVersionOf(c).failWith(c, err)
+			return
+		}
+		for i := range l.Visitors {
+			h := gin.H{"id": l.Visitors[i].ID, "name": html.EscapeString(l.Visitors[i].Name)}
+			if l.Visitors[i].Locale != "" {
+				h["locale"] = l.Visitors[i].Locale
+			}
+			suggestions = append(suggestions, h)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"suggestions": suggestions})
+}
+
+/**
+ * GET /api/v1/visitors/:id
+ * Returns a single visitor. The ETag is its revision.
+ */
+func (a *visitorsAPI) Get(c *gin.Context) {
+	v := apiVersionOf(c)
+	visitor, err := a.visitors.Get(c.Request.Context(), visitorStore(c), c.Param("id"))
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	if notModified(c, revETag(visitor.Rev)) {
+		return
+	}
+	c.JSON(http.StatusOK, v.Visitor(visitor))
+}
+
+/**
+ * PUT /api/v1/visitors/:id
+ * { "name": "Bob", "locale": "de" }
+ * Renames a visitor. An empty locale keeps the current one. With
+ * If-Match the visitor is only renamed at the given revision.
+ */
+func (a *visitorsAPI) Update(c *gin.Context) {
+	v := apiVersionOf(c)
+	var req struct {
+		Name   string `json:"name"`
+		Locale string `json:"locale"`
+	}
+	if err := binding.JSON.Bind(c.Request, &req); err != nil {
+		v.fail(c, http.StatusBadRequest, codeInvalidRequest, "invalid body: "+err.Error())
+		return
+	}
+	visitor, err := a.visitors.Update(c.Request.Context(), visitorStore(c), c.Param("id"), req.Name, req.Locale, c.Request.Header.Get("If-Match"))
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	c.Header("ETag", revETag(visitor.Rev))
+	c.JSON(http.StatusOK, v.Visitor(visitor))
+}
+
+/**
+ * DELETE /api/v1/visitors/:id
+ * Moves a visitor to the trash, only at the given revision with
+ * If-Match.
+ */
+func (a *visitorsAPI) Delete(c *gin.Context) {
+	v := apiVersionOf(c)
+	if err := a.visitors.Delete(c.Request.Context(), visitorStore(c), c.Param("id"), c.Request.Header.Get("If-Match")); err != nil {
+		v.failWith(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+/**
+ * GET /api/v1/trash?limit=20&bookmark=…
+ * Lists the visitors in the trash, longest deleted first, and a bookmark
+ * to send along for the next page.
+ */
+func (a *visitorsAPI) Trash(c *gin.Context) {
+	v := apiVersionOf(c)
+	limit := defaultPerPage
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxPerPage {
+		limit = maxPerPage
+	}
+	visitors, next, err := a.visitors.Trash(c.Request.Context(), visitorStore(c), c.Query("bookmark"), limit)
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	out := make([]interface{}, len(visitors))
+	for i := range visitors {
+		out[i] = v.Visitor(&visitors[i])
+	}
+	resp := gin.H{"visitors": out}
+	if next != "" {
+		resp["bookmark"] = next
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+/**
+ * POST /api/v1/trash/:id/restore
+ * Takes a visitor out of the trash, only at the given revision with
+ * If-Match.
+ */
+func (a *visitorsAPI) Undelete(c *gin.Context) {
+	v := apiVersionOf(c)
+	visitor, err := a.visitors.Undelete(c.Request.Context(), visitorStore(c), c.Param("id"), c.Request.Header.Get("If-Match"))
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	c.Header("ETag", revETag(visitor.Rev))
+	c.JSON(http.StatusOK, v.Visitor(visitor))
+}
+
+/**
+ * DELETE /api/v1/trash/:id
+ * Purges a visitor in the trash for good, only at the given revision
+ * with If-Match. Its audit trail is kept.
+ */
+func (a *visitorsAPI) Purge(c *gin.Context) {
+	v := apiVersionOf(c)
+	if err := a.visitors.Purge(c.Request.Context(), visitorStore(c), c.Param("id"), c.Request.Header.Get("If-Match")); err != nil {
+		v.failWith(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+/**
+ * GET /api/v1/visitors/:id/history
+ * Returns the revisions of a visitor, newest first, with the audit record
+ * of each change: who made it, in which request, from which address, and
+ * the changed fields. Versions that can be reconstructed are included,
+ * also of deleted visitors.
+ */
+func (a *visitorsAPI) History(c *gin.Context) {
+	v := apiVersionOf(c)
+	id := c.Param("id")
+	history, err := a.visitors.History(c.Request.Context(), visitorStore(c), id)
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	revisions := make([]gin.H, len(history))
+	for i, e := range history {
+		h := gin.H{"status": e.Status}
+		if e.Rev != "" {
+			h["rev"] = e.Rev
+		}
+		if e.Visitor != nil {
+			h["visitor"] = v.Visitor(e.Visitor)
+		}
+		if e.Audit != nil {
+			h["audit"] = v1Audit(e.Audit)
+		}
+		revisions[i] = h
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "revisions": revisions})
+}
+
+// v1Audit escapes names like v1Visitor does.
+func v1Audit(rec *auditRecord) gin.H {
+	changes := make([]gin.H, len(rec.Changes))
+	for i, ch := range rec.Changes {
+		from, to := ch.From, ch.To
+		if ch.Field == "name" {
+			if s, ok := from.(string); ok {
+				from = html.EscapeString(s)
+			}
+			if s, ok := to.(string); ok {
+				to = html.EscapeString(s)
+			}
+		}
+		changes[i] = gin.H{"field": ch.Field, "from": from, "to": to}
+	}
+	h := gin.H{"action": rec.Action, "actor": rec.Actor, "at": rec.At.UTC().Format(time.RFC3339Nano), "changes": changes}
+	if rec.BaseRev != "" {
+		h["base_rev"] = rec.BaseRev
+	}
+	if rec.RequestID != "" {
+		h["request_id"] = rec.RequestID
+	}
+	if rec.SourceIP != "" {
+		h["source_ip"] = rec.SourceIP
+	}
+	return h
+}
+
+/**
+ * GET /api/v1/visitors/:id/history/:rev
+ * Returns a visitor as of a revision of its history. The ETag is that
+ * revision.
+ */
+func (a *visitorsAPI) Version(c *gin.Context) {
+	v := apiVersionOf(c)
+	visitor, err := a.visitors.Version(c.Request.Context(), visitorStore(c), c.Param("id"), c.Param("rev"))
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	if notModified(c, revETag(visitor.Rev)) {
+		return
+	}
+	c.JSON(http.StatusOK, v.Visitor(visitor))
+}
+
+/**
+ * PUT /api/v1/visitors/:id/restore
+ * { "rev": "2-…" }
+ * Writes the name, locale and tags of an earlier revision as a new
+ * revision. With If-Match the visitor is only restored at the given
+ * revision.
+ */
+func (a *visitorsAPI) Restore(c *gin.Context) {
+	v := apiVersionOf(c)
+	var req struct {
+		Rev string `json:"rev"`
+	}
+	if err := binding.JSON.Bind(c.Request, &req); err != nil || req.Rev == "" {
+		v.fail(c, http.StatusBadRequest, codeInvalidRequest, "rev is required")
+		return
+	}
+	visitor, err := a.visitors.Restore(c.Request.Context(), visitorStore(c), c.Param("id"), req.Rev, c.Request.Header.Get("If-Match"))
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	c.Header("ETag", revETag(visitor.Rev))
+	c.JSON(http.StatusOK, v.Visitor(visitor))
+}
+
+/**
+ * GET /api/v1/stats
+ * Counts the visitors by locale. The ETag works like for the list.
+ */
+func (a *visitorsAPI) Stats(c *gin.Context) {
+	v := apiVersionOf(c)
+	store := visitorStore(c)
+	if store != nil && a.listNotModified(c, v, store) {
+		return
+	}
+	stats, err := a.visitors.Stats(c.Request.Context(), store)
+	if err != nil {
+		v.failWith(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"visitors": stats.Visitors, "locales": stats.Locales})
+}
+
+// listNotModified sets the ETag of a response derived from the whole
+// store and answers 304 if the client has it already. Without an update
+// sequence the response is sent without an ETag.
+func (a *visitorsAPI) listNotModified(c *gin.Context, v *apiVersion, store VisitorStore) bool {
+	seq, err := a.visitors.UpdateSeq(c.Request.Context(), store)
+	if err != nil {
+		return false
+	}
+	return notModified(c, listETag(c, v, seq))
+}
+
+// stream writes every visitor as one line of newline-delimited JSON,
+// reading the store a page at a time. An error after the first line has
+// been sent is reported as a final error line.
+func (a *visitorsAPI) stream(c *gin.Context, v *apiVersion, store VisitorStore) {
+	c.Header("Content-Type", mimeNDJSON)
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	ctx := c.Request.Context()
+	for after := ""; ctx.Err() == nil; {
+		visitors, next, err := a.visitors.Scan(ctx, store, after, maxPerPage)
+		if err != nil {
+			enc.Encode(v.Error(asAPIError(err)))
+			return
+		}
+		for i := range visitors {
+			if err := enc.Encode(v.Visitor(&visitors[i])); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+		if next == "" {
+			return
+		}
+		after = next
+	}
+}
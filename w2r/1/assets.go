@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// The frontend, the default message catalogs, the OpenAPI document and the
+// database migrations are embedded in the binary, so the app does not
+// depend on third-party CDNs or on files next to the executable.
+//
+//go:embed static templates locales openapi migrations
+var embedded embed.FS
+
+// asset is an embedded static file with its pre-compressed variants.
+type asset struct {
+	name        string // path below static/, e.g. "lib/bootstrap/css/bootstrap.min.css"
+	fingerprint string // name with the content hash inserted before the extension
+	contentType string
+	hash        string
+	data        []byte
+	gzip        []byte // nil if compression does not pay off
+	br          []byte
+}
+
+// assetStore serves the embedded static files. Every file is reachable under
+// its plain name, which clients must revalidate, and under a fingerprinted
+// name, which can be cached forever because its content never changes.
+type assetStore struct {
+	byName        map[string]*asset
+	byFingerprint map[string]*asset
+}
+
+var (
+	// htmlAssetRef matches asset references in templates, e.g. static/styles.css.
+	htmlAssetRef = regexp.MustCompile(`static/[A-Za-z0-9_./-]+`)
+	// cssAssetRef matches url() references in stylesheets. The first group is
+	// the referenced path, the second an optional query or fragment.
+	cssAssetRef = regexp.MustCompile(`url\(\s*['"]?([^'"?#()\s]+)([?#][^'"()\s]*)?['"]?\s*\)`)
+)
+
+// newAssetStore loads, fingerprints and compresses all files below root.
+// Stylesheets are loaded last so that their url() references can be
+// rewritten to the fingerprinted names of the files they point to.
+func newAssetStore(fsys fs.FS, root string) (*assetStore, error) {
+	var names []string
+	err := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			names = append(names, strings.TrimPrefix(p, root+"/"))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return path.Ext(names[i]) != ".css" && path.Ext(names[j]) == ".css"
+	})
+
+	s := &assetStore{byName: make(map[string]*asset), byFingerprint: make(map[string]*asset)}
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, path.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+		if path.Ext(name) == ".css" {
+			data = s.rewriteCSS(name, data)
+		}
+		a, err := newAsset(name, data)
+		if err != nil {
+			return nil, err
+		}
+		s.byName[a.name] = a
+		s.byFingerprint[a.fingerprint] = a
+	}
+	return s, nil
+}
+
+func newAsset(name string, data []byte) (*asset, error) {
+	sum := sha256.Sum256(data)
+	ext := path.Ext(name)
+	a := &asset{
+		name:        name,
+		hash:        hex.EncodeToString(sum[:])[:16],
+		contentType: mime.TypeByExtension(ext),
+		data:        data,
+	}
+	a.fingerprint = strings.TrimSuffix(name, ext) + "." + a.hash + ext
+	if a.contentType == "" {
+		a.contentType = http.DetectContentType(data)
+	}
+	if !compressible(a.contentType) {
+		return a, nil
+	}
+
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() < len(data)*9/10 {
+		a.gzip = append([]byte(nil), buf.Bytes()...)
+	}
+
+	buf.Reset()
+	br := brotli.NewWriterLevel(&buf, brotliLevel(len(data)))
+	if _, err := br.Write(data); err != nil {
+		return nil, err
+	}
+	if err := br.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() < len(data)*9/10 {
+		a.br = append([]byte(nil), buf.Bytes()...)
+	}
+	return a, nil
+}
+
+// brotliLevel returns the compression level for an asset of size bytes.
+// The best level takes seconds on bundles of a megabyte or more, which
+// would slow down every start of the app for a few percent of size.
+func brotliLevel(size int) int {
+	if size > 256<<10 {
+		return 9
+	}
+	return brotli.BestCompression
+}
+
+// compressible reports whether content of the given type benefits from
+// compression. Images and web fonts other than SVG are already compressed.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "javascript"),
+		strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/vnd.ms-fontobject",
+		mediaType == "font/ttf":
+		return true
+	}
+	return false
+}
+
+// rewriteCSS replaces url() references of a stylesheet with the
+// fingerprinted names of the referenced assets.
+func (s *assetStore) rewriteCSS(name string, data []byte) []byte {
+	dir := path.Dir(name)
+	return cssAssetRef.ReplaceAllFunc(data, func(m []byte) []byte {
+		sub := cssAssetRef.FindSubmatch(m)
+		ref := string(sub[1])
+		if strings.Contains(ref, ":") || strings.HasPrefix(ref, "/") {
+			return m // data: URIs and absolute references
+		}
+		a, ok := s.byName[path.Join(dir, ref)]
+		if !ok {
+			return m
+		}
+		ref = path.Join(path.Dir(ref), path.Base(a.fingerprint))
+		return []byte("url(" + ref + string(sub[2]) + ")")
+	})
+}
+
+// RewriteHTML replaces static/<name> references in HTML with the
+// fingerprinted names of the assets.
+func (s *assetStore) RewriteHTML(html []byte) []byte {
+	return htmlAssetRef.ReplaceAllFunc(html, func(ref []byte) []byte {
+		if a, ok := s.byName[strings.TrimPrefix(string(ref), "static/")]; ok {
+			return []byte("static/" + a.fingerprint)
+		}
+		return ref
+	})
+}
+
+// Handler serves the asset named by the *filepath route parameter.
+func (s *assetStore) Handler(c *gin.Context) {
+	name := strings.TrimPrefix(path.Clean("/"+c.Param("filepath")), "/")
+	a, immutable := s.byFingerprint[name]
+	if !immutable {
+		if a = s.byName[name]; a == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+	}
+
+	body, encoding := a.data, ""
+	if a.br != nil && acceptsEncoding(c.Request, "br") {
+		body, encoding = a.br, "br"
+	} else if a.gzip != nil && acceptsEncoding(c.Request, "gzip") {
+		body, encoding = a.gzip, "gzip"
+	}
+	etag := `"` + a.hash + `"`
+	if encoding != "" {
+		etag = `"` + a.hash + "-" + encoding + `"`
+	}
+
+	h := c.Writer.Header()
+	h.Set("ETag", etag)
+	h.Set("Vary", "Accept-Encoding")
+	if immutable {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+	if etagMatches(c.Request.Header.Get("If-None-Match"), etag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	c.Data(http.StatusOK, a.contentType, body)
+}
+
+// Register adds GET and HEAD routes for the assets below relativePath.
+func (s *assetStore) Register(r gin.IRoutes, relativePath string) {
+	r.GET(relativePath+"/*filepath", s.Handler)
+	r.HEAD(relativePath+"/*filepath", s.Handler)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// the given content coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != coding {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header matches etag,
+// using the weak comparison required for GET and HEAD.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
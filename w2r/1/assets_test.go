@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+var testCSS = "body { background: url('img/bg.png'); }\n" + strings.Repeat(".row { margin: 0 auto; }\n", 50)
+
+// newTestAssets serves a stylesheet and the image it references below
+// /static.
+func newTestAssets(t *testing.T) (*assetStore, http.Handler) {
+	t.Helper()
+	s, err := newAssetStore(fstest.MapFS{
+		"static/styles.css": {Data: []byte(testCSS)},
+		"static/img/bg.png": {Data: []byte("\x89PNG\r\n\x1a\nnot really")},
+	}, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	s.Register(r, "/static")
+	return s, r
+}
+
+func getAsset(h http.Handler, url string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAssetFingerprints(t *testing.T) {
+	s, h := newTestAssets(t)
+	css, png := s.byName["styles.css"], s.byName["img/bg.png"]
+
+	if want := "styles." + css.hash + ".css"; css.fingerprint != want {
+		t.Errorf("fingerprint = %q, want %q", css.fingerprint, want)
+	}
+	if !strings.Contains(string(css.data), "url(img/bg."+png.hash+".png)") {
+		t.Errorf("stylesheet does not reference the fingerprinted image:\n%.80s", css.data)
+	}
+	if got, want := string(s.RewriteHTML([]byte(`<link href="static/styles.css"><img src="static/missing.png">`))),
+		`<link href="static/`+css.fingerprint+`"><img src="static/missing.png">`; got != want {
+		t.Errorf("RewriteHTML = %s, want %s", got, want)
+	}
+
+	w := getAsset(h, "/static/"+css.fingerprint)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("fingerprinted name: %d, Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	w = getAsset(h, "/static/styles.css")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("plain name: %d, Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	if w := getAsset(h, "/static/styles.0123456789abcdef.css"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown fingerprint: %d, want 404", w.Code)
+	}
+}
+
+func TestAssetEncoding(t *testing.T) {
+	_, h := newTestAssets(t)
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+	tests := []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		w := getAsset(h, "/static/styles.css", "Accept-Encoding", tt.accept)
+		if got := w.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", tt.accept, got, tt.want)
+			continue
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary %q", tt.accept, w.Header().Get("Vary"))
+		}
+		r, err := decoders[tt.want](w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Accept-Encoding %q: %v", tt.accept, err)
+		}
+		if !strings.Contains(string(body), ".row { margin: 0 auto; }") {
+			t.Errorf("Accept-Encoding %q: body %.40q", tt.accept, body)
+		}
+	}
+
+	//Images are not compressed again.
+	if w := getAsset(h, "/static/img/bg.png", "Accept-Encoding", "gzip, br"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("image served with Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestAssetNotModified(t *testing.T) {
+	_, h := newTestAssets(t)
+
+	plain := getAsset(h, "/static/styles.css")
+	gz := getAsset(h, "/static/styles.css", "Accept-Encoding", "gzip")
+	etag, gzETag := plain.Header().Get("ETag"), gz.Header().Get("ETag")
+	if etag == "" || etag == gzETag {
+		t.Fatalf("ETags %q and %q, want distinct tags per encoding", etag, gzETag)
+	}
+
+	w := getAsset(h, "/static/styles.css", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match of the current tag: %d with %d bytes, want 304", w.Code, w.Body.Len())
+	}
+	if w := getAsset(h, "/static/styles.css", "If-None-Match", `"other", W/`+gzETag, "Accept-Encoding", "gzip"); w.Code != http.StatusNotModified {
+		t.Errorf("weak If-None-Match in a list: %d, want 304", w.Code)
+	}
+	if w := getAsset(h, "/static/styles.css", "If-None-Match", gzETag); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match of the gzip tag without gzip: %d, want 200", w.Code)
+	}
+	if w := getAsset(h, "/static/styles.css", "If-None-Match", "*"); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match *: %d, want 304", w.Code)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions recorded in the audit trail.
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete" // moved to the trash
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+// anonymousActor is the actor of requests without an authenticated user.
+const anonymousActor = "anonymous"
+
+// auditActorHeaderFromEnv returns the request header that names the
+// authenticated user, AUDIT_ACTOR_HEADER. Only set it when a proxy in
+// front of the app authenticates the users and sets the header, since
+// clients can send any value otherwise.
+func auditActorHeaderFromEnv() string {
+	return os.Getenv("AUDIT_ACTOR_HEADER")
+}
+
+// requestIDHeader carries the ID of a request, which the audit records
+// of its changes refer to.
+const requestIDHeader = "X-Request-ID"
+
+// requestID takes the X-Request-ID of a request, as set by the Cloud
+// Foundry router or a client, or generates one, and returns it in the
+// response.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 || !validIdempotencyKey(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Set("requestID", id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// auditInfo says who made a change.
+type auditInfo struct {
+	Actor     string
+	RequestID string
+	SourceIP  string
+}
+
+type auditInfoKey struct{}
+
+func withAuditInfo(ctx context.Context, info auditInfo) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, info)
+}
+
+// auditInfoFrom returns the auditInfo of ctx. Changes made outside of a
+// request are made by the system.
+func auditInfoFrom(ctx context.Context) auditInfo {
+	info, ok := ctx.Value(auditInfoKey{}).(auditInfo)
+	if !ok {
+		info.Actor = "system"
+	}
+	return info
+}
+
+// auditContext adds the auditInfo of a request to its context. The actor
+// is read from actorHeader, if it is set.
+func auditContext(actorHeader string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info := auditInfo{Actor: anonymousActor, SourceIP: c.ClientIP()}
+		if id, ok := c.Get("requestID"); ok {
+			info.RequestID = id.(string)
+		}
+		if actorHeader != "" {
+			if actor := strings.TrimSpace(c.Request.Header.Get(actorHeader)); actor != "" && len(actor) <= 256 {
+				info.Actor = actor
+			}
+		}
+		c.Request = c.Request.WithContext(withAuditInfo(c.Request.Context(), info))
+		c.Next()
+	}
+}
+
+// auditRecord is an entry of the audit trail of a visitor. Records are
+// written once and never changed.
+type auditRecord struct {
+	VisitorID string        `json:"visitor_id"`
+	Action    string        `json:"action"`
+	Rev       string        `json:"rev,omitempty"`      // revision written, empty for purges
+	BaseRev   string        `json:"base_rev,omitempty"` // revision the change was made to
+	Actor     string        `json:"actor"`
+	RequestID string        `json:"request_id,omitempty"`
+	SourceIP  string        `json:"source_ip,omitempty"`
+	At        time.Time     `json:"at"`
+	Changes   []fieldChange `json:"changes"`
+}
+
+// fieldChange is a changed field of a visitor. From is nil for created
+// visitors and To for purged ones.
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// auditedFields are the fields of a visitor that the audit trail tracks,
+// in the order of its diffs.
+var auditedFields = []string{"name", "locale", "tags", "created_at", "deleted_at"}
+
+// visitorField returns a field of v, or nil if it is not set.
+func visitorField(v *visitorResource, field string) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch field {
+	case "name":
+		if v.Name != "" {
+			return v.Name
+		}
+	case "locale":
+		if v.Locale != "" {
+			return v.Locale
+		}
+	case "tags":
+		if len(v.Tags) > 0 {
+			return v.Tags
+		}
+	case "created_at":
+		if !v.Created.IsZero() {
+			return v.Created.UTC().Format(createdLayout)
+		}
+	case "deleted_at":
+		if !v.Deleted.IsZero() {
+			return v.Deleted.UTC().Format(createdLayout)
+		}
+	}
+	return nil
+}
+
+// setVisitorField sets a field of v to a value of a fieldChange, which is
+// a []interface{} for tags once it has been stored as JSON.
+func setVisitorField(v *visitorResource, field string, value interface{}) {
+	s, _ := value.(string)
+	switch field {
+	case "name":
+		v.Name = s
+	case "locale":
+		v.Locale = s
+	case "tags":
+		v.Tags = nil
+		switch tags := value.(type) {
+		case []string:
+			v.Tags = append(v.Tags, tags...)
+		case []interface{}:
+			for _, t := range tags {
+				if t, ok := t.(string); ok {
+					v.Tags = append(v.Tags, t)
+				}
+			}
+		}
+	case "created_at":
+		v.Created, _ = time.Parse(time.RFC3339, s)
+	case "deleted_at":
+		v.Deleted, _ = time.Parse(time.RFC3339, s)
+	}
+}
+
+// diffVisitors lists the fields that differ between before and after,
+// either of which may be nil.
+func diffVisitors(before, after *visitorResource) []fieldChange {
+	changes := []fieldChange{}
+	for _, field := range auditedFields {
+		from, to := visitorField(before, field), visitorField(after, field)
+		if !sameField(from, to) {
+			changes = append(changes, fieldChange{Field: field, From: from, To: to})
+		}
+	}
+	return changes
+}
+
+func sameField(a, b interface{}) bool {
+	ta, aok := a.([]string)
+	tb, bok := b.([]string)
+	if aok || bok {
+		return strings.Join(ta, "\x00") == strings.Join(tb, "\x00") && len(ta) == len(tb)
+	}
+	return a == b
+}
+
+// audit stores the record of a change made to a visitor at the request
+// of ctx. The change has been made, so a failure is only logged, and the
+// record is stored even if the request was canceled meanwhile.
+func (s *visitorService) audit(ctx context.Context, store auditStore, action, id, rev, baseRev string, before, after *visitorResource) {
+	info := auditInfoFrom(ctx)
+	rec := &auditRecord{
+		VisitorID: id,
+		Action:    action,
+		Rev:       rev,
+		BaseRev:   baseRev,
+		Actor:     info.Actor,
+		RequestID: info.RequestID,
+		SourceIP:  info.SourceIP,
+		At:        time.Now().UTC(),
+		Changes:   diffVisitors(before, after),
+	}
+	if err := store.AddAudit(context.WithoutCancel(ctx), rec); err != nil {
+		log.Printf("Can not store the audit record of %s %s by %s (request %s): %v", action, id, info.Actor, info.RequestID, err)
+	}
+}
+
+// revisionInfo is a revision of a visitor that the store knows. Status
+// is "available", "missing" once its body has been compacted away, or
+// "deleted" for a deletion.
+type revisionInfo struct {
+	Rev    string
+	Status string
+}
+
+// visitorRevision is an entry of the history of a visitor. Audit is nil
+// for revisions written without an audit record, for example before the
+// audit trail was introduced; Visitor is nil if the version can not be
+// reconstructed, and for purges.
+type visitorRevision struct {
+	Rev     string
+	Status  string // as in revisionInfo, or "unknown" if only the audit trail has the revision
+	Audit   *auditRecord
+	Visitor *visitorResource
+}
+
+var errNoRevision = &apiError{http.StatusNotFound, codeNotFound, "revision not found"}
+
+// revGeneration returns the number of a revision, which counts its
+// updates with both backends.
+func revGeneration(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
+// History merges the audit trail of a visitor with the revisions that
+// the store knows, newest first. The versions are reconstructed from the
+// current visitor by undoing the changes of the audit trail, so they are
+// known even after CouchDB compacted their bodies away.
+func (s *visitorService) History(ctx context.Context, store VisitorStore, id string) ([]visitorRevision, error) {
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	records, err := store.AuditTrail(ctx, id)
+	if err != nil {
+		return nil, storeError(err, "unable to read the audit trail")
+	}
+	revs, err := store.Revisions(ctx, id)
+	if err != nil && err != errStoreNotFound {
+		return nil, storeError(err, "unable to read the revisions")
+	}
+	if len(records) == 0 && len(revs) == 0 {
+		return nil, errNoVisitor
+	}
+	current, err := store.Get(ctx, id)
+	if err != nil && err != errStoreNotFound {
+		return nil, storeError(err, "unable to fetch visitor")
+	}
+
+	byRev := make(map[string]*visitorRevision)
+	var history []*visitorRevision
+	entry := func(rev, status string) *visitorRevision {
+		if e, ok := byRev[rev]; ok && rev != "" {
+			return e
+		}
+		e := &visitorRevision{Rev: rev, Status: status}
+		if rev != "" {
+			byRev[rev] = e
+		}
+		history = append(history, e)
+		return e
+	}
+	for _, r := range revs {
+		entry(r.Rev, r.Status)
+	}
+	//A purge is recorded with the revision it removed; its tombstone is
+	//the next revision.
+	tombstone := func(baseRev string) string {
+		for _, r := range revs {
+			if r.Status == "deleted" && revGeneration(r.Rev) == revGeneration(baseRev)+1 {
+				return r.Rev
+			}
+		}
+		return ""
+	}
+	state := current
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := &records[i]
+		var e *visitorRevision
+		switch {
+		case rec.Rev == "":
+			e = entry(tombstone(rec.BaseRev), "deleted")
+			//A purge records every field of the visitor it removed.
+			state = &visitorResource{ID: id}
+		case state != nil && state.Rev == rec.Rev:
+			e = entry(rec.Rev, "unknown")
+			v := *state
+			e.Visitor = &v
+		default:
+			//A write without an audit record came in between, so the
+			//older versions can not be reconstructed.
+			e = entry(rec.Rev, "unknown")
+			state = nil
+		}
+		e.Audit = rec
+		//Undo the change to get the version it was made to.
+		if state == nil || rec.BaseRev == "" {
+			state = nil
+			continue
+		}
+		prev := *state
+		prev.Rev = rec.BaseRev
+		for _, c := range rec.Changes {
+			setVisitorField(&prev, c.Field, c.From)
+		}
+		state = &prev
+	}
+	if current != nil {
+		if e, ok := byRev[current.Rev]; ok && e.Visitor == nil {
+			e.Visitor = current
+		}
+	}
+
+	out := make([]visitorRevision, len(history))
+	for i, e := range history {
+		out[i] = *e
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		gi, gj := revGeneration(out[i].Rev), revGeneration(out[j].Rev)
+		if out[i].Rev == "" || out[j].Rev == "" {
+			//Purges without a known tombstone are the newest entries.
+			return out[i].Rev == "" && out[j].Rev != ""
+		}
+		return gi > gj
+	})
+	return out, nil
+}
+
+// Version returns a visitor as of rev: the stored body if the store still
+// has it, or the version reconstructed from the audit trail.
+func (s *visitorService) Version(ctx context.Context, store VisitorStore, id, rev string) (*visitorResource, error) {
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	v, err := store.GetRevision(ctx, id, rev)
+	if err == nil {
+		return v, nil
+	} else if err != errStoreNotFound {
+		return nil, storeError(err, "unable to fetch revision")
+	}
+	history, err := s.History(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range history {
+		if e.Rev == rev && e.Visitor != nil {
+			return e.Visitor, nil
+		}
+	}
+	return nil, errNoRevision
+}
+
+// Restore makes the name, locale and tags of rev those of the current
+// revision of a visitor. ifMatch works like for Update. Visitors in the
+// trash have to be undeleted first.
+func (s *visitorService) Restore(ctx context.Context, store VisitorStore, id, rev, ifMatch string) (*visitorResource, error) {
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	version, err := s.Version(ctx, store, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.get(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" && !strongETagMatches(ifMatch, revETag(v.Rev)) {
+		return nil, errStaleVisitor
+	}
+	before := *v
+	v.Name, v.Locale, v.Tags = version.Name, version.Locale, version.Tags
+	if err := store.Update(ctx, v); err != nil {
+		return nil, preconditionError(storeError(err, "unable to restore visitor"), ifMatch)
+	}
+	s.audit(ctx, store, auditRestore, id, v.Rev, before.Rev, &before, v)
+	return v, nil
+}
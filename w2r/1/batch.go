@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What Add does when the write queue is full.
+const (
+	overflowBlock  = "block"  // wait for room, until the request is canceled
+	overflowReject = "reject" // fail right away with errStoreBusy
+)
+
+// batchConfig holds the write-behind settings read from the environment.
+type batchConfig struct {
+	Size     int           // visitors per bulk write, 0 turns batching off
+	Delay    time.Duration // how long the first visitor of a batch waits for more
+	Queue    int           // visitors waiting for a batch
+	Overflow string
+}
+
+// maxBatchSize keeps a Postgres batch within the limit of 65535
+// parameters per statement.
+const maxBatchSize = 1000
+
+func batchConfigFromEnv() batchConfig {
+	cfg := batchConfig{Delay: 25 * time.Millisecond, Queue: 1000, Overflow: overflowBlock}
+	if v := os.Getenv("WRITE_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxBatchSize {
+			log.Printf("ignoring invalid WRITE_BATCH_SIZE %q", v)
+		} else {
+			cfg.Size = n
+		}
+	}
+	if v := os.Getenv("WRITE_BATCH_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring invalid WRITE_BATCH_DELAY %q", v)
+		} else {
+			cfg.Delay = d
+		}
+	}
+	if v := os.Getenv("WRITE_BATCH_QUEUE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("ignoring invalid WRITE_BATCH_QUEUE %q", v)
+		} else {
+			cfg.Queue = n
+		}
+	}
+	if v := strings.ToLower(os.Getenv("WRITE_BATCH_OVERFLOW")); v != "" {
+		if v != overflowBlock && v != overflowReject {
+			log.Printf("ignoring invalid WRITE_BATCH_OVERFLOW %q", v)
+		} else {
+			cfg.Overflow = v
+		}
+	}
+	return cfg
+}
+
+// pendingAdd is a visitor waiting in the write queue. Its result is sent
+// to a buffered channel, so the flusher never waits for the caller.
+type pendingAdd struct {
+	visitor Visitor
+	result  chan addResult
+}
+
+// batchingStore is a VisitorStore that gathers the visitors passed to
+// Add and stores them with AddBatch, once Size of them are queued or the
+// first one waited for Delay. Every caller still gets its own result.
+// The other methods are not batched.
+type batchingStore struct {
+	VisitorStore
+	cfg   batchConfig
+	queue chan *pendingAdd
+	done  chan struct{} // closed when the flusher has stopped
+
+	mu     sync.RWMutex // held for reading while sending to queue
+	closed bool
+
+	batches  int64
+	batched  int64
+	failed   int64
+	rejected int64
+}
+
+func newBatchingStore(store VisitorStore, cfg batchConfig) *batchingStore {
+	s := &batchingStore{
+		VisitorStore: store,
+		cfg:          cfg,
+		queue:        make(chan *pendingAdd, cfg.Queue),
+		done:         make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Add queues v and waits for the batch that stores it. If ctx is done
+// first, v may still be stored. After Close, visitors are stored right
+// away.
+func (s *batchingStore) Add(ctx context.Context, v Visitor) (*visitorResource, error) {
+	p := &pendingAdd{visitor: v, result: make(chan addResult, 1)}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return s.VisitorStore.Add(ctx, v)
+	}
+	err := s.enqueue(ctx, p)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-p.result:
+		return r.Visitor, r.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *batchingStore) enqueue(ctx context.Context, p *pendingAdd) error {
+	if s.cfg.Overflow == overflowReject {
+		select {
+		case s.queue <- p:
+			return nil
+		default:
+			atomic.AddInt64(&s.rejected, 1)
+			return errStoreBusy
+		}
+	}
+	select {
+	case s.queue <- p:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run flushes batches until the queue is closed and drained.
+func (s *batchingStore) run() {
+	defer close(s.done)
+	for first := range s.queue {
+		s.flush(s.collect(first))
+	}
+}
+
+// collect gathers the visitors that arrive within Delay after first,
+// up to Size.
+func (s *batchingStore) collect(first *pendingAdd) []*pendingAdd {
+	batch := []*pendingAdd{first}
+	timer := time.NewTimer(s.cfg.Delay)
+	defer timer.Stop()
+	for len(batch) < s.cfg.Size {
+		select {
+		case p, ok := <-s.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, p)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// flush stores a batch. It does not use the context of any request, so
+// that one canceled request does not fail the others.
+func (s *batchingStore) flush(batch []*pendingAdd) {
+	visitors := make([]Visitor, len(batch))
+	for i, p := range batch {
+		visitors[i] = p.visitor
+	}
+	results, err := s.VisitorStore.AddBatch(context.Background(), visitors)
+	atomic.AddInt64(&s.batches, 1)
+	atomic.AddInt64(&s.batched, int64(len(batch)))
+	for i, p := range batch {
+		r := addResult{Err: err}
+		if err == nil {
+			r = results[i]
+		}
+		if r.Err != nil {
+			atomic.AddInt64(&s.failed, 1)
+		}
+		p.result <- r
+	}
+}
+
+// Close stores the queued visitors and waits until they are written or
+// ctx is done.
+func (s *batchingStore) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeMetrics implements metricsSource.
+func (s *batchingStore) writeMetrics(w io.Writer) {
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"visitor_write_batches_total", "counter", "Bulk writes of queued visitors.", atomic.LoadInt64(&s.batches)},
+		{"visitor_write_batched_total", "counter", "Visitors stored by bulk writes.", atomic.LoadInt64(&s.batched)},
+		{"visitor_write_failed_total", "counter", "Queued visitors that could not be stored.", atomic.LoadInt64(&s.failed)},
+		{"visitor_write_rejected_total", "counter", "Visitors rejected because the write queue was full.", atomic.LoadInt64(&s.rejected)},
+		{"visitor_write_queue_length", "gauge", "Visitors waiting for a bulk write.", int64(len(s.queue))},
+		{"visitor_write_queue_capacity", "gauge", "WRITE_BATCH_QUEUE.", int64(s.cfg.Queue)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
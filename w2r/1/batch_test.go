@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStore records the visitors of every AddBatch call.
+type recordingStore struct {
+	VisitorStore
+
+	mu      sync.Mutex
+	batches [][]Visitor
+}
+
+func (s *recordingStore) AddBatch(ctx context.Context, visitors []Visitor) ([]addResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, visitors)
+	results := make([]addResult, len(visitors))
+	for i, v := range visitors {
+		results[i].Visitor = &visitorResource{ID: fmt.Sprintf("%d-%d", len(s.batches), i), Name: v.Name}
+	}
+	return results, nil
+}
+
+func (s *recordingStore) Add(ctx context.Context, v Visitor) (*visitorResource, error) {
+	return &visitorResource{ID: "single", Name: v.Name}, nil
+}
+
+func (s *recordingStore) batchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sizes := make([]int, len(s.batches))
+	for i, b := range s.batches {
+		sizes[i] = len(b)
+	}
+	return sizes
+}
+
+// addAll adds n visitors concurrently and returns a channel that gets
+// the error of each.
+func addAll(s *batchingStore, n int) <-chan error {
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			v, err := s.Add(context.Background(), Visitor{Name: fmt.Sprint("Visitor ", i)})
+			if err == nil && v.Name != fmt.Sprint("Visitor ", i) {
+				err = fmt.Errorf("Add returned %+v", v)
+			}
+			errs <- err
+		}(i)
+	}
+	return errs
+}
+
+func waitAll(t *testing.T, errs <-chan error, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-deadline:
+			t.Fatalf("%d of %d visitors were stored", i, n)
+		}
+	}
+}
+
+func TestBatchFlushOnSize(t *testing.T) {
+	store := &recordingStore{}
+	s := newBatchingStore(store, batchConfig{Size: 3, Delay: time.Hour, Queue: 10, Overflow: overflowBlock})
+	defer s.Close(context.Background())
+
+	waitAll(t, addAll(s, 3), 3, 5*time.Second)
+	if sizes := store.batchSizes(); len(sizes) != 1 || sizes[0] != 3 {
+		t.Errorf("batches %v, want one of 3", sizes)
+	}
+}
+
+func TestBatchFlushOnDelay(t *testing.T) {
+	store := &recordingStore{}
+	s := newBatchingStore(store, batchConfig{Size: 100, Delay: 20 * time.Millisecond, Queue: 10, Overflow: overflowBlock})
+	defer s.Close(context.Background())
+
+	start := time.Now()
+	waitAll(t, addAll(s, 1), 1, 5*time.Second)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("the batch was written after %v, before the delay", d)
+	}
+	if sizes := store.batchSizes(); len(sizes) != 1 || sizes[0] != 1 {
+		t.Errorf("batches %v, want one of 1", sizes)
+	}
+}
+
+func TestBatchFlushOnClose(t *testing.T) {
+	store := &recordingStore{}
+	s := newBatchingStore(store, batchConfig{Size: 100, Delay: time.Hour, Queue: 10, Overflow: overflowBlock})
+
+	errs := addAll(s, 2)
+	time.Sleep(100 * time.Millisecond)
+	if sizes := store.batchSizes(); len(sizes) != 0 {
+		t.Fatalf("batches %v before Close", sizes)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitAll(t, errs, 2, time.Second)
+	if sizes := store.batchSizes(); len(sizes) != 1 || sizes[0] != 2 {
+		t.Errorf("batches %v, want one of 2", sizes)
+	}
+
+	//After Close visitors are stored right away.
+	if v, err := s.Add(context.Background(), Visitor{Name: "Late"}); err != nil || v.ID != "single" {
+		t.Errorf("Add after Close = %+v, %v", v, err)
+	}
+}
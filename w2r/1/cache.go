@@ -0,0 +1,476 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cacheConfig holds the cache settings read from the environment.
+type cacheConfig struct {
+	MaxBytes int64         // 0 disables the cache
+	TTL      time.Duration // safety net for changes the feed missed
+}
+
+func cacheConfigFromEnv() cacheConfig {
+	cfg := cacheConfig{MaxBytes: 16 << 20, TTL: 5 * time.Minute}
+	if v := os.Getenv("CACHE_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("ignoring invalid CACHE_MAX_BYTES %q", v)
+		} else {
+			cfg.MaxBytes = n
+		}
+	}
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring invalid CACHE_TTL %q", v)
+		} else {
+			cfg.TTL = d
+		}
+	}
+	return cfg
+}
+
+// Kinds of cache entries, which decide what a change invalidates.
+const (
+	cachedVisitor = iota // a single visitor
+	cachedPage           // a page of the visitor list
+	cachedCount          // the number of visitors
+	cachedStats          // visitor stats
+	cachedSeq            // the update sequence
+)
+
+// cacheEntry is a cached store result. ids lists the visitors it
+// contains.
+type cacheEntry struct {
+	key     string
+	kind    int
+	ids     []string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// cacheCall is a load in progress that concurrent misses wait for. It
+// is canceled when all of them gave up.
+type cacheCall struct {
+	done    chan struct{}
+	value   interface{}
+	err     error
+	waiters int // guarded by visitorCache.mu
+	cancel  context.CancelFunc
+}
+
+// visitorCache keeps the results of store reads in memory, least recently
+// used first out once MaxBytes is reached. Entries are invalidated by the
+// writes of this instance and by the changes feed of the store, which also
+// carries the writes of other instances.
+type visitorCache struct {
+	cfg cacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List                 // of *cacheEntry, most recently used first
+	byID    map[string]map[string]bool // visitor ID to the keys of the entries containing it
+	calls   map[string]*cacheCall
+	bytes   int64
+	epoch   uint64 // counts invalidations, so loads started before one are not stored
+
+	hits, misses, coalesced, evictions, invalidations, feedErrors int64
+}
+
+func newVisitorCache(cfg cacheConfig) *visitorCache {
+	return &visitorCache{
+		cfg:     cfg,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		byID:    make(map[string]map[string]bool),
+		calls:   make(map[string]*cacheCall),
+	}
+}
+
+// load returns the cached value of key, or calls fn to load it. Only one
+// load per key runs at a time; concurrent misses wait for its result. fn
+// returns the value, the IDs of the visitors in it and its approximate
+// size in bytes. The load is aborted once the contexts of all callers
+// waiting for it are done.
+func (c *visitorCache) load(ctx context.Context, key string, kind int, fn func(ctx context.Context) (interface{}, []string, int64, error)) (interface{}, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			c.mu.Unlock()
+			return e.value, nil
+		}
+		c.remove(el)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.coalesced++
+		call.waiters++
+		c.mu.Unlock()
+		return c.wait(ctx, key, call)
+	}
+	//The load serves the waiters too, so it must outlive this request.
+	loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	call := &cacheCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	c.calls[key] = call
+	c.misses++
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		value, ids, size, err := fn(loadCtx)
+		call.value, call.err = value, err
+
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		if err == nil && c.epoch == epoch {
+			c.add(&cacheEntry{key: key, kind: kind, ids: ids, value: value, size: size + int64(len(key)) + 128})
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	return c.wait(ctx, key, call)
+}
+
+// wait returns the result of call. If ctx is done first and no other
+// caller waits, the load is canceled and the next miss starts a new one.
+func (c *visitorCache) wait(ctx context.Context, key string, call *cacheCall) (interface{}, error) {
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// add stores an entry and evicts the least recently used ones until the
+// cache fits into MaxBytes. An entry with the same key, stored by a load
+// that started before the previous one was abandoned, is replaced. The
+// caller holds c.mu.
+func (c *visitorCache) add(e *cacheEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	if e.size > c.cfg.MaxBytes {
+		return
+	}
+	e.expires = time.Now().Add(c.cfg.TTL)
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size
+	for _, id := range e.ids {
+		if c.byID[id] == nil {
+			c.byID[id] = make(map[string]bool)
+		}
+		c.byID[id][e.key] = true
+	}
+	for c.bytes > c.cfg.MaxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// remove drops an entry. The caller holds c.mu.
+func (c *visitorCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+	for _, id := range e.ids {
+		delete(c.byID[id], e.key)
+		if len(c.byID[id]) == 0 {
+			delete(c.byID, id)
+		}
+	}
+}
+
+// removeKind drops all entries of the given kinds. The caller holds c.mu.
+func (c *visitorCache) removeKind(kinds ...int) {
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		for _, kind := range kinds {
+			if el.Value.(*cacheEntry).kind == kind {
+				c.remove(el)
+				break
+			}
+		}
+		el = next
+	}
+}
+
+// invalidate drops the entries that a change of the visitor id may have
+// made stale. A change of a visitor on a cached page is an update, which
+// only affects the entries containing it and the stats. Any other change
+// may add or remove a visitor, for example by restoring it from the
+// trash, which shifts every page.
+func (c *visitorCache) invalidate(id string, deleted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.invalidations++
+	if keys := c.byID[id]; c.listed(keys) && !deleted {
+		for key := range keys {
+			c.remove(c.entries[key])
+		}
+		c.removeKind(cachedStats, cachedSeq)
+		return
+	}
+	if el, ok := c.entries[visitorKey(id)]; ok {
+		c.remove(el)
+	}
+	c.removeKind(cachedPage, cachedCount, cachedStats, cachedSeq)
+}
+
+// listed reports whether keys include a page. The caller holds c.mu.
+func (c *visitorCache) listed(keys map[string]bool) bool {
+	for key := range keys {
+		if el, ok := c.entries[key]; ok && el.Value.(*cacheEntry).kind == cachedPage {
+			return true
+		}
+	}
+	return false
+}
+
+// flush drops all entries.
+func (c *visitorCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Front())
+	}
+}
+
+// handleChange invalidates entries for a change of a visitor delivered
+// by the changes processor of the CouchDB guestbook. The processor
+// resumes from its checkpoint after a failure, so nothing is missed.
+func (c *visitorCache) handleChange(ctx context.Context, ev *changeEvent) error {
+	change, err := ev.visitorChange()
+	if err != nil {
+		return err
+	}
+	c.invalidate(change.Visitor.ID, change.Deleted)
+	return nil
+}
+
+// watch invalidates entries for the changes of store until ctx is done,
+// for stores without a changes processor. When the feed fails, the cache
+// is flushed and the feed resumed after the last change it delivered.
+func (c *visitorCache) watch(ctx context.Context, store VisitorStore) {
+	since := "now"
+	backoff := time.Second
+	for {
+		err := store.Watch(ctx, since, func(change visitorChange) error {
+			c.invalidate(change.Visitor.ID, change.Deleted)
+			since = change.Seq
+			backoff = time.Second
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("visitor cache: changes feed stopped:", err)
+		c.mu.Lock()
+		c.feedErrors++
+		c.mu.Unlock()
+		c.flush()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// writeMetrics writes the cache metrics in the Prometheus text format.
+func (c *visitorCache) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"visitor_cache_hits_total", "counter", "Reads answered from the cache.", c.hits},
+		{"visitor_cache_misses_total", "counter", "Reads that loaded from the store.", c.misses},
+		{"visitor_cache_coalesced_total", "counter", "Reads that waited for the load of a concurrent miss.", c.coalesced},
+		{"visitor_cache_evictions_total", "counter", "Entries evicted to stay within CACHE_MAX_BYTES.", c.evictions},
+		{"visitor_cache_invalidations_total", "counter", "Changes that invalidated entries.", c.invalidations},
+		{"visitor_cache_feed_errors_total", "counter", "Failures of the changes feed.", c.feedErrors},
+		{"visitor_cache_entries", "gauge", "Cached entries.", int64(c.lru.Len())},
+		{"visitor_cache_bytes", "gauge", "Approximate size of the cached entries.", c.bytes},
+		{"visitor_cache_max_bytes", "gauge", "CACHE_MAX_BYTES.", c.cfg.MaxBytes},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+func visitorKey(id string) string {
+	return "visitor/" + id
+}
+
+// visitorSize approximates the memory used by a cached visitor.
+func visitorSize(v *visitorResource) int64 {
+	size := int64(len(v.ID)+len(v.Rev)+len(v.Name)+len(v.Locale)) + 144
+	for _, t := range v.Tags {
+		size += int64(len(t)) + 16
+	}
+	return size
+}
+
+// cachedStore is a VisitorStore that reads visitors, list pages, counts,
+// stats and the update sequence through a visitorCache. Results are copied, so callers may
+// modify them. Scan, Search, Find and Watch are not cached.
+type cachedStore struct {
+	VisitorStore
+	cache *visitorCache
+}
+
+func (s *cachedStore) Get(ctx context.Context, id string) (*visitorResource, error) {
+	value, err := s.cache.load(ctx, visitorKey(id), cachedVisitor, func(ctx context.Context) (interface{}, []string, int64, error) {
+		v, err := s.VisitorStore.Get(ctx, id)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return *v, []string{id}, visitorSize(v), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := value.(visitorResource)
+	return &v, nil
+}
+
+// visitorPage is a cached result of List.
+type visitorPage struct {
+	visitors []visitorResource
+	total    int
+}
+
+func (s *cachedStore) List(ctx context.Context, page, perPage int) ([]visitorResource, int, error) {
+	key := fmt.Sprintf("page/%d/%d", page, perPage)
+	value, err := s.cache.load(ctx, key, cachedPage, func(ctx context.Context) (interface{}, []string, int64, error) {
+		visitors, total, err := s.VisitorStore.List(ctx, page, perPage)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		ids := make([]string, len(visitors))
+		var size int64
+		for i := range visitors {
+			ids[i] = visitors[i].ID
+			size += visitorSize(&visitors[i]) + int64(len(ids[i]))
+		}
+		return visitorPage{visitors, total}, ids, size, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	p := value.(visitorPage)
+	return append([]visitorResource(nil), p.visitors...), p.total, nil
+}
+
+func (s *cachedStore) Count(ctx context.Context) (int, error) {
+	value, err := s.cache.load(ctx, "count", cachedCount, func(ctx context.Context) (interface{}, []string, int64, error) {
+		n, err := s.VisitorStore.Count(ctx)
+		return n, nil, 8, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value.(int), nil
+}
+
+func (s *cachedStore) Stats(ctx context.Context) (*visitorStats, error) {
+	value, err := s.cache.load(ctx, "stats", cachedStats, func(ctx context.Context) (interface{}, []string, int64, error) {
+		stats, err := s.VisitorStore.Stats(ctx)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		var size int64
+		for locale := range stats.Locales {
+			size += int64(len(locale)) + 48
+		}
+		return stats, nil, size, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := value.(*visitorStats)
+	copied := &visitorStats{Visitors: stats.Visitors, Locales: make(map[string]int, len(stats.Locales))}
+	for locale, n := range stats.Locales {
+		copied.Locales[locale] = n
+	}
+	return copied, nil
+}
+
+func (s *cachedStore) UpdateSeq(ctx context.Context) (string, error) {
+	value, err := s.cache.load(ctx, "seq", cachedSeq, func(ctx context.Context) (interface{}, []string, int64, error) {
+		seq, err := s.VisitorStore.UpdateSeq(ctx)
+		return seq, nil, int64(len(seq)), err
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// The writes invalidate the cache right away, so that this instance
+// reads its own writes before the changes feed reports them.
+
+func (s *cachedStore) Add(ctx context.Context, v Visitor) (*visitorResource, error) {
+	added, err := s.VisitorStore.Add(ctx, v)
+	if err == nil {
+		s.cache.invalidate(added.ID, false)
+	}
+	return added, err
+}
+
+func (s *cachedStore) AddBatch(ctx context.Context, visitors []Visitor) ([]addResult, error) {
+	results, err := s.VisitorStore.AddBatch(ctx, visitors)
+	for _, r := range results {
+		if r.Err == nil {
+			s.cache.invalidate(r.Visitor.ID, false)
+		}
+	}
+	return results, err
+}
+
+// Update treats moving a visitor to the trash like a deletion.
+func (s *cachedStore) Update(ctx context.Context, v *visitorResource) error {
+	err := s.VisitorStore.Update(ctx, v)
+	if err == nil {
+		s.cache.invalidate(v.ID, !v.Deleted.IsZero())
+	}
+	return err
+}
+
+func (s *cachedStore) Delete(ctx context.Context, id, rev string) error {
+	err := s.VisitorStore.Delete(ctx, id, rev)
+	if err == nil {
+		s.cache.invalidate(id, true)
+	}
+	return err
+}
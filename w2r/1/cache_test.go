@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loadValue returns a load function with a fixed result of size bytes.
+func loadValue(value interface{}, size int64, ids ...string) func(context.Context) (interface{}, []string, int64, error) {
+	return func(context.Context) (interface{}, []string, int64, error) {
+		return value, ids, size, nil
+	}
+}
+
+func TestCacheCoalescesLoads(t *testing.T) {
+	c := newVisitorCache(cacheConfig{MaxBytes: 1 << 20, TTL: time.Minute})
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(context.Context) (interface{}, []string, int64, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil, 10, nil
+	}
+	const readers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.load(context.Background(), "key", cachedCount, fn); err != nil || v != "value" {
+				t.Errorf("load = %v, %v", v, err)
+			}
+		}()
+	}
+	//Wait until every reader found the load in progress.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		n := c.misses + c.coalesced
+		c.mu.Unlock()
+		if n == readers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d readers started", n, readers)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || c.misses != 1 || c.coalesced != readers-1 {
+		t.Errorf("%d loads, %d misses, %d coalesced; want 1, 1, %d", calls, c.misses, c.coalesced, readers-1)
+	}
+	if v, err := c.load(context.Background(), "key", cachedCount, fn); err != nil || v != "value" || calls != 1 || c.hits != 1 {
+		t.Errorf("load after the miss = %v, %v with %d loads and %d hits", v, err, calls, c.hits)
+	}
+}
+
+func TestCacheAbandonedLoad(t *testing.T) {
+	c := newVisitorCache(cacheConfig{MaxBytes: 1 << 20, TTL: time.Minute})
+
+	//The only reader of the first load gives up, so the next miss starts
+	//a second load while the first still runs; both store their result.
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		c.load(ctx, "key", cachedCount, func(context.Context) (interface{}, []string, int64, error) {
+			<-release
+			return "old", nil, 10, nil
+		})
+	}()
+	for c.pending("key") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	call := c.pending("key")
+	cancel()
+	<-first
+	if v, err := c.load(context.Background(), "key", cachedCount, loadValue("new", 10)); err != nil || v != "new" {
+		t.Fatalf("second load = %v, %v", v, err)
+	}
+	close(release)
+	<-call.done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru.Len() != 1 || len(c.entries) != 1 || c.bytes != 10+int64(len("key"))+128 {
+		t.Errorf("%d entries in the list, %d in the map, %d bytes; want one entry", c.lru.Len(), len(c.entries), c.bytes)
+	}
+}
+
+// pending returns the load in progress for key.
+func (c *visitorCache) pending(key string) *cacheCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[key]
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	//Every entry takes 100 bytes plus its key and 128 bytes of overhead.
+	c := newVisitorCache(cacheConfig{MaxBytes: 500, TTL: time.Minute})
+	ctx := context.Background()
+
+	c.load(ctx, "a", cachedVisitor, loadValue("a", 100))
+	c.load(ctx, "b", cachedVisitor, loadValue("b", 100))
+	c.load(ctx, "a", cachedVisitor, loadValue("stale", 100)) // a is now the most recently used
+	c.load(ctx, "c", cachedVisitor, loadValue("c", 100))
+	c.load(ctx, "d", cachedVisitor, loadValue("d", 1000))
+
+	if _, ok := c.entries["b"]; ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if _, ok := c.entries["d"]; ok {
+		t.Error("an entry larger than MaxBytes was stored")
+	}
+	if len(c.entries) != 2 || c.bytes != 2*229 || c.evictions != 1 {
+		t.Errorf("%d entries with %d bytes after %d evictions, want a and c with 458 bytes", len(c.entries), c.bytes, c.evictions)
+	}
+	if v, _ := c.load(ctx, "a", cachedVisitor, loadValue("stale", 100)); v != "a" {
+		t.Errorf("a = %v, want the cached value", v)
+	}
+}
+
+// countingStore counts the reads that reach the store.
+type countingStore struct {
+	VisitorStore
+	gets, lists int32
+}
+
+func (s *countingStore) Get(ctx context.Context, id string) (*visitorResource, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.VisitorStore.Get(ctx, id)
+}
+
+func (s *countingStore) List(ctx context.Context, page, perPage int) ([]visitorResource, int, error) {
+	atomic.AddInt32(&s.lists, 1)
+	return s.VisitorStore.List(ctx, page, perPage)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{VisitorStore: newTestCouchStore(t, newTestCouch(t), "mydb")}
+	cache := newVisitorCache(cacheConfig{MaxBytes: 1 << 20, TTL: time.Minute})
+	cached := &cachedStore{VisitorStore: store, cache: cache}
+
+	anna, err := cached.Add(ctx, Visitor{Name: "Anna"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := cached.Add(ctx, Visitor{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() {
+		t.Helper()
+		if _, err := cached.Get(ctx, anna.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cached.Get(ctx, bob.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := cached.List(ctx, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := cached.List(ctx, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read()
+	read()
+	if store.gets != 2 || store.lists != 2 {
+		t.Fatalf("%d gets and %d lists reached the store, want 2 and 2", store.gets, store.lists)
+	}
+
+	//Renaming the visitor on page 1 invalidates the visitor and its page,
+	//but not the other visitor or page 2.
+	first, _, _ := cached.List(ctx, 1, 1)
+	renamed := first[0]
+	renamed.Name = "Renamed"
+	if err := cached.Update(ctx, &renamed); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	if store.gets != 3 || store.lists != 3 {
+		t.Errorf("after an update: %d gets and %d lists, want 3 and 3", store.gets, store.lists)
+	}
+	if page, _, _ := cached.List(ctx, 1, 1); page[0].Name != "Renamed" {
+		t.Errorf("page 1 after the update = %+v", page)
+	}
+
+	//A new visitor shifts every page.
+	if _, err := cached.Add(ctx, Visitor{Name: "Carl"}); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	if store.gets != 3 || store.lists != 5 {
+		t.Errorf("after an add: %d gets and %d lists, want 3 and 5", store.gets, store.lists)
+	}
+
+	//Changes of other instances arrive through the changes feed.
+	cache.invalidate(bob.ID, true)
+	read()
+	if store.gets != 4 || store.lists != 7 {
+		t.Errorf("after a deletion from the feed: %d gets and %d lists, want 4 and 7", store.gets, store.lists)
+	}
+}
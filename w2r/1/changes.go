@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timjacobi/go-couchdb"
+)
+
+// Modes of the changes feed, selected with CHANGES_FEED.
+const (
+	feedContinuous = "continuous"
+	feedLongpoll   = "longpoll"
+)
+
+// changesConfig holds the settings of changes processors.
+type changesConfig struct {
+	Mode               string        // feedContinuous or feedLongpoll
+	CheckpointInterval time.Duration // how often the checkpoint is saved and the lag measured
+	BatchSize          int           // changes per longpoll request
+}
+
+func changesConfigFromEnv() changesConfig {
+	cfg := changesConfig{Mode: feedContinuous, CheckpointInterval: 5 * time.Second, BatchSize: 100}
+	if v := os.Getenv("CHANGES_FEED"); v != "" {
+		if v != feedContinuous && v != feedLongpoll {
+			log.Printf("ignoring invalid CHANGES_FEED %q", v)
+		} else {
+			cfg.Mode = v
+		}
+	}
+	if v := os.Getenv("CHANGES_CHECKPOINT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring invalid CHANGES_CHECKPOINT_INTERVAL %q", v)
+		} else {
+			cfg.CheckpointInterval = d
+		}
+	}
+	if v := os.Getenv("CHANGES_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Printf("ignoring invalid CHANGES_BATCH_SIZE %q", v)
+		} else {
+			cfg.BatchSize = n
+		}
+	}
+	return cfg
+}
+
+// Document types that handlers can filter by. Documents with a string
+// type field have that type instead.
+const (
+	docTypeVisitor = "visitor"
+	docTypeDesign  = "design"
+)
+
+// changeEvent is a document change delivered to a changes handler.
+type changeEvent struct {
+	Seq     string
+	ID      string
+	Rev     string
+	Deleted bool
+	Type    string          // see docType
+	Doc     json.RawMessage // as of Rev; only _id, _rev and _deleted for deletions
+}
+
+// docType returns the type of a changed document: docTypeDesign for
+// design documents, the type field if there is one, and docTypeVisitor
+// otherwise, since visitors have none.
+func docType(id string, doc json.RawMessage) string {
+	if strings.HasPrefix(id, "_design/") {
+		return docTypeDesign
+	}
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(doc, &typed) == nil && typed.Type != "" {
+		return typed.Type
+	}
+	return docTypeVisitor
+}
+
+// changeHandler reacts to the changes of some document types.
+type changeHandler struct {
+	name  string
+	types map[string]bool // nil for all types
+	fn    func(ctx context.Context, ev *changeEvent) error
+}
+
+// changesProcessor delivers the changes of a database to its handlers.
+// The seq of the last change that all handlers processed is saved as a
+// checkpoint in the _local document changes-<name>, from which the
+// processor resumes after a restart or a failure of the feed.
+//
+// Delivery is at least once: a handler that fails gets the change again
+// after a backoff, and so do the handlers that already processed it, as
+// well as the handlers of all changes after the checkpoint when the
+// process dies. Handlers must therefore be idempotent. A handler that
+// keeps failing stops the processor at its change.
+type changesProcessor struct {
+	name     string
+	db       func() *couchdb.DB
+	cfg      changesConfig
+	handlers []*changeHandler
+
+	saveMu     sync.Mutex // serializes saveCheckpoint
+	mu         sync.Mutex
+	seq        string // of the last processed change
+	saved      string // seq of the checkpoint
+	rev        string // of the checkpoint document
+	savedAt    time.Time
+	lag        int64 // changes between seq and the update sequence of the database
+	lastChange time.Time
+
+	processed, handlerErrors, feedErrors, checkpoints int64
+}
+
+func newChangesProcessor(name string, db func() *couchdb.DB, cfg changesConfig) *changesProcessor {
+	return &changesProcessor{name: name, db: db, cfg: cfg}
+}
+
+// newConnChangesProcessor returns a processor of the database db that
+// follows the client rotations of conn.
+func newConnChangesProcessor(name string, conn *couchConn, db string, cfg changesConfig) *changesProcessor {
+	return newChangesProcessor(name, func() *couchdb.DB { return conn.DB(db) }, cfg)
+}
+
+// Idle reports whether no handler is registered, so that the processor
+// need not run.
+func (p *changesProcessor) Idle() bool {
+	return len(p.handlers) == 0
+}
+
+// Handle registers fn for the changes of the documents of types, or of
+// all documents if there are none. Handlers must be registered before
+// run is called; they are called one at a time, in order.
+func (p *changesProcessor) Handle(name string, types []string, fn func(ctx context.Context, ev *changeEvent) error) {
+	h := &changeHandler{name: name, fn: fn}
+	if len(types) > 0 {
+		h.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			h.types[t] = true
+		}
+	}
+	p.handlers = append(p.handlers, h)
+}
+
+// checkpointDoc is the _local document with the checkpoint.
+type checkpointDoc struct {
+	Rev       string    `json:"_rev,omitempty"`
+	Seq       string    `json:"seq"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (p *changesProcessor) checkpointID() string {
+	return "_local/changes-" + p.name
+}
+
+// loadCheckpoint reads the checkpoint. Without one, the processor starts
+// with the first change of the database.
+func (p *changesProcessor) loadCheckpoint(ctx context.Context) error {
+	var doc checkpointDoc
+	err := p.db().GetContext(ctx, p.checkpointID(), &doc, nil)
+	if err != nil && !couchdb.NotFound(err) {
+		return err
+	}
+	p.mu.Lock()
+	p.seq, p.saved, p.rev = doc.Seq, doc.Seq, doc.Rev
+	p.mu.Unlock()
+	return nil
+}
+
+// saveCheckpoint stores the seq of the last processed change, unless it
+// is saved already. Instances running the same processor share its
+// checkpoint; the last one to save it wins.
+func (p *changesProcessor) saveCheckpoint(ctx context.Context) error {
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	p.mu.Lock()
+	seq, saved, rev := p.seq, p.saved, p.rev
+	p.mu.Unlock()
+	if seq == "" || seq == saved {
+		return nil
+	}
+	doc := checkpointDoc{Rev: rev, Seq: seq, UpdatedAt: time.Now().UTC()}
+	newRev, err := p.db().PutContext(ctx, p.checkpointID(), doc, rev)
+	if couchdb.Conflict(err) {
+		if rev, err = p.db().RevContext(ctx, p.checkpointID()); err == nil {
+			doc.Rev = rev
+			newRev, err = p.db().PutContext(ctx, p.checkpointID(), doc, rev)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.saved, p.rev, p.savedAt = seq, newRev, time.Now()
+	p.checkpoints++
+	p.mu.Unlock()
+	return nil
+}
+
+// updateLag compares the processed seq with the update sequence of the
+// database. Sequences of CouchDB 2 and later are opaque, but start with
+// the number of changes, so the lag is an approximation.
+func (p *changesProcessor) updateLag(ctx context.Context) {
+	var result struct {
+		UpdateSeq interface{} `json:"update_seq"`
+	}
+	if err := p.db().AllDocsContext(ctx, &result, couchdb.Options{"limit": 0, "update_seq": true}); err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if lag := seqNumber(seqString(result.UpdateSeq)) - seqNumber(p.seq); lag >= 0 {
+		p.lag = lag
+	}
+}
+
+// seqNumber returns the numeric prefix of a sequence.
+func seqNumber(seq string) int64 {
+	n, _ := strconv.ParseInt(strings.SplitN(seq, "-", 2)[0], 10, 64)
+	return n
+}
+
+// process delivers one change to the handlers of its type, retrying a
+// failed handler until it succeeds or ctx is done.
+func (p *changesProcessor) process(ctx context.Context, ev *changeEvent) error {
+	for _, h := range p.handlers {
+		if h.types != nil && !h.types[ev.Type] {
+			continue
+		}
+		backoff := time.Second
+		for {
+			err := h.fn(ctx, ev)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			p.mu.Lock()
+			p.handlerErrors++
+			p.mu.Unlock()
+			log.Printf("changes processor %s: handler %s failed for %s, retrying in %s: %v", p.name, h.name, ev.ID, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		}
+	}
+	p.mu.Lock()
+	p.seq = ev.Seq
+	p.processed++
+	p.lastChange = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// errFeedEnded is returned when CouchDB closes a continuous feed.
+var errFeedEnded = errors.New("changes feed ended")
+
+// follow reads the feed from the current seq until it fails or ctx is
+// done. A longpoll request returns after BatchSize changes, or when none
+// arrived for a minute.
+func (p *changesProcessor) follow(ctx context.Context) error {
+	p.mu.Lock()
+	since := p.seq
+	p.mu.Unlock()
+	opts := couchdb.Options{"feed": p.cfg.Mode, "include_docs": true}
+	if since != "" {
+		opts["since"] = since
+	}
+	if p.cfg.Mode == feedLongpoll {
+		opts["limit"] = p.cfg.BatchSize
+		opts["timeout"] = 60000
+	} else {
+		opts["heartbeat"] = 30000
+	}
+	feed, err := p.db().ChangesContext(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer feed.Close()
+
+	for feed.Next() {
+		if feed.ID == "" {
+			continue
+		}
+		ev := &changeEvent{Seq: seqString(feed.Seq), ID: feed.ID, Deleted: feed.Deleted, Doc: feed.Doc}
+		if len(feed.Changes) > 0 {
+			ev.Rev = feed.Changes[0].Rev
+		}
+		ev.Type = docType(ev.ID, ev.Doc)
+		if err := p.process(ctx, ev); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := feed.Err(); err != nil {
+		return err
+	}
+	if p.cfg.Mode == feedContinuous {
+		return errFeedEnded
+	}
+	return nil
+}
+
+// run loads the checkpoint and follows the feed until ctx is done. It
+// reconnects with a backoff of up to a minute when the feed fails. The
+// checkpoint is saved and the lag measured every CheckpointInterval,
+// which is safe while changes are processed since seq only moves past a
+// change once all its handlers are done. The checkpoint is saved once
+// more when ctx is done.
+func (p *changesProcessor) run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.cfg.CheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := p.saveCheckpoint(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("changes processor %s: can not save the checkpoint: %v", p.name, err)
+			}
+			p.updateLag(ctx)
+		}
+	}()
+	backoff := time.Second
+	loaded := false
+	for {
+		var err error
+		if !loaded {
+			if err = p.loadCheckpoint(ctx); err == nil {
+				loaded = true
+			}
+		}
+		if loaded {
+			p.mu.Lock()
+			before := p.processed
+			p.mu.Unlock()
+			err = p.follow(ctx)
+			p.mu.Lock()
+			if p.processed > before {
+				backoff = time.Second
+			}
+			p.mu.Unlock()
+		}
+		if ctx.Err() != nil {
+			saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			if err := p.saveCheckpoint(saveCtx); err != nil {
+				log.Printf("changes processor %s: can not save the checkpoint: %v", p.name, err)
+			}
+			cancel()
+			return
+		}
+		if err == nil {
+			//A longpoll request returned.
+			continue
+		}
+		log.Printf("changes processor %s: feed stopped, reconnecting in %s: %v", p.name, backoff, err)
+		p.mu.Lock()
+		p.feedErrors++
+		p.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			//The next iteration saves the checkpoint.
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// writeMetrics writes the processor metrics in the Prometheus text
+// format, labeled with the name of the processor.
+func (p *changesProcessor) writeMetrics(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var checkpointAge, idle float64
+	if !p.savedAt.IsZero() {
+		checkpointAge = time.Since(p.savedAt).Seconds()
+	}
+	if !p.lastChange.IsZero() {
+		idle = time.Since(p.lastChange).Seconds()
+	}
+	for _, m := range []struct {
+		name, typ, help string
+		value           float64
+	}{
+		{"changes_processed_total", "counter", "Changes delivered to all their handlers.", float64(p.processed)},
+		{"changes_handler_errors_total", "counter", "Failed handler calls, which are retried.", float64(p.handlerErrors)},
+		{"changes_feed_errors_total", "counter", "Failures of the changes feed, after which it reconnects.", float64(p.feedErrors)},
+		{"changes_checkpoints_total", "counter", "Saved checkpoints.", float64(p.checkpoints)},
+		{"changes_lag", "gauge", "Approximate number of changes not processed yet.", float64(p.lag)},
+		{"changes_checkpoint_age_seconds", "gauge", "Time since the checkpoint was saved.", checkpointAge},
+		{"changes_idle_seconds", "gauge", "Time since the last change was processed.", idle},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{processor=%q} %g\n", m.name, m.help, m.name, m.typ, m.name, p.name, m.value)
+	}
+}
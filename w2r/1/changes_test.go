@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/timjacobi/go-couchdb"
+)
+
+// testChangesConfig saves checkpoints only when a processor stops.
+var testChangesConfig = changesConfig{Mode: feedContinuous, CheckpointInterval: time.Hour, BatchSize: 100}
+
+// runTestProcessor runs p until the returned function is called or the
+// test ends, which wait until it saved its checkpoint.
+func runTestProcessor(t *testing.T, p *changesProcessor) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// startTestProcessor runs a processor named test of db whose handler
+// sends the IDs of the changed documents to the returned channel.
+func startTestProcessor(t *testing.T, db *couchdb.DB) (<-chan string, func()) {
+	t.Helper()
+	p := newChangesProcessor("test", func() *couchdb.DB { return db }, testChangesConfig)
+	ids := make(chan string, 100)
+	p.Handle("record", []string{docTypeVisitor}, func(ctx context.Context, ev *changeEvent) error {
+		ids <- ev.ID
+		return nil
+	})
+	return ids, runTestProcessor(t, p)
+}
+
+// receive waits for the next ID from ids.
+func receive(t *testing.T, ids <-chan string) string {
+	t.Helper()
+	select {
+	case id := <-ids:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change delivered")
+		return ""
+	}
+}
+
+func TestChangesProcessorCheckpoint(t *testing.T) {
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	db := store.db()
+	added := addVisitors(t, store, "Anna", "Bob")
+
+	ids, stop := startTestProcessor(t, db)
+	for _, v := range added {
+		if id := receive(t, ids); id != v.ID {
+			t.Fatalf("processor delivered %s, want %s", id, v.ID)
+		}
+	}
+	stop()
+
+	var doc checkpointDoc
+	if err := db.Get("_local/changes-test", &doc, nil); err != nil || doc.Seq == "" {
+		t.Fatalf("checkpoint = %+v, %v", doc, err)
+	}
+
+	//A processor of the same name resumes after the changes processed
+	//before the restart.
+	later := addVisitors(t, store, "Carl")[0]
+	ids, _ = startTestProcessor(t, db)
+	if id := receive(t, ids); id != later.ID {
+		t.Errorf("restarted processor delivered %s, want %s", id, later.ID)
+	}
+}
+
+func TestVisitorCacheHandleChange(t *testing.T) {
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	cache := newVisitorCache(cacheConfig{MaxBytes: 1 << 20, TTL: time.Hour})
+	cached := &cachedStore{VisitorStore: store, cache: cache}
+	p := newChangesProcessor("visitors", store.db, testChangesConfig)
+	p.Handle("visitor-cache", []string{docTypeVisitor}, cache.handleChange)
+	runTestProcessor(t, p)
+	ctx := context.Background()
+
+	v := addVisitors(t, store, "Anna")[0]
+	if _, err := cached.Get(ctx, v.ID); err != nil {
+		t.Fatal(err)
+	}
+	//Writes that bypass the cache, like those of other instances, reach
+	//it through the processor.
+	v.Name = "Anna Maria"
+	if err := store.Update(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := cached.Get(ctx, v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name == v.Name {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cached name is still %q", got.Name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSuggestIndexHandleChange(t *testing.T) {
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	x := newSuggestIndex()
+	p := newChangesProcessor("visitors", store.db, testChangesConfig)
+	p.Handle("suggest-index", []string{docTypeVisitor}, x.handleChange)
+	ctx := context.Background()
+
+	//Changes delivered before the build are held until it is done.
+	anna := addVisitors(t, store, "Anna")[0]
+	ev := &changeEvent{Seq: "1", ID: "early", Type: docTypeVisitor, Doc: []byte(`{"_id":"early","name":"Bernadette"}`)}
+	if err := x.handleChange(ctx, ev); err != nil {
+		t.Fatal(err)
+	}
+	x.run(ctx, store, false)
+	if !x.Ready() || len(x.Suggest("anna", 10)) != 1 || len(x.Suggest("bernadette", 10)) != 1 {
+		t.Fatalf("index after the build: anna %v, bernadette %v", x.Suggest("anna", 10), x.Suggest("bernadette", 10))
+	}
+
+	runTestProcessor(t, p)
+	anna.Name = "Hannelore"
+	if err := store.Update(ctx, anna); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(x.Suggest("hannelore", 10)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the rename did not reach the index")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := x.Suggest("anna", 10); len(s) != 0 {
+		t.Errorf("old name still suggested: %v", s)
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import "net/http"
+
+// Authenticator adds credentials to a request before it is sent. It is
+// called again for every retry.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// AuthFunc adapts a function to an Authenticator.
+type AuthFunc func(req *http.Request) error
+
+// Authenticate calls f(req).
+func (f AuthFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// BearerToken sends token in the Authorization header.
+func BearerToken(token string) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// BasicAuth sends a user name and password.
+func BasicAuth(username, password string) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		req.SetBasicAuth(username, password)
+		return nil
+	})
+}
+
+// Header sets a fixed header, e.g. the tenant header of deployments that
+// run in header tenant mode.
+func Header(name, value string) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		req.Header.Set(name, value)
+		return nil
+	})
+}
+
+// Chain applies several authenticators in order.
+func Chain(auths ...Authenticator) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		for _, a := range auths {
+			if err := a.Authenticate(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
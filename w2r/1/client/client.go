@@ -0,0 +1,263 @@
+// Package client is a Go client for the visitors API of the get-started-go
+// app.
+//
+//	c, err := client.New("https://get-started-go.example.com",
+//		client.WithAuth(client.BearerToken(token)))
+//	if err != nil {
+//		return err
+//	}
+//	v, err := c.CreateVisitor(ctx, client.VisitorInput{Name: "Bob", Lang: "de"})
+//
+// Idempotent calls are retried on network errors and on 429, 502, 503 and
+// 504 responses. Errors returned by the server are *Error values that can
+// be compared with errors.Is against ErrNotFound and the other sentinels.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one deployment of the app. It is safe for concurrent use.
+type Client struct {
+	base       *url.URL
+	httpClient *http.Client
+	auth       Authenticator
+	retry      RetryPolicy
+	userAgent  string
+}
+
+// RetryPolicy controls how idempotent requests are retried.
+type RetryPolicy struct {
+	MaxAttempts int           // total number of attempts, 1 disables retries
+	MinBackoff  time.Duration // wait before the first retry, doubled after each attempt
+	MaxBackoff  time.Duration // upper bound for a single wait
+}
+
+// DefaultRetryPolicy makes up to three attempts.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, MinBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+// The default is http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAuth sets the Authenticator that is applied to every request.
+func WithAuth(a Authenticator) Option {
+	return func(c *Client) { c.auth = a }
+}
+
+// WithRetry replaces DefaultRetryPolicy.
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// WithUserAgent sets the User-Agent header.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New returns a client for the app at baseURL. In path tenant mode,
+// include the tenant prefix, e.g. "https://example.com/t/acme".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("client: base URL %q must be absolute", baseURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	c := &Client{
+		base:       u,
+		httpClient: http.DefaultClient,
+		retry:      DefaultRetryPolicy,
+		userAgent:  "get-started-go-client",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retry.MaxAttempts < 1 {
+		c.retry.MaxAttempts = 1
+	}
+	return c, nil
+}
+
+// request describes one API call.
+type request struct {
+	method string
+	path   string // relative to the base URL, e.g. "api/v1/visitors"
+	query  url.Values
+	body   interface{}
+	accept string
+	header http.Header // extra headers, e.g. If-Match
+}
+
+// do sends req, retrying idempotent methods and requests with an
+// Idempotency-Key, and returns the response of the last attempt. Responses other than 2xx are turned into *Error,
+// except 304 Not Modified if the request has If-None-Match.
+// The caller must close the body of a successful response.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return nil, err
+		}
+	}
+	u := c.base.ResolveReference(&url.URL{Path: req.path, RawQuery: req.query.Encode()})
+	attempts := 1
+	keyed := req.header.Get("Idempotency-Key") != ""
+	if idempotent(req.method) || keyed {
+		attempts = c.retry.MaxAttempts
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+		hr, err := http.NewRequest(req.method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		hr = hr.WithContext(ctx)
+		if body != nil {
+			hr.Header.Set("Content-Type", "application/json")
+		}
+		hr.Header.Set("Accept", "application/json")
+		if req.accept != "" {
+			hr.Header.Set("Accept", req.accept)
+		}
+		hr.Header.Set("User-Agent", c.userAgent)
+		for k, v := range req.header {
+			hr.Header[k] = v
+		}
+		if c.auth != nil {
+			if err := c.auth.Authenticate(hr); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.httpClient.Do(hr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if resp.StatusCode == http.StatusNotModified && req.header.Get("If-None-Match") != "" {
+			return resp, nil
+		}
+		lastErr = errorFromResponse(resp)
+		//409 means that the first request with the key is still running.
+		if !retryable(resp.StatusCode) && !(keyed && resp.StatusCode == http.StatusConflict) {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// doJSON sends req and decodes the response body into out, if not nil.
+func (c *Client) doJSON(ctx context.Context, req request, out interface{}) error {
+	_, err := c.doJSONHeader(ctx, req, out)
+	return err
+}
+
+// doJSONHeader is doJSON for callers that need the status and headers of
+// the response. out is left alone on 304 Not Modified.
+func (c *Client) doJSONHeader(ctx context.Context, req request, out interface{}) (*http.Response, error) {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNotModified {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return resp, err
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before the given retry. A Retry-After sent with
+// the previous response takes precedence over the exponential backoff.
+func (c *Client) backoff(attempt int, lastErr error) time.Duration {
+	if e, ok := lastErr.(*Error); ok && e.RetryAfter > 0 {
+		return e.RetryAfter
+	}
+	d := c.retry.MinBackoff << uint(attempt-1)
+	if d <= 0 || d > c.retry.MaxBackoff {
+		d = c.retry.MaxBackoff
+	}
+	// Full jitter spreads out clients that failed at the same time.
+	if d > 0 {
+		d = time.Duration(rand.Int63n(int64(d)) + 1)
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Error codes sent by the server, see the APIError schema of the
+// OpenAPI document.
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodePrecondition   = "precondition_failed"
+	CodeKeyReused      = "idempotency_key_reused"
+	CodeQuotaExceeded  = "quota_exceeded"
+	CodeUnavailable    = "unavailable"
+	CodeInternal       = "internal"
+)
+
+// Sentinel errors to compare with errors.Is.
+var (
+	ErrInvalidRequest = &Error{Code: CodeInvalidRequest}
+	ErrNotFound       = &Error{Code: CodeNotFound}
+	ErrConflict       = &Error{Code: CodeConflict}
+	ErrPrecondition   = &Error{Code: CodePrecondition}
+	ErrKeyReused      = &Error{Code: CodeKeyReused}
+	ErrQuotaExceeded  = &Error{Code: CodeQuotaExceeded}
+	ErrUnavailable    = &Error{Code: CodeUnavailable}
+	ErrInternal       = &Error{Code: CodeInternal}
+)
+
+// Error is an error response of the API.
+type Error struct {
+	StatusCode int
+	Code       string // one of the Code constants; derived from StatusCode if the server sent none
+	Message    string
+	RetryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("client: %d %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is reports whether target is an *Error with the same code, so that
+// errors.Is(err, ErrNotFound) matches every not found response.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// errorFromResponse reads an error response and closes its body.
+func errorFromResponse(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil {
+		e.Code, e.Message = body.Code, body.Error
+	} else {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	if e.Code == "" {
+		e.Code = codeForStatus(resp.StatusCode)
+	}
+	return e
+}
+
+// codeForStatus maps responses without a code, like those of the tenant
+// middleware or a proxy, to the closest code.
+func codeForStatus(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return CodeNotFound
+	case status == http.StatusConflict:
+		return CodeConflict
+	case status == http.StatusPreconditionFailed:
+		return CodePrecondition
+	case status == http.StatusForbidden:
+		return CodeQuotaExceeded
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable ||
+		status == http.StatusBadGateway || status == http.StatusGatewayTimeout:
+		return CodeUnavailable
+	case status >= 400 && status < 500:
+		return CodeInvalidRequest
+	}
+	return CodeInternal
+}
@@ -0,0 +1,417 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Visitor is a visitor of the guestbook. Names and greetings are
+// HTML-escaped by the server.
+type Visitor struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Locale   string    `json:"locale,omitempty"`
+	Created  time.Time `json:"created_at"` // zero for visitors stored before it was recorded
+	Tags     []string  `json:"tags,omitempty"`
+	Deleted  time.Time `json:"deleted_at"`         // only set in the trash
+	Greeting string    `json:"greeting,omitempty"` // only set by CreateVisitor
+
+	// ETag identifies the revision of the visitor. It is set by the
+	// methods that return a single visitor.
+	ETag string `json:"-"`
+}
+
+// VisitorInput describes a new visitor. Lang selects the language of the
+// greeting; the server's default language is used if it is empty.
+type VisitorInput struct {
+	Name string   `json:"name"`
+	Lang string   `json:"lang,omitempty"`
+	Tags []string `json:"tags,omitempty"` // at most 10 words
+}
+
+// VisitorUpdate replaces the name of a visitor. An empty Locale keeps the
+// current one.
+type VisitorUpdate struct {
+	Name   string `json:"name"`
+	Locale string `json:"locale,omitempty"`
+}
+
+// Page is one page of visitors.
+type Page struct {
+	Visitors []Visitor `json:"visitors"`
+	Total    int       `json:"total"`
+	Number   int       `json:"page"`
+	PerPage  int       `json:"per_page"`
+
+	// ETag changes with every write to the database.
+	ETag string `json:"-"`
+
+	query url.Values // to fetch the page again
+}
+
+const visitorsPath = "api/v1/visitors"
+
+func visitorPath(id string) string {
+	return visitorsPath + "/" + url.PathEscape(id)
+}
+
+// CreateVisitor greets and stores a visitor. The returned visitor carries
+// the greeting. CreateVisitor is not retried, since a retry could store
+// the visitor twice.
+func (c *Client) CreateVisitor(ctx context.Context, in VisitorInput) (*Visitor, error) {
+	return c.visitor(ctx, request{method: http.MethodPost, path: visitorsPath, body: in})
+}
+
+// CreateVisitorWithKey is CreateVisitor with an Idempotency-Key, so that
+// it is retried like the idempotent calls. Retries and later calls with
+// the same key and input return the visitor created first; reusing the
+// key for another input fails with ErrKeyReused.
+func (c *Client) CreateVisitorWithKey(ctx context.Context, key string, in VisitorInput) (*Visitor, error) {
+	return c.visitor(ctx, request{method: http.MethodPost, path: visitorsPath, body: in, header: http.Header{"Idempotency-Key": {key}}})
+}
+
+// GetVisitor returns the visitor with the given id.
+func (c *Client) GetVisitor(ctx context.Context, id string) (*Visitor, error) {
+	return c.visitor(ctx, request{method: http.MethodGet, path: visitorPath(id)})
+}
+
+// RevalidateVisitor fetches v again unless it is unchanged, which costs
+// the server no more than a revision check. It returns v itself and
+// false if v is current.
+func (c *Client) RevalidateVisitor(ctx context.Context, v *Visitor) (*Visitor, bool, error) {
+	req := request{method: http.MethodGet, path: visitorPath(v.ID), header: http.Header{"If-None-Match": {v.ETag}}}
+	fresh, err := c.visitor(ctx, req)
+	if err != nil {
+		return nil, false, err
+	}
+	if fresh == nil {
+		return v, false, nil
+	}
+	return fresh, true, nil
+}
+
+// UpdateVisitor replaces the name of a visitor and returns the result.
+func (c *Client) UpdateVisitor(ctx context.Context, id string, u VisitorUpdate) (*Visitor, error) {
+	return c.visitor(ctx, request{method: http.MethodPut, path: visitorPath(id), body: u})
+}
+
+// UpdateVisitorIfUnchanged is UpdateVisitor for a visitor that was read
+// before. It fails with ErrPrecondition if v has been modified since,
+// so that the update does not overwrite changes that v does not have.
+func (c *Client) UpdateVisitorIfUnchanged(ctx context.Context, v *Visitor, u VisitorUpdate) (*Visitor, error) {
+	req := request{method: http.MethodPut, path: visitorPath(v.ID), body: u, header: ifMatch(v)}
+	return c.visitor(ctx, req)
+}
+
+// DeleteVisitor moves a visitor to the trash.
+func (c *Client) DeleteVisitor(ctx context.Context, id string) error {
+	return c.doJSON(ctx, request{method: http.MethodDelete, path: visitorPath(id)}, nil)
+}
+
+// DeleteVisitorIfUnchanged moves v to the trash unless it has been modified since
+// it was read, in which case it fails with ErrPrecondition.
+func (c *Client) DeleteVisitorIfUnchanged(ctx context.Context, v *Visitor) error {
+	return c.doJSON(ctx, request{method: http.MethodDelete, path: visitorPath(v.ID), header: ifMatch(v)}, nil)
+}
+
+// ifMatch returns the If-Match header for a write to v. A visitor
+// without an ETag never matches.
+func ifMatch(v *Visitor) http.Header {
+	etag := v.ETag
+	if etag == "" {
+		etag = `""`
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+// visitor sends a request that returns a single visitor. It returns nil
+// on 304 Not Modified.
+func (c *Client) visitor(ctx context.Context, req request) (*Visitor, error) {
+	var v Visitor
+	resp, err := c.doJSONHeader(ctx, req, &v)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	v.ETag = resp.Header.Get("ETag")
+	return &v, nil
+}
+
+// page fetches a page of visitors. It returns nil on 304 Not Modified.
+func (c *Client) page(ctx context.Context, query url.Values, etag string) (*Page, error) {
+	req := request{method: http.MethodGet, path: visitorsPath, query: query}
+	if etag != "" {
+		req.header = http.Header{"If-None-Match": {etag}}
+	}
+	var p Page
+	resp, err := c.doJSONHeader(ctx, req, &p)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	p.ETag = resp.Header.Get("ETag")
+	p.query = query
+	return &p, nil
+}
+
+// RevalidatePage fetches p again unless no visitor has been written
+// since. It returns p itself and false if p is current.
+func (c *Client) RevalidatePage(ctx context.Context, p *Page) (*Page, bool, error) {
+	fresh, err := c.page(ctx, p.query, p.ETag)
+	if err != nil {
+		return nil, false, err
+	}
+	if fresh == nil {
+		return p, false, nil
+	}
+	return fresh, true, nil
+}
+
+// ListOptions selects the pages returned by ListVisitors.
+type ListOptions struct {
+	Page    int // first page, 1 if zero
+	PerPage int // server default if zero, at most 100
+}
+
+// ListVisitors returns an iterator over the pages of visitors:
+//
+//	it := c.ListVisitors(ctx, client.ListOptions{PerPage: 50})
+//	for it.Next() {
+//		for _, v := range it.Page().Visitors {
+//			...
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) ListVisitors(ctx context.Context, opts ListOptions) *PageIterator {
+	next := opts.Page
+	if next < 1 {
+		next = 1
+	}
+	return &PageIterator{ctx: ctx, c: c, next: next, perPage: opts.PerPage}
+}
+
+// PageIterator iterates over the pages of a visitor list.
+type PageIterator struct {
+	ctx     context.Context
+	c       *Client
+	next    int
+	perPage int
+	page    *Page
+	done    bool
+	err     error
+}
+
+// Next fetches the next page. It returns false when there are no more
+// pages or an error occurred.
+func (it *PageIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	query := url.Values{"page": {strconv.Itoa(it.next)}}
+	if it.perPage > 0 {
+		query.Set("per_page", strconv.Itoa(it.perPage))
+	}
+	p, err := it.c.page(it.ctx, query, "")
+	if err != nil {
+		it.err, it.done = err, true
+		return false
+	}
+	if len(p.Visitors) == 0 {
+		it.done = true
+		return false
+	}
+	it.page = p
+	it.next++
+	if p.PerPage <= 0 || p.Number*p.PerPage >= p.Total {
+		it.done = true
+	}
+	return true
+}
+
+// Page returns the page fetched by the last call to Next.
+func (it *PageIterator) Page() *Page {
+	return it.page
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *PageIterator) Err() error {
+	return it.err
+}
+
+// SearchVisitors returns up to perPage visitors with a name word starting
+// with each word of query. perPage 0 selects the server default.
+func (c *Client) SearchVisitors(ctx context.Context, query string, perPage int) (*Page, error) {
+	q := url.Values{"q": {query}}
+	if perPage > 0 {
+		q.Set("per_page", strconv.Itoa(perPage))
+	}
+	return c.page(ctx, q, "")
+}
+
+// VisitorFilter selects the visitors returned by FindVisitors. Every
+// condition that is set must hold.
+type VisitorFilter struct {
+	NamePrefix    string    `json:"name_prefix,omitempty"` // ignoring case
+	CreatedAfter  time.Time `json:"-"`                     // inclusive
+	CreatedBefore time.Time `json:"-"`                     // exclusive
+	Tags          []string  `json:"tags,omitempty"`        // all of them
+	Locales       []string  `json:"locales,omitempty"`     // any of them
+	Limit         int       `json:"limit,omitempty"`       // server default if zero, at most 100
+	Bookmark      string    `json:"bookmark,omitempty"`    // of the previous FindResult
+}
+
+// FindResult is a page of the visitors that match a VisitorFilter. To
+// get the next page, set the Bookmark of the filter to the one of the
+// result. It is empty after the last page.
+type FindResult struct {
+	Visitors []Visitor `json:"visitors"`
+	Bookmark string    `json:"bookmark"`
+}
+
+// FindVisitors returns the visitors that match f.
+func (c *Client) FindVisitors(ctx context.Context, f VisitorFilter) (*FindResult, error) {
+	body := struct {
+		VisitorFilter
+		CreatedAfter  string `json:"created_after,omitempty"`
+		CreatedBefore string `json:"created_before,omitempty"`
+	}{VisitorFilter: f}
+	if !f.CreatedAfter.IsZero() {
+		body.CreatedAfter = f.CreatedAfter.Format(time.RFC3339Nano)
+	}
+	if !f.CreatedBefore.IsZero() {
+		body.CreatedBefore = f.CreatedBefore.Format(time.RFC3339Nano)
+	}
+	var result FindResult
+	if err := c.doJSON(ctx, request{method: http.MethodPost, path: visitorsPath + "/search", body: body}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Revision is an entry of the history of a visitor, newest first.
+type Revision struct {
+	Rev     string       `json:"rev"`    // empty for a deletion whose tombstone the server does not know
+	Status  string       `json:"status"` // available, missing, deleted or unknown
+	Visitor *Visitor     `json:"visitor"`
+	Audit   *AuditRecord `json:"audit"` // nil for revisions written before the audit trail
+}
+
+// AuditRecord says who made a change to a visitor.
+type AuditRecord struct {
+	Action    string        `json:"action"` // create, update, delete or restore
+	Actor     string        `json:"actor"`
+	At        time.Time     `json:"at"`
+	BaseRev   string        `json:"base_rev"`
+	RequestID string        `json:"request_id"`
+	SourceIP  string        `json:"source_ip"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+// FieldChange is a changed field of a visitor. From and To are nil if the
+// field was not set.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// VisitorHistory returns the revisions of a visitor with their audit
+// records, also of a deleted visitor.
+func (c *Client) VisitorHistory(ctx context.Context, id string) ([]Revision, error) {
+	var result struct {
+		Revisions []Revision `json:"revisions"`
+	}
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: visitorPath(id) + "/history"}, &result); err != nil {
+		return nil, err
+	}
+	return result.Revisions, nil
+}
+
+// GetVisitorRevision returns a visitor as of a revision of its history.
+func (c *Client) GetVisitorRevision(ctx context.Context, id, rev string) (*Visitor, error) {
+	return c.visitor(ctx, request{method: http.MethodGet, path: visitorPath(id) + "/history/" + url.PathEscape(rev)})
+}
+
+// RestoreVisitor writes the name, locale and tags of an earlier revision
+// as a new revision of the visitor.
+func (c *Client) RestoreVisitor(ctx context.Context, id, rev string) (*Visitor, error) {
+	body := struct {
+		Rev string `json:"rev"`
+	}{rev}
+	return c.visitor(ctx, request{method: http.MethodPut, path: visitorPath(id) + "/restore", body: body})
+}
+
+const trashPath = "api/v1/trash"
+
+// ListTrash returns up to limit visitors in the trash, longest deleted
+// first, continuing after the page that bookmark came with. The server
+// default applies if limit is zero.
+func (c *Client) ListTrash(ctx context.Context, bookmark string, limit int) (*FindResult, error) {
+	q := url.Values{}
+	if bookmark != "" {
+		q.Set("bookmark", bookmark)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var result FindResult
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: trashPath, query: q}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UndeleteVisitor takes a visitor out of the trash.
+func (c *Client) UndeleteVisitor(ctx context.Context, id string) (*Visitor, error) {
+	return c.visitor(ctx, request{method: http.MethodPost, path: trashPath + "/" + url.PathEscape(id) + "/restore"})
+}
+
+// PurgeVisitor removes a visitor in the trash for good.
+func (c *Client) PurgeVisitor(ctx context.Context, id string) error {
+	return c.doJSON(ctx, request{method: http.MethodDelete, path: trashPath + "/" + url.PathEscape(id)}, nil)
+}
+
+// StreamVisitors calls fn for every visitor, streamed by the server in a
+// single response. It stops at the first error returned by fn.
+func (c *Client) StreamVisitors(ctx context.Context, fn func(Visitor) error) error {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: visitorsPath, accept: "application/x-ndjson"})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line struct {
+			Visitor
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return err
+		}
+		if line.Error != "" {
+			return &Error{StatusCode: http.StatusInternalServerError, Code: line.Code, Message: line.Error}
+		}
+		if err := fn(line.Visitor); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
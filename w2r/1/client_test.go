@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"testing"
+
+	"github.com/IBM-Cloud/get-started-go/client"
+)
+
+// newTestClient returns a client of the app serving a new CouchDB
+// guestbook.
+func newTestClient(t *testing.T) *client.Client {
+	t.Helper()
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	c, err := client.New(newTestApp(t, store).URL, client.WithRetry(client.RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	//The server escapes names for HTML.
+	name := `O'Brien <b>`
+	created, err := c.CreateVisitor(ctx, client.VisitorInput{Name: name, Lang: "de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Name != html.EscapeString(name) || created.Locale != "de" {
+		t.Fatalf("CreateVisitor = %+v", created)
+	}
+	if !strings.Contains(created.Greeting, html.EscapeString(name)) {
+		t.Errorf("greeting %q does not contain the escaped name", created.Greeting)
+	}
+	got, err := c.GetVisitor(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != created.Name || got.Locale != "de" {
+		t.Fatalf("GetVisitor = %+v", got)
+	}
+	updated, err := c.UpdateVisitor(ctx, created.ID, client.VisitorUpdate{Name: "Bob", Locale: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID || updated.Name != "Bob" || updated.Locale != "en" {
+		t.Fatalf("UpdateVisitor = %+v", updated)
+	}
+	if err := c.DeleteVisitor(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetVisitor(ctx, created.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetVisitor after the delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientConditionalRequests(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	created, err := c.CreateVisitor(ctx, client.VisitorInput{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetVisitor(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ETag == "" || got.ETag != created.ETag {
+		t.Fatalf("GetVisitor ETag = %q, want %q", got.ETag, created.ETag)
+	}
+	if v, changed, err := c.RevalidateVisitor(ctx, got); err != nil || changed || v != got {
+		t.Errorf("RevalidateVisitor of the current revision = %+v, %v, %v", v, changed, err)
+	}
+	updated, err := c.UpdateVisitorIfUnchanged(ctx, got, client.VisitorUpdate{Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "Alice" || updated.ETag == got.ETag {
+		t.Fatalf("UpdateVisitorIfUnchanged = %+v", updated)
+	}
+	if v, changed, err := c.RevalidateVisitor(ctx, got); err != nil || !changed || v.ETag != updated.ETag {
+		t.Errorf("RevalidateVisitor of a stale revision = %+v, %v, %v", v, changed, err)
+	}
+
+	//The revision read first is stale now.
+	if _, err := c.UpdateVisitorIfUnchanged(ctx, got, client.VisitorUpdate{Name: "Bob"}); !errors.Is(err, client.ErrPrecondition) {
+		t.Errorf("update of a stale visitor: got %v, want ErrPrecondition", err)
+	}
+	if err := c.DeleteVisitorIfUnchanged(ctx, got); !errors.Is(err, client.ErrPrecondition) {
+		t.Errorf("delete of a stale visitor: got %v, want ErrPrecondition", err)
+	}
+	if err := c.DeleteVisitorIfUnchanged(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	if _, err := c.GetVisitor(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetVisitor of an unknown visitor: got %v, want ErrNotFound", err)
+	}
+	if _, err := c.CreateVisitor(ctx, client.VisitorInput{}); !errors.Is(err, client.ErrInvalidRequest) {
+		t.Errorf("CreateVisitor without a name: got %v, want ErrInvalidRequest", err)
+	}
+	var apiErr *client.Error
+	if _, err := c.UpdateVisitor(ctx, "missing", client.VisitorUpdate{Name: "Bob"}); !errors.As(err, &apiErr) || apiErr.StatusCode != 404 {
+		t.Errorf("UpdateVisitor of an unknown visitor: got %v, want a 404 *Error", err)
+	}
+	if err := c.DeleteVisitor(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("DeleteVisitor of an unknown visitor: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientListAndStream(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	want := make(map[string]bool)
+	for i := 0; i < 7; i++ {
+		v, err := c.CreateVisitor(ctx, client.VisitorInput{Name: fmt.Sprintf("Visitor %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[v.ID] = true
+	}
+
+	seen := make(map[string]bool)
+	pages := 0
+	it := c.ListVisitors(ctx, client.ListOptions{PerPage: 3})
+	for it.Next() {
+		pages++
+		p := it.Page()
+		if p.Total != len(want) {
+			t.Errorf("page %d: total %d, want %d", p.Number, p.Total, len(want))
+		}
+		for _, v := range p.Visitors {
+			if seen[v.ID] {
+				t.Errorf("visitor %s listed twice", v.ID)
+			}
+			seen[v.ID] = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(want) || pages != 3 {
+		t.Errorf("ListVisitors returned %d visitors in %d pages, want %d in 3", len(seen), pages, len(want))
+	}
+
+	streamed := 0
+	err := c.StreamVisitors(ctx, func(v client.Visitor) error {
+		if !want[v.ID] {
+			t.Errorf("streamed unknown visitor %s", v.ID)
+		}
+		streamed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed != len(want) {
+		t.Errorf("StreamVisitors returned %d visitors, want %d", streamed, len(want))
+	}
+}
+
+func TestClientIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	in := client.VisitorInput{Name: "Bob"}
+	first, err := c.CreateVisitorWithKey(ctx, "key-1", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := c.CreateVisitorWithKey(ctx, "key-1", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ID != first.ID {
+		t.Errorf("replay created visitor %s, want %s", replayed.ID, first.ID)
+	}
+	if _, err := c.CreateVisitorWithKey(ctx, "key-1", client.VisitorInput{Name: "Alice"}); !errors.Is(err, client.ErrKeyReused) {
+		t.Errorf("reuse of a key: got %v, want ErrKeyReused", err)
+	}
+}
+
+func TestClientTrash(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	v, err := c.CreateVisitor(ctx, client.VisitorInput{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteVisitor(ctx, v.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetVisitor(ctx, v.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetVisitor in the trash: got %v, want ErrNotFound", err)
+	}
+	trash, err := c.ListTrash(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Visitors) != 1 || trash.Visitors[0].ID != v.ID || trash.Visitors[0].Deleted.IsZero() {
+		t.Fatalf("ListTrash = %+v", trash)
+	}
+	restored, err := c.UndeleteVisitor(ctx, v.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != "Bob" || !restored.Deleted.IsZero() {
+		t.Errorf("UndeleteVisitor = %+v", restored)
+	}
+	if err := c.PurgeVisitor(ctx, v.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("PurgeVisitor out of the trash: got %v, want ErrNotFound", err)
+	}
+	if err := c.DeleteVisitor(ctx, v.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PurgeVisitor(ctx, v.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UndeleteVisitor(ctx, v.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("UndeleteVisitor after the purge: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,156 @@
+package couchserver
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// attachmentsOf returns the attachments of a new revision from the
+// _attachments field of its body. Stubs refer to attachments of the
+// current revision; attachments with data are stored. Attachments that
+// are not mentioned are removed, as in CouchDB.
+func (db *database) attachmentsOf(id string, body map[string]interface{}) (map[string]*attachment, error) {
+	field, ok := body["_attachments"].(map[string]interface{})
+	if !ok || len(field) == 0 {
+		return nil, nil
+	}
+	var cur map[string]*attachment
+	if doc, err := db.get(id); err == nil {
+		cur = doc.Atts
+	}
+	atts := make(map[string]*attachment, len(field))
+	for name, v := range field {
+		spec, _ := v.(map[string]interface{})
+		if stub, _ := spec["stub"].(bool); stub {
+			a, ok := cur[name]
+			if !ok {
+				return nil, errMissingStub
+			}
+			copied := *a
+			atts[name] = &copied
+			continue
+		}
+		encoded, ok := spec["data"].(string)
+		if !ok {
+			return nil, badRequest("attachment " + name + " has neither data nor stub")
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, badRequest("invalid base64 data of attachment " + name)
+		}
+		digest, err := db.putBlob(data)
+		if err != nil {
+			return nil, err
+		}
+		contentType, _ := spec["content_type"].(string)
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		atts[name] = &attachment{ContentType: contentType, Length: int64(len(data)), Digest: digest}
+	}
+	return atts, nil
+}
+
+// attachment serves the requests on /db/docid/name.
+func (s *Server) attachment(w http.ResponseWriter, r *http.Request, db *database, id, name string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		doc, err := db.get(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+		if rev := r.URL.Query().Get("rev"); rev != "" && rev != doc.Rev {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		a, ok := doc.Atts[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Document is missing attachment")
+			return
+		}
+		etag := `"` + a.Digest + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-MD5", strings.TrimPrefix(a.Digest, "md5-"))
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(a.Length, 10))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		data, err := db.readBlob(a.Digest)
+		if err != nil {
+			w.Header().Del("Content-Length")
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		digest, err := db.putBlob(data)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		added := &attachment{ContentType: contentType, Length: int64(len(data)), Digest: digest}
+		s.updateAttachments(w, r, db, id, func(atts map[string]*attachment) error {
+			atts[name] = added
+			return nil
+		}, http.StatusCreated)
+	case http.MethodDelete:
+		s.updateAttachments(w, r, db, id, func(atts map[string]*attachment) error {
+			if _, ok := atts[name]; !ok {
+				return errMissing
+			}
+			delete(atts, name)
+			return nil
+		}, http.StatusOK)
+	default:
+		methodNotAllowed(w, "DELETE,GET,HEAD,PUT")
+	}
+}
+
+// updateAttachments stores a new revision of a document with the
+// attachments changed by fn. A missing document is created by adding an
+// attachment.
+func (s *Server) updateAttachments(w http.ResponseWriter, r *http.Request, db *database, id string, fn func(map[string]*attachment) error, status int) {
+	rev := requestRev(r, nil)
+	db.mu.Lock()
+	doc, err := db.getLocked(id)
+	var body map[string]interface{}
+	atts := make(map[string]*attachment)
+	if err == nil {
+		body = doc.Body
+		for name, a := range doc.Atts {
+			copied := *a
+			atts[name] = &copied
+		}
+	}
+	err = fn(atts)
+	if err == nil {
+		doc, err = db.updateLocked(id, rev, body, atts, false)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+doc.Rev+`"`)
+	writeJSON(w, status, map[string]interface{}{"ok": true, "id": id, "rev": doc.Rev})
+}
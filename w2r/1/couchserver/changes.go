@@ -0,0 +1,214 @@
+package couchserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// change is a row of the _changes feed.
+type change struct {
+	Seq     int64                  `json:"seq"`
+	ID      string                 `json:"id"`
+	Changes []map[string]string    `json:"changes"`
+	Deleted bool                   `json:"deleted,omitempty"`
+	Doc     map[string]interface{} `json:"doc,omitempty"`
+}
+
+// changesSince returns the changes after since, at most limit of them if
+// limit is not negative, and the sequence of the last one.
+func (db *database) changesSince(since int64, limit int, includeDocs bool) ([]change, int64, error) {
+	db.mu.RLock()
+	var docs []*document
+	for _, doc := range db.docs {
+		if doc.Seq > since {
+			docs = append(docs, doc)
+		}
+	}
+	last := db.seq
+	db.mu.RUnlock()
+
+	sortBySeq(docs)
+	if limit >= 0 && len(docs) > limit {
+		docs = docs[:limit]
+		last = docs[len(docs)-1].Seq
+	}
+	changes := make([]change, len(docs))
+	for i, doc := range docs {
+		changes[i] = change{Seq: doc.Seq, ID: doc.ID, Changes: []map[string]string{{"rev": doc.Rev}}, Deleted: doc.Deleted}
+		if includeDocs {
+			full, err := db.docJSON(doc, false)
+			if err != nil {
+				return nil, 0, err
+			}
+			changes[i].Doc = full
+		}
+	}
+	return changes, last, nil
+}
+
+// parseSince reads the since parameter: "now", or a sequence as sent in
+// the seq field of an earlier change. Sequences of real CouchDB 2
+// servers are strings starting with the number.
+func parseSince(s string, current int64) int64 {
+	if s == "now" {
+		return current
+	}
+	s = strings.SplitN(s, "-", 2)[0]
+	s = strings.Trim(s, `"`)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// millis reads a duration parameter given in milliseconds.
+func millis(s string, def time.Duration) time.Duration {
+	if s == "true" {
+		return 60 * time.Second
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return def
+}
+
+// changes serves GET /db/_changes. It supports the normal, longpoll and
+// continuous feeds with the since, limit, include_docs, heartbeat and
+// timeout parameters.
+func (s *Server) changes(w http.ResponseWriter, r *http.Request, db *database) {
+	q := r.URL.Query()
+	feed := q.Get("feed")
+	includeDocs := q.Get("include_docs") == "true"
+	limit := -1
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n >= 0 {
+		limit = n
+	}
+	db.mu.RLock()
+	since := parseSince(q.Get("since"), db.seq)
+	db.mu.RUnlock()
+	timeout := millis(q.Get("timeout"), 60*time.Second)
+
+	switch feed {
+	case "", "normal", "longpoll":
+		changed := db.changed()
+		results, last, err := db.changesSince(since, limit, includeDocs)
+		if err == nil && len(results) == 0 && feed == "longpoll" {
+			select {
+			case <-changed:
+			case <-time.After(timeout):
+			case <-r.Context().Done():
+				return
+			case <-s.done:
+			}
+			results, last, err = db.changesSince(since, limit, includeDocs)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		//Clients like go-couchdb expect results to come first, as with
+		//CouchDB, so a struct keeps the order of the fields.
+		writeJSON(w, http.StatusOK, struct {
+			Results []change `json:"results"`
+			LastSeq int64    `json:"last_seq"`
+			Pending int      `json:"pending"`
+		}{results, last, 0})
+	case "continuous":
+		//Like CouchDB, a feed with heartbeats only times out when asked to.
+		if q.Get("heartbeat") != "" && q.Get("timeout") == "" {
+			timeout = 0
+		}
+		s.continuousChanges(w, r, db, since, limit, includeDocs, timeout, q.Get("heartbeat"))
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", "unsupported feed "+feed)
+	}
+}
+
+// continuousChanges writes one change per line until the client goes
+// away, the limit is reached or no change arrived within timeout, if it
+// is not zero. Empty lines are sent as heartbeats.
+func (s *Server) continuousChanges(w http.ResponseWriter, r *http.Request, db *database, since int64, limit int, includeDocs bool, timeout time.Duration, heartbeat string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+	enc := json.NewEncoder(w)
+	var beat <-chan time.Time
+	if heartbeat != "" {
+		ticker := time.NewTicker(millis(heartbeat, 60*time.Second))
+		defer ticker.Stop()
+		beat = ticker.C
+	}
+	var idle *time.Timer
+	var idleC <-chan time.Time
+	if timeout > 0 {
+		idle = time.NewTimer(timeout)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+	for {
+		changed := db.changed()
+		results, last, err := db.changesSince(since, limit, includeDocs)
+		if err != nil {
+			return
+		}
+		for _, c := range results {
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+		}
+		since = last
+		if limit >= 0 {
+			if limit -= len(results); limit == 0 {
+				enc.Encode(map[string]int64{"last_seq": last})
+				return
+			}
+		}
+		if len(results) > 0 {
+			flush()
+		}
+		if len(results) > 0 && idle != nil {
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(timeout)
+		}
+		if !s.waitForChange(w, db, changed, beat, idleC, r, flush) {
+			if !db.isDropped() {
+				enc.Encode(map[string]int64{"last_seq": since})
+			}
+			return
+		}
+	}
+}
+
+// waitForChange blocks until changed is closed and reports whether the
+// feed should go on. Heartbeats are written while waiting.
+func (s *Server) waitForChange(w http.ResponseWriter, db *database, changed <-chan struct{}, beat, idle <-chan time.Time, r *http.Request, flush func()) bool {
+	for {
+		select {
+		case <-changed:
+			return !db.isDropped()
+		case <-beat:
+			w.Write([]byte("\n"))
+			flush()
+		case <-idle:
+			return false
+		case <-r.Context().Done():
+			return false
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+func sortBySeq(docs []*document) {
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Seq < docs[j].Seq })
+}
@@ -0,0 +1,442 @@
+package couchserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errConflict    = errors.New("Document update conflict.")
+	errMissing     = errors.New("missing")
+	errDeleted     = errors.New("deleted")
+	errMissingStub = errors.New("Invalid attachment stub")
+)
+
+// document is the current revision of a document. Older revisions are
+// not kept, so a document has exactly one leaf; only their IDs are, like
+// in a compacted CouchDB database.
+type document struct {
+	ID      string                 `json:"id"`
+	Rev     string                 `json:"rev"`
+	Revs    []string               `json:"revs,omitempty"` // ancestors of Rev, newest first
+	Seq     int64                  `json:"seq"`
+	Deleted bool                   `json:"deleted,omitempty"`
+	Body    map[string]interface{} `json:"body,omitempty"` // without the special _ fields
+	Atts    map[string]*attachment `json:"atts,omitempty"`
+}
+
+// attachment is the metadata of an attachment. The data is stored in the
+// attachments directory of the database, named by its MD5 sum.
+type attachment struct {
+	ContentType string `json:"content_type"`
+	Length      int64  `json:"length"`
+	Digest      string `json:"digest"` // "md5-" followed by the base64 MD5 sum
+	RevPos      int    `json:"revpos"`
+}
+
+// revsLimit is the number of ancestors that are remembered, the default
+// _revs_limit of CouchDB.
+const revsLimit = 1000
+
+// generation returns the number in front of a revision.
+func generation(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
+// isLocal reports whether id is a _local document, which is neither
+// listed nor replicated.
+func isLocal(id string) bool {
+	return strings.HasPrefix(id, "_local/")
+}
+
+// docJSON returns the document as CouchDB sends it. With inline set,
+// attachments carry their data instead of being stubs.
+func (db *database) docJSON(doc *document, inline bool) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(doc.Body)+3)
+	for k, v := range doc.Body {
+		out[k] = v
+	}
+	out["_id"] = doc.ID
+	out["_rev"] = doc.Rev
+	if doc.Deleted {
+		out["_deleted"] = true
+	}
+	if len(doc.Atts) > 0 {
+		atts := make(map[string]interface{}, len(doc.Atts))
+		for name, a := range doc.Atts {
+			stub := map[string]interface{}{
+				"content_type": a.ContentType,
+				"length":       a.Length,
+				"digest":       a.Digest,
+				"revpos":       a.RevPos,
+			}
+			if inline {
+				data, err := db.readBlob(a.Digest)
+				if err != nil {
+					return nil, err
+				}
+				stub["data"] = base64.StdEncoding.EncodeToString(data)
+			} else {
+				stub["stub"] = true
+			}
+			atts[name] = stub
+		}
+		out["_attachments"] = atts
+	}
+	return out, nil
+}
+
+// database is a database of the server. Every write is appended to
+// docs.log in its directory; the log is replayed when the server starts
+// and compacted when it has grown to several times the live data.
+type database struct {
+	name string
+	dir  string
+
+	mu      sync.RWMutex
+	docs    map[string]*document
+	local   map[string]*document
+	seq     int64
+	log     *os.File
+	records int           // number of records in the log
+	notify  chan struct{} // closed and replaced on every change
+	views   map[string]*viewIndex
+	dropped bool
+}
+
+const logFile = "docs.log"
+
+// openDatabase loads the database stored in dir, creating it if needed.
+func openDatabase(name, dir string) (*database, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "attachments"), 0755); err != nil {
+		return nil, err
+	}
+	db := &database{
+		name:   name,
+		dir:    dir,
+		docs:   make(map[string]*document),
+		local:  make(map[string]*document),
+		notify: make(chan struct{}),
+		views:  make(map[string]*viewIndex),
+	}
+	if err := db.replay(); err != nil {
+		return nil, fmt.Errorf("couchserver: database %s: %v", name, err)
+	}
+	if db.records > 2*(len(db.docs)+len(db.local))+100 {
+		if err := db.compact(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.log = f
+	return db, nil
+}
+
+// replay reads the log. A torn record at the end, left by a crash during
+// a write, is cut off.
+func (db *database) replay() error {
+	path := filepath.Join(db.dir, logFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return os.Truncate(path, offset)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var doc document
+		if err := json.Unmarshal(line, &doc); err != nil {
+			return fmt.Errorf("corrupt record at offset %d: %v", offset, err)
+		}
+		offset += int64(len(line))
+		db.records++
+		db.apply(&doc)
+	}
+}
+
+// apply makes doc the current revision.
+func (db *database) apply(doc *document) {
+	if isLocal(doc.ID) {
+		if doc.Deleted {
+			delete(db.local, doc.ID)
+		} else {
+			db.local[doc.ID] = doc
+		}
+		return
+	}
+	db.docs[doc.ID] = doc
+	if doc.Seq > db.seq {
+		db.seq = doc.Seq
+	}
+}
+
+// compact rewrites the log with only the current revisions and removes
+// attachment data that no document refers to.
+func (db *database) compact() error {
+	path := filepath.Join(db.dir, logFile)
+	tmp, err := ioutil.TempFile(db.dir, logFile+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	used := make(map[string]bool)
+	docs := db.sortedBySeq()
+	for _, doc := range db.local {
+		docs = append(docs, doc)
+	}
+	for _, doc := range docs {
+		line, err := json.Marshal(doc)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+		for _, a := range doc.Atts {
+			used[blobName(a.Digest)] = true
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if db.log != nil {
+		db.log.Close()
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	db.records = len(docs)
+	if db.log != nil {
+		if db.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+	blobs, _ := ioutil.ReadDir(filepath.Join(db.dir, "attachments"))
+	for _, fi := range blobs {
+		if !used[fi.Name()] {
+			os.Remove(filepath.Join(db.dir, "attachments", fi.Name()))
+		}
+	}
+	return nil
+}
+
+// sortedBySeq returns the documents in the order of their last change.
+func (db *database) sortedBySeq() []*document {
+	docs := make([]*document, 0, len(db.docs))
+	for _, doc := range db.docs {
+		docs = append(docs, doc)
+	}
+	sortBySeq(docs)
+	return docs
+}
+
+// close closes the log file.
+func (db *database) close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.drop()
+	return db.log.Close()
+}
+
+// drop wakes up the change listeners of a database that is going away.
+// The caller holds db.mu.
+func (db *database) drop() {
+	if !db.dropped {
+		db.dropped = true
+		close(db.notify)
+	}
+}
+
+// isDropped reports whether the database was deleted or closed.
+func (db *database) isDropped() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.dropped
+}
+
+// get returns the current revision of a document.
+func (db *database) get(id string) (*document, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getLocked(id)
+}
+
+func (db *database) getLocked(id string) (*document, error) {
+	if isLocal(id) {
+		if doc, ok := db.local[id]; ok {
+			return doc, nil
+		}
+		return nil, errMissing
+	}
+	doc, ok := db.docs[id]
+	switch {
+	case !ok:
+		return nil, errMissing
+	case doc.Deleted:
+		return doc, errDeleted
+	}
+	return doc, nil
+}
+
+// update stores a new revision of a document. rev must be the current
+// revision; it must be empty for new and deleted documents. Attachments
+// without a RevPos were added by this revision.
+func (db *database) update(id, rev string, body map[string]interface{}, atts map[string]*attachment, deleted bool) (*document, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.updateLocked(id, rev, body, atts, deleted)
+}
+
+func (db *database) updateLocked(id, rev string, body map[string]interface{}, atts map[string]*attachment, deleted bool) (*document, error) {
+	if db.dropped {
+		return nil, errMissing
+	}
+	cur, err := db.getLocked(id)
+	switch {
+	case err == errMissing && deleted:
+		return nil, errMissing
+	case err == errMissing || err == errDeleted:
+		if rev != "" && (cur == nil || rev != cur.Rev) {
+			return nil, errConflict
+		}
+	case rev != cur.Rev:
+		return nil, errConflict
+	}
+	gen := 1
+	if cur != nil {
+		gen = generation(cur.Rev) + 1
+	}
+	for _, a := range atts {
+		if a.RevPos == 0 {
+			a.RevPos = gen
+		}
+	}
+	if deleted {
+		body, atts = nil, nil
+	}
+	doc := &document{ID: id, Deleted: deleted, Body: body, Atts: atts}
+	h := md5.New()
+	if cur != nil {
+		io.WriteString(h, cur.Rev)
+	}
+	json.NewEncoder(h).Encode(doc)
+	doc.Rev = strconv.Itoa(gen) + "-" + hex.EncodeToString(h.Sum(nil))
+	if isLocal(id) {
+		doc.Rev = "0-" + strconv.Itoa(gen)
+	} else {
+		doc.Seq = db.seq + 1
+		if cur != nil {
+			doc.Revs = append([]string{cur.Rev}, cur.Revs...)
+			if len(doc.Revs) > revsLimit {
+				doc.Revs = doc.Revs[:revsLimit]
+			}
+		}
+	}
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.log.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	db.records++
+	db.apply(doc)
+	if !isLocal(id) {
+		close(db.notify)
+		db.notify = make(chan struct{})
+	}
+	return doc, nil
+}
+
+// changed returns a channel that is closed by the next change.
+func (db *database) changed() <-chan struct{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.notify
+}
+
+// info returns the database information sent for GET /db.
+func (db *database) info() map[string]interface{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	count, deleted := 0, 0
+	for _, doc := range db.docs {
+		if doc.Deleted {
+			deleted++
+		} else {
+			count++
+		}
+	}
+	var size int64
+	if fi, err := db.log.Stat(); err == nil {
+		size = fi.Size()
+	}
+	return map[string]interface{}{
+		"db_name":         db.name,
+		"doc_count":       count,
+		"doc_del_count":   deleted,
+		"update_seq":      db.seq,
+		"disk_size":       size,
+		"compact_running": false,
+	}
+}
+
+// blobName returns the file name of the attachment data with digest.
+func blobName(digest string) string {
+	sum, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(digest, "md5-"))
+	return hex.EncodeToString(sum)
+}
+
+// putBlob stores attachment data and returns its digest.
+func (db *database) putBlob(data []byte) (string, error) {
+	sum := md5.Sum(data)
+	digest := "md5-" + base64.StdEncoding.EncodeToString(sum[:])
+	path := filepath.Join(db.dir, "attachments", hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(path); err == nil {
+		return digest, nil
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(tmp, path)
+}
+
+// readBlob returns the attachment data with digest.
+func (db *database) readBlob(digest string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(db.dir, "attachments", blobName(digest)))
+}
@@ -0,0 +1,633 @@
+package couchserver
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// findQuery is the body of POST /db/_find.
+type findQuery struct {
+	Selector map[string]interface{} `json:"selector"`
+	Fields   []string               `json:"fields"`
+	Sort     []interface{}          `json:"sort"`
+	Limit    *int                   `json:"limit"`
+	Skip     int                    `json:"skip"`
+	Bookmark string                 `json:"bookmark"`
+}
+
+// sortField is a field of the sort order of a query or index.
+type sortField struct {
+	name string
+	path []string
+	desc bool
+}
+
+// parseSort reads the sort of a query or the fields of an index, which
+// are field names or {"field": "asc"|"desc"} objects.
+func parseSort(fields []interface{}) ([]sortField, error) {
+	out := make([]sortField, 0, len(fields))
+	for _, f := range fields {
+		var sf sortField
+		switch f := f.(type) {
+		case string:
+			sf.name = f
+		case map[string]interface{}:
+			if len(f) != 1 {
+				return nil, errors.New("each sort field must have exactly one key")
+			}
+			for name, dir := range f {
+				sf.name = name
+				switch dir {
+				case "asc":
+				case "desc":
+					sf.desc = true
+				default:
+					return nil, fmt.Errorf("invalid sort direction %v", dir)
+				}
+			}
+		default:
+			return nil, errors.New("sort fields must be strings or objects")
+		}
+		sf.path = splitField(sf.name)
+		out = append(out, sf)
+	}
+	return out, nil
+}
+
+// find serves POST /db/_find. Every query scans all documents in id
+// order, or in the order of its sort fields; indexes are not needed and
+// not used. Documents that lack a sort field are left out, as they are
+// missing from the index CouchDB would need. Design documents are not
+// searched. The bookmark holds the sort key of the last document, so
+// pages do not shift while documents are added.
+func (s *Server) find(w http.ResponseWriter, r *http.Request, db *database) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	var q findQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+		return
+	}
+	if q.Selector == nil {
+		writeError(w, http.StatusBadRequest, "missing_required_key", "Missing required key: selector")
+		return
+	}
+	match, err := compileObject(nil, q.Selector)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_operator", err.Error())
+		return
+	}
+	order, err := parseSort(q.Sort)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	limit := 25
+	if q.Limit != nil {
+		limit = *q.Limit
+	}
+	if limit < 0 || q.Skip < 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "limit and skip must not be negative")
+		return
+	}
+	var after []interface{}
+	if q.Bookmark != "" && q.Bookmark != "nil" {
+		b, err := base64.RawURLEncoding.DecodeString(q.Bookmark)
+		if err == nil {
+			err = json.Unmarshal(b, &after)
+		}
+		if err == nil && len(after) == len(order)+1 {
+			_, ok := after[len(order)].(string)
+			if !ok {
+				err = errors.New("invalid id")
+			}
+		}
+		if err != nil || len(after) != len(order)+1 {
+			writeError(w, http.StatusBadRequest, "invalid_bookmark", "Invalid bookmark value: "+q.Bookmark)
+			return
+		}
+	}
+
+	type hit struct {
+		doc map[string]interface{}
+		key []interface{} // values of the sort fields, then the id
+	}
+	db.mu.RLock()
+	docs := make([]*document, 0, len(db.docs))
+	for _, doc := range db.docs {
+		if !doc.Deleted && !strings.HasPrefix(doc.ID, "_design/") {
+			docs = append(docs, doc)
+		}
+	}
+	db.mu.RUnlock()
+	var hits []hit
+	for _, doc := range docs {
+		full, err := db.docJSON(doc, false)
+		if err != nil || !match(full) {
+			continue
+		}
+		key := make([]interface{}, 0, len(order)+1)
+		for _, sf := range order {
+			v, ok := lookup(full, sf.path)
+			if !ok {
+				break
+			}
+			key = append(key, v)
+		}
+		if len(key) == len(order) {
+			hits = append(hits, hit{full, append(key, doc.ID)})
+		}
+	}
+	compare := func(a, b []interface{}) int {
+		for i, sf := range order {
+			if c := collate(a[i], b[i]); c != 0 {
+				if sf.desc {
+					return -c
+				}
+				return c
+			}
+		}
+		return strings.Compare(a[len(order)].(string), b[len(order)].(string))
+	}
+	sort.Slice(hits, func(i, j int) bool { return compare(hits[i].key, hits[j].key) < 0 })
+	if after != nil {
+		i := sort.Search(len(hits), func(i int) bool { return compare(hits[i].key, after) > 0 })
+		hits = hits[i:]
+	}
+	if q.Skip >= len(hits) {
+		hits = nil
+	} else {
+		hits = hits[q.Skip:]
+	}
+	if limit < len(hits) {
+		hits = hits[:limit]
+	}
+
+	out := make([]map[string]interface{}, len(hits))
+	for i, h := range hits {
+		out[i] = project(h.doc, q.Fields)
+	}
+	bookmark := q.Bookmark
+	if len(hits) > 0 {
+		b, _ := json.Marshal(hits[len(hits)-1].key)
+		bookmark = base64.RawURLEncoding.EncodeToString(b)
+	}
+	if bookmark == "" {
+		bookmark = "nil"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"docs": out, "bookmark": bookmark})
+}
+
+// project returns the given fields of doc, or all of them if fields is
+// empty.
+func project(doc map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return doc
+	}
+	out := make(map[string]interface{})
+	for _, f := range fields {
+		path := splitField(f)
+		v, ok := lookup(doc, path)
+		if !ok {
+			continue
+		}
+		m := out
+		for _, seg := range path[:len(path)-1] {
+			next, ok := m[seg].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				m[seg] = next
+			}
+			m = next
+		}
+		m[path[len(path)-1]] = v
+	}
+	return out
+}
+
+// splitField splits a field name at its dots, which select nested
+// fields. A dot escaped with a backslash is part of the name.
+func splitField(name string) []string {
+	var path []string
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name) && name[i+1] == '.':
+			b.WriteByte('.')
+			i++
+		case name[i] == '.':
+			path = append(path, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(name[i])
+		}
+	}
+	return append(path, b.String())
+}
+
+// lookup returns the value at path in v.
+func lookup(v interface{}, path []string) (interface{}, bool) {
+	for _, seg := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// matcher reports whether a value matches a selector.
+type matcher func(v interface{}) bool
+
+// compileObject compiles a selector object that applies to the field at
+// path. Its keys are nested field names, combination operators like
+// $and, or condition operators like $gt.
+func compileObject(path []string, sel map[string]interface{}) (matcher, error) {
+	var parts []matcher
+	for k, arg := range sel {
+		var m matcher
+		var err error
+		switch {
+		case k == "$and" || k == "$or" || k == "$nor":
+			m, err = compileCombination(path, k, arg)
+		case k == "$not":
+			obj, ok := arg.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("$not requires an object")
+			}
+			var inner matcher
+			if inner, err = compileObject(path, obj); err == nil {
+				m = func(v interface{}) bool { return !inner(v) }
+			}
+		case strings.HasPrefix(k, "$"):
+			m, err = compileOperator(path, k, arg)
+		default:
+			sub := append(append([]string(nil), path...), splitField(k)...)
+			if obj, ok := arg.(map[string]interface{}); ok {
+				m, err = compileObject(sub, obj)
+			} else {
+				m, err = compileOperator(sub, "$eq", arg)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, m)
+	}
+	return func(v interface{}) bool {
+		for _, m := range parts {
+			if !m(v) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileCombination(path []string, op string, arg interface{}) (matcher, error) {
+	list, ok := arg.([]interface{})
+	if !ok {
+		return nil, errors.New(op + " requires an array")
+	}
+	parts := make([]matcher, len(list))
+	for i, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(op + " requires an array of objects")
+		}
+		m, err := compileObject(path, obj)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = m
+	}
+	return func(v interface{}) bool {
+		for _, m := range parts {
+			matched := m(v)
+			switch {
+			case op == "$and" && !matched:
+				return false
+			case op == "$or" && matched:
+				return true
+			case op == "$nor" && matched:
+				return false
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+// compileOperator compiles a condition on the field at path. Only
+// $exists matches fields that are missing.
+func compileOperator(path []string, op string, arg interface{}) (matcher, error) {
+	var test func(v interface{}) bool
+	switch op {
+	case "$eq":
+		test = func(v interface{}) bool { return collate(v, arg) == 0 }
+	case "$ne":
+		test = func(v interface{}) bool { return collate(v, arg) != 0 }
+	case "$gt":
+		test = func(v interface{}) bool { return collate(v, arg) > 0 }
+	case "$gte":
+		test = func(v interface{}) bool { return collate(v, arg) >= 0 }
+	case "$lt":
+		test = func(v interface{}) bool { return collate(v, arg) < 0 }
+	case "$lte":
+		test = func(v interface{}) bool { return collate(v, arg) <= 0 }
+	case "$exists":
+		want, ok := arg.(bool)
+		if !ok {
+			return nil, errors.New("$exists requires a boolean")
+		}
+		return func(v interface{}) bool {
+			_, found := lookup(v, path)
+			return found == want
+		}, nil
+	case "$type":
+		want, ok := arg.(string)
+		if !ok {
+			return nil, errors.New("$type requires a string")
+		}
+		test = func(v interface{}) bool { return typeName(v) == want }
+	case "$in", "$nin", "$all":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, errors.New(op + " requires an array")
+		}
+		contains := func(values []interface{}, x interface{}) bool {
+			for _, y := range values {
+				if collate(x, y) == 0 {
+					return true
+				}
+			}
+			return false
+		}
+		switch op {
+		case "$in", "$nin":
+			want := op == "$in"
+			test = func(v interface{}) bool {
+				if arr, ok := v.([]interface{}); ok {
+					for _, x := range arr {
+						if contains(list, x) {
+							return want
+						}
+					}
+					return !want
+				}
+				return contains(list, v) == want
+			}
+		default:
+			test = func(v interface{}) bool {
+				arr, ok := v.([]interface{})
+				if !ok {
+					return false
+				}
+				for _, x := range list {
+					if !contains(arr, x) {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	case "$size":
+		n, ok := arg.(float64)
+		if !ok {
+			return nil, errors.New("$size requires a number")
+		}
+		test = func(v interface{}) bool {
+			arr, ok := v.([]interface{})
+			return ok && float64(len(arr)) == n
+		}
+	case "$mod":
+		pair, ok := arg.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, errors.New("$mod requires [divisor, remainder]")
+		}
+		div, ok1 := pair[0].(float64)
+		rem, ok2 := pair[1].(float64)
+		if !ok1 || !ok2 || div == 0 {
+			return nil, errors.New("$mod requires a non-zero divisor and a remainder")
+		}
+		test = func(v interface{}) bool {
+			n, ok := v.(float64)
+			return ok && n == math.Trunc(n) && math.Mod(n, div) == rem
+		}
+	case "$regex":
+		pattern, ok := arg.(string)
+		if !ok {
+			return nil, errors.New("$regex requires a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $regex: %v", err)
+		}
+		test = func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		}
+	case "$elemMatch", "$allMatch":
+		obj, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(op + " requires an object")
+		}
+		inner, err := compileObject(nil, obj)
+		if err != nil {
+			return nil, err
+		}
+		all := op == "$allMatch"
+		test = func(v interface{}) bool {
+			arr, ok := v.([]interface{})
+			if !ok || len(arr) == 0 {
+				return false
+			}
+			for _, x := range arr {
+				if inner(x) != all {
+					return !all
+				}
+			}
+			return all
+		}
+	default:
+		return nil, fmt.Errorf("Invalid operator: %s", op)
+	}
+	return func(v interface{}) bool {
+		field, ok := lookup(v, path)
+		return ok && test(field)
+	}, nil
+}
+
+// typeName returns the name of the JSON type of v, as used by $type.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// index serves GET and POST /db/_index. Indexes are stored in design
+// documents with the query language, like CouchDB does, but find does
+// not use them.
+func (s *Server) index(w http.ResponseWriter, r *http.Request, db *database) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listIndexes(w, db)
+	case http.MethodPost:
+		s.createIndex(w, r, db)
+	default:
+		methodNotAllowed(w, "GET,POST")
+	}
+}
+
+func (s *Server) listIndexes(w http.ResponseWriter, db *database) {
+	indexes := []map[string]interface{}{{
+		"ddoc": nil,
+		"name": "_all_docs",
+		"type": "special",
+		"def":  map[string]interface{}{"fields": []interface{}{map[string]interface{}{"_id": "asc"}}},
+	}}
+	db.mu.RLock()
+	var ddocs []*document
+	for id, doc := range db.docs {
+		if strings.HasPrefix(id, "_design/") && !doc.Deleted && doc.Body["language"] == "query" {
+			ddocs = append(ddocs, doc)
+		}
+	}
+	db.mu.RUnlock()
+	sort.Slice(ddocs, func(i, j int) bool { return ddocs[i].ID < ddocs[j].ID })
+	for _, doc := range ddocs {
+		views, _ := doc.Body["views"].(map[string]interface{})
+		for _, name := range sortedKeys(views) {
+			view, _ := views[name].(map[string]interface{})
+			options, _ := view["options"].(map[string]interface{})
+			indexes = append(indexes, map[string]interface{}{"ddoc": doc.ID, "name": name, "type": "json", "def": options["def"]})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total_rows": len(indexes), "indexes": indexes})
+}
+
+func (s *Server) createIndex(w http.ResponseWriter, r *http.Request, db *database) {
+	var req struct {
+		Index struct {
+			Fields                []interface{}          `json:"fields"`
+			PartialFilterSelector map[string]interface{} `json:"partial_filter_selector"`
+		} `json:"index"`
+		DDoc string `json:"ddoc"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+		return
+	}
+	if req.Type != "" && req.Type != "json" {
+		writeError(w, http.StatusBadRequest, "invalid_index", "Only json indexes are supported.")
+		return
+	}
+	order, err := parseSort(req.Index.Fields)
+	if err != nil || len(order) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_index", "Index fields must be a non-empty list of field names.")
+		return
+	}
+	fields := make([]interface{}, len(order))
+	mapFields := make(map[string]interface{}, len(order))
+	for i, sf := range order {
+		dir := "asc"
+		if sf.desc {
+			dir = "desc"
+		}
+		fields[i] = map[string]interface{}{sf.name: dir}
+		mapFields[sf.name] = dir
+	}
+	def := map[string]interface{}{"fields": fields}
+	if req.Index.PartialFilterSelector != nil {
+		if _, err := compileObject(nil, req.Index.PartialFilterSelector); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_operator", err.Error())
+			return
+		}
+		def["partial_filter_selector"] = req.Index.PartialFilterSelector
+	}
+	//Without a name or design document, both are derived from the
+	//definition, so creating the same index twice finds the first.
+	b, _ := json.Marshal(def)
+	sum := md5.Sum(b)
+	hash := hex.EncodeToString(sum[:])
+	if req.DDoc == "" {
+		req.DDoc = hash
+	}
+	if req.Name == "" {
+		req.Name = hash
+	}
+	id := "_design/" + strings.TrimPrefix(req.DDoc, "_design/")
+	view := map[string]interface{}{
+		"map":     map[string]interface{}{"fields": mapFields, "partial_filter_selector": def["partial_filter_selector"]},
+		"reduce":  "_count",
+		"options": map[string]interface{}{"def": def},
+	}
+	var normalized interface{}
+	json.Unmarshal(b, &normalized)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	body := map[string]interface{}{"language": "query", "views": map[string]interface{}{}}
+	var rev string
+	var atts map[string]*attachment
+	if doc, err := db.getLocked(id); err == nil {
+		if doc.Body["language"] != "query" {
+			writeError(w, http.StatusBadRequest, "invalid_index", "Design document "+id+" is not a query design document.")
+			return
+		}
+		body, _ = copyJSON(doc.Body).(map[string]interface{})
+		rev, atts = doc.Rev, doc.Atts
+		views, _ := body["views"].(map[string]interface{})
+		if existing, ok := views[req.Name].(map[string]interface{}); ok {
+			options, _ := existing["options"].(map[string]interface{})
+			if collate(options["def"], normalized) == 0 {
+				writeJSON(w, http.StatusOK, map[string]string{"result": "exists", "id": id, "name": req.Name})
+				return
+			}
+		}
+	}
+	views, ok := body["views"].(map[string]interface{})
+	if !ok {
+		views = make(map[string]interface{})
+		body["views"] = views
+	}
+	views[req.Name] = copyJSON(view)
+	if _, err := db.updateLocked(id, rev, body, atts, false); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "created", "id": id, "name": req.Name})
+}
+
+// copyJSON returns a deep copy of v with the types of decoded JSON.
+func copyJSON(v interface{}) interface{} {
+	b, _ := json.Marshal(v)
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
@@ -0,0 +1,721 @@
+// Package couchserver is an in-process server for the subset of the
+// CouchDB HTTP API that the app and go-couchdb use: databases, documents
+// with revisions and conflict detection, _all_docs and _local_docs,
+// views with Go map functions, Mango queries, _changes and attachments.
+// It is meant for local development and tests, so that couchdb.NewClient
+// can point at it unchanged:
+//
+//	srv, err := couchserver.New("./data")
+//	...
+//	go http.Serve(listener, srv)
+//	client, err := couchdb.NewClient("http://"+listener.Addr().String(), nil)
+//
+// Only the current revision of a document is kept, so there are no
+// conflicting leaves and no replication; revs_info reports the older
+// revisions as missing. Every database is stored in a directory below
+// the data directory.
+package couchserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Version is sent as the CouchDB version in the welcome message.
+const Version = "2.3.1"
+
+var dbNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_$()+/-]*$`)
+
+// Server serves the CouchDB API for the databases in a directory.
+type Server struct {
+	dir  string
+	uuid string
+
+	mu    sync.RWMutex
+	dbs   map[string]*database
+	views map[string]View // keyed by "ddoc/view"
+	done  chan struct{}
+}
+
+// New opens the databases stored in dir, creating it if needed.
+func New(dir string) (*Server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		dir:   dir,
+		uuid:  newUUID(),
+		dbs:   make(map[string]*database),
+		views: make(map[string]View),
+		done:  make(chan struct{}),
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range entries {
+		if !fi.IsDir() {
+			continue
+		}
+		name, err := url.QueryUnescape(fi.Name())
+		if err != nil || !dbNamePattern.MatchString(name) {
+			continue
+		}
+		db, err := openDatabase(name, filepath.Join(dir, fi.Name()))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.dbs[name] = db
+	}
+	return s, nil
+}
+
+// Close ends all change feeds and closes the databases.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+		close(s.done)
+	}
+	var first error
+	for _, db := range s.dbs {
+		if err := db.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// RegisterView adds a view that is answered for
+// /db/_design/<ddoc>/_view/<name> in every database, whether or not the
+// design document exists. ddoc is given without the _design/ prefix.
+func (s *Server) RegisterView(ddoc, name string, v View) {
+	s.mu.Lock()
+	s.views[ddoc+"/"+name] = v
+	s.mu.Unlock()
+}
+
+func (s *Server) view(ddoc, name string) (View, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.views[ddoc+"/"+name]
+	return v, ok
+}
+
+func (s *Server) db(name string) *database {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dbs[name]
+}
+
+// ServeHTTP routes a request of the CouchDB API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "CouchDB/"+Version+" (couchserver)")
+	w.Header().Set("Cache-Control", "must-revalidate")
+	var segs []string
+	for _, seg := range strings.Split(r.URL.EscapedPath(), "/") {
+		if seg == "" {
+			continue
+		}
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid path")
+			return
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) == 0 {
+		s.welcome(w, r)
+		return
+	}
+	if strings.HasPrefix(segs[0], "_") {
+		s.serverEndpoint(w, r, segs)
+		return
+	}
+	name := segs[0]
+	if len(segs) == 1 {
+		s.database(w, r, name)
+		return
+	}
+	db := s.db(name)
+	if db == nil {
+		writeError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+		return
+	}
+	rest := segs[1:]
+	switch rest[0] {
+	case "_all_docs":
+		s.allDocs(w, r, db, false)
+		return
+	case "_local_docs":
+		s.allDocs(w, r, db, true)
+		return
+	case "_changes":
+		s.changes(w, r, db)
+		return
+	case "_bulk_docs":
+		s.bulkDocs(w, r, db)
+		return
+	case "_find":
+		s.find(w, r, db)
+		return
+	case "_index":
+		s.index(w, r, db)
+		return
+	case "_compact":
+		db.mu.Lock()
+		err := db.compact()
+		db.mu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+		return
+	case "_ensure_full_commit":
+		db.mu.Lock()
+		err := db.log.Sync()
+		db.mu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "instance_start_time": "0"})
+		return
+	case "_security":
+		if r.Method == http.MethodPut {
+			writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		} else {
+			writeJSON(w, http.StatusOK, map[string]interface{}{})
+		}
+		return
+	}
+	// Design and local documents have a slash in their id, which
+	// go-couchdb does not escape for _design.
+	id, rest := rest[0], rest[1:]
+	if (id == "_design" || id == "_local") && len(rest) > 0 {
+		id, rest = id+"/"+rest[0], rest[1:]
+	}
+	if strings.HasPrefix(id, "_") && !strings.HasPrefix(id, "_design/") && !strings.HasPrefix(id, "_local/") {
+		writeError(w, http.StatusBadRequest, "illegal_docid", "Only reserved document ids may start with underscore.")
+		return
+	}
+	if strings.HasPrefix(id, "_design/") && len(rest) == 2 && rest[0] == "_view" {
+		s.queryView(w, r, db, strings.TrimPrefix(id, "_design/"), rest[1])
+		return
+	}
+	if len(rest) > 0 {
+		s.attachment(w, r, db, id, strings.Join(rest, "/"))
+		return
+	}
+	s.document(w, r, db, id)
+}
+
+// welcome serves GET / and HEAD /, which go-couchdb's Ping uses.
+func (s *Server) welcome(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"couchdb": "Welcome",
+		"version": Version,
+		"uuid":    s.uuid,
+		"vendor":  map[string]string{"name": "couchserver"},
+	})
+}
+
+// serverEndpoint serves the endpoints below / that start with an
+// underscore.
+func (s *Server) serverEndpoint(w http.ResponseWriter, r *http.Request, segs []string) {
+	switch segs[0] {
+	case "_all_dbs":
+		s.mu.RLock()
+		names := make([]string, 0, len(s.dbs))
+		for name := range s.dbs {
+			names = append(names, name)
+		}
+		s.mu.RUnlock()
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, names)
+	case "_uuids":
+		n := 1
+		if c, err := parseCount(r.URL.Query().Get("count")); err == nil {
+			n = c
+		}
+		uuids := make([]string, n)
+		for i := range uuids {
+			uuids[i] = newUUID()
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"uuids": uuids})
+	case "_up":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case "_session":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":      true,
+			"userCtx": map[string]interface{}{"name": nil, "roles": []string{"_admin"}},
+		})
+	default:
+		illegal(w, segs[0])
+	}
+}
+
+func parseCount(s string) (int, error) {
+	var n int
+	err := json.Unmarshal([]byte(s), &n)
+	if err == nil && (n < 1 || n > 1000) {
+		n = 1
+	}
+	return n, err
+}
+
+// database serves the requests on /db.
+func (s *Server) database(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		db := s.db(name)
+		if db == nil {
+			writeError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+			return
+		}
+		writeJSON(w, http.StatusOK, db.info())
+	case http.MethodPut:
+		if !dbNamePattern.MatchString(name) {
+			illegal(w, name)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.dbs[name]; ok {
+			writeError(w, http.StatusPreconditionFailed, "file_exists", "The database could not be created, the file already exists.")
+			return
+		}
+		db, err := openDatabase(name, filepath.Join(s.dir, url.QueryEscape(name)))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		s.dbs[name] = db
+		w.Header().Set("Location", "/"+url.PathEscape(name))
+		writeJSON(w, http.StatusCreated, map[string]bool{"ok": true})
+	case http.MethodDelete:
+		s.mu.Lock()
+		db, ok := s.dbs[name]
+		delete(s.dbs, name)
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+			return
+		}
+		db.close()
+		if err := os.RemoveAll(db.dir); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	case http.MethodPost:
+		db := s.db(name)
+		if db == nil {
+			writeError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+			return
+		}
+		body, ok := readDocBody(w, r)
+		if !ok {
+			return
+		}
+		id, _ := body["_id"].(string)
+		if id == "" {
+			id = newUUID()
+		}
+		s.putDocument(w, r, db, id, body, http.StatusCreated)
+	default:
+		methodNotAllowed(w, "DELETE,GET,HEAD,POST,PUT")
+	}
+}
+
+// document serves the requests on /db/docid.
+func (s *Server) document(w http.ResponseWriter, r *http.Request, db *database, id string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		q := r.URL.Query()
+		doc, err := db.get(id)
+		//A deleted document can still be read at its tombstone revision.
+		if err == errDeleted && q.Get("rev") == doc.Rev {
+			err = nil
+		}
+		if err != nil {
+			writeError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+		if rev := q.Get("rev"); rev != "" && rev != doc.Rev {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		etag := `"` + doc.Rev + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full, err := db.docJSON(doc, q.Get("attachments") == "true")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		if q.Get("revs") == "true" {
+			full["_revisions"] = revisions(doc)
+		}
+		if q.Get("revs_info") == "true" {
+			full["_revs_info"] = revsInfo(doc)
+		}
+		w.Header().Set("ETag", etag)
+		writeJSON(w, http.StatusOK, full)
+	case http.MethodPut:
+		body, ok := readDocBody(w, r)
+		if !ok {
+			return
+		}
+		s.putDocument(w, r, db, id, body, http.StatusCreated)
+	case http.MethodDelete:
+		doc, err := db.update(id, requestRev(r, nil), nil, nil, true)
+		if err != nil {
+			writeUpdateError(w, err)
+			return
+		}
+		w.Header().Set("ETag", `"`+doc.Rev+`"`)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "id": id, "rev": doc.Rev})
+	default:
+		methodNotAllowed(w, "DELETE,GET,HEAD,PUT")
+	}
+}
+
+// revisions returns the _revisions of a document: the generation of its
+// revision and the hashes of it and its ancestors, newest first.
+func revisions(doc *document) map[string]interface{} {
+	ids := make([]string, 0, len(doc.Revs)+1)
+	for _, rev := range append([]string{doc.Rev}, doc.Revs...) {
+		ids = append(ids, strings.SplitN(rev, "-", 2)[1])
+	}
+	return map[string]interface{}{"start": generation(doc.Rev), "ids": ids}
+}
+
+// revsInfo returns the _revs_info of a document. The bodies of older
+// revisions are not kept, so they are all missing.
+func revsInfo(doc *document) []map[string]string {
+	status := "available"
+	if doc.Deleted {
+		status = "deleted"
+	}
+	info := []map[string]string{{"rev": doc.Rev, "status": status}}
+	for _, rev := range doc.Revs {
+		info = append(info, map[string]string{"rev": rev, "status": "missing"})
+	}
+	return info
+}
+
+// putDocument stores body as the new revision of a document.
+func (s *Server) putDocument(w http.ResponseWriter, r *http.Request, db *database, id string, body map[string]interface{}, status int) {
+	rev := requestRev(r, body)
+	deleted, _ := body["_deleted"].(bool)
+	atts, err := db.attachmentsOf(id, body)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	doc, err := db.update(id, rev, userFields(body), atts, deleted)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+doc.Rev+`"`)
+	w.Header().Set("Location", "/"+url.PathEscape(db.name)+"/"+url.PathEscape(id))
+	writeJSON(w, status, map[string]interface{}{"ok": true, "id": id, "rev": doc.Rev})
+}
+
+// bulkDocs serves POST /db/_bulk_docs. Every document is stored on its
+// own, as with CouchDB; the response lists the result of each.
+func (s *Server) bulkDocs(w http.ResponseWriter, r *http.Request, db *database) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	var req struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Docs == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "POST body must include `docs` parameter.")
+		return
+	}
+	results := make([]map[string]interface{}, len(req.Docs))
+	for i, body := range req.Docs {
+		id, _ := body["_id"].(string)
+		if id == "" {
+			id = newUUID()
+		}
+		rev, _ := body["_rev"].(string)
+		deleted, _ := body["_deleted"].(bool)
+		atts, err := db.attachmentsOf(id, body)
+		var doc *document
+		if err == nil {
+			doc, err = db.update(id, rev, userFields(body), atts, deleted)
+		}
+		switch {
+		case err == errConflict:
+			results[i] = map[string]interface{}{"id": id, "error": "conflict", "reason": err.Error()}
+		case err != nil:
+			results[i] = map[string]interface{}{"id": id, "error": "not_found", "reason": err.Error()}
+		default:
+			results[i] = map[string]interface{}{"ok": true, "id": id, "rev": doc.Rev}
+		}
+	}
+	writeJSON(w, http.StatusCreated, results)
+}
+
+// allDocs serves GET and POST /db/_all_docs, or /db/_local_docs if local
+// is set.
+func (s *Server) allDocs(w http.ResponseWriter, r *http.Request, db *database, local bool) {
+	keys, ok := readKeys(w, r)
+	if !ok {
+		return
+	}
+	vq, err := parseViewQuery(r.URL.Query(), keys)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_parse_error", err.Error())
+		return
+	}
+	vq.collate = rawCollate
+	sorted, seq := db.allDocsRows(local)
+	var out []map[string]interface{}
+	offset := 0
+	if vq.keys != nil {
+		// Unlike views, _all_docs answers every requested key, with an
+		// error row for missing documents.
+		for _, key := range vq.keys {
+			id, _ := key.(string)
+			doc, err := db.get(id)
+			switch {
+			case err == errDeleted:
+				out = append(out, map[string]interface{}{"id": id, "key": id, "value": map[string]interface{}{"rev": doc.Rev, "deleted": true}, "doc": nil})
+			case err != nil:
+				out = append(out, map[string]interface{}{"key": key, "error": "not_found"})
+			default:
+				out = append(out, s.row(db, viewRow{ID: id, Key: id, Value: map[string]interface{}{"rev": doc.Rev}}, vq))
+			}
+		}
+		if vq.skip >= len(out) {
+			out = out[:0]
+		} else {
+			out = out[vq.skip:]
+		}
+		if vq.limit >= 0 && vq.limit < len(out) {
+			out = out[:vq.limit]
+		}
+	} else {
+		var rows []viewRow
+		rows, offset = vq.selectRows(sorted)
+		for _, row := range rows {
+			out = append(out, s.row(db, row, vq))
+		}
+	}
+	if out == nil {
+		out = []map[string]interface{}{}
+	}
+	result := map[string]interface{}{"total_rows": len(sorted), "offset": offset, "rows": out}
+	if vq.updateSeq {
+		result["update_seq"] = seq
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// queryView serves GET and POST /db/_design/ddoc/_view/name.
+func (s *Server) queryView(w http.ResponseWriter, r *http.Request, db *database, ddoc, name string) {
+	v, ok := s.view(ddoc, name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "missing_named_view")
+		return
+	}
+	keys, ok := readKeys(w, r)
+	if !ok {
+		return
+	}
+	vq, err := parseViewQuery(r.URL.Query(), keys)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_parse_error", err.Error())
+		return
+	}
+	sorted, seq, err := db.viewRows(ddoc+"/"+name, v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+		return
+	}
+	if v.Reduce != "" && vq.reduce {
+		if vq.includeDocs {
+			writeError(w, http.StatusBadRequest, "query_parse_error", "`include_docs` is invalid for reduce")
+			return
+		}
+		// Reduce over the whole key range, then page the groups.
+		skip, limit := vq.skip, vq.limit
+		vq.skip, vq.limit = 0, -1
+		selected, _ := vq.selectRows(sorted)
+		groups, err := reduceRows(v.Reduce, selected, vq)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+			return
+		}
+		if skip >= len(groups) {
+			groups = groups[:0]
+		} else {
+			groups = groups[skip:]
+		}
+		if limit >= 0 && limit < len(groups) {
+			groups = groups[:limit]
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rows": groups})
+		return
+	}
+	if (vq.group || vq.groupLevel >= 0) && v.Reduce == "" {
+		writeError(w, http.StatusBadRequest, "query_parse_error", "Invalid use of grouping on a map view.")
+		return
+	}
+	rows, offset := vq.selectRows(sorted)
+	out := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		out[i] = s.row(db, row, vq)
+	}
+	result := map[string]interface{}{"total_rows": len(sorted), "offset": offset, "rows": out}
+	if vq.updateSeq {
+		result["update_seq"] = seq
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// row renders a row of a view or _all_docs. With include_docs the
+// document is added, or null if it is gone.
+func (s *Server) row(db *database, row viewRow, vq *viewQuery) map[string]interface{} {
+	out := map[string]interface{}{"id": row.ID, "key": row.Key, "value": row.Value}
+	if !vq.includeDocs {
+		return out
+	}
+	out["doc"] = nil
+	if doc, err := db.get(row.ID); err == nil {
+		if full, err := db.docJSON(doc, vq.attachments); err == nil {
+			out["doc"] = full
+		}
+	}
+	return out
+}
+
+// readKeys reads the keys of a POST request to a view or _all_docs.
+func readKeys(w http.ResponseWriter, r *http.Request) ([]interface{}, bool) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return nil, true
+	case http.MethodPost:
+		var body struct {
+			Keys []interface{} `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+			return nil, false
+		}
+		return body.Keys, true
+	}
+	methodNotAllowed(w, "GET,HEAD,POST")
+	return nil, false
+}
+
+// readDocBody decodes the JSON object of a document request.
+func readDocBody(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Document must be a JSON object")
+		return nil, false
+	}
+	return body, true
+}
+
+// requestRev returns the revision a write is based on: the rev query
+// parameter, the _rev field of the body or the If-Match header.
+func requestRev(r *http.Request, body map[string]interface{}) string {
+	if rev := r.URL.Query().Get("rev"); rev != "" {
+		return rev
+	}
+	if rev, _ := body["_rev"].(string); rev != "" {
+		return rev
+	}
+	return strings.Trim(r.Header.Get("If-Match"), `"`)
+}
+
+// userFields returns the fields of a document body that do not start
+// with an underscore.
+func userFields(body map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		if !strings.HasPrefix(k, "_") {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func writeUpdateError(w http.ResponseWriter, err error) {
+	switch err {
+	case errConflict:
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errMissing, errDeleted:
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+	case errMissingStub:
+		writeError(w, http.StatusPreconditionFailed, "missing_stub", err.Error())
+	default:
+		if _, ok := err.(badRequest); ok {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+	}
+}
+
+// badRequest is an error caused by an invalid request.
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+func illegal(w http.ResponseWriter, name string) {
+	writeError(w, http.StatusBadRequest, "illegal_database_name", "Name: '"+name+"'. Only lowercase characters (a-z), digits (0-9), and any of the characters _, $, (, ), +, -, and / are allowed. Must begin with a letter.")
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only "+allowed+" allowed")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]string{"error": "internal_server_error", "reason": err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, code, reason string) {
+	writeJSON(w, status, map[string]string{"error": code, "reason": reason})
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
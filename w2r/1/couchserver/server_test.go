@@ -0,0 +1,226 @@
+package couchserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer serves a new server from a temporary directory until the
+// test ends.
+type testServer struct {
+	t   *testing.T
+	url string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		srv.Close()
+		hs.Close()
+	})
+	ts := &testServer{t: t, url: hs.URL}
+	ts.do("PUT", "/db", nil, http.StatusCreated)
+	return ts
+}
+
+// do sends a request with body encoded as JSON, checks the status and
+// returns the decoded response.
+func (ts *testServer) do(method, path string, body interface{}, status int) map[string]interface{} {
+	ts.t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, ts.url+path, bytes.NewReader(data))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != status {
+		ts.t.Fatalf("%s %s: %d %v, want %d", method, path, resp.StatusCode, out, status)
+	}
+	return out
+}
+
+func TestRevisionConflicts(t *testing.T) {
+	ts := newTestServer(t)
+
+	rev1 := ts.do("PUT", "/db/doc", map[string]interface{}{"n": 1}, http.StatusCreated)["rev"].(string)
+	if !strings.HasPrefix(rev1, "1-") {
+		t.Fatalf("first revision %q", rev1)
+	}
+	if e := ts.do("PUT", "/db/doc", map[string]interface{}{"n": 2}, http.StatusConflict); e["error"] != "conflict" {
+		t.Errorf("update without a revision: %v", e)
+	}
+	rev2 := ts.do("PUT", "/db/doc", map[string]interface{}{"_rev": rev1, "n": 2}, http.StatusCreated)["rev"].(string)
+	if !strings.HasPrefix(rev2, "2-") {
+		t.Fatalf("second revision %q", rev2)
+	}
+	ts.do("PUT", "/db/doc", map[string]interface{}{"_rev": rev1, "n": 3}, http.StatusConflict)
+	ts.do("DELETE", "/db/doc?rev="+rev1, nil, http.StatusConflict)
+	if doc := ts.do("GET", "/db/doc", nil, http.StatusOK); doc["_rev"] != rev2 || doc["n"] != 2.0 {
+		t.Errorf("after the conflicts: %v", doc)
+	}
+
+	rev3 := ts.do("DELETE", "/db/doc?rev="+rev2, nil, http.StatusOK)["rev"].(string)
+	ts.do("GET", "/db/doc", nil, http.StatusNotFound)
+	//A deleted document is recreated without a revision, on top of the
+	//tombstone.
+	if rev := ts.do("PUT", "/db/doc", map[string]interface{}{"n": 4}, http.StatusCreated)["rev"].(string); !strings.HasPrefix(rev, "4-") {
+		t.Errorf("recreated after %s with revision %q", rev3, rev)
+	}
+
+	bulk := []interface{}{
+		map[string]interface{}{"_id": "a"},
+		map[string]interface{}{"_id": "doc", "n": 5},
+	}
+	var results []map[string]interface{}
+	data, _ := json.Marshal(map[string]interface{}{"docs": bulk})
+	resp, err := http.Post(ts.url+"/db/_bulk_docs", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if len(results) != 2 || results[0]["ok"] != true || results[1]["error"] != "conflict" {
+		t.Errorf("_bulk_docs = %v", results)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.do("PUT", "/db/a", map[string]interface{}{"n": 1}, http.StatusCreated)
+	rev := ts.do("PUT", "/db/b", map[string]interface{}{"n": 2}, http.StatusCreated)["rev"].(string)
+	ts.do("DELETE", "/db/b?rev="+rev, nil, http.StatusOK)
+
+	feed := ts.do("GET", "/db/_changes?include_docs=true", nil, http.StatusOK)
+	results := feed["results"].([]interface{})
+	if len(results) != 2 {
+		t.Fatalf("_changes = %v, want a and b", feed)
+	}
+	a, b := results[0].(map[string]interface{}), results[1].(map[string]interface{})
+	if a["id"] != "a" || a["doc"].(map[string]interface{})["n"] != 1.0 {
+		t.Errorf("first change %v", a)
+	}
+	if b["id"] != "b" || b["deleted"] != true {
+		t.Errorf("second change %v, want the deletion of b", b)
+	}
+	last := feed["last_seq"]
+	if len(ts.do("GET", "/db/_changes?since="+jsonString(last), nil, http.StatusOK)["results"].([]interface{})) != 0 {
+		t.Error("changes since last_seq are not empty")
+	}
+	if n := len(ts.do("GET", "/db/_changes?limit=1", nil, http.StatusOK)["results"].([]interface{})); n != 1 {
+		t.Errorf("limit=1 returned %d changes", n)
+	}
+
+	//A longpoll feed waits for the next change.
+	done := make(chan map[string]interface{})
+	go func() {
+		resp, err := http.Get(ts.url + "/db/_changes?feed=longpoll&timeout=5000&since=" + jsonString(last))
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		done <- out
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ts.do("PUT", "/db/c", map[string]interface{}{}, http.StatusCreated)
+	select {
+	case out := <-done:
+		results, _ := out["results"].([]interface{})
+		if len(results) != 1 || results[0].(map[string]interface{})["id"] != "c" {
+			t.Errorf("longpoll = %v, want the change of c", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("longpoll feed did not return the change")
+	}
+}
+
+func TestFind(t *testing.T) {
+	ts := newTestServer(t)
+	for _, doc := range []map[string]interface{}{
+		{"_id": "anna", "name": "Anna", "age": 31, "tags": []string{"vip"}},
+		{"_id": "bob", "name": "Bob", "age": 19},
+		{"_id": "chloe", "name": "Chloé", "age": 45, "tags": []string{"speaker", "vip"}},
+		{"_id": "dave", "name": "Dave"},
+	} {
+		ts.do("PUT", "/db/"+doc["_id"].(string), doc, http.StatusCreated)
+	}
+
+	ids := func(out map[string]interface{}) []string {
+		var ids []string
+		for _, d := range out["docs"].([]interface{}) {
+			ids = append(ids, d.(map[string]interface{})["_id"].(string))
+		}
+		return ids
+	}
+	tests := []struct {
+		query map[string]interface{}
+		want  string
+	}{
+		{map[string]interface{}{"selector": map[string]interface{}{"age": map[string]interface{}{"$gt": 20}}}, "anna chloe"},
+		{map[string]interface{}{"selector": map[string]interface{}{"tags": map[string]interface{}{"$all": []string{"vip"}}}}, "anna chloe"},
+		{map[string]interface{}{"selector": map[string]interface{}{"age": map[string]interface{}{"$exists": false}}}, "dave"},
+		{map[string]interface{}{"selector": map[string]interface{}{"name": map[string]interface{}{"$regex": "^[AB]"}}}, "anna bob"},
+		{map[string]interface{}{"selector": map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"age": 19},
+			map[string]interface{}{"tags": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": "speaker"}}},
+		}}}, "bob chloe"},
+		//Documents without the sort field are left out.
+		{map[string]interface{}{"selector": map[string]interface{}{}, "sort": []interface{}{map[string]string{"age": "desc"}}, "limit": 2}, "chloe anna"},
+	}
+	for _, tt := range tests {
+		out := ts.do("POST", "/db/_find", tt.query, http.StatusOK)
+		if got := strings.Join(ids(out), " "); got != tt.want {
+			t.Errorf("_find %v = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	out := ts.do("POST", "/db/_find", map[string]interface{}{"selector": map[string]interface{}{"age": map[string]interface{}{"$gte": 0}}, "fields": []string{"_id", "age"}, "limit": 1}, http.StatusOK)
+	first := out["docs"].([]interface{})[0].(map[string]interface{})
+	if _, ok := first["name"]; ok || len(first) != 2 {
+		t.Errorf("fields selected %v", first)
+	}
+	next := ts.do("POST", "/db/_find", map[string]interface{}{"selector": map[string]interface{}{"age": map[string]interface{}{"$gte": 0}}, "bookmark": out["bookmark"]}, http.StatusOK)
+	if got := strings.Join(ids(next), " "); got != "bob chloe" {
+		t.Errorf("page after the bookmark = %s, want bob chloe", got)
+	}
+
+	if e := ts.do("POST", "/db/_find", map[string]interface{}{"selector": map[string]interface{}{"age": map[string]interface{}{"$near": 1}}}, http.StatusBadRequest); e["error"] != "invalid_operator" {
+		t.Errorf("unknown operator: %v", e)
+	}
+	ts.do("POST", "/db/_find", map[string]interface{}{"fields": []string{"_id"}}, http.StatusBadRequest)
+}
+
+// jsonString formats a sequence for a query parameter.
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,497 @@
+package couchserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MapFunc is the Go counterpart of a JavaScript map function. It is
+// called with every document, including its _id and _rev, and calls emit
+// for every row it adds to the view. Keys and values must be encodable as
+// JSON.
+type MapFunc func(doc map[string]interface{}, emit func(key, value interface{}))
+
+// View is a view that the server answers for _design/<ddoc>/_view/<name>
+// in every database. Reduce is empty or one of the built-in reduce
+// functions "_count" and "_sum".
+type View struct {
+	Map    MapFunc
+	Reduce string
+}
+
+// viewRow is a row of a view or of _all_docs.
+type viewRow struct {
+	ID    string      `json:"id"`
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// viewIndex caches the sorted rows of a view until the next change.
+type viewIndex struct {
+	seq  int64
+	rows []viewRow
+}
+
+// viewQuery holds the query parameters of a view or _all_docs request.
+type viewQuery struct {
+	keys         []interface{}
+	startKey     interface{}
+	endKey       interface{}
+	hasStart     bool
+	hasEnd       bool
+	startDocID   string
+	endDocID     string
+	inclusiveEnd bool
+	descending   bool
+	skip         int
+	limit        int // -1 for no limit
+	includeDocs  bool
+	reduce       bool
+	reduceSet    bool
+	group        bool
+	groupLevel   int // -1 unless group_level is set
+	attachments  bool
+	updateSeq    bool
+
+	// collate orders the keys; _all_docs compares ids as raw strings.
+	collate func(a, b interface{}) int
+}
+
+// parseViewQuery reads the query parameters. keys may also come from the
+// body of a POST request.
+func parseViewQuery(q url.Values, keys []interface{}) (*viewQuery, error) {
+	vq := &viewQuery{inclusiveEnd: true, limit: -1, groupLevel: -1, keys: keys, collate: collate}
+	jsonParam := func(names ...string) (interface{}, bool, error) {
+		for _, name := range names {
+			if s, ok := q[name]; ok {
+				var v interface{}
+				if err := json.Unmarshal([]byte(s[0]), &v); err != nil {
+					return nil, false, errors.New("invalid value for " + name)
+				}
+				return v, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+	boolParam := func(name string, def bool) (bool, error) {
+		s := q.Get(name)
+		switch s {
+		case "":
+			return def, nil
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return false, errors.New("invalid boolean parameter " + name)
+	}
+	intParam := func(name string, def int) (int, error) {
+		s := q.Get(name)
+		if s == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, errors.New("invalid integer parameter " + name)
+		}
+		return n, nil
+	}
+	key, hasKey, err := jsonParam("key")
+	if err != nil {
+		return nil, err
+	}
+	if v, ok, err := jsonParam("keys"); err != nil {
+		return nil, err
+	} else if ok {
+		list, isList := v.([]interface{})
+		if !isList {
+			return nil, errors.New("keys must be an array")
+		}
+		vq.keys = list
+	}
+	if vq.startKey, vq.hasStart, err = jsonParam("startkey", "start_key"); err != nil {
+		return nil, err
+	} else if !vq.hasStart && hasKey {
+		vq.startKey, vq.hasStart = key, true
+	}
+	if vq.endKey, vq.hasEnd, err = jsonParam("endkey", "end_key"); err != nil {
+		return nil, err
+	} else if !vq.hasEnd && hasKey {
+		vq.endKey, vq.hasEnd = key, true
+	}
+	vq.startDocID = firstOf(q, "startkey_docid", "start_key_doc_id")
+	vq.endDocID = firstOf(q, "endkey_docid", "end_key_doc_id")
+	if vq.inclusiveEnd, err = boolParam("inclusive_end", true); err != nil {
+		return nil, err
+	}
+	if vq.descending, err = boolParam("descending", false); err != nil {
+		return nil, err
+	}
+	if vq.includeDocs, err = boolParam("include_docs", false); err != nil {
+		return nil, err
+	}
+	if vq.attachments, err = boolParam("attachments", false); err != nil {
+		return nil, err
+	}
+	if vq.group, err = boolParam("group", false); err != nil {
+		return nil, err
+	}
+	if vq.updateSeq, err = boolParam("update_seq", false); err != nil {
+		return nil, err
+	}
+	_, vq.reduceSet = q["reduce"]
+	if vq.reduce, err = boolParam("reduce", true); err != nil {
+		return nil, err
+	}
+	if vq.skip, err = intParam("skip", 0); err != nil {
+		return nil, err
+	}
+	if vq.limit, err = intParam("limit", -1); err != nil {
+		return nil, err
+	}
+	if vq.groupLevel, err = intParam("group_level", -1); err != nil {
+		return nil, err
+	}
+	return vq, nil
+}
+
+func firstOf(q url.Values, names ...string) string {
+	for _, name := range names {
+		if v := q.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// selectRows returns the rows of sorted that match the query and the offset
+// of the first of them.
+func (vq *viewQuery) selectRows(sorted []viewRow) ([]viewRow, int) {
+	if vq.keys != nil {
+		var out []viewRow
+		for _, key := range vq.keys {
+			i := sort.Search(len(sorted), func(i int) bool { return vq.collate(sorted[i].Key, key) >= 0 })
+			for ; i < len(sorted) && vq.collate(sorted[i].Key, key) == 0; i++ {
+				out = append(out, sorted[i])
+			}
+		}
+		if vq.descending {
+			reverse(out)
+		}
+		return vq.page(out), 0
+	}
+	rows := sorted
+	if vq.descending {
+		rows = make([]viewRow, len(sorted))
+		copy(rows, sorted)
+		reverse(rows)
+	}
+	// cmp orders a row relative to a bound in the direction of iteration.
+	cmp := func(r viewRow, key interface{}, docID string) int {
+		c := vq.collate(r.Key, key)
+		if c == 0 && docID != "" {
+			c = strings.Compare(r.ID, docID)
+		}
+		if vq.descending {
+			c = -c
+		}
+		return c
+	}
+	first := 0
+	if vq.hasStart {
+		first = sort.Search(len(rows), func(i int) bool { return cmp(rows[i], vq.startKey, vq.startDocID) >= 0 })
+	}
+	last := len(rows)
+	if vq.hasEnd {
+		last = sort.Search(len(rows), func(i int) bool {
+			c := cmp(rows[i], vq.endKey, vq.endDocID)
+			if vq.inclusiveEnd {
+				return c > 0
+			}
+			return c >= 0
+		})
+	}
+	if last < first {
+		last = first
+	}
+	return vq.page(rows[first:last]), first + minInt(vq.skip, last-first)
+}
+
+// page applies skip and limit.
+func (vq *viewQuery) page(rows []viewRow) []viewRow {
+	if vq.skip >= len(rows) {
+		return []viewRow{}
+	}
+	rows = rows[vq.skip:]
+	if vq.limit >= 0 && vq.limit < len(rows) {
+		rows = rows[:vq.limit]
+	}
+	return rows
+}
+
+func reverse(rows []viewRow) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// viewRows returns the sorted rows of a view, mapping the documents
+// again if the database has changed since the rows were cached.
+func (db *database) viewRows(name string, v View) ([]viewRow, int64, error) {
+	db.mu.RLock()
+	idx, ok := db.views[name]
+	seq := db.seq
+	if ok && idx.seq == seq {
+		db.mu.RUnlock()
+		return idx.rows, seq, nil
+	}
+	docs := make([]*document, 0, len(db.docs))
+	for _, doc := range db.docs {
+		if !doc.Deleted && !strings.HasPrefix(doc.ID, "_design/") {
+			docs = append(docs, doc)
+		}
+	}
+	db.mu.RUnlock()
+
+	var rows []viewRow
+	for _, doc := range docs {
+		full, err := db.docJSON(doc, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		var emitErr error
+		v.Map(full, func(key, value interface{}) {
+			key, err := normalize(key)
+			if err != nil {
+				emitErr = err
+				return
+			}
+			value, err = normalize(value)
+			if err != nil {
+				emitErr = err
+				return
+			}
+			rows = append(rows, viewRow{ID: doc.ID, Key: key, Value: value})
+		})
+		if emitErr != nil {
+			return nil, 0, emitErr
+		}
+	}
+	sortRows(rows)
+
+	db.mu.Lock()
+	db.views[name] = &viewIndex{seq: seq, rows: rows}
+	db.mu.Unlock()
+	return rows, seq, nil
+}
+
+// allDocsRows returns the rows of _all_docs, or of _local_docs if local
+// is set, sorted by id.
+func (db *database) allDocsRows(local bool) ([]viewRow, int64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	docs := db.docs
+	if local {
+		docs = db.local
+	}
+	rows := make([]viewRow, 0, len(docs))
+	for _, doc := range docs {
+		if !doc.Deleted {
+			rows = append(rows, viewRow{ID: doc.ID, Key: doc.ID, Value: map[string]interface{}{"rev": doc.Rev}})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	return rows, db.seq
+}
+
+func sortRows(rows []viewRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if c := collate(rows[i].Key, rows[j].Key); c != 0 {
+			return c < 0
+		}
+		return rows[i].ID < rows[j].ID
+	})
+}
+
+// normalize converts an emitted Go value to the value it has in JSON, so
+// that numbers are float64 and structs become maps.
+func normalize(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, bool, string, float64:
+		return v, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// reduceRows applies a built-in reduce function, grouping the rows as
+// asked by the query.
+func reduceRows(fn string, rows []viewRow, vq *viewQuery) ([]map[string]interface{}, error) {
+	groupKey := func(key interface{}) interface{} {
+		switch {
+		case vq.groupLevel >= 0:
+			if list, ok := key.([]interface{}); ok && len(list) > vq.groupLevel {
+				return list[:vq.groupLevel]
+			}
+			return key
+		case vq.group:
+			return key
+		}
+		return nil
+	}
+	var out []map[string]interface{}
+	var values []interface{}
+	var current interface{}
+	flush := func() error {
+		if values == nil {
+			return nil
+		}
+		value, err := reduceValues(fn, values)
+		if err != nil {
+			return err
+		}
+		out = append(out, map[string]interface{}{"key": current, "value": value})
+		return nil
+	}
+	for _, r := range rows {
+		key := groupKey(r.Key)
+		if values != nil && collate(key, current) != 0 {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			values = nil
+		}
+		current = key
+		values = append(values, r.Value)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if out == nil && !vq.group && vq.groupLevel < 0 {
+		value, _ := reduceValues(fn, nil)
+		out = append(out, map[string]interface{}{"key": nil, "value": value})
+	}
+	return out, nil
+}
+
+func reduceValues(fn string, values []interface{}) (interface{}, error) {
+	switch fn {
+	case "_count":
+		return len(values), nil
+	case "_sum":
+		var sum float64
+		for _, v := range values {
+			n, ok := v.(float64)
+			if !ok {
+				return nil, errors.New("_sum requires numeric values")
+			}
+			sum += n
+		}
+		return sum, nil
+	}
+	return nil, errors.New("unsupported reduce function " + fn)
+}
+
+// collate compares two JSON values in CouchDB view order: null, false,
+// true, numbers, strings, arrays and objects. Strings are compared case
+// insensitively first, which approximates the ICU collation of CouchDB
+// for the usual ASCII keys.
+func collate(a, b interface{}) int {
+	ra, rb := collationRank(a), collationRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		b := b.(string)
+		if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+			return c
+		}
+		return -strings.Compare(a, b) // lower case first
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := collate(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		ka, kb := sortedKeys(a), sortedKeys(b)
+		for i := 0; i < len(ka) && i < len(kb); i++ {
+			if c := collate(ka[i], kb[i]); c != 0 {
+				return c
+			}
+			if c := collate(a[ka[i]], b[kb[i]]); c != 0 {
+				return c
+			}
+		}
+		return len(ka) - len(kb)
+	}
+	return 0
+}
+
+// rawCollate is collate with strings compared byte by byte, the order of
+// _all_docs.
+func rawCollate(a, b interface{}) int {
+	if a, ok := a.(string); ok {
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	}
+	return collate(a, b)
+}
+
+func collationRank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
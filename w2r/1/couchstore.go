@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/timjacobi/go-couchdb"
+)
+
+// couchStore is a VisitorStore backed by a CouchDB or Cloudant database,
+// one document per visitor. The audit trail is kept in a second database
+// named after the first with auditDBSuffix.
+type couchStore struct {
+	client func() *couchdb.Client
+	name   string
+}
+
+func newCouchStore(client *couchdb.Client, name string) *couchStore {
+	return &couchStore{client: func() *couchdb.Client { return client }, name: name}
+}
+
+// newConnCouchStore returns a store of the database name that follows
+// the client rotations of conn.
+func newConnCouchStore(conn *couchConn, name string) *couchStore {
+	return &couchStore{client: conn.Client, name: name}
+}
+
+func (s *couchStore) db() *couchdb.DB {
+	return s.client().DB(s.name)
+}
+
+// couchError converts the not found and conflict errors of go-couchdb.
+func couchError(err error) error {
+	switch {
+	case couchdb.NotFound(err):
+		return errStoreNotFound
+	case couchdb.Conflict(err):
+		return errStoreConflict
+	}
+	return err
+}
+
+func (s *couchStore) Add(ctx context.Context, v Visitor) (*visitorResource, error) {
+	id, rev, err := s.db().PostContext(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return v.resource(id, rev), nil
+}
+
+// AddBatch uses _bulk_docs, which stores every document on its own.
+func (s *couchStore) AddBatch(ctx context.Context, visitors []Visitor) ([]addResult, error) {
+	docs := make([]interface{}, len(visitors))
+	for i, v := range visitors {
+		docs[i] = v
+	}
+	rows, err := s.db().BulkDocsContext(ctx, docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != len(visitors) {
+		return nil, fmt.Errorf("_bulk_docs returned %d results for %d documents", len(rows), len(visitors))
+	}
+	results := make([]addResult, len(rows))
+	for i, row := range rows {
+		if row.Error != "" {
+			results[i].Err = fmt.Errorf("_bulk_docs: %s: %s", row.Error, row.Reason)
+			continue
+		}
+		results[i].Visitor = visitors[i].resource(row.ID, row.Rev)
+	}
+	return results, nil
+}
+
+func (s *couchStore) Get(ctx context.Context, id string) (*visitorResource, error) {
+	var doc map[string]interface{}
+	if err := s.db().GetContext(ctx, id, &doc, nil); err != nil {
+		return nil, couchError(err)
+	}
+	v := visitorFromDoc(doc)
+	return &v, nil
+}
+
+// List reads a page of the view visitors/all, whose total_rows counts
+// the visitors without the design documents and the trash.
+func (s *couchStore) List(ctx context.Context, page, perPage int) ([]visitorResource, int, error) {
+	var result alldocsResult
+	opts := couchdb.Options{"include_docs": true}
+	if perPage > 0 {
+		opts["limit"] = perPage
+		opts["skip"] = (page - 1) * perPage
+	}
+	if err := s.view(ctx, "all", &result, opts); err != nil {
+		return nil, 0, err
+	}
+	visitors := make([]visitorResource, len(result.Rows))
+	for i, row := range result.Rows {
+		doc, _ := row["doc"].(map[string]interface{})
+		visitors[i] = visitorFromDoc(doc)
+	}
+	return visitors, result.TotalRows, nil
+}
+
+// Scan reads the view visitors/all, which is keyed by ID.
+func (s *couchStore) Scan(ctx context.Context, after string, limit int) ([]visitorResource, string, error) {
+	var result alldocsResult
+	opts := couchdb.Options{"include_docs": true, "limit": limit}
+	if after != "" {
+		//startkey is inclusive, so fetch one more row and drop it.
+		opts["startkey"] = after
+		opts["limit"] = limit + 1
+	}
+	if err := s.view(ctx, "all", &result, opts); err != nil {
+		return nil, "", err
+	}
+	rows := result.Rows
+	if after != "" && len(rows) > 0 && rows[0]["id"] == after {
+		rows = rows[1:]
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	visitors := make([]visitorResource, len(rows))
+	for i, row := range rows {
+		doc, _ := row["doc"].(map[string]interface{})
+		visitors[i] = visitorFromDoc(doc)
+	}
+	var next string
+	if len(rows) == limit {
+		next, _ = rows[len(rows)-1]["id"].(string)
+	}
+	return visitors, next, nil
+}
+
+// visitorsDesign is the design document _design/visitors with the views
+// of List and Scan, which leave out the design documents and the trash,
+// the visitors with a deleted_at time. The embedded
+// server, which does not run JavaScript, answers them with the Go map
+// functions of localVisitorViews.
+var visitorsDesign = map[string]interface{}{
+	"language": "javascript",
+	"views": map[string]interface{}{
+		"all": map[string]interface{}{
+			"map": "function(doc) { if (doc._id.indexOf('_design/') !== 0 && !doc.deleted_at) { emit(doc._id, null); } }",
+		},
+	},
+}
+
+// ensureVisitorViews creates _design/visitors, or updates it when its
+// views changed.
+func ensureVisitorViews(ctx context.Context, db *couchdb.DB) error {
+	var current map[string]interface{}
+	err := db.GetContext(ctx, "_design/visitors", &current, nil)
+	if err != nil && !couchdb.NotFound(err) {
+		return err
+	}
+	want, _ := json.Marshal(visitorsDesign["views"])
+	have, _ := json.Marshal(current["views"])
+	if string(want) == string(have) {
+		return nil
+	}
+	rev, _ := current["_rev"].(string)
+	if _, err := db.PutContext(ctx, "_design/visitors", visitorsDesign, rev); err != nil && !couchdb.Conflict(err) {
+		return err
+	}
+	//On a conflict another instance updated it.
+	return nil
+}
+
+// view queries a view of _design/visitors. The design document is
+// created on first use if it could not be created at startup.
+func (s *couchStore) view(ctx context.Context, name string, result interface{}, opts couchdb.Options) error {
+	err := s.db().ViewContext(ctx, "_design/visitors", name, result, opts)
+	if couchdb.NotFound(err) {
+		if err = ensureVisitorViews(ctx, s.db()); err == nil {
+			err = s.db().ViewContext(ctx, "_design/visitors", name, result, opts)
+		}
+	}
+	return err
+}
+
+// Search scans all visitors, since CouchDB has no full-text index.
+// Cloudant search indexes are not used so that the query behaves the
+// same with plain CouchDB and the embedded server.
+func (s *couchStore) Search(ctx context.Context, query string, limit int) ([]visitorResource, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	var found []visitorResource
+	after := ""
+	for {
+		page, next, err := s.Scan(ctx, after, maxPerPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range page {
+			if matchesWords(v.Name, words) {
+				found = append(found, v)
+				if len(found) == limit {
+					return found, nil
+				}
+			}
+		}
+		if next == "" || ctx.Err() != nil {
+			return found, ctx.Err()
+		}
+		after = next
+	}
+}
+
+// matchesWords reports whether every word is the prefix of a word of name.
+func matchesWords(name string, words []string) bool {
+	nameWords := searchWords(name)
+	sort.Strings(nameWords)
+	for _, w := range words {
+		i := sort.SearchStrings(nameWords, w)
+		if i == len(nameWords) || !strings.HasPrefix(nameWords[i], w) {
+			return false
+		}
+	}
+	return true
+}
+
+// visitorIndexes are the Mango indexes that Find can use for date ranges
+// and locales. Name prefixes and tags are matched while scanning. Trash
+// and Expired sort and select by deleted_at.
+var visitorIndexes = []couchdb.Index{
+	{DDoc: "visitor-search", Name: "created_at", Fields: []interface{}{"created_at"}},
+	{DDoc: "visitor-search", Name: "locale", Fields: []interface{}{"locale"}},
+	{DDoc: "visitor-search", Name: "deleted_at", Fields: []interface{}{"deleted_at"}},
+}
+
+// ensureVisitorIndexes creates the indexes of Find in db unless they
+// exist, and the views of List. Find works without the indexes, only
+// slower.
+func ensureVisitorIndexes(ctx context.Context, db *couchdb.DB) error {
+	for _, idx := range visitorIndexes {
+		if _, err := db.CreateIndexContext(ctx, idx); err != nil {
+			return err
+		}
+	}
+	return ensureVisitorViews(ctx, db)
+}
+
+// mangoSelector translates f into a Mango selector. Values of the
+// filter are only ever used as operands, and the name prefix is quoted,
+// so a filter cannot change the structure of the query.
+func mangoSelector(f *visitorFilter) map[string]interface{} {
+	//Every visitor has a name, which leaves out design documents.
+	name := map[string]interface{}{"$gt": nil}
+	if f.NamePrefix != "" {
+		name = map[string]interface{}{"$regex": "(?i)^" + regexp.QuoteMeta(f.NamePrefix)}
+	}
+	sel := map[string]interface{}{"name": name, "deleted_at": map[string]interface{}{"$exists": false}}
+	created := map[string]interface{}{}
+	if f.CreatedAfter != nil {
+		created["$gte"] = f.CreatedAfter.UTC().Format(createdLayout)
+	}
+	if f.CreatedBefore != nil {
+		created["$lt"] = f.CreatedBefore.UTC().Format(createdLayout)
+	}
+	if len(created) > 0 {
+		sel["created_at"] = created
+	}
+	if len(f.Tags) > 0 {
+		sel["tags"] = map[string]interface{}{"$all": f.Tags}
+	}
+	if len(f.Locales) > 0 {
+		sel["locale"] = map[string]interface{}{"$in": f.Locales}
+	}
+	return sel
+}
+
+// Find runs a Mango query. The order of the results depends on the
+// index that CouchDB picks; the bookmark is CouchDB's own.
+func (s *couchStore) Find(ctx context.Context, f *visitorFilter, bookmark string, limit int) ([]visitorResource, string, error) {
+	var result struct {
+		Docs     []map[string]interface{} `json:"docs"`
+		Bookmark string                   `json:"bookmark"`
+	}
+	q := &couchdb.FindQuery{Selector: mangoSelector(f), Limit: limit, Bookmark: bookmark}
+	if err := s.db().FindContext(ctx, q, &result); err != nil {
+		if bookmark != "" && couchdb.ErrorStatus(err, http.StatusBadRequest) {
+			return nil, "", errStoreBadBookmark
+		}
+		return nil, "", err
+	}
+	visitors := make([]visitorResource, len(result.Docs))
+	for i, doc := range result.Docs {
+		visitors[i] = visitorFromDoc(doc)
+	}
+	var next string
+	if len(visitors) == limit {
+		next = result.Bookmark
+	}
+	return visitors, next, nil
+}
+
+// Update keeps the fields of the document that the app does not know.
+func (s *couchStore) Update(ctx context.Context, v *visitorResource) error {
+	var doc map[string]interface{}
+	if err := s.db().GetContext(ctx, v.ID, &doc, nil); err != nil {
+		return couchError(err)
+	}
+	doc["_rev"] = v.Rev
+	doc["name"] = v.Name
+	doc["locale"] = v.Locale
+	if len(v.Tags) > 0 {
+		doc["tags"] = v.Tags
+	} else {
+		delete(doc, "tags")
+	}
+	if !v.Deleted.IsZero() {
+		doc["deleted_at"] = v.Deleted.UTC().Format(createdLayout)
+	} else {
+		delete(doc, "deleted_at")
+	}
+	rev, err := s.db().PutContext(ctx, v.ID, doc, v.Rev)
+	if err != nil {
+		return couchError(err)
+	}
+	v.Rev = rev
+	return nil
+}
+
+func (s *couchStore) Delete(ctx context.Context, id, rev string) error {
+	var err error
+	if rev == "" {
+		rev, err = s.db().RevContext(ctx, id)
+	}
+	if err == nil {
+		_, err = s.db().DeleteContext(ctx, id, rev)
+	}
+	return couchError(err)
+}
+
+// Trash pages with CouchDB's bookmarks, like Find.
+func (s *couchStore) Trash(ctx context.Context, bookmark string, limit int) ([]visitorResource, string, error) {
+	var result struct {
+		Docs     []map[string]interface{} `json:"docs"`
+		Bookmark string                   `json:"bookmark"`
+	}
+	q := &couchdb.FindQuery{
+		Selector: map[string]interface{}{"deleted_at": map[string]interface{}{"$gt": nil}},
+		Sort:     []interface{}{"deleted_at"},
+		Limit:    limit,
+		Bookmark: bookmark,
+	}
+	if err := s.db().FindContext(ctx, q, &result); err != nil {
+		if bookmark != "" && couchdb.ErrorStatus(err, http.StatusBadRequest) {
+			return nil, "", errStoreBadBookmark
+		}
+		return nil, "", err
+	}
+	visitors := make([]visitorResource, len(result.Docs))
+	for i, doc := range result.Docs {
+		visitors[i] = visitorFromDoc(doc)
+	}
+	var next string
+	if len(visitors) == limit {
+		next = result.Bookmark
+	}
+	return visitors, next, nil
+}
+
+// Expired runs a Mango query for each condition, so that both can use
+// an index.
+func (s *couchStore) Expired(ctx context.Context, trashedBefore, createdBefore time.Time, limit int) ([]visitorResource, error) {
+	var selectors []map[string]interface{}
+	if !trashedBefore.IsZero() {
+		selectors = append(selectors, map[string]interface{}{
+			"deleted_at": map[string]interface{}{"$gt": nil, "$lt": trashedBefore.UTC().Format(createdLayout)},
+		})
+	}
+	if !createdBefore.IsZero() {
+		selectors = append(selectors, map[string]interface{}{
+			"created_at": map[string]interface{}{"$gt": nil, "$lt": createdBefore.UTC().Format(createdLayout)},
+		})
+	}
+	var visitors []visitorResource
+	seen := make(map[string]bool)
+	for _, sel := range selectors {
+		var result struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		if err := s.db().FindContext(ctx, &couchdb.FindQuery{Selector: sel, Limit: limit}, &result); err != nil {
+			return nil, err
+		}
+		for _, doc := range result.Docs {
+			if v := visitorFromDoc(doc); !seen[v.ID] && len(visitors) < limit {
+				seen[v.ID] = true
+				visitors = append(visitors, v)
+			}
+		}
+	}
+	return visitors, nil
+}
+
+// Count returns total_rows of the view visitors/all.
+func (s *couchStore) Count(ctx context.Context) (int, error) {
+	var result alldocsResult
+	if err := s.view(ctx, "all", &result, couchdb.Options{"limit": 0}); err != nil {
+		return 0, err
+	}
+	return result.TotalRows, nil
+}
+
+// UpdateSeq returns the update_seq of the database, which _all_docs
+// reports when asked to.
+func (s *couchStore) UpdateSeq(ctx context.Context) (string, error) {
+	var result struct {
+		UpdateSeq interface{} `json:"update_seq"`
+	}
+	if err := s.db().AllDocsContext(ctx, &result, couchdb.Options{"limit": 0, "update_seq": true}); err != nil {
+		return "", err
+	}
+	return seqString(result.UpdateSeq), nil
+}
+
+// Stats scans all visitors, like Search.
+func (s *couchStore) Stats(ctx context.Context) (*visitorStats, error) {
+	stats := &visitorStats{Locales: make(map[string]int)}
+	after := ""
+	for {
+		page, next, err := s.Scan(ctx, after, maxPerPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range page {
+			if v.Name != "" {
+				stats.Visitors++
+				stats.Locales[v.Locale]++
+			}
+		}
+		if next == "" || ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		after = next
+	}
+}
+
+// Watch reads the continuous changes feed. Design documents are skipped,
+// and visitors with a deleted_at time are reported as deleted.
+func (s *couchStore) Watch(ctx context.Context, since string, fn func(visitorChange) error) error {
+	opts := couchdb.Options{
+		"feed":         "continuous",
+		"include_docs": true,
+		"heartbeat":    30000,
+	}
+	if since != "" {
+		opts["since"] = since
+	}
+	//The feed ends when ctx is done.
+	feed, err := s.db().ChangesContext(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer feed.Close()
+	for feed.Next() {
+		if strings.HasPrefix(feed.ID, "_design/") {
+			continue
+		}
+		change, err := couchVisitorChange(seqString(feed.Seq), feed.ID, feed.Deleted, feed.Doc)
+		if err != nil {
+			return err
+		}
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return feed.Err()
+}
+
+// couchVisitorChange converts a change of the visitor id in the changes
+// feed. A visitor moved to the trash is reported as deleted.
+func couchVisitorChange(seq, id string, deleted bool, raw json.RawMessage) (visitorChange, error) {
+	change := visitorChange{Seq: seq, Deleted: deleted}
+	change.Visitor.ID = id
+	if deleted {
+		return change, nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return change, err
+	}
+	if v := visitorFromDoc(doc); v.Deleted.IsZero() {
+		change.Visitor = v
+	} else {
+		change.Deleted = true
+	}
+	return change, nil
+}
+
+// visitorChange converts a change of a visitor delivered by a changes
+// processor, like Watch does.
+func (ev *changeEvent) visitorChange() (visitorChange, error) {
+	return couchVisitorChange(ev.Seq, ev.ID, ev.Deleted, ev.Doc)
+}
+
+// keyDoc is an idempotency record stored as a _local document, which is
+// neither listed, counted nor replicated.
+type keyDoc struct {
+	Rev string `json:"_rev,omitempty"`
+	*idempotencyRecord
+}
+
+// keyDocPrefix starts the IDs of the idempotency records.
+const keyDocPrefix = "_local/idempotency-"
+
+func keyDocID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return keyDocPrefix + hex.EncodeToString(sum[:])
+}
+
+// keysPurged holds the unix time of the last purge of expired keys by
+// database name. It is shared by the stores of a database, since tenant
+// requests each get their own.
+var keysPurged sync.Map
+
+// purgeKeys deletes the expired idempotency records of the database,
+// which _local_docs lists a page at a time. A record that is replaced
+// meanwhile is left alone.
+func (s *couchStore) purgeKeys(ctx context.Context) error {
+	startkey := keyDocPrefix
+	for {
+		var result struct {
+			Rows []struct {
+				ID  string `json:"id"`
+				Doc struct {
+					Rev     string    `json:"_rev"`
+					Expires time.Time `json:"expires"`
+				} `json:"doc"`
+			} `json:"rows"`
+		}
+		opts := couchdb.Options{"include_docs": true, "startkey": startkey, "endkey": keyDocPrefix + "\ufff0", "limit": keyPurgePage}
+		if err := s.db().LocalDocsContext(ctx, &result, opts); err != nil {
+			return err
+		}
+		for _, row := range result.Rows {
+			if row.ID == startkey || row.Doc.Expires.After(time.Now()) {
+				continue
+			}
+			if _, err := s.db().DeleteContext(ctx, row.ID, row.Doc.Rev); err != nil && !couchdb.Conflict(err) && !couchdb.NotFound(err) {
+				return err
+			}
+		}
+		if len(result.Rows) < keyPurgePage {
+			return nil
+		}
+		startkey = result.Rows[len(result.Rows)-1].ID
+	}
+}
+
+// keyPurgePage is the number of records read per request of purgeKeys.
+const keyPurgePage = 1000
+
+func (s *couchStore) getKey(ctx context.Context, key string) (*idempotencyRecord, error) {
+	doc := keyDoc{idempotencyRecord: &idempotencyRecord{}}
+	if err := s.db().GetContext(ctx, keyDocID(key), &doc, nil); err != nil {
+		return nil, couchError(err)
+	}
+	doc.rev = doc.Rev
+	return doc.idempotencyRecord, nil
+}
+
+// ReserveKey replaces an expired record. Of two requests that reserve
+// the same key at once, the one that loses the conflict gets the record
+// of the other. Expired records of the database are deleted in the
+// background once a minute.
+func (s *couchStore) ReserveKey(ctx context.Context, rec *idempotencyRecord) (*idempotencyRecord, error) {
+	now := time.Now().Unix()
+	last, _ := keysPurged.LoadOrStore(s.name, new(int64))
+	if prev := atomic.LoadInt64(last.(*int64)); now-prev >= 60 && atomic.CompareAndSwapInt64(last.(*int64), prev, now) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+			defer cancel()
+			if err := s.purgeKeys(ctx); err != nil {
+				log.Println("Can not delete expired idempotency keys:", err)
+			}
+		}()
+	}
+	existing, err := s.getKey(ctx, rec.Key)
+	switch {
+	case err == nil && !existing.expired():
+		return existing, nil
+	case err == nil:
+		rec.rev = existing.rev
+	case err != errStoreNotFound:
+		return nil, err
+	}
+	rev, err := s.db().PutContext(ctx, keyDocID(rec.Key), keyDoc{Rev: rec.rev, idempotencyRecord: rec}, rec.rev)
+	if couchError(err) == errStoreConflict {
+		return s.getKey(ctx, rec.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.rev = rev
+	return nil, nil
+}
+
+func (s *couchStore) CompleteKey(ctx context.Context, rec *idempotencyRecord) error {
+	rev, err := s.db().PutContext(ctx, keyDocID(rec.Key), keyDoc{Rev: rec.rev, idempotencyRecord: rec}, rec.rev)
+	if err != nil {
+		return couchError(err)
+	}
+	rec.rev = rev
+	return nil
+}
+
+func (s *couchStore) ReleaseKey(ctx context.Context, rec *idempotencyRecord) error {
+	_, err := s.db().DeleteContext(ctx, keyDocID(rec.Key), rec.rev)
+	return couchError(err)
+}
+
+// auditDBSuffix names the audit database of a visitor database. Tenant
+// names have no underscores, so it can not clash with a tenant database.
+const auditDBSuffix = "_audit"
+
+// auditDesign rejects changes to stored audit records, even by admins.
+// The embedded server does not run JavaScript and accepts them.
+var auditDesign = map[string]interface{}{
+	"validate_doc_update": "function(newDoc, oldDoc) { if (oldDoc) { throw({forbidden: 'audit records can not be changed'}); } }",
+}
+
+func (s *couchStore) auditDB() *couchdb.DB {
+	return s.client().DB(s.name + auditDBSuffix)
+}
+
+// ensureAuditDB creates the audit database and its design document.
+func (s *couchStore) ensureAuditDB(ctx context.Context) error {
+	db, err := s.client().EnsureDBContext(ctx, s.name+auditDBSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := db.PutContext(ctx, "_design/audit", auditDesign, ""); err != nil && !couchdb.Conflict(err) {
+		return err
+	}
+	return nil
+}
+
+// auditDocID orders the records of a visitor by time. The random suffix
+// keeps records written in the same nanosecond apart.
+func auditDocID(rec *auditRecord) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s:%020d-%s", rec.VisitorID, rec.At.UnixNano(), hex.EncodeToString(b))
+}
+
+// AddAudit creates the audit database on first use.
+func (s *couchStore) AddAudit(ctx context.Context, rec *auditRecord) error {
+	id := auditDocID(rec)
+	_, err := s.auditDB().PutContext(ctx, id, rec, "")
+	if couchdb.NotFound(err) {
+		if err = s.ensureAuditDB(ctx); err == nil {
+			_, err = s.auditDB().PutContext(ctx, id, rec, "")
+		}
+	}
+	return err
+}
+
+func (s *couchStore) AuditTrail(ctx context.Context, id string) ([]auditRecord, error) {
+	var result struct {
+		Rows []struct {
+			Doc auditRecord `json:"doc"`
+		} `json:"rows"`
+	}
+	opts := couchdb.Options{"include_docs": true, "startkey": id + ":", "endkey": id + ":\ufff0"}
+	if err := s.auditDB().AllDocsContext(ctx, &result, opts); err != nil {
+		if couchdb.NotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	records := make([]auditRecord, len(result.Rows))
+	for i, row := range result.Rows {
+		records[i] = row.Doc
+	}
+	return records, nil
+}
+
+// Revisions reads revs_info. CouchDB keeps the revision IDs of compacted
+// revisions, which it reports as missing. The tombstone of a deleted
+// visitor is looked up with _all_docs, which lists it for keys.
+func (s *couchStore) Revisions(ctx context.Context, id string) ([]revisionInfo, error) {
+	var doc struct {
+		RevsInfo []revisionInfo `json:"_revs_info"`
+	}
+	err := s.db().GetContext(ctx, id, &doc, couchdb.Options{"revs_info": true})
+	if couchdb.NotFound(err) {
+		var rev string
+		if rev, err = s.tombstone(ctx, id); err == nil {
+			err = s.db().GetContext(ctx, id, &doc, couchdb.Options{"rev": rev, "revs_info": true})
+		}
+	}
+	if err != nil {
+		return nil, couchError(err)
+	}
+	return doc.RevsInfo, nil
+}
+
+// tombstone returns the revision that deleted a visitor.
+func (s *couchStore) tombstone(ctx context.Context, id string) (string, error) {
+	var result struct {
+		Rows []struct {
+			Value struct {
+				Rev     string `json:"rev"`
+				Deleted bool   `json:"deleted"`
+			} `json:"value"`
+		} `json:"rows"`
+	}
+	//go-couchdb sends strings as they are, so keys is encoded here.
+	keys, _ := json.Marshal([]string{id})
+	if err := s.db().AllDocsContext(ctx, &result, couchdb.Options{"keys": string(keys)}); err != nil {
+		return "", err
+	}
+	if len(result.Rows) == 0 || !result.Rows[0].Value.Deleted {
+		return "", errStoreNotFound
+	}
+	return result.Rows[0].Value.Rev, nil
+}
+
+func (s *couchStore) GetRevision(ctx context.Context, id, rev string) (*visitorResource, error) {
+	var doc map[string]interface{}
+	if err := s.db().GetContext(ctx, id, &doc, couchdb.Options{"rev": rev}); err != nil {
+		return nil, couchError(err)
+	}
+	if deleted, _ := doc["_deleted"].(bool); deleted {
+		return nil, errStoreNotFound
+	}
+	v := visitorFromDoc(doc)
+	return &v, nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errBreakerOpen is returned without a request while the circuit
+// breaker considers the database to be down.
+var errBreakerOpen = errors.New("couchdb: circuit breaker is open")
+
+// transportConfig holds the settings of the CouchDB HTTP transport read
+// from the environment.
+type transportConfig struct {
+	ConnectTimeout  time.Duration // dialing and TLS handshake
+	ResponseTimeout time.Duration // until the response headers arrive
+	MaxIdleConns    int
+	MaxConns        int // per host, 0 for no limit
+	Retries         int // after the first attempt
+	MaxRetryWait    time.Duration
+	BreakerFailures int // consecutive failures that open the breaker
+	BreakerCooldown time.Duration
+
+	//A private CA and a client certificate, as files or as PEM from the
+	//service binding. Files take precedence.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	CAPEM    []byte
+	CertPEM  []byte
+	KeyPEM   []byte
+}
+
+func transportConfigFromEnv() transportConfig {
+	cfg := transportConfig{
+		ConnectTimeout:  5 * time.Second,
+		ResponseTimeout: 30 * time.Second,
+		MaxIdleConns:    32,
+		MaxConns:        64,
+		Retries:         3,
+		MaxRetryWait:    10 * time.Second,
+		BreakerFailures: 5,
+		BreakerCooldown: 30 * time.Second,
+		CAFile:          os.Getenv("COUCHDB_CA_FILE"),
+		CertFile:        os.Getenv("COUCHDB_CERT_FILE"),
+		KeyFile:         os.Getenv("COUCHDB_KEY_FILE"),
+	}
+	for name, d := range map[string]*time.Duration{
+		"COUCHDB_CONNECT_TIMEOUT":  &cfg.ConnectTimeout,
+		"COUCHDB_RESPONSE_TIMEOUT": &cfg.ResponseTimeout,
+		"COUCHDB_MAX_RETRY_WAIT":   &cfg.MaxRetryWait,
+		"COUCHDB_BREAKER_COOLDOWN": &cfg.BreakerCooldown,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				log.Printf("ignoring invalid %s %q", name, v)
+			} else {
+				*d = parsed
+			}
+		}
+	}
+	for name, n := range map[string]*int{
+		"COUCHDB_MAX_IDLE_CONNS":   &cfg.MaxIdleConns,
+		"COUCHDB_MAX_CONNS":        &cfg.MaxConns,
+		"COUCHDB_RETRIES":          &cfg.Retries,
+		"COUCHDB_BREAKER_FAILURES": &cfg.BreakerFailures,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				log.Printf("ignoring invalid %s %q", name, v)
+			} else {
+				*n = parsed
+			}
+		}
+	}
+	return cfg
+}
+
+// useCredentials takes the CA bundle and client certificate from the
+// credentials of a Cloudant or CouchDB service binding. Values may be PEM
+// or base64 encoded PEM.
+func (cfg *transportConfig) useCredentials(creds map[string]interface{}) {
+	cfg.CAPEM = pemCredential(creds["ca_certificate"])
+	if cfg.CAPEM == nil {
+		cfg.CAPEM = pemCredential(creds["ca_certificate_base64"])
+	}
+	cfg.CertPEM = pemCredential(creds["client_certificate"])
+	cfg.KeyPEM = pemCredential(creds["client_key"])
+}
+
+// tlsConfig returns the TLS settings for CouchDB, or nil to use the
+// system roots without a client certificate.
+func (cfg transportConfig) tlsConfig() (*tls.Config, error) {
+	var tc tls.Config
+	if cfg.CAFile != "" || cfg.CAPEM != nil {
+		pool, err := loadCertPool(cfg.CAFile, cfg.CAPEM)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	switch {
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	case cfg.CertPEM != nil || cfg.KeyPEM != nil:
+		cert, err := tls.X509KeyPair(cfg.CertPEM, cfg.KeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate of the service binding: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if tc.RootCAs == nil && tc.Certificates == nil {
+		return nil, nil
+	}
+	tc.MinVersion = tls.VersionTLS12
+	return &tc, nil
+}
+
+// States of the circuit breaker.
+const (
+	breakerClosed   = "closed"    // requests pass
+	breakerOpen     = "open"      // requests fail with errBreakerOpen
+	breakerHalfOpen = "half_open" // one request probes the database
+)
+
+// couchTransport is the http.RoundTripper of the CouchDB client. It
+// retries throttled and failed requests and stops sending requests
+// while the database is down.
+type couchTransport struct {
+	cfg  transportConfig
+	base http.RoundTripper
+
+	mu       sync.Mutex
+	state    string
+	failures int       // consecutive, while closed
+	openedAt time.Time // while open
+	probing  bool      // a half-open probe is in flight
+
+	requests int64
+	retries  int64
+	rejected int64
+}
+
+func newCouchTransport(cfg transportConfig) (*couchTransport, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	return &couchTransport{
+		cfg: cfg,
+		base: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   cfg.ConnectTimeout,
+			ResponseHeaderTimeout: cfg.ResponseTimeout,
+			MaxIdleConns:          cfg.MaxIdleConns,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConns,
+			MaxConnsPerHost:       cfg.MaxConns,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		state: breakerClosed,
+	}, nil
+}
+
+// RoundTrip sends req, retrying up to Retries times with jittered
+// exponential backoff. Network errors and 5xx responses are retried for
+// idempotent methods only. 429 is retried for every method, since
+// Cloudant rejects throttled requests before processing them. The
+// response timeout only covers the headers, so that changes feeds can
+// stream as long as they like.
+func (t *couchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.allow() {
+		atomic.AddInt64(&t.rejected, 1)
+		return nil, errBreakerOpen
+	}
+	atomic.AddInt64(&t.requests, 1)
+	var resp *http.Response
+	var err error
+	retried := 0
+	for attempt := 0; ; attempt++ {
+		resp, err = t.base.RoundTrip(req)
+		if attempt == t.cfg.Retries || !t.retryable(req, resp, err) {
+			break
+		}
+		wait := t.backoff(attempt, resp)
+		if wait < 0 {
+			break
+		}
+		next, rerr := rewind(req)
+		if rerr != nil {
+			break
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			t.abandon()
+			return nil, req.Context().Err()
+		}
+		atomic.AddInt64(&t.retries, 1)
+		retried++
+		req = next
+	}
+	if retried > 0 {
+		spanFromContext(req.Context()).SetAttr("http.request.resend_count", retried)
+	}
+	if err != nil && req.Context().Err() != nil {
+		t.abandon()
+	} else {
+		t.record(err == nil && resp.StatusCode < 500)
+	}
+	return resp, err
+}
+
+func (t *couchTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if !idempotentMethod(req.Method) {
+		return false
+	}
+	return err != nil || resp.StatusCode >= 500
+}
+
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before the retry after attempt, or -1 if the
+// server asks to wait longer than MaxRetryWait.
+func (t *couchTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if d > t.cfg.MaxRetryWait {
+				return -1
+			}
+			return d
+		}
+	}
+	d := 100 * time.Millisecond << uint(attempt)
+	if d > t.cfg.MaxRetryWait {
+		d = t.cfg.MaxRetryWait
+	}
+	// Full jitter spreads out the instances that were throttled together.
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP
+// date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		d := time.Until(at)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// rewind returns a copy of req with a fresh body for another attempt.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("couchdb: request body cannot be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	next := req.Clone(req.Context())
+	next.Body = body
+	return next, nil
+}
+
+// allow reports whether a request may be sent. After the cooldown, one
+// request at a time probes whether the database is back.
+func (t *couchTransport) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case breakerOpen:
+		if time.Since(t.openedAt) < t.cfg.BreakerCooldown {
+			return false
+		}
+		t.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if t.probing {
+			return false
+		}
+		t.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a request.
+func (t *couchTransport) record(ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == breakerHalfOpen {
+		t.probing = false
+	}
+	if ok {
+		if t.state != breakerClosed {
+			log.Println("CouchDB is reachable again, closing the circuit breaker")
+		}
+		t.state, t.failures = breakerClosed, 0
+		return
+	}
+	t.failures++
+	if t.state == breakerHalfOpen || (t.cfg.BreakerFailures > 0 && t.failures >= t.cfg.BreakerFailures) {
+		if t.state == breakerClosed {
+			log.Printf("CouchDB failed %d times in a row, opening the circuit breaker for %s", t.failures, t.cfg.BreakerCooldown)
+		}
+		t.state, t.openedAt = breakerOpen, time.Now()
+	}
+}
+
+// abandon ends a request that was canceled by the caller, which says
+// nothing about the database.
+func (t *couchTransport) abandon() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == breakerHalfOpen {
+		t.probing = false
+	}
+}
+
+// readiness implements readinessSource. The database is not ready while
+// the breaker is open.
+func (t *couchTransport) readiness() (string, bool, interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := map[string]interface{}{"breaker": t.state, "failures": t.failures}
+	if t.state == breakerOpen {
+		retry := t.cfg.BreakerCooldown - time.Since(t.openedAt)
+		if retry < 0 {
+			retry = 0
+		}
+		status["retry_in_seconds"] = int(retry.Seconds() + 0.5)
+	}
+	return "couchdb", t.state != breakerOpen, status
+}
+
+// writeMetrics implements metricsSource.
+func (t *couchTransport) writeMetrics(w io.Writer) {
+	t.mu.Lock()
+	var open int64
+	if t.state != breakerClosed {
+		open = 1
+	}
+	t.mu.Unlock()
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"couchdb_requests_total", "counter", "Requests sent to CouchDB, not counting retries.", atomic.LoadInt64(&t.requests)},
+		{"couchdb_retries_total", "counter", "Retries of throttled or failed CouchDB requests.", atomic.LoadInt64(&t.retries)},
+		{"couchdb_breaker_rejected_total", "counter", "Requests failed by the open circuit breaker.", atomic.LoadInt64(&t.rejected)},
+		{"couchdb_breaker_open", "gauge", "1 while the circuit breaker is open or half open.", open},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedServer answers with the next of statuses, repeating the last
+// one, and records the bodies it received.
+type scriptedServer struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	bodies   []string
+}
+
+func (s *scriptedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	status := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	s.bodies = append(s.bodies, string(body))
+	s.mu.Unlock()
+	for name, values := range s.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+}
+
+func (s *scriptedServer) script(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses, s.bodies = statuses, nil
+}
+
+func (s *scriptedServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func newTestTransport(t *testing.T, cfg transportConfig) (*couchTransport, *scriptedServer, string) {
+	t.Helper()
+	srv := &scriptedServer{statuses: []int{http.StatusOK}, header: make(http.Header)}
+	hs := httptest.NewServer(srv)
+	t.Cleanup(hs.Close)
+	tr, err := newCouchTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, srv, hs.URL
+}
+
+func roundTrip(t *testing.T, tr http.RoundTripper, method, url, body string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestTransportRetries(t *testing.T) {
+	tr, srv, url := newTestTransport(t, transportConfig{Retries: 3, MaxRetryWait: 5 * time.Millisecond})
+
+	tests := []struct {
+		method   string
+		statuses []int
+		status   int
+		attempts int
+	}{
+		//Throttled requests are retried for every method.
+		{"POST", []int{429, 429, 201}, 201, 3},
+		{"GET", []int{503, 502, 200}, 200, 3},
+		//Writes that may have been processed are not.
+		{"POST", []int{503, 201}, 503, 1},
+		{"PUT", []int{500, 201}, 201, 2},
+		{"GET", []int{503}, 503, 4},
+		{"GET", []int{404, 200}, 404, 1},
+	}
+	for _, tt := range tests {
+		srv.script(tt.statuses...)
+		resp, err := roundTrip(t, tr, tt.method, url+"/db", `{"name": "Bob"}`)
+		if err != nil {
+			t.Fatalf("%s %v: %v", tt.method, tt.statuses, err)
+		}
+		if resp.StatusCode != tt.status || srv.attempts() != tt.attempts {
+			t.Errorf("%s %v: status %d after %d attempts, want %d after %d", tt.method, tt.statuses, resp.StatusCode, srv.attempts(), tt.status, tt.attempts)
+		}
+		for _, body := range srv.bodies {
+			if body != `{"name": "Bob"}` {
+				t.Errorf("%s %v: attempt sent body %q", tt.method, tt.statuses, body)
+			}
+		}
+	}
+}
+
+func TestTransportRetryAfter(t *testing.T) {
+	tr, srv, url := newTestTransport(t, transportConfig{Retries: 3, MaxRetryWait: 2 * time.Second})
+
+	srv.header.Set("Retry-After", "1")
+	srv.script(429, 200)
+	start := time.Now()
+	resp, err := roundTrip(t, tr, "GET", url+"/db", "")
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("GET = %v, %v", resp, err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %v, want Retry-After: 1", d)
+	}
+
+	//A server that asks for more than MaxRetryWait is not retried.
+	srv.header.Set("Retry-After", "60")
+	srv.script(429, 200)
+	if resp, err := roundTrip(t, tr, "GET", url+"/db", ""); err != nil || resp.StatusCode != 429 || srv.attempts() != 1 {
+		t.Errorf("GET with Retry-After: 60 = %v, %v after %d attempts", resp, err, srv.attempts())
+	}
+}
+
+func TestTransportBreaker(t *testing.T) {
+	tr, srv, url := newTestTransport(t, transportConfig{BreakerFailures: 2, BreakerCooldown: 50 * time.Millisecond})
+
+	srv.script(500)
+	roundTrip(t, tr, "GET", url+"/db", "")
+	if _, ready, _ := tr.readiness(); !ready || tr.state != breakerClosed {
+		t.Fatalf("state %s after one failure, want closed", tr.state)
+	}
+	roundTrip(t, tr, "GET", url+"/db", "")
+	if _, ready, _ := tr.readiness(); ready || tr.state != breakerOpen {
+		t.Fatalf("state %s after two failures, want open", tr.state)
+	}
+
+	//While open, requests fail without reaching the database.
+	if _, err := roundTrip(t, tr, "GET", url+"/db", ""); !errors.Is(err, errBreakerOpen) || srv.attempts() != 2 {
+		t.Errorf("request to an open breaker: %v after %d attempts", err, srv.attempts())
+	}
+
+	//After the cooldown one probe is let through, and fails.
+	time.Sleep(60 * time.Millisecond)
+	if resp, err := roundTrip(t, tr, "GET", url+"/db", ""); err != nil || resp.StatusCode != 500 || tr.state != breakerOpen {
+		t.Errorf("failed probe: %v, %v, state %s; want 500 and open", resp, err, tr.state)
+	}
+	if _, err := roundTrip(t, tr, "GET", url+"/db", ""); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("request after a failed probe: %v, want errBreakerOpen", err)
+	}
+
+	//Only one probe is in flight at a time.
+	time.Sleep(60 * time.Millisecond)
+	if !tr.allow() || tr.state != breakerHalfOpen {
+		t.Fatalf("state %s after the cooldown, want half_open", tr.state)
+	}
+	if tr.allow() {
+		t.Error("a second probe was let through")
+	}
+	tr.abandon()
+
+	srv.script(200)
+	if resp, err := roundTrip(t, tr, "GET", url+"/db", ""); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("probe = %v, %v", resp, err)
+	}
+	if _, ready, _ := tr.readiness(); !ready || tr.state != breakerClosed || tr.failures != 0 {
+		t.Errorf("state %s with %d failures after a successful probe, want closed", tr.state, tr.failures)
+	}
+}
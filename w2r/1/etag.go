@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// revETag returns the strong ETag of a visitor at revision rev.
+func revETag(rev string) string {
+	return `"` + rev + `"`
+}
+
+// listETag returns the strong ETag of a list response. It changes with
+// the update sequence of the store and differs for everything else that
+// shapes the response: the API version, the query, the Accept header and
+// the tenant.
+func listETag(c *gin.Context, v *apiVersion, seq string) string {
+	h := sha256.New()
+	var tenant string
+	if t, ok := c.Get("tenant"); ok {
+		tenant = t.(*Tenant).Name
+	}
+	for _, s := range []string{seq, v.Name, c.Request.URL.RawQuery, c.Request.Header.Get("Accept"), tenant} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// strongETagMatches reports whether an If-Match header matches etag,
+// using the strong comparison required for writes: weak ETags never
+// match.
+func strongETagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag of a GET response and answers 304 Not
+// Modified if it matches If-None-Match. It reports whether it did.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	if etagMatches(c.Request.Header.Get("If-None-Match"), etag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return true
+	}
+	return false
+}
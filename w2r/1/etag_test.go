@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// send makes a request to the test app and returns the response with
+// its body closed.
+func send(t *testing.T, method, url, body string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	hs := newTestApp(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+
+	created := send(t, "POST", hs.URL+"/api/v1/visitors", `{"name": "Bob"}`)
+	url := hs.URL + created.Header.Get("Location")
+	etag := created.Header.Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("created visitor has ETag %q, want a strong one", etag)
+	}
+	if resp := send(t, "GET", url, "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Errorf("GET with the current ETag: %d, ETag %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp := send(t, "GET", url, "", "If-None-Match", `"other", W/`+etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with a weak ETag in a list: %d, want 304", resp.StatusCode)
+	}
+	if resp := send(t, "GET", url, "", "If-None-Match", `"other"`); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET with another ETag: %d, want 200", resp.StatusCode)
+	}
+
+	list := send(t, "GET", hs.URL+"/api/v1/visitors", "")
+	listETag := list.Header.Get("ETag")
+	if resp := send(t, "GET", hs.URL+"/api/v1/visitors", "", "If-None-Match", listETag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("list with the current ETag: %d, want 304", resp.StatusCode)
+	}
+	send(t, "POST", hs.URL+"/api/v1/visitors", `{"name": "Alice"}`)
+	if resp := send(t, "GET", hs.URL+"/api/v1/visitors", "", "If-None-Match", listETag); resp.StatusCode != http.StatusOK {
+		t.Errorf("list after a write with the old ETag: %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	hs := newTestApp(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+
+	created := send(t, "POST", hs.URL+"/api/v1/visitors", `{"name": "Bob"}`)
+	url := hs.URL + created.Header.Get("Location")
+	etag := created.Header.Get("ETag")
+
+	updated := send(t, "PUT", url, `{"name": "Alice"}`, "If-Match", etag)
+	if updated.StatusCode != http.StatusOK || updated.Header.Get("ETag") == etag {
+		t.Fatalf("PUT with the current ETag: %d, ETag %q", updated.StatusCode, updated.Header.Get("ETag"))
+	}
+	tests := []struct {
+		method, body, ifMatch string
+	}{
+		{"PUT", `{"name": "Carl"}`, etag},
+		{"PUT", `{"name": "Carl"}`, "W/" + updated.Header.Get("ETag")},
+		{"DELETE", "", etag},
+	}
+	for _, tt := range tests {
+		if resp := send(t, tt.method, url, tt.body, "If-Match", tt.ifMatch); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("%s with If-Match %s: %d, want 412", tt.method, tt.ifMatch, resp.StatusCode)
+		}
+	}
+	if resp := send(t, "DELETE", url, "", "If-Match", "*"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE with If-Match *: %d, want 204", resp.StatusCode)
+	}
+}
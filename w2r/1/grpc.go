@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/IBM-Cloud/get-started-go/visitorpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+)
+
+// grpcPortFromEnv returns the port of the gRPC server, or "" if GRPC_PORT
+// is "off".
+func grpcPortFromEnv() string {
+	port := envOr("GRPC_PORT", "50051")
+	if strings.ToLower(port) == "off" {
+		return ""
+	}
+	return port
+}
+
+// grpcVisitorServer implements visitorpb.VisitorServiceServer on top of
+// the visitorService that also backs the REST API.
+type grpcVisitorServer struct {
+	visitors *visitorService
+	store    VisitorStore    // store used without TENANT_MODE, nil without a database
+	tenants  *tenantRegistry // nil without TENANT_MODE
+}
+
+// serveGRPC serves the VisitorService, the health service and server
+// reflection on port, over TLS unless tlsConfig is nil. It only returns
+// if the listener fails.
+func serveGRPC(port string, srv *grpcVisitorServer, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	log.Printf("gRPC server listening on :%s", port)
+	return newGRPCServer(srv, tlsConfig).Serve(lis)
+}
+
+// newGRPCServer registers the VisitorService, the health service and
+// server reflection on a new gRPC server.
+func newGRPCServer(srv *grpcVisitorServer, tlsConfig *tls.Config) *grpc.Server {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	visitorpb.RegisterVisitorServiceServer(s, srv)
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthSrv.SetServingStatus("visitors.v1.VisitorService", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthSrv)
+	reflection.Register(s)
+	return s
+}
+
+// database returns the tenant and visitor store of a call. In tenant
+// mode the tenant name is read from the request metadata, whatever
+// TENANT_MODE selects for HTTP requests.
+func (s *grpcVisitorServer) database(ctx context.Context) (*Tenant, VisitorStore, error) {
+	if s.tenants == nil {
+		return nil, s.store, nil
+	}
+	//Metadata keys are lower case; TENANT_HEADER names the key.
+	var name string
+	key := strings.ToLower(s.tenants.cfg.Header)
+	if md, ok := metadata.FromContext(ctx); ok && len(md[key]) > 0 {
+		name = md[key][0]
+	}
+	t, store, err := s.tenants.Resolve(ctx, name)
+	switch {
+	case err == errTenantNotFound:
+		return nil, nil, grpc.Errorf(codes.NotFound, "unknown tenant")
+	case err == errTenantSuspended:
+		return nil, nil, grpc.Errorf(codes.PermissionDenied, "tenant suspended")
+	case err != nil:
+		log.Printf("tenant %s: %v", name, err)
+		return nil, nil, grpc.Errorf(codes.Unavailable, "unable to load tenant")
+	}
+	return t, store, nil
+}
+
+// grpcError converts an error of the visitor service to a gRPC status.
+func grpcError(err error) error {
+	e := asAPIError(err)
+	code := codes.Internal
+	switch e.Code {
+	case codeInvalidRequest:
+		code = codes.InvalidArgument
+	case codeNotFound:
+		code = codes.NotFound
+	case codeConflict:
+		code = codes.Aborted
+	case codePrecondition:
+		code = codes.FailedPrecondition
+	case codeQuotaExceeded:
+		code = codes.ResourceExhausted
+	case codeUnavailable:
+		code = codes.Unavailable
+	}
+	return grpc.Errorf(code, "%s", e.Message)
+}
+
+// grpcAuditContext adds the auditInfo of a call to ctx. Calls are not
+// authenticated, so the actor is always grpc; the x-request-id metadata
+// is taken as the request ID.
+func grpcAuditContext(ctx context.Context) context.Context {
+	info := auditInfo{Actor: "grpc"}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		info.SourceIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(info.SourceIP); err == nil {
+			info.SourceIP = host
+		}
+	}
+	if md, ok := metadata.FromContext(ctx); ok && len(md["x-request-id"]) > 0 {
+		info.RequestID = md["x-request-id"][0]
+	}
+	return withAuditInfo(ctx, info)
+}
+
+// pbVisitor escapes names like v1Visitor does.
+func pbVisitor(v *visitorResource) *visitorpb.Visitor {
+	return &visitorpb.Visitor{Id: v.ID, Name: html.EscapeString(v.Name), Locale: v.Locale, Greeting: html.EscapeString(v.Greeting)}
+}
+
+// Create greets and stores a visitor.
+func (s *grpcVisitorServer) Create(ctx context.Context, req *visitorpb.CreateVisitorRequest) (*visitorpb.Visitor, error) {
+	t, store, err := s.database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.visitors.Create(grpcAuditContext(ctx), store, t, req.Name, nil, req.Lang, "")
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return pbVisitor(v), nil
+}
+
+// Get returns a single visitor.
+func (s *grpcVisitorServer) Get(ctx context.Context, req *visitorpb.GetVisitorRequest) (*visitorpb.Visitor, error) {
+	_, store, err := s.database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.visitors.Get(ctx, store, req.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return pbVisitor(v), nil
+}
+
+// List streams all visitors, reading the store a page at a time.
+func (s *grpcVisitorServer) List(req *visitorpb.ListVisitorsRequest, stream visitorpb.VisitorService_ListServer) error {
+	ctx := stream.Context()
+	_, store, err := s.database(ctx)
+	if err != nil {
+		return err
+	}
+	perPage := int(req.PageSize)
+	if perPage <= 0 || perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	for after := ""; ; {
+		if err := ctx.Err(); err != nil {
+			return grpc.Errorf(codes.Canceled, "%v", err)
+		}
+		visitors, next, err := s.visitors.Scan(ctx, store, after, perPage)
+		if err != nil {
+			return grpcError(err)
+		}
+		for i := range visitors {
+			if err := stream.Send(pbVisitor(&visitors[i])); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		after = next
+	}
+}
+
+// Watch streams changes to visitors from the store until the client
+// cancels the call.
+func (s *grpcVisitorServer) Watch(req *visitorpb.WatchVisitorsRequest, stream visitorpb.VisitorService_WatchServer) error {
+	ctx := stream.Context()
+	_, store, err := s.database(ctx)
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return grpcError(errNoDatabase)
+	}
+	since := req.Since
+	if since == "" {
+		since = "now"
+	}
+	var sendErr error
+	err = store.Watch(ctx, since, func(change visitorChange) error {
+		event := &visitorpb.VisitorEvent{Seq: change.Seq, Visitor: pbVisitor(&change.Visitor)}
+		if change.Deleted {
+			event.Type = visitorpb.VisitorEvent_DELETED
+		}
+		sendErr = stream.Send(event)
+		return sendErr
+	})
+	switch {
+	case sendErr != nil:
+		return sendErr
+	case ctx.Err() != nil:
+		return grpc.Errorf(codes.Canceled, "%v", ctx.Err())
+	case err != nil:
+		return grpcError(internalError(err, "changes feed failed"))
+	}
+	return nil
+}
+
+// seqString formats an update sequence, which is a number in CouchDB 1.x
+// and an opaque string in CouchDB 2.
+func seqString(seq interface{}) string {
+	switch seq := seq.(type) {
+	case string:
+		return seq
+	case float64:
+		return strconv.FormatFloat(seq, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(seq)
+}
+
+// startGRPC starts the gRPC server in the background unless GRPC_PORT
+// is "off".
+func startGRPC(srv *grpcVisitorServer, tlsConfig *tls.Config) {
+	port := grpcPortFromEnv()
+	if port == "" {
+		return
+	}
+	go func() {
+		if err := serveGRPC(port, srv, tlsConfig); err != nil {
+			log.Fatalln("gRPC server:", err)
+		}
+	}()
+}
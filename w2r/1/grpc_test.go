@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/IBM-Cloud/get-started-go/visitorpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// newTestGRPCClient serves the VisitorService for store on a loopback
+// port until the test ends. The vendored grpc has no bufconn package.
+func newTestGRPCClient(t *testing.T, store VisitorStore) visitorpb.VisitorServiceClient {
+	t.Helper()
+	messages, err := loadCatalogs(embedded, "locales", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGRPCServer(&grpcVisitorServer{visitors: &visitorService{messages: messages}, store: store}, nil)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return visitorpb.NewVisitorServiceClient(conn)
+}
+
+func TestGRPCCreateAndList(t *testing.T) {
+	ctx := context.Background()
+	c := newTestGRPCClient(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+
+	created := make(map[string]*visitorpb.Visitor)
+	for _, req := range []*visitorpb.CreateVisitorRequest{
+		{Name: "Anna", Lang: "de"},
+		{Name: "Bob"},
+		{Name: "Chloé", Lang: "fr"},
+	} {
+		v, err := c.Create(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Id == "" || v.Name != req.Name || v.Greeting == "" || (req.Lang != "" && v.Locale != req.Lang) {
+			t.Fatalf("Create(%v) = %v", req, v)
+		}
+		created[v.Id] = v
+	}
+
+	//A page size below the number of visitors makes List read several pages.
+	stream, err := c.List(ctx, &visitorpb.ListVisitorsRequest{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := 0
+	for {
+		v, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := created[v.Id]
+		if !ok || v.Name != want.Name || v.Locale != want.Locale || v.Greeting != "" {
+			t.Errorf("listed %v, want %v", v, want)
+		}
+		delete(created, v.Id)
+		listed++
+	}
+	if listed != 3 || len(created) != 0 {
+		t.Errorf("listed %d visitors, missing %v", listed, created)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newTestGRPCClient(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+
+	if _, err := c.Create(ctx, &visitorpb.CreateVisitorRequest{}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Create without a name: %v, want InvalidArgument", err)
+	}
+	if _, err := c.Get(ctx, &visitorpb.GetVisitorRequest{Id: "missing"}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("Get of an unknown visitor: %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessSource is a dependency that decides whether the app can serve
+// requests.
+type readinessSource interface {
+	// readiness returns the name of the dependency, whether it is ready
+	// and details for the response.
+	readiness() (name string, ready bool, status interface{})
+}
+
+/**
+ * GET /readyz
+ * Reports whether the app can serve requests, with the status of every
+ * dependency. Responds 503 while one is not ready, so that load balancers
+ * and Kubernetes stop routing requests to the instance.
+ */
+func readinessHandler(sources ...readinessSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ready := true
+		checks := gin.H{}
+		for _, s := range sources {
+			name, ok, status := s.readiness()
+			checks[name] = gin.H{"ready": ok, "status": status}
+			ready = ready && ok
+		}
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(status, gin.H{"ready": ready, "checks": checks})
+	}
+}
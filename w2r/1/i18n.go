@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Plural categories, as defined by the Unicode CLDR.
+const (
+	pluralZero  = "zero"
+	pluralOne   = "one"
+	pluralTwo   = "two"
+	pluralFew   = "few"
+	pluralMany  = "many"
+	pluralOther = "other"
+)
+
+// pluralRules maps base languages to their CLDR cardinal plural rule.
+// Languages that are not listed only use "other".
+var pluralRules = map[string]func(n int) string{
+	"en": pluralOneOther,
+	"de": pluralOneOther,
+	"es": pluralOneOther,
+	"it": pluralOneOther,
+	"nl": pluralOneOther,
+	"pt": pluralOneOther,
+	"fr": func(n int) string {
+		if n == 0 || n == 1 {
+			return pluralOne
+		}
+		return pluralOther
+	},
+	"ru": pluralSlavic,
+	"uk": pluralSlavic,
+	"pl": func(n int) string {
+		switch {
+		case n == 1:
+			return pluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return pluralFew
+		default:
+			return pluralMany
+		}
+	},
+	"ar": func(n int) string {
+		switch {
+		case n == 0:
+			return pluralZero
+		case n == 1:
+			return pluralOne
+		case n == 2:
+			return pluralTwo
+		case n%100 >= 3 && n%100 <= 10:
+			return pluralFew
+		case n%100 >= 11:
+			return pluralMany
+		default:
+			return pluralOther
+		}
+	},
+}
+
+func pluralOneOther(n int) string {
+	if n == 1 {
+		return pluralOne
+	}
+	return pluralOther
+}
+
+func pluralSlavic(n int) string {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return pluralOne
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return pluralFew
+	default:
+		return pluralMany
+	}
+}
+
+// catalog holds the messages of one language. Every message is a
+// text/template; plural messages have one template per plural category.
+// Messages missing from the catalog are taken from its fallback, the
+// catalog of the default language.
+type catalog struct {
+	lang     string
+	plural   func(n int) string
+	msgs     map[string]map[string]*template.Template
+	fallback *catalog
+}
+
+// lookup returns the catalog that defines message key and its forms.
+func (cat *catalog) lookup(key string) (*catalog, map[string]*template.Template, error) {
+	for c := cat; c != nil; c = c.fallback {
+		if forms, ok := c.msgs[key]; ok {
+			return c, forms, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("i18n: %s: no message %q", cat.lang, key)
+}
+
+// T renders the message key with data.
+func (cat *catalog) T(key string, data interface{}) (string, error) {
+	_, forms, err := cat.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	tmpl, ok := forms[""]
+	if !ok {
+		tmpl = forms[pluralOther]
+	}
+	return execTemplate(tmpl, data)
+}
+
+// N renders the plural form of message key that matches n.
+// The template data is {"Count": n}. A message taken from the fallback
+// catalog uses the plural rule of its language.
+func (cat *catalog) N(key string, n int) (string, error) {
+	owner, forms, err := cat.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	tmpl, ok := forms[owner.plural(n)]
+	if !ok {
+		if tmpl, ok = forms[pluralOther]; !ok {
+			tmpl = forms[""]
+		}
+	}
+	return execTemplate(tmpl, map[string]interface{}{"Count": n})
+}
+
+func execTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// i18nBundle is the set of message catalogs loaded at startup.
+type i18nBundle struct {
+	def      string
+	catalogs map[string]*catalog
+}
+
+// loadCatalogs reads one JSON catalog per language from dir of fsys. Files
+// are named after their language tag, for example "en.json" or "pt-BR.json".
+// Each message is either a template string or an object mapping plural
+// categories to template strings:
+//
+//	{
+//	  "greeting": "Hello {{.Name}}",
+//	  "visitors": {"one": "{{.Count}} visitor", "other": "{{.Count}} visitors"}
+//	}
+//
+// Templates can use {{plural "visitors" .Count}} to render another message in
+// the matching plural form.
+func loadCatalogs(fsys fs.FS, dir, def string) (*i18nBundle, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	b := &i18nBundle{def: normalizeLang(def), catalogs: make(map[string]*catalog)}
+	for _, file := range files {
+		lang := normalizeLang(strings.TrimSuffix(path.Base(file), ".json"))
+		cat, err := loadCatalog(fsys, file, lang)
+		if err != nil {
+			return nil, err
+		}
+		b.catalogs[lang] = cat
+	}
+	fallback, ok := b.catalogs[b.def]
+	if !ok {
+		return nil, fmt.Errorf("i18n: no catalog for default language %q in %s", b.def, dir)
+	}
+	for lang, cat := range b.catalogs {
+		if lang != b.def {
+			cat.fallback = fallback
+		}
+	}
+	return b, nil
+}
+
+func loadCatalog(fsys fs.FS, file, lang string) (*catalog, error) {
+	data, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("i18n: %s: %v", file, err)
+	}
+	cat := &catalog{lang: lang, msgs: make(map[string]map[string]*template.Template)}
+	cat.plural = pluralRules[baseLang(lang)]
+	if cat.plural == nil {
+		cat.plural = func(int) string { return pluralOther }
+	}
+	funcs := template.FuncMap{
+		"plural": func(key string, n int) (string, error) { return cat.N(key, n) },
+	}
+	for key, value := range raw {
+		forms := make(map[string]string)
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			forms[""] = text
+		} else if err := json.Unmarshal(value, &forms); err != nil {
+			return nil, fmt.Errorf("i18n: %s: message %q must be a string or an object of plural forms", file, key)
+		}
+		cat.msgs[key] = make(map[string]*template.Template, len(forms))
+		for form, text := range forms {
+			tmpl, err := template.New(key).Funcs(funcs).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("i18n: %s: message %q: %v", file, key, err)
+			}
+			cat.msgs[key][form] = tmpl
+		}
+	}
+	return cat, nil
+}
+
+// Languages returns the tags of all loaded catalogs.
+func (b *i18nBundle) Languages() []string {
+	langs := make([]string, 0, len(b.catalogs))
+	for lang := range b.catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Catalog returns the catalog for lang, which must be a negotiated tag.
+func (b *i18nBundle) Catalog(lang string) *catalog {
+	if cat, ok := b.catalogs[lang]; ok {
+		return cat
+	}
+	return b.catalogs[b.def]
+}
+
+// Negotiate picks the catalog language for a request. An explicit language
+// wins if a catalog matches it; otherwise the Accept-Language header is
+// consulted in order of preference, falling back to the default language.
+func (b *i18nBundle) Negotiate(explicit, acceptLanguage string) string {
+	if explicit != "" {
+		if lang, ok := b.match(explicit); ok {
+			return lang
+		}
+	}
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if tag == "*" {
+			return b.def
+		}
+		if lang, ok := b.match(tag); ok {
+			return lang
+		}
+	}
+	return b.def
+}
+
+// match finds the catalog for tag, trying the exact tag first and then
+// its base language.
+func (b *i18nBundle) match(tag string) (string, bool) {
+	tag = normalizeLang(tag)
+	if _, ok := b.catalogs[tag]; ok {
+		return tag, true
+	}
+	if _, ok := b.catalogs[baseLang(tag)]; ok {
+		return baseLang(tag), true
+	}
+	return "", false
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language
+// header ordered by descending quality. Tags with q=0 are dropped.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
+
+// normalizeLang canonicalizes the case of a language tag, e.g. "pt_br" -> "pt-BR".
+func normalizeLang(tag string) string {
+	parts := strings.Split(strings.Replace(tag, "_", "-", -1), "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		} else {
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func baseLang(tag string) string {
+	if i := strings.IndexByte(tag, '-'); i > 0 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// i18nConfigFromEnv returns the catalogs and the default language.
+// The embedded catalogs are used unless LOCALES_DIR names a directory.
+func i18nConfigFromEnv() (fsys fs.FS, dir, def string) {
+	fsys, dir, def = embedded, "locales", os.Getenv("DEFAULT_LOCALE")
+	if d := os.Getenv("LOCALES_DIR"); d != "" {
+		fsys, dir = os.DirFS(d), "."
+	}
+	if def == "" {
+		def = "en"
+	}
+	return fsys, dir, def
+}
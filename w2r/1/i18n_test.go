@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPluralRules(t *testing.T) {
+	tests := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"en", 0, pluralOther},
+		{"en", 1, pluralOne},
+		{"en", 2, pluralOther},
+		{"fr", 0, pluralOne},
+		{"fr", 1, pluralOne},
+		{"fr", 2, pluralOther},
+		{"ru", 1, pluralOne},
+		{"ru", 3, pluralFew},
+		{"ru", 5, pluralMany},
+		{"ru", 11, pluralMany},
+		{"ru", 12, pluralMany},
+		{"ru", 21, pluralOne},
+		{"ru", 22, pluralFew},
+		{"pl", 1, pluralOne},
+		{"pl", 21, pluralMany},
+		{"pl", 22, pluralFew},
+		{"ar", 0, pluralZero},
+		{"ar", 2, pluralTwo},
+		{"ar", 103, pluralFew},
+		{"ar", 111, pluralMany},
+		{"ar", 100, pluralOther},
+	}
+	for _, tt := range tests {
+		if got := pluralRules[tt.lang](tt.n); got != tt.want {
+			t.Errorf("%s plural of %d = %s, want %s", tt.lang, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogPlural(t *testing.T) {
+	b, err := loadCatalogs(embedded, "locales", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"en", 1, "1 visitor"},
+		{"en", 0, "0 visitors"},
+		{"ru", 1, "1 посетитель"},
+		{"ru", 2, "2 посетителя"},
+		{"ru", 5, "5 посетителей"},
+		{"ru", 21, "21 посетитель"},
+	}
+	for _, tt := range tests {
+		got, err := b.Catalog(tt.lang).N("visitors", tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: visitors(%d) = %q, want %q", tt.lang, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogFallback(t *testing.T) {
+	fsys := fstest.MapFS{
+		"locales/en.json": {Data: []byte(`{"greeting": "Hello {{.Name}}", "visitors": {"one": "{{.Count}} visitor", "other": "{{.Count}} visitors"}}`)},
+		"locales/de.json": {Data: []byte(`{"greeting": "Hallo {{.Name}}"}`)},
+	}
+	b, err := loadCatalogs(fsys, "locales", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	de := b.Catalog("de")
+	if got, err := de.T("greeting", Visitor{Name: "Bob"}); err != nil || got != "Hallo Bob" {
+		t.Errorf("T(greeting) = %q, %v", got, err)
+	}
+	if got, err := de.N("visitors", 1); err != nil || got != "1 visitor" {
+		t.Errorf("N(visitors) missing from de = %q, %v, want the en message", got, err)
+	}
+	if _, err := de.T("missing", nil); err == nil {
+		t.Error("T of a message missing from every catalog succeeded")
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"fr;q=0.5, de, en;q=0.8", []string{"de", "en", "fr"}},
+		{"de;q=0, en", []string{"en"}},
+		{"es;q=bad, fr;q=0.9", []string{"es", "fr"}},
+		{" ru ; q=0.3 ,, *;q=0.1", []string{"ru", "*"}},
+	}
+	for _, tt := range tests {
+		if got := parseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAcceptLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	b, err := loadCatalogs(embedded, "locales", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		explicit, accept, want string
+	}{
+		{"", "", "en"},
+		{"fr", "de", "fr"},
+		{"xx", "de", "de"},
+		{"", "it;q=0.9, ru;q=0.5, de;q=0.7", "de"},
+		{"", "de-AT", "de"},
+		{"", "pt-BR, *;q=0.5, fr;q=0.1", "en"},
+		{"", "de;q=0, fr", "fr"},
+	}
+	for _, tt := range tests {
+		if got := b.Negotiate(tt.explicit, tt.accept); got != tt.want {
+			t.Errorf("Negotiate(%q, %q) = %q, want %q", tt.explicit, tt.accept, got, tt.want)
+		}
+	}
+}
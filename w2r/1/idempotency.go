@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyKeyTTLFromEnv returns how long the responses of requests
+// with an Idempotency-Key are kept for replay, IDEMPOTENCY_KEY_TTL.
+func idempotencyKeyTTLFromEnv() time.Duration {
+	d := 24 * time.Hour
+	if v := os.Getenv("IDEMPOTENCY_KEY_TTL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			log.Printf("ignoring invalid IDEMPOTENCY_KEY_TTL %q", v)
+		} else {
+			d = parsed
+		}
+	}
+	return d
+}
+
+// idempotencyLockTTL is how long a key stays reserved by a request that
+// has not finished, for instance because the instance died.
+const idempotencyLockTTL = time.Minute
+
+// maxIdempotentBody limits the request bodies that are hashed.
+const maxIdempotentBody = 1 << 20
+
+// replayedHeaders are the response headers stored with a key. The others
+// are set again by the middleware of the replay.
+var replayedHeaders = []string{"Content-Type", "Content-Language", "Location", "ETag", "Set-Cookie"}
+
+// idempotencyRecord is a stored Idempotency-Key. While Pending, its
+// request is running; afterwards it holds the response.
+type idempotencyRecord struct {
+	Key         string      `json:"key"`
+	RequestHash string      `json:"request_hash"` // operation, API version, content type and body
+	Pending     bool        `json:"pending"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	Expires     time.Time   `json:"expires"`
+
+	rev string // of the CouchDB document
+}
+
+// expired reports whether the record can be replaced.
+func (r *idempotencyRecord) expired() bool {
+	return !time.Now().Before(r.Expires)
+}
+
+// validIdempotencyKey accepts up to 255 printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if len(key) > 255 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Operations that take an Idempotency-Key. The request hash covers the
+// operation and the API version rather than the path, so that a key sent
+// with and without the tenant prefix identifies the same request, while
+// a key of the legacy route is not replayed in its format on the v1
+// route.
+const (
+	opCreateVisitor = "create-visitor"
+)
+
+// idempotent runs create at most once per Idempotency-Key. A retry of op
+// with the same key and body gets the stored response with
+// Idempotent-Replayed set, a request that reuses the key for another
+// body or API version gets 422, and one that arrives while the first is still running
+// gets 409. Responses with a 5xx status are not stored, so that the
+// request can be retried.
+func (a *visitorsAPI) idempotent(c *gin.Context, v *apiVersion, key, op string, create func()) {
+	var keys idempotencyStore = visitorStore(c)
+	if keys == nil {
+		create()
+		return
+	}
+	if !validIdempotencyKey(key) {
+		v.fail(c, http.StatusBadRequest, codeInvalidRequest, "Idempotency-Key must be at most 255 printable ASCII characters")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxIdempotentBody+1))
+	if err != nil || len(body) > maxIdempotentBody {
+		v.fail(c, http.StatusBadRequest, codeInvalidRequest, "invalid body")
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	h := sha256.New()
+	for _, s := range []string{op, v.Name, c.ContentType()} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+
+	rec := &idempotencyRecord{
+		Key:         key,
+		RequestHash: hex.EncodeToString(h.Sum(nil)),
+		Pending:     true,
+		Expires:     time.Now().Add(idempotencyLockTTL),
+	}
+	existing, err := keys.ReserveKey(c.Request.Context(), rec)
+	if err != nil {
+		v.failWith(c, storeError(err, "unable to reserve idempotency key"))
+		return
+	}
+	switch {
+	case existing == nil:
+	case existing.RequestHash != rec.RequestHash:
+		v.failWith(c, errKeyReused)
+		return
+	case existing.Pending:
+		c.Header("Retry-After", "1")
+		v.failWith(c, errKeyInProgress)
+		return
+	default:
+		for name, values := range existing.Header {
+			for _, value := range values {
+				c.Writer.Header().Add(name, value)
+			}
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Status(existing.Status)
+		c.Writer.Write(existing.Body)
+		return
+	}
+
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	create()
+	c.Writer = w.ResponseWriter
+
+	//The outcome is stored even if the client is gone, since it is the
+	//one most likely to retry.
+	ctx := context.WithoutCancel(c.Request.Context())
+	if status := w.Status(); status >= 500 {
+		err = keys.ReleaseKey(ctx, rec)
+	} else {
+		rec.Pending = false
+		rec.Status = status
+		rec.Header = make(http.Header)
+		for _, name := range replayedHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				rec.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		rec.Body = w.body.Bytes()
+		rec.Expires = time.Now().Add(a.keyTTL)
+		err = keys.CompleteKey(ctx, rec)
+	}
+	if err != nil {
+		log.Printf("Can not store idempotency key %q: %v", key, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyKeyAcrossRoutes(t *testing.T) {
+	app := newTestApp(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+	post := func(path, key, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, app.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	first := post("/api/visitors", "key-1", `{"name":"Bob"}`)
+	if first.StatusCode != http.StatusOK && first.StatusCode != http.StatusCreated {
+		t.Fatalf("first request: %s", first.Status)
+	}
+	replayed := post("/api/visitors", "key-1", `{"name":"Bob"}`)
+	if replayed.Header.Get("Idempotent-Replayed") != "true" || replayed.StatusCode != first.StatusCode || replayed.Header.Get("Content-Type") != first.Header.Get("Content-Type") {
+		t.Errorf("retry: %s %q, replayed %q; want %s %q replayed", replayed.Status, replayed.Header.Get("Content-Type"), replayed.Header.Get("Idempotent-Replayed"), first.Status, first.Header.Get("Content-Type"))
+	}
+	//The response of the legacy route is not replayed on the v1 route.
+	if resp := post("/api/v1/visitors", "key-1", `{"name":"Bob"}`); resp.StatusCode != http.StatusUnprocessableEntity || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("v1 request with the legacy key: %s, replayed %q; want 422", resp.Status, resp.Header.Get("Idempotent-Replayed"))
+	}
+
+	created := post("/api/v1/visitors", "key-2", `{"name":"Bob"}`)
+	replayed = post("/api/v1/visitors", "key-2", `{"name":"Bob"}`)
+	if replayed.Header.Get("Idempotent-Replayed") != "true" || replayed.StatusCode != http.StatusCreated || !strings.HasPrefix(replayed.Header.Get("Content-Type"), "application/json") || replayed.Header.Get("Location") != created.Header.Get("Location") {
+		t.Errorf("v1 retry: %s %q at %q, replayed %q; want 201 JSON at %q", replayed.Status, replayed.Header.Get("Content-Type"), replayed.Header.Get("Location"), replayed.Header.Get("Idempotent-Replayed"), created.Header.Get("Location"))
+	}
+	if resp := post("/api/v1/visitors", "key-2", `{"name":"Alice"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("request with the key and another body: %s, want 422", resp.Status)
+	}
+}
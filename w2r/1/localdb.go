@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/IBM-Cloud/get-started-go/couchserver"
+)
+
+var (
+	localDBDir  = flag.String("local-db", os.Getenv("LOCAL_DB_DIR"), "run an embedded CouchDB-compatible server that persists to `dir` instead of using CLOUDANT_URL")
+	localDBAddr = flag.String("local-db-addr", envOr("LOCAL_DB_ADDR", "127.0.0.1:5984"), "listen address of the embedded database server")
+)
+
+// startLocalDB serves the databases in dir on addr and returns the URL
+// to pass to couchdb.NewClient.
+func startLocalDB(dir, addr string) (string, error) {
+	srv, err := couchserver.New(dir)
+	if err != nil {
+		return "", err
+	}
+	registerLocalViews(srv)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		srv.Close()
+		return "", err
+	}
+	go func() {
+		log.Println("embedded database server:", http.Serve(lis, srv))
+	}()
+	url := "http://" + lis.Addr().String()
+	log.Printf("Using the embedded database server at %s, data in %s", url, dir)
+	return url, nil
+}
+
+// localVisitorViews are the Go counterparts of the map functions of
+// visitorsDesign. The server does not pass design documents to them.
+var localVisitorViews = map[string]couchserver.MapFunc{
+	"all": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if doc["deleted_at"] == nil {
+			emit(doc["_id"], nil)
+		}
+	},
+}
+
+// registerLocalViews makes srv answer the views of _design/visitors.
+func registerLocalViews(srv *couchserver.Server) {
+	for name, fn := range localVisitorViews {
+		srv.RegisterView("visitors", name, couchserver.View{Map: fn})
+	}
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
-import "github.com/timjacobi/go-couchdb"
-
 type Visitor struct {
-	Name string `json:"name"`
+	Name    string   `json:"name"`
+	Locale  string   `json:"locale,omitempty"`
+	Created string   `json:"created_at,omitempty"` // in createdLayout
+	Tags    []string `json:"tags,omitempty"`
 }
 
 type Visitors []Visitor
@@ -24,81 +32,453 @@ type alldocsResult struct {
 	Rows      []map[string]interface{}
 }
 
+// visitorStore returns the visitor store of the request, or nil when no
+// database is configured.
+func visitorStore(c *gin.Context) VisitorStore {
+	v, _ := c.Get("store")
+	store, _ := v.(VisitorStore)
+	return store
+}
+
 func main() {
-	r := gin.Default()
+	flag.Parse()
 
-	r.StaticFile("/", "./static/index.html")
-	r.Static("/static", "./static")
+	//Requests and CouchDB calls are traced when TRACE_EXPORTER is set, or
+	//with -trace-collector for local development.
+	traceCfg := traceConfigFromEnv()
+	if *traceCollectorAddr != "" {
+		endpoint, err := startTraceCollector(*traceCollectorAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		traceCfg.Exporter, traceCfg.Endpoint = traceExporterOTLP, endpoint
+	}
+	tracer := newTracer(traceCfg)
+
+	//The API is described by openapi/openapi.json. Set OPENAPI_VALIDATE to
+	//check requests and responses against it.
+	spec, err := loadOpenAPI(embedded, "openapi/openapi.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	assets, err := newAssetStore(embedded, "static")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	var dbName = "mydb"
 
 	//When running locally, get credentials from .env file.
-	err := godotenv.Load()
+	err = godotenv.Load()
 	if err != nil {
 		log.Println(".env file does not exist")
 	}
-	cloudantUrl := os.Getenv("CLOUDANT_URL")
+	cloudantUrl := secretFromEnv("CLOUDANT_URL")
+	cloudantUrlFile := os.Getenv("CLOUDANT_URL_FILE")
 
+	transportCfg := transportConfigFromEnv()
 	appEnv, _ := cfenv.Current()
 	if appEnv != nil {
 		cloudantService, _ := appEnv.Services.WithLabel("cloudantNoSQLDB")
 		if len(cloudantService) > 0 {
 			cloudantUrl = cloudantService[0].Credentials["url"].(string)
+			cloudantUrlFile = ""
+			transportCfg.useCredentials(cloudantService[0].Credentials)
+		}
+	}
+
+	//For local development, run with -local-db ./data to use an embedded
+	//CouchDB-compatible server instead.
+	if *localDBDir != "" {
+		cloudantUrl, err = startLocalDB(*localDBDir, *localDBAddr)
+		cloudantUrlFile = ""
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	cloudant, err := couchdb.NewClient(cloudantUrl, nil)
+	//CouchDB requests time out, are retried when throttled and fail fast
+	//while the database is down, see couchtransport.go.
+	couchTransport, err := newCouchTransport(transportCfg)
+	if err != nil {
+		log.Fatal("Can not configure TLS for CouchDB: ", err)
+	}
+	metrics := []metricsSource{couchTransport}
+
+	//With TLS_CERT_FILE the app serves HTTPS itself, and reloads the
+	//certificate when the file changes.
+	var tlsCerts *certReloader
+	if tlsCfg := serverTLSConfigFromEnv(); tlsCfg.CertFile != "" {
+		tlsCerts, err = newCertReloader(tlsCfg)
+		if err != nil {
+			log.Fatal("Can not load the TLS certificate: ", err)
+		}
+		metrics = append(metrics, tlsCerts)
+	}
+	var couchRT http.RoundTripper = couchTransport
+	if tracer != nil {
+		couchRT = &tracingTransport{tracer: tracer, base: couchTransport}
+		metrics = append(metrics, tracer)
+	}
+	cloudant, err := newCouchConn(cloudantUrl, couchRT, couchTransport.base, dbName)
 	if err != nil {
 		log.Println("Can not connect to Cloudant database")
 	}
+	metrics = append(metrics, cloudant)
 
 	//ensure db exists
 	//if the db exists the db will be returned anyway
-	cloudant.CreateDB(dbName)
+	cloudant.Client().CreateDB(dbName)
+
+	//A URL mounted from a secret with CLOUDANT_URL_FILE is watched, and
+	//the client is replaced when the secret is rotated.
+	if cloudantUrlFile != "" {
+		go cloudant.watch(context.Background(), cloudantUrlFile, secretsReloadIntervalFromEnv())
+	}
+
+	//Visitors are stored in CouchDB unless STORE_BACKEND=postgres, or a
+	//PostgreSQL URL is configured instead of a Cloudant one.
+	var store VisitorStore
+	storeCfg := storeConfigFromEnv(appEnv, cloudantUrl)
+	switch {
+	case storeCfg.Backend == storePostgres:
+		if storeCfg.PostgresURL == "" {
+			log.Fatal("STORE_BACKEND=postgres needs DATABASE_URL or a bound PostgreSQL service")
+		}
+		pg, err := openPostgresStore(storeCfg.PostgresURL, dbName)
+		if err != nil {
+			log.Fatal("Can not open PostgreSQL database: ", err)
+		}
+		store = pg
+	case storeCfg.Backend != storeCouchDB:
+		log.Fatalf("unknown STORE_BACKEND %q", storeCfg.Backend)
+	case cloudantUrl != "":
+		store = newConnCouchStore(cloudant, dbName)
+		if err := ensureVisitorIndexes(context.Background(), cloudant.DB(dbName)); err != nil {
+			log.Println("Can not create the visitor search indexes:", err)
+		}
+	}
+
+	//Greetings are rendered from the message catalogs in LOCALES_DIR.
+	messages, err := loadCatalogs(i18nConfigFromEnv())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//The index page and the visitor list are rendered on the server.
+	templates, err := loadTemplates(embedded, "templates", assets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Visitor endpoints run against the database of the current tenant.
+	//Without TENANT_MODE every request uses dbName. Tenant records and
+	//databases live in CouchDB.
+	var tenants *tenantRegistry
+	tenantCfg := tenantConfigFromEnv()
+	if tenantCfg.Mode != tenantModeNone {
+		if storeCfg.Backend != storeCouchDB {
+			log.Fatal("TENANT_MODE requires STORE_BACKEND=couchdb")
+		}
+		tenants = newTenantRegistry(cloudant, tenantCfg)
+		if err := tenants.init(context.Background()); err != nil {
+			log.Println("Can not create tenant registry database")
+		}
+	}
+
+	//Features that react to the changes of the single CouchDB guestbook
+	//register handlers with the changes processor, see changes.go. It
+	//only runs if one did.
+	var changes *changesProcessor
+	if store != nil && storeCfg.Backend == storeCouchDB && tenantCfg.Mode == tenantModeNone {
+		changes = newConnChangesProcessor("visitors", cloudant, dbName, changesConfigFromEnv())
+	}
+
+	//New visitors of the single guestbook can be queued and stored in
+	//bulk, see WRITE_BATCH_SIZE. The queue is flushed on shutdown.
+	var batcher *batchingStore
+	if batchCfg := batchConfigFromEnv(); store != nil && tenantCfg.Mode == tenantModeNone && batchCfg.Size > 0 {
+		batcher = newBatchingStore(store, batchCfg)
+		store = batcher
+		metrics = append(metrics, batcher)
+	}
+
+	//Reads of the single guestbook are cached in memory and invalidated
+	//from the changes feed. Set CACHE_MAX_BYTES=0 to turn the cache off.
+	if cacheCfg := cacheConfigFromEnv(); store != nil && tenantCfg.Mode == tenantModeNone && cacheCfg.MaxBytes > 0 {
+		cache := newVisitorCache(cacheCfg)
+		if changes != nil {
+			changes.Handle("visitor-cache", []string{docTypeVisitor}, cache.handleChange)
+		} else {
+			go cache.watch(context.Background(), store)
+		}
+		store = &cachedStore{VisitorStore: store, cache: cache}
+		metrics = append(metrics, cache)
+	}
+
+	//Names of the single guestbook are indexed in memory for typeahead,
+	//see suggest.go. Set SUGGEST_INDEX=off to turn the index off.
+	var suggest *suggestIndex
+	if store != nil && tenantCfg.Mode == tenantModeNone && suggestIndexFromEnv() {
+		suggest = newSuggestIndex()
+		if changes != nil {
+			changes.Handle("suggest-index", []string{docTypeVisitor}, suggest.handleChange)
+		}
+		go suggest.run(context.Background(), store, changes == nil)
+		metrics = append(metrics, suggest)
+	}
+
+	//Visitors are purged for good when their trash period ends or they
+	//are older than VISITOR_MAX_AGE, see retention.go.
+	service := &visitorService{messages: messages}
+	retention := newRetentionJob(service, func(ctx context.Context) (map[string]VisitorStore, error) {
+		if tenants == nil {
+			if store == nil {
+				return nil, nil
+			}
+			return map[string]VisitorStore{"": store}, nil
+		}
+		list, err := tenants.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stores := make(map[string]VisitorStore, len(list))
+		for _, t := range list {
+			if _, err := tenants.Open(ctx, t); err != nil {
+				return nil, err
+			}
+			stores[t.Name] = newCouchStore(cloudant.Client(), t.DB)
+		}
+		return stores, nil
+	}, retentionConfigFromEnv())
+	if !retention.Idle() {
+		metrics = append(metrics, retention)
+		go retention.run(context.Background())
+	}
+
+	changesCtx, stopChanges := context.WithCancel(context.Background())
+	changesDone := make(chan struct{})
+	if changes != nil && !changes.Idle() {
+		go func() {
+			changes.run(changesCtx)
+			close(changesDone)
+		}()
+		metrics = append(metrics, changes)
+	} else {
+		close(changesDone)
+	}
+
+	r := newRouter(routerConfig{
+		Tracer:      tracer,
+		Security:    securityConfigFromEnv(),
+		Spec:        spec,
+		Validate:    openAPIValidateFromEnv(),
+		Assets:      assets,
+		Templates:   templates,
+		Messages:    messages,
+		Ready:       []readinessSource{couchTransport},
+		Metrics:     metrics,
+		Store:       store,
+		Tenants:     tenants,
+		Visitors:    &visitorsAPI{visitors: service, keyTTL: idempotencyKeyTTLFromEnv(), suggest: suggest},
+		Timeout:     requestTimeoutFromEnv(),
+		ActorHeader: auditActorHeaderFromEnv(),
+	})
+
+	//The same service is exposed over gRPC on GRPC_PORT, see visitorpb.
+	//It uses the certificate of the HTTPS server, if there is one.
+	var grpcTLS *tls.Config
+	if tlsCerts != nil {
+		grpcTLS = tlsCerts.tlsConfig()
+	}
+	startGRPC(&grpcVisitorServer{
+		visitors: service,
+		store:    store,
+		tenants:  tenants,
+	}, grpcTLS)
+
+	//When running on Cloud Foundry, get the PORT from the environment variable.
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080" //Local
+	}
+	if gin.Mode() == gin.DebugMode {
+		spec.reportDrift(r.Routes())
+	}
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	if tlsCerts != nil {
+		srv.TLSConfig = tlsCerts.tlsConfig()
+	}
+	go func() {
+		var err error
+		if tlsCerts == nil {
+			log.Printf("Listening and serving HTTP on :%s", port)
+			err = srv.ListenAndServe()
+		} else {
+			log.Printf("Listening and serving HTTPS on :%s", port)
+			err = srv.ListenAndServeTLS("", "")
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	//On SIGTERM, finish the requests in flight and store the queued
+	//visitors before exiting. Cloud Foundry kills the app after 10s.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 9*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	if batcher != nil {
+		if err := batcher.Close(ctx); err != nil {
+			log.Println("Can not flush queued visitors:", err)
+		}
+	}
+	stopChanges()
+	select {
+	case <-changesDone:
+	case <-ctx.Done():
+	}
+	if tracer != nil {
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Println("Can not export spans:", err)
+		}
+	}
+}
+
+// routerConfig holds the parts of the app that newRouter serves.
+type routerConfig struct {
+	Tracer    *tracer // nil without tracing
+	Security  SecurityConfig
+	Spec      *openAPISpec
+	Validate  string // see OPENAPI_VALIDATE
+	Assets    *assetStore
+	Templates *template.Template
+	Messages  *i18nBundle
+	Ready     []readinessSource
+	Metrics   []metricsSource
+
+	// Store is the single guestbook, nil without a database. With Tenants
+	// every request uses the database of its tenant instead.
+	Store   VisitorStore
+	Tenants *tenantRegistry
+
+	Visitors    *visitorsAPI
+	Timeout     time.Duration // see REQUEST_TIMEOUT
+	ActorHeader string        // see AUDIT_ACTOR_HEADER
+}
+
+// newRouter returns the gin engine with the pages, the visitor API and
+// the operational endpoints of the app.
+func newRouter(cfg routerConfig) *gin.Engine {
+	r := gin.Default()
+	if cfg.Tracer != nil {
+		r.Use(tracing(cfg.Tracer))
+	}
+	r.Use(securityHeaders(cfg.Security))
+	r.Use(requestID())
+	if cfg.Validate != validateOff {
+		r.Use(cfg.Spec.validator(cfg.Validate))
+	}
+	r.GET(openAPIPath, cfg.Spec.Handler)
+	r.GET(apiDocsPath, apiDocsHandler)
+	r.POST(cspReportPath, cspReportHandler)
+	cfg.Assets.Register(r, "/static")
+	r.GET("/readyz", readinessHandler(cfg.Ready...))
+	r.GET("/metrics", metricsHandler(cfg.Metrics...))
+	r.SetHTMLTemplate(cfg.Templates)
+
+	api := r.Group("/")
+	if cfg.Tenants == nil {
+		store := cfg.Store
+		api.Use(func(c *gin.Context) {
+			if store != nil {
+				c.Set("store", store)
+			}
+			c.Next()
+		})
+	} else {
+		if cfg.Tenants.cfg.Mode == tenantModePath {
+			api = r.Group("/t/:tenant")
+			cfg.Assets.Register(api, "/static")
+		}
+		api.Use(cfg.Tenants.middleware())
+		registerTenantAdmin(r, cfg.Tenants)
+	}
+
+	//Database requests of the visitor endpoints are aborted after
+	//REQUEST_TIMEOUT or when the client disconnects.
+	api.Use(withTimeout(cfg.Timeout))
+
+	//Changes to visitors are recorded in an audit trail with the actor
+	//named by AUDIT_ACTOR_HEADER, see audit.go.
+	api.Use(auditContext(cfg.ActorHeader))
+
+	visitors, messages := cfg.Visitors, cfg.Messages
+	visitors.register(api.Group("/api/v1"), apiV1)
+
+	//Index page with the welcome form and the first page of visitors.
+	//Send Accept: application/json to get the JSON representation instead.
+	api.GET("/", func(c *gin.Context) {
+		if wantsJSON(c, false) {
+			visitors.List(c)
+			return
+		}
+		renderVisitors(c, messages, visitorStore(c), "")
+	})
 
 	/* Endpoint to greet and add a new visitor to database.
 	* Send a POST request to http://localhost:8080/api/visitors with body
 	* {
-	* 	"name": "Bob"
+	* 	"name": "Bob",
+	* 	"lang": "de"
 	* }
+	* The optional lang field overrides Accept-Language negotiation.
+	* HTML form posts are redirected back to the index page.
+	* Deprecated: use POST /api/v1/visitors.
 	 */
-	r.POST("/api/visitors", func(c *gin.Context) {
-		var visitor Visitor
-		if c.BindJSON(&visitor) == nil {
-			cloudant.DB(dbName).Post(visitor)
-			c.String(200, "Hello "+visitor.Name)
-		}
-	})
+	api.POST("/api/visitors", visitors.Create)
+
+	/**
+	 * Endpoint to search visitors, the same as POST /api/v1/visitors/search.
+	 */
+	api.POST("/api/visitors/search", pinAPIVersion(apiV1), visitors.Search)
+
+	/**
+	 * Endpoint for typeahead, e.g.
+	 * GET http://localhost:8080/api/visitors/suggest?q=anan
+	 * Response:
+	 * { "suggestions": [ { "id": "…", "name": "Anna", "score": 0.65 } ] }
+	 * Matches tolerate typos, see suggest.go. The same as
+	 * GET /api/v1/visitors/suggest.
+	 */
+	api.GET("/api/visitors/suggest", pinAPIVersion(apiV1), visitors.Suggest)
 
 	/**
 	 * Endpoint to get a JSON array of all the visitors in the database
 	 * REST API example:
 	 * <code>
-	 * GET http://localhost:8080/api/visitors
+	 * GET http://localhost:8080/api/visitors?page=1&per_page=20
 	 * </code>
 	 *
 	 * Response:
 	 * [ "Bob", "Jane" ]
 	 * @return An array of all the visitor names
+	 * Without page or per_page all visitors are returned. Browsers asking
+	 * for text/html get the rendered index page.
+	 * Deprecated: use GET /api/v1/visitors.
 	 */
-	r.GET("/api/visitors", func(c *gin.Context) {
-		var result alldocsResult
-		if cloudantUrl == "" {
-			c.JSON(200, gin.H{})
+	api.GET("/api/visitors", func(c *gin.Context) {
+		if wantsJSON(c, true) {
+			visitors.List(c)
 			return
 		}
-		err := cloudant.DB(dbName).AllDocs(&result, couchdb.Options{"include_docs": true})
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to fetch docs"})
-		} else {
-			c.JSON(200, result.Rows)
-		}
+		renderVisitors(c, messages, visitorStore(c), "api/visitors")
 	})
-
-	//When running on Cloud Foundry, get the PORT from the environment variable.
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080" //Local
-	}
-	r.Run(":" + port)
+	return r
 }
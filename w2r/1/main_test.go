@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/IBM-Cloud/get-started-go/couchserver"
+	"github.com/gin-gonic/gin"
+	"github.com/timjacobi/go-couchdb"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestCouch serves an empty embedded database server until the test
+// ends and returns a client for it.
+func newTestCouch(t *testing.T) *couchdb.Client {
+	t.Helper()
+	srv, err := couchserver.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerLocalViews(srv)
+	hs := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		//Closing the server first ends its continuous feeds.
+		srv.Close()
+		hs.Close()
+	})
+	client, err := couchdb.NewClient(hs.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newTestCouchStore creates the database name with its indexes and
+// returns its store.
+func newTestCouchStore(t *testing.T, client *couchdb.Client, name string) *couchStore {
+	t.Helper()
+	db, err := client.EnsureDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureVisitorIndexes(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return newCouchStore(client, name)
+}
+
+// newTestApp serves the router of the app for the single guestbook store
+// until the test ends.
+func newTestApp(t *testing.T, store VisitorStore) *httptest.Server {
+	t.Helper()
+	hs := httptest.NewServer(newRouter(newTestRouterConfig(t, store)))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// newTestRouterConfig configures the router for the single guestbook
+// store. Requests and responses are validated against the OpenAPI
+// document.
+func newTestRouterConfig(t *testing.T, store VisitorStore) routerConfig {
+	t.Helper()
+	spec, err := loadOpenAPI(embedded, "openapi/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets, err := newAssetStore(embedded, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := loadTemplates(embedded, "templates", assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := loadCatalogs(embedded, "locales", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routerConfig{
+		Security:    securityConfigFromEnv(),
+		Spec:        spec,
+		Validate:    validateAll,
+		Assets:      assets,
+		Templates:   templates,
+		Messages:    messages,
+		Store:       store,
+		Visitors:    &visitorsAPI{visitors: &visitorService{messages: messages}, keyTTL: time.Hour},
+		Timeout:     10 * time.Second,
+		ActorHeader: "X-Forwarded-User",
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsSource is a component that reports metrics.
+type metricsSource interface {
+	// writeMetrics writes the metrics in the Prometheus text format.
+	writeMetrics(w io.Writer)
+}
+
+// metricsHandler serves the metrics of sources for Prometheus.
+func metricsHandler(sources ...metricsSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		for _, s := range sources {
+			s.writeMetrics(c.Writer)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+-- One row per visitor. guestbook is the name the CouchDB backend uses as
+-- the database name, so several guestbooks can share a schema.
+CREATE TABLE visitors (
+	guestbook  text NOT NULL,
+	id         text COLLATE "C" NOT NULL,
+	rev        integer NOT NULL DEFAULT 1,
+	name       text NOT NULL,
+	locale     text NOT NULL DEFAULT '',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (guestbook, id)
+);
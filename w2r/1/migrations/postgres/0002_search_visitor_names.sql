@@ -0,0 +1,3 @@
+-- Full-text index for name search. The simple configuration lower-cases
+-- words without stemming, which suits names in any language.
+CREATE INDEX visitors_name_search ON visitors USING gin (to_tsvector('simple', name));
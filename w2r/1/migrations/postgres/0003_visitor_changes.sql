@@ -0,0 +1,36 @@
+-- The latest change of every visitor, in the order of seq, like the
+-- CouchDB changes feed. Deleted visitors keep a row so that watchers learn
+-- about the deletion.
+CREATE TABLE visitor_changes (
+	seq       bigserial PRIMARY KEY,
+	guestbook text NOT NULL,
+	id        text COLLATE "C" NOT NULL,
+	deleted   boolean NOT NULL DEFAULT false,
+	UNIQUE (guestbook, id)
+);
+
+CREATE INDEX visitor_changes_guestbook_seq ON visitor_changes (guestbook, seq);
+
+-- visitor_changed records a change and notifies the listeners of the
+-- guestbook when the transaction commits. Writes to a guestbook take a
+-- lock until they commit, so that changes become visible in seq order and
+-- a watcher that has seen seq n never misses a change below n.
+CREATE FUNCTION visitor_changed() RETURNS trigger AS $$
+DECLARE
+	r visitors;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		r := OLD;
+	ELSE
+		r := NEW;
+	END IF;
+	PERFORM pg_advisory_xact_lock(hashtext('visitor_changes:' || r.guestbook));
+	DELETE FROM visitor_changes WHERE guestbook = r.guestbook AND id = r.id;
+	INSERT INTO visitor_changes (guestbook, id, deleted) VALUES (r.guestbook, r.id, TG_OP = 'DELETE');
+	PERFORM pg_notify('visitor_changes', r.guestbook);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER visitors_changed AFTER INSERT OR UPDATE OR DELETE ON visitors
+	FOR EACH ROW EXECUTE PROCEDURE visitor_changed();
@@ -0,0 +1,15 @@
+-- Idempotency-Key records of visitor creation, with the response to replay
+-- while the key has not expired.
+CREATE TABLE idempotency_keys (
+	guestbook    text NOT NULL,
+	key          text NOT NULL,
+	request_hash text NOT NULL,
+	pending      boolean NOT NULL,
+	status       integer NOT NULL DEFAULT 0,
+	header       jsonb,
+	body         bytea,
+	expires_at   timestamptz NOT NULL,
+	PRIMARY KEY (guestbook, key)
+);
+
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at);
@@ -0,0 +1,6 @@
+-- Tags given when a visitor is created, and the indexes of the visitor
+-- search: tags with @>, creation time ranges by guestbook.
+ALTER TABLE visitors ADD COLUMN tags text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX visitors_tags ON visitors USING gin (tags);
+CREATE INDEX visitors_guestbook_created_at ON visitors (guestbook, created_at);
@@ -0,0 +1,27 @@
+-- The audit trail of visitor changes. Records are only ever inserted; the
+-- trigger rejects updates and deletions. Deleted visitors keep their
+-- records.
+CREATE TABLE visitor_audit (
+	seq        bigserial PRIMARY KEY,
+	guestbook  text NOT NULL,
+	visitor_id text COLLATE "C" NOT NULL,
+	action     text NOT NULL,
+	rev        text NOT NULL DEFAULT '',
+	base_rev   text NOT NULL DEFAULT '',
+	actor      text NOT NULL,
+	request_id text NOT NULL DEFAULT '',
+	source_ip  text NOT NULL DEFAULT '',
+	at         timestamptz NOT NULL,
+	changes    jsonb NOT NULL
+);
+
+CREATE INDEX visitor_audit_guestbook_visitor_id ON visitor_audit (guestbook, visitor_id, seq);
+
+CREATE FUNCTION visitor_audit_immutable() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'visitor_audit records can not be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER visitor_audit_immutable BEFORE UPDATE OR DELETE ON visitor_audit
+	FOR EACH ROW EXECUTE PROCEDURE visitor_audit_immutable();
@@ -0,0 +1,6 @@
+-- Visitors moved to the trash keep their row with the time of the
+-- deletion until they are restored or purged. Lists only read rows
+-- without one; the partial index serves the trash and its retention.
+ALTER TABLE visitors ADD COLUMN deleted_at timestamptz;
+
+CREATE INDEX visitors_guestbook_deleted_at ON visitors (guestbook, deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	openAPIPath = "/api/openapi.json"
+	apiDocsPath = "/api/docs"
+
+	// maxValidatedBody limits the request bodies read by the validator.
+	maxValidatedBody = 1 << 20
+)
+
+// openAPISpec is the parsed OpenAPI document. Only the parts needed to
+// validate requests and responses are decoded; the raw document is served
+// unchanged.
+type openAPISpec struct {
+	raw  []byte
+	etag string
+
+	Paths      map[string]map[string]*apiOperation `json:"paths"`
+	Components struct {
+		Schemas    map[string]*apiSchema    `json:"schemas"`
+		Parameters map[string]*apiParameter `json:"parameters"`
+		Responses  map[string]*apiResponse  `json:"responses"`
+	} `json:"components"`
+
+	templates []pathTemplate
+	patterns  sync.Map // pattern string -> *regexp.Regexp
+}
+
+type apiOperation struct {
+	OperationID string                  `json:"operationId"`
+	Parameters  []*apiParameter         `json:"parameters"`
+	RequestBody *apiRequestBody         `json:"requestBody"`
+	Responses   map[string]*apiResponse `json:"responses"`
+}
+
+type apiParameter struct {
+	Ref      string     `json:"$ref"`
+	Name     string     `json:"name"`
+	In       string     `json:"in"`
+	Required bool       `json:"required"`
+	Schema   *apiSchema `json:"schema"`
+}
+
+type apiRequestBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]apiMediaType `json:"content"`
+}
+
+type apiResponse struct {
+	Ref     string                  `json:"$ref"`
+	Content map[string]apiMediaType `json:"content"`
+}
+
+type apiMediaType struct {
+	Schema *apiSchema `json:"schema"`
+}
+
+// apiSchema is the subset of the OpenAPI schema object that the validator
+// understands. Unknown keywords are ignored.
+type apiSchema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Properties           map[string]*apiSchema `json:"properties"`
+	Required             []string              `json:"required"`
+	AdditionalProperties *bool                 `json:"additionalProperties"`
+	MaxProperties        *int                  `json:"maxProperties"`
+	Items                *apiSchema            `json:"items"`
+	Enum                 []interface{}         `json:"enum"`
+	Pattern              string                `json:"pattern"`
+	MinLength            *int                  `json:"minLength"`
+	MaxLength            *int                  `json:"maxLength"`
+	Minimum              *float64              `json:"minimum"`
+	Maximum              *float64              `json:"maximum"`
+	Nullable             bool                  `json:"nullable"`
+	OneOf                []*apiSchema          `json:"oneOf"`
+}
+
+// pathTemplate is a path of the document split into segments, where
+// "{name}" segments match any value.
+type pathTemplate struct {
+	path     string
+	segments []string
+}
+
+// loadOpenAPI reads the OpenAPI document from file of fsys.
+func loadOpenAPI(fsys fs.FS, file string) (*openAPISpec, error) {
+	raw, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	spec := &openAPISpec{raw: raw}
+	if err := json.Unmarshal(raw, spec); err != nil {
+		return nil, fmt.Errorf("openapi: %s: %v", file, err)
+	}
+	sum := sha256.Sum256(raw)
+	spec.etag = `"` + hex.EncodeToString(sum[:])[:16] + `"`
+	for p := range spec.Paths {
+		spec.templates = append(spec.templates, pathTemplate{p, strings.Split(p, "/")})
+	}
+	// Literal segments win over parameters, e.g. /a/b over /a/{x}.
+	sort.Slice(spec.templates, func(i, j int) bool {
+		return strings.Count(spec.templates[i].path, "{") < strings.Count(spec.templates[j].path, "{")
+	})
+	return spec, nil
+}
+
+// Handler serves the raw document.
+func (spec *openAPISpec) Handler(c *gin.Context) {
+	c.Header("ETag", spec.etag)
+	c.Header("Cache-Control", "no-cache")
+	if etagMatches(c.Request.Header.Get("If-None-Match"), spec.etag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, gin.MIMEJSON, spec.raw)
+}
+
+/**
+ * Interactive API documentation, rendered by the bundled Swagger UI
+ * from /api/openapi.json.
+ */
+func apiDocsHandler(c *gin.Context) {
+	// Swagger UI sets inline styles on the elements it renders.
+	for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		if policy := c.Writer.Header().Get(name); policy != "" {
+			c.Header(name, strings.Replace(policy, "style-src ", "style-src 'unsafe-inline' ", 1))
+		}
+	}
+	c.HTML(http.StatusOK, "docs.tmpl", gin.H{"Base": basePath(c, "api/docs"), "Nonce": cspNonce(c)})
+}
+
+// find returns the operation for method and path together with its
+// document path. A /t/{tenant} prefix, used in path tenant mode, is ignored.
+func (spec *openAPISpec) find(method, path string) (*apiOperation, string) {
+	op, tmpl := spec.match(method, path)
+	if op == nil && strings.HasPrefix(path, "/t/") {
+		if i := strings.IndexByte(path[3:], '/'); i >= 0 {
+			op, tmpl = spec.match(method, path[3+i:])
+		}
+	}
+	return op, tmpl
+}
+
+func (spec *openAPISpec) match(method, path string) (*apiOperation, string) {
+	segments := strings.Split(path, "/")
+	for _, t := range spec.templates {
+		if len(t.segments) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, s := range t.segments {
+			if s != segments[i] && !(strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}")) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return spec.Paths[t.path][strings.ToLower(method)], t.path
+		}
+	}
+	return nil, ""
+}
+
+func (spec *openAPISpec) parameter(p *apiParameter) *apiParameter {
+	if p.Ref != "" {
+		return spec.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+func (spec *openAPISpec) response(r *apiResponse) *apiResponse {
+	if r.Ref != "" {
+		return spec.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+func (spec *openAPISpec) schema(s *apiSchema) *apiSchema {
+	for s != nil && s.Ref != "" {
+		s = spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validate checks value against schema and returns a description of every
+// violation, prefixed with the location of the offending value.
+func (spec *openAPISpec) validate(s *apiSchema, value interface{}, at string) []string {
+	s = spec.schema(s)
+	if s == nil {
+		return nil
+	}
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return []string{at + ": must not be null"}
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, alt := range s.OneOf {
+			if len(spec.validate(alt, value, at)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return []string{fmt.Sprintf("%s: must match exactly one schema, matches %d", at, matches)}
+		}
+	}
+
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, at+": "+fmt.Sprintf(format, args...))
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if e == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", s.Enum)
+		}
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			break
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				fail("missing property %q", name)
+			}
+		}
+		if s.MaxProperties != nil && len(obj) > *s.MaxProperties {
+			fail("must have at most %d properties", *s.MaxProperties)
+		}
+		for name, v := range obj {
+			if prop, ok := s.Properties[name]; ok {
+				errs = append(errs, spec.validate(prop, v, at+"."+name)...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				fail("unknown property %q", name)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			fail("must be an array")
+			break
+		}
+		for i, v := range arr {
+			errs = append(errs, spec.validate(s.Items, v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			break
+		}
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.Pattern != "" && !spec.pattern(s.Pattern).MatchString(str) {
+			fail("must match %s", s.Pattern)
+		}
+	case "integer", "number":
+		num, ok := value.(float64)
+		if !ok || s.Type == "integer" && num != float64(int64(num)) {
+			fail("must be %s %s", article(s.Type), s.Type)
+			break
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && num > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean")
+		}
+	}
+	return errs
+}
+
+func article(word string) string {
+	if strings.IndexByte("aeiou", word[0]) >= 0 {
+		return "an"
+	}
+	return "a"
+}
+
+func (spec *openAPISpec) pattern(expr string) *regexp.Regexp {
+	if re, ok := spec.patterns.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Printf("openapi: invalid pattern %q: %v", expr, err)
+		re = regexp.MustCompile("")
+	}
+	spec.patterns.Store(expr, re)
+	return re
+}
+
+// coerce converts a parameter or form value to the type of its schema, so
+// that "2" is validated as the integer 2.
+func (spec *openAPISpec) coerce(s *apiSchema, value string) interface{} {
+	s = spec.schema(s)
+	if s == nil {
+		return value
+	}
+	switch s.Type {
+	case "integer", "number":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// validateRequest checks the parameters and the body of r against op.
+// The body is read and replaced so that handlers can read it again.
+func (spec *openAPISpec) validateRequest(op *apiOperation, tmpl string, r *http.Request) (status int, errs []string) {
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		p = spec.parameter(p)
+		if p == nil {
+			continue
+		}
+		var value string
+		var present bool
+		switch p.In {
+		case "query":
+			var vs []string
+			vs, present = query[p.Name]
+			if present {
+				value = vs[0]
+			}
+		case "header":
+			value = r.Header.Get(p.Name)
+			present = value != ""
+		case "path":
+			value, present = pathParam(tmpl, r.URL.Path, p.Name)
+		}
+		if !present {
+			if p.Required {
+				errs = append(errs, fmt.Sprintf("%s parameter %q is required", p.In, p.Name))
+			}
+			continue
+		}
+		errs = append(errs, spec.validate(p.Schema, spec.coerce(p.Schema, value), p.Name)...)
+	}
+
+	if op.RequestBody == nil {
+		return http.StatusBadRequest, errs
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValidatedBody))
+	if err != nil {
+		return http.StatusBadRequest, append(errs, "unable to read body")
+	}
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if len(body) == 0 {
+		if op.RequestBody.Required {
+			errs = append(errs, "body is required")
+		}
+		return http.StatusBadRequest, errs
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	content, ok := op.RequestBody.Content[mediaType]
+	if !ok {
+		return http.StatusUnsupportedMediaType, append(errs, fmt.Sprintf("unsupported content type %q", mediaType))
+	}
+	value, err := spec.decode(content.Schema, mediaType, body)
+	if err != nil {
+		return http.StatusBadRequest, append(errs, "body: "+err.Error())
+	}
+	return http.StatusBadRequest, append(errs, spec.validate(content.Schema, value, "body")...)
+}
+
+// decode parses a JSON or form encoded body for validation. Bodies of
+// other types are validated as strings.
+func (spec *openAPISpec) decode(s *apiSchema, mediaType string, body []byte) (interface{}, error) {
+	switch {
+	case mediaType == gin.MIMEPOSTForm:
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{}, len(form))
+		for name, vs := range form {
+			var prop *apiSchema
+			if s := spec.schema(s); s != nil {
+				prop = s.Properties[name]
+			}
+			obj[name] = spec.coerce(prop, vs[0])
+		}
+		return obj, nil
+	case mediaType == gin.MIMEJSON, strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/csp-report":
+		var value interface{}
+		err := json.Unmarshal(body, &value)
+		return value, err
+	}
+	return string(body), nil
+}
+
+// pathParam extracts the value of the {name} segment of tmpl from path.
+func pathParam(tmpl, path, name string) (string, bool) {
+	segments := strings.Split(path, "/")
+	tsegs := strings.Split(tmpl, "/")
+	offset := len(segments) - len(tsegs) // tenant path prefix
+	for i, s := range tsegs {
+		if s == "{"+name+"}" && offset >= 0 {
+			v, err := url.PathUnescape(segments[offset+i])
+			return v, err == nil
+		}
+	}
+	return "", false
+}
+
+// validateResponse checks a response written for op.
+func (spec *openAPISpec) validateResponse(op *apiOperation, status int, contentType string, body []byte) []string {
+	code := strconv.Itoa(status)
+	resp, ok := op.Responses[code]
+	if !ok {
+		if resp, ok = op.Responses[code[:1]+"XX"]; !ok {
+			if resp, ok = op.Responses["default"]; !ok {
+				return []string{"status " + code + " is not documented"}
+			}
+		}
+	}
+	resp = spec.response(resp)
+	if resp == nil || len(resp.Content) == 0 {
+		if len(body) > 0 && status != http.StatusSeeOther {
+			return []string{"status " + code + " has an undocumented body"}
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		return []string{fmt.Sprintf("status %s: content type %q is not documented", code, mediaType)}
+	}
+	if status == http.StatusNotModified || len(body) == 0 {
+		return nil
+	}
+	value, err := spec.decode(content.Schema, mediaType, body)
+	if err != nil {
+		return []string{"body: " + err.Error()}
+	}
+	return spec.validate(content.Schema, value, "body")
+}
+
+// Validation modes, selected with the OPENAPI_VALIDATE environment variable.
+const (
+	validateOff       = ""
+	validateRequests  = "requests"
+	validateResponses = "responses"
+	validateAll       = "all"
+)
+
+func openAPIValidateFromEnv() string {
+	mode := strings.ToLower(os.Getenv("OPENAPI_VALIDATE"))
+	switch mode {
+	case validateOff, validateRequests, validateResponses, validateAll:
+		return mode
+	case "true":
+		return validateAll
+	}
+	log.Printf("ignoring invalid OPENAPI_VALIDATE %q", mode)
+	return validateOff
+}
+
+// capturingWriter keeps a copy of the response body for validation.
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// validator checks requests and responses of documented operations against
+// the document. Invalid requests are rejected with 400, or 415 for an
+// unsupported body type; invalid responses are logged, since they have
+// already been sent.
+func (spec *openAPISpec) validator(mode string) gin.HandlerFunc {
+	requests := mode == validateRequests || mode == validateAll
+	responses := mode == validateResponses || mode == validateAll
+	return func(c *gin.Context) {
+		op, tmpl := spec.find(c.Request.Method, c.Request.URL.Path)
+		if op == nil {
+			c.Next()
+			return
+		}
+		if requests {
+			if status, errs := spec.validateRequest(op, tmpl, c.Request); len(errs) > 0 {
+				c.JSON(status, gin.H{"error": "request does not match the API specification", "details": errs})
+				c.Abort()
+				return
+			}
+		}
+		if !responses {
+			c.Next()
+			return
+		}
+		w := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		errs := spec.validateResponse(op, w.Status(), w.Header().Get("Content-Type"), w.body.Bytes())
+		for _, e := range errs {
+			log.Printf("openapi: %s %s (%s): response %s", c.Request.Method, c.Request.URL.Path, op.OperationID, e)
+		}
+	}
+}
+
+// reportDrift logs routes that the document does not describe and
+// operations of the document without a route.
+func (spec *openAPISpec) reportDrift(routes gin.RoutesInfo) {
+	routed := make(map[string]bool)
+	for _, route := range routes {
+		if route.Method == "HEAD" || strings.Contains(route.Path, "/static/") {
+			continue
+		}
+		p := strings.TrimPrefix(route.Path, "/t/:tenant")
+		if p == "" {
+			p = "/"
+		}
+		segments := strings.Split(p, "/")
+		for i, s := range segments {
+			if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+				segments[i] = "{" + s[1:] + "}"
+			}
+		}
+		p = strings.Join(segments, "/")
+		key := route.Method + " " + p
+		if routed[key] {
+			continue
+		}
+		routed[key] = true
+		if spec.Paths[p][strings.ToLower(route.Method)] == nil {
+			log.Printf("openapi drift: %s is not documented", key)
+		}
+	}
+	for p, ops := range spec.Paths {
+		for method := range ops {
+			if key := strings.ToUpper(method) + " " + p; !routed[key] && !routedByParameter(routed, key) {
+				log.Printf("openapi drift: %s is documented but has no route", key)
+			}
+		}
+	}
+}
+
+// routedByParameter reports whether a routed path with parameters serves
+// key, like GET /api/v1/visitors/{id} serves GET /api/v1/visitors/suggest.
+func routedByParameter(routed map[string]bool, key string) bool {
+	segments := strings.Split(key, "/")
+	for route := range routed {
+		rs := strings.Split(route, "/")
+		if len(rs) != len(segments) || rs[0] != segments[0] {
+			continue
+		}
+		matched := true
+		for i := 1; i < len(rs) && matched; i++ {
+			matched = rs[i] == segments[i] || strings.HasPrefix(rs[i], "{") && !strings.HasPrefix(segments[i], "{")
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
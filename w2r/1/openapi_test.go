@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidatorRejectsRequest(t *testing.T) {
+	hs := newTestApp(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+
+	tests := []struct {
+		method, path, contentType, body string
+		status                          int
+	}{
+		{"POST", "/api/v1/visitors", "application/json", `{"name": 5}`, http.StatusBadRequest},
+		{"POST", "/api/v1/visitors", "application/json", `{}`, http.StatusBadRequest},
+		{"POST", "/api/v1/visitors", "text/xml", `<name>Bob</name>`, http.StatusUnsupportedMediaType},
+		{"GET", "/api/v1/visitors?per_page=many", "", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, hs.URL+tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Error   string
+			Details []string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || err != nil || len(body.Details) == 0 {
+			t.Errorf("%s %s %s: %d %+v, want %d with details", tt.method, tt.path, tt.body, resp.StatusCode, body, tt.status)
+		}
+	}
+}
+
+func TestValidatorLogsInvalidResponse(t *testing.T) {
+	spec, err := loadOpenAPI(embedded, "openapi/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	r := gin.New()
+	r.Use(spec.validator(validateResponses))
+	r.GET("/api/v1/visitors/:id", func(c *gin.Context) {
+		//The name is required and the id must be a string.
+		c.JSON(http.StatusOK, gin.H{"id": 42})
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/visitors/42", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d; invalid responses must still be sent", w.Code)
+	}
+	for _, want := range []string{"openapi: GET /api/v1/visitors/42", "body.id", "name"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log does not contain %q:\n%s", want, logged.String())
+		}
+	}
+}
+
+func TestDocumentMatchesRoutes(t *testing.T) {
+	cfg := newTestRouterConfig(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+	r := newRouter(cfg)
+	var logged bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	cfg.Spec.reportDrift(r.Routes())
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		//The tenant admin routes only exist in TENANT_MODE.
+		if line != "" && !strings.Contains(line, " /admin/tenants") {
+			t.Error(line)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pgStore is a VisitorStore backed by the visitors table of a PostgreSQL
+// database. Revisions are numbers that count the updates of a visitor.
+type pgStore struct {
+	db        *sql.DB
+	dsn       string // for the LISTEN connections of Watch
+	guestbook string
+
+	keysPurged int64 // unix time of the last purge of expired keys
+}
+
+// openPostgresStore connects to the database at dsn, applies the pending
+// migrations and returns the store of guestbook.
+func openPostgresStore(dsn, guestbook string) (*pgStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db, embedded, "migrations/postgres"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &pgStore{db: db, dsn: dsn, guestbook: guestbook}, nil
+}
+
+// migrationLock is the advisory lock that serializes migrations when
+// several instances start at once.
+const migrationLock = 7260001
+
+// migrate applies the SQL files in dir that are not recorded in
+// schema_migrations yet, in the order of the version number they start
+// with. Every file runs in its own transaction.
+func migrate(db *sql.DB, fsys fs.FS, dir string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.SplitN(e.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s: name must start with a version number", e.Name())
+		}
+		script, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(db, version, string(script)); err != nil {
+			return fmt.Errorf("migration %s: %v", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, script string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+	log.Printf("Applied database migration %d", version)
+	return tx.Commit()
+}
+
+// newVisitorID returns a random ID in the format of CouchDB's UUIDs.
+func newVisitorID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// visitorColumns are the columns that queryVisitors reads.
+const visitorColumns = `id, rev, name, locale, created_at, tags, deleted_at`
+
+// pgVisitor returns the created_at and tags values of v. Visitors
+// without a creation time get the current one.
+func pgVisitor(v Visitor) (time.Time, interface{}) {
+	created, err := time.Parse(time.RFC3339, v.Created)
+	if err != nil {
+		created = time.Now().UTC()
+	}
+	tags := v.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return created, pq.Array(tags)
+}
+
+func (s *pgStore) Add(ctx context.Context, v Visitor) (*visitorResource, error) {
+	id, err := newVisitorID()
+	if err != nil {
+		return nil, err
+	}
+	created, tags := pgVisitor(v)
+	_, err = s.db.ExecContext(ctx, `INSERT INTO visitors (guestbook, id, name, locale, created_at, tags) VALUES ($1, $2, $3, $4, $5, $6)`,
+		s.guestbook, id, v.Name, v.Locale, created, tags)
+	if err != nil {
+		return nil, err
+	}
+	r := v.resource(id, "1")
+	r.Created = created
+	return r, nil
+}
+
+// AddBatch inserts all visitors with one statement, so either all of
+// them are stored or none.
+func (s *pgStore) AddBatch(ctx context.Context, visitors []Visitor) ([]addResult, error) {
+	var values []string
+	args := []interface{}{s.guestbook}
+	results := make([]addResult, len(visitors))
+	for i, v := range visitors {
+		id, err := newVisitorID()
+		if err != nil {
+			return nil, err
+		}
+		n := len(args)
+		created, tags := pgVisitor(v)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, id, v.Name, v.Locale, created, tags)
+		results[i].Visitor = v.resource(id, "1")
+		results[i].Visitor.Created = created
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO visitors (guestbook, id, name, locale, created_at, tags) VALUES `+strings.Join(values, ", "), args...)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *pgStore) Get(ctx context.Context, id string) (*visitorResource, error) {
+	v := visitorResource{ID: id}
+	var rev int
+	var tags pq.StringArray
+	var deleted sql.NullTime
+	err := s.db.QueryRowContext(ctx, `SELECT rev, name, locale, created_at, tags, deleted_at FROM visitors WHERE guestbook = $1 AND id = $2`,
+		s.guestbook, id).Scan(&rev, &v.Name, &v.Locale, &v.Created, &tags, &deleted)
+	if err == sql.ErrNoRows {
+		return nil, errStoreNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	v.Rev = strconv.Itoa(rev)
+	v.Tags = tags
+	v.Deleted = deleted.Time
+	return &v, nil
+}
+
+// queryVisitors returns the visitors selected by a query for
+// visitorColumns.
+func (s *pgStore) queryVisitors(ctx context.Context, query string, args ...interface{}) ([]visitorResource, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var visitors []visitorResource
+	for rows.Next() {
+		var v visitorResource
+		var rev int
+		var tags pq.StringArray
+		var deleted sql.NullTime
+		if err := rows.Scan(&v.ID, &rev, &v.Name, &v.Locale, &v.Created, &tags, &deleted); err != nil {
+			return nil, err
+		}
+		v.Rev = strconv.Itoa(rev)
+		v.Tags = tags
+		v.Deleted = deleted.Time
+		visitors = append(visitors, v)
+	}
+	return visitors, rows.Err()
+}
+
+// List pages with OFFSET, so Postgres walks the primary key through all
+// earlier pages. Keyset pagination cannot serve it: the REST API
+// addresses pages by number, and the ID a page starts after is only known
+// once the pages before it have been read. Callers that read every
+// visitor use Scan, which continues with WHERE id > $2 on the same key.
+func (s *pgStore) List(ctx context.Context, page, perPage int) ([]visitorResource, int, error) {
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM visitors WHERE guestbook = $1 AND deleted_at IS NULL`,
+		s.guestbook).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	//LIMIT NULL returns all rows.
+	var limit interface{}
+	offset := 0
+	if perPage > 0 {
+		limit, offset = perPage, (page-1)*perPage
+	}
+	visitors, err := s.queryVisitors(ctx, `SELECT `+visitorColumns+` FROM visitors
+		WHERE guestbook = $1 AND deleted_at IS NULL ORDER BY id LIMIT $2 OFFSET $3`, s.guestbook, limit, offset)
+	return visitors, total, err
+}
+
+func (s *pgStore) Scan(ctx context.Context, after string, limit int) ([]visitorResource, string, error) {
+	visitors, err := s.queryVisitors(ctx, `SELECT `+visitorColumns+` FROM visitors
+		WHERE guestbook = $1 AND id > $2 AND deleted_at IS NULL ORDER BY id LIMIT $3`, s.guestbook, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(visitors) == limit {
+		next = visitors[len(visitors)-1].ID
+	}
+	return visitors, next, nil
+}
+
+// Search matches every word of query as a prefix, e.g. "ann" finds
+// "Anna Smith". The words only contain letters and digits, so they are
+// safe to use in the tsquery syntax.
+func (s *pgStore) Search(ctx context.Context, query string, limit int) ([]visitorResource, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	for i, w := range words {
+		words[i] = w + ":*"
+	}
+	return s.queryVisitors(ctx, `SELECT `+visitorColumns+` FROM visitors
+		WHERE guestbook = $1 AND deleted_at IS NULL AND to_tsvector('simple', name) @@ to_tsquery('simple', $2)
+		ORDER BY id LIMIT $3`, s.guestbook, strings.Join(words, " & "), limit)
+}
+
+// Find pages by ID. The bookmark is the encoded ID of the last visitor.
+func (s *pgStore) Find(ctx context.Context, f *visitorFilter, bookmark string, limit int) ([]visitorResource, string, error) {
+	after, err := base64.RawURLEncoding.DecodeString(bookmark)
+	if err != nil {
+		return nil, "", errStoreBadBookmark
+	}
+	where := []string{"guestbook = $1", "id > $2", "deleted_at IS NULL"}
+	args := []interface{}{s.guestbook, string(after)}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if f.NamePrefix != "" {
+		prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.NamePrefix)
+		where = append(where, "lower(name) LIKE lower("+arg(prefix+"%")+")")
+	}
+	if f.CreatedAfter != nil {
+		where = append(where, "created_at >= "+arg(*f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		where = append(where, "created_at < "+arg(*f.CreatedBefore))
+	}
+	if len(f.Tags) > 0 {
+		where = append(where, "tags @> "+arg(pq.Array(f.Tags)))
+	}
+	if len(f.Locales) > 0 {
+		where = append(where, "locale = ANY("+arg(pq.Array(f.Locales))+")")
+	}
+	visitors, err := s.queryVisitors(ctx, `SELECT `+visitorColumns+` FROM visitors
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY id LIMIT `+arg(limit), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(visitors) == limit {
+		next = base64.RawURLEncoding.EncodeToString([]byte(visitors[len(visitors)-1].ID))
+	}
+	return visitors, next, nil
+}
+
+func (s *pgStore) Update(ctx context.Context, v *visitorResource) error {
+	rev, err := strconv.Atoi(v.Rev)
+	if err != nil {
+		return errStoreConflict
+	}
+	tags := v.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	deleted := sql.NullTime{Time: v.Deleted, Valid: !v.Deleted.IsZero()}
+	err = s.db.QueryRowContext(ctx, `UPDATE visitors SET name = $4, locale = $5, tags = $6, deleted_at = $7, rev = rev + 1, updated_at = now()
+		WHERE guestbook = $1 AND id = $2 AND rev = $3 RETURNING rev`,
+		s.guestbook, v.ID, rev, v.Name, v.Locale, pq.Array(tags), deleted).Scan(&rev)
+	if err == sql.ErrNoRows {
+		return s.missingOrConflict(ctx, v.ID)
+	} else if err != nil {
+		return err
+	}
+	v.Rev = strconv.Itoa(rev)
+	return nil
+}
+
+func (s *pgStore) Delete(ctx context.Context, id, rev string) error {
+	query := `DELETE FROM visitors WHERE guestbook = $1 AND id = $2`
+	args := []interface{}{s.guestbook, id}
+	if rev != "" {
+		n, err := strconv.Atoi(rev)
+		if err != nil {
+			return errStoreConflict
+		}
+		query += ` AND rev = $3`
+		args = append(args, n)
+	}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return s.missingOrConflict(ctx, id)
+	}
+	return nil
+}
+
+// missingOrConflict explains why a conditional write changed no row.
+func (s *pgStore) missingOrConflict(ctx context.Context, id string) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	return errStoreConflict
+}
+
+// Trash pages by deletion time and ID. The bookmark encodes both of the
+// last visitor.
+func (s *pgStore) Trash(ctx context.Context, bookmark string, limit int) ([]visitorResource, string, error) {
+	after := time.Time{}
+	var afterID string
+	if bookmark != "" {
+		b, err := base64.RawURLEncoding.DecodeString(bookmark)
+		parts := strings.SplitN(string(b), " ", 2)
+		if err != nil || len(parts) != 2 {
+			return nil, "", errStoreBadBookmark
+		}
+		if after, err = time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+			return nil, "", errStoreBadBookmark
+		}
+		afterID = parts[1]
+	}
+	visitors, err := s.queryVisitors(ctx, `SELECT `+visitorColumns+` FROM visitors
+		WHERE guestbook = $1 AND deleted_at IS NOT NULL AND (deleted_at, id) > ($2, $3)
+		ORDER BY deleted_at, id LIMIT $4`, s.guestbook, after, afterID, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(visitors) == limit {
+		last := visitors[len(visitors)-1]
+		next = base64.RawURLEncoding.EncodeToString([]byte(last.Deleted.UTC().Format(time.RFC3339Nano) + " " + last.ID))
+	}
+	return visitors, next, nil
+}
+
+func (s *pgStore) Expired(ctx context.Context, trashedBefore, createdBefore time.Time, limit int) ([]visitorResource, error) {
+	trashed := sql.NullTime{Time: trashedBefore, Valid: !trashedBefore.IsZero()}
+	created := sql.NullTime{Time: createdBefore, Valid: !createdBefore.IsZero()}
+	return s.queryVisitors(ctx, `SELECT `+visitorColumns+` FROM visitors
+		WHERE guestbook = $1 AND (deleted_at < $2 OR created_at < $3) LIMIT $4`, s.guestbook, trashed, created, limit)
+}
+
+func (s *pgStore) Count(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM visitors WHERE guestbook = $1 AND deleted_at IS NULL`,
+		s.guestbook).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) Stats(ctx context.Context) (*visitorStats, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT locale, count(*) FROM visitors WHERE guestbook = $1 AND deleted_at IS NULL GROUP BY locale`,
+		s.guestbook)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := &visitorStats{Locales: make(map[string]int)}
+	for rows.Next() {
+		var locale string
+		var n int
+		if err := rows.Scan(&locale, &n); err != nil {
+			return nil, err
+		}
+		stats.Visitors += n
+		stats.Locales[locale] = n
+	}
+	return stats, rows.Err()
+}
+
+// UpdateSeq returns the seq of the last change, the same value that Watch
+// reports.
+func (s *pgStore) UpdateSeq(ctx context.Context) (string, error) {
+	var seq int64
+	err := s.db.QueryRowContext(ctx, `SELECT coalesce(max(seq), 0) FROM visitor_changes WHERE guestbook = $1`,
+		s.guestbook).Scan(&seq)
+	return strconv.FormatInt(seq, 10), err
+}
+
+// Watch reads visitor_changes whenever the visitor_changed trigger sends
+// a notification for the guestbook. Notifications only wake the watcher
+// up, so none are lost while the listener reconnects.
+func (s *pgStore) Watch(ctx context.Context, since string, fn func(visitorChange) error) error {
+	listener := pq.NewListener(s.dsn, time.Second, time.Minute, nil)
+	defer listener.Close()
+	if err := listener.Listen("visitor_changes"); err != nil {
+		return err
+	}
+	if since == "now" {
+		var err error
+		if since, err = s.UpdateSeq(ctx); err != nil {
+			return err
+		}
+	}
+	var last int64
+	if since != "" {
+		var err error
+		if last, err = strconv.ParseInt(since, 10, 64); err != nil {
+			return fmt.Errorf("invalid since %q", since)
+		}
+	}
+	for {
+		var err error
+		if last, err = s.sendChanges(ctx, last, fn); err != nil {
+			return err
+		}
+		if err := s.waitForChange(ctx, listener); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForChange blocks until a notification for the guestbook arrives.
+func (s *pgStore) waitForChange(ctx context.Context, listener *pq.Listener) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			//n is nil after a reconnect, when changes may have been missed.
+			if n == nil || n.Extra == s.guestbook {
+				return nil
+			}
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+// sendChanges calls fn for the changes after seq and returns the seq of
+// the last one.
+func (s *pgStore) sendChanges(ctx context.Context, seq int64, fn func(visitorChange) error) (int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT c.seq, c.id, c.deleted, v.rev, v.name, v.locale, v.created_at, v.tags, v.deleted_at
+		FROM visitor_changes c LEFT JOIN visitors v ON v.guestbook = c.guestbook AND v.id = c.id
+		WHERE c.guestbook = $1 AND c.seq > $2 ORDER BY c.seq`, s.guestbook, seq)
+	if err != nil {
+		return seq, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change visitorChange
+		var rev sql.NullInt64
+		var name, locale sql.NullString
+		var created, deleted sql.NullTime
+		var tags pq.StringArray
+		if err := rows.Scan(&seq, &change.Visitor.ID, &change.Deleted, &rev, &name, &locale, &created, &tags, &deleted); err != nil {
+			return seq, err
+		}
+		//A visitor deleted after the change was read has no row left, and
+		//one in the trash is gone for watchers.
+		if !rev.Valid || deleted.Valid {
+			change.Deleted = true
+		}
+		if !change.Deleted {
+			change.Visitor.Rev = strconv.FormatInt(rev.Int64, 10)
+			change.Visitor.Name, change.Visitor.Locale = name.String, locale.String
+			change.Visitor.Created, change.Visitor.Tags = created.Time, tags
+		}
+		change.Seq = strconv.FormatInt(seq, 10)
+		if err := fn(change); err != nil {
+			return seq, err
+		}
+	}
+	return seq, rows.Err()
+}
+
+func (s *pgStore) AddAudit(ctx context.Context, rec *auditRecord) error {
+	changes, err := json.Marshal(rec.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO visitor_audit
+		(guestbook, visitor_id, action, rev, base_rev, actor, request_id, source_ip, at, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		s.guestbook, rec.VisitorID, rec.Action, rec.Rev, rec.BaseRev, rec.Actor, rec.RequestID, rec.SourceIP, rec.At, changes)
+	return err
+}
+
+func (s *pgStore) AuditTrail(ctx context.Context, id string) ([]auditRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT action, rev, base_rev, actor, request_id, source_ip, at, changes
+		FROM visitor_audit WHERE guestbook = $1 AND visitor_id = $2 ORDER BY seq`, s.guestbook, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []auditRecord
+	for rows.Next() {
+		rec := auditRecord{VisitorID: id}
+		var changes []byte
+		if err := rows.Scan(&rec.Action, &rec.Rev, &rec.BaseRev, &rec.Actor, &rec.RequestID, &rec.SourceIP, &rec.At, &changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &rec.Changes); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// Revisions only has the body of the current revision; the older ones
+// are reported as missing, like CouchDB does after a compaction. Deleted
+// visitors leave no revision behind.
+func (s *pgStore) Revisions(ctx context.Context, id string) ([]revisionInfo, error) {
+	v, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(v.Rev)
+	revs := []revisionInfo{{Rev: v.Rev, Status: "available"}}
+	for i := n - 1; i > 0; i-- {
+		revs = append(revs, revisionInfo{Rev: strconv.Itoa(i), Status: "missing"})
+	}
+	return revs, nil
+}
+
+func (s *pgStore) GetRevision(ctx context.Context, id, rev string) (*visitorResource, error) {
+	v, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if v.Rev != rev {
+		return nil, errStoreNotFound
+	}
+	return v, nil
+}
+
+// ReserveKey inserts rec, or replaces an expired record of its key.
+// Expired records of the guestbook are deleted once a minute.
+func (s *pgStore) ReserveKey(ctx context.Context, rec *idempotencyRecord) (*idempotencyRecord, error) {
+	now := time.Now().Unix()
+	if last := atomic.LoadInt64(&s.keysPurged); now-last >= 60 && atomic.CompareAndSwapInt64(&s.keysPurged, last, now) {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE guestbook = $1 AND expires_at <= now()`,
+			s.guestbook); err != nil {
+			log.Println("Can not delete expired idempotency keys:", err)
+		}
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (guestbook, key, request_hash, pending, expires_at)
+		VALUES ($1, $2, $3, true, $4)
+		ON CONFLICT (guestbook, key) DO UPDATE
+		SET request_hash = excluded.request_hash, pending = true, status = 0, header = NULL, body = NULL,
+			expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= now()`,
+		s.guestbook, rec.Key, rec.RequestHash, rec.Expires)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+	existing := &idempotencyRecord{Key: rec.Key}
+	var header []byte
+	err = s.db.QueryRowContext(ctx, `SELECT request_hash, pending, status, header, body, expires_at
+		FROM idempotency_keys WHERE guestbook = $1 AND key = $2`, s.guestbook, rec.Key).
+		Scan(&existing.RequestHash, &existing.Pending, &existing.Status, &header, &existing.Body, &existing.Expires)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		if err := json.Unmarshal(header, &existing.Header); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+func (s *pgStore) CompleteKey(ctx context.Context, rec *idempotencyRecord) error {
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE idempotency_keys
+		SET pending = false, status = $3, header = $4, body = $5, expires_at = $6
+		WHERE guestbook = $1 AND key = $2`,
+		s.guestbook, rec.Key, rec.Status, header, rec.Body, rec.Expires)
+	return err
+}
+
+func (s *pgStore) ReleaseKey(ctx context.Context, rec *idempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE guestbook = $1 AND key = $2 AND pending`,
+		s.guestbook, rec.Key)
+	return err
+}
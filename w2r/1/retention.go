@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retentionConfig says which visitors the retention job purges. A zero
+// MaxAge or TrashPeriod turns its rule off.
+type retentionConfig struct {
+	MaxAge      time.Duration // since creation, in or out of the trash
+	TrashPeriod time.Duration // since the visitor was moved to the trash
+	Interval    time.Duration
+}
+
+// retentionConfigFromEnv reads VISITOR_MAX_AGE, TRASH_RETENTION and
+// RETENTION_INTERVAL. The trash is emptied after 30 days by default;
+// visitors are kept for good unless VISITOR_MAX_AGE is set.
+func retentionConfigFromEnv() retentionConfig {
+	cfg := retentionConfig{TrashPeriod: 30 * 24 * time.Hour, Interval: time.Hour}
+	for _, d := range []struct {
+		name string
+		dst  *time.Duration
+		min  time.Duration
+	}{
+		{"VISITOR_MAX_AGE", &cfg.MaxAge, 0},
+		{"TRASH_RETENTION", &cfg.TrashPeriod, 0},
+		{"RETENTION_INTERVAL", &cfg.Interval, time.Minute},
+	} {
+		v := os.Getenv(d.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < d.min {
+			log.Printf("ignoring invalid %s %q", d.name, v)
+			continue
+		}
+		*d.dst = parsed
+	}
+	return cfg
+}
+
+// retentionBatch is the number of expired visitors read at once.
+const retentionBatch = 100
+
+// Reasons for purging a visitor.
+const (
+	purgeTrash = "trash" // its trash period ended
+	purgeAge   = "age"   // it is older than VISITOR_MAX_AGE
+)
+
+// purgedVisitor is a visitor that the retention job removed.
+type purgedVisitor struct {
+	Guestbook string // tenant name, empty for the single guestbook
+	ID        string
+	Reason    string
+	Created   time.Time
+	Deleted   time.Time
+}
+
+// purgeReport lists what a run of the retention job removed.
+type purgeReport struct {
+	Started  time.Time
+	Finished time.Time
+	Purged   []purgedVisitor
+	Failures int
+}
+
+// retentionJob purges the visitors whose trash period ended or who are
+// older than the maximum age, from every guestbook that guestbooks
+// returns by tenant name. Each purge is recorded in the audit trail of
+// the visitor with the actor retention. Instances run the job on their
+// own; a visitor that another instance purged first is skipped.
+type retentionJob struct {
+	visitors   *visitorService
+	guestbooks func(ctx context.Context) (map[string]VisitorStore, error)
+	cfg        retentionConfig
+
+	mu       sync.Mutex
+	runs     int64
+	failures int64
+	purged   map[string]int64 // by reason
+	last     *purgeReport
+}
+
+func newRetentionJob(visitors *visitorService, guestbooks func(ctx context.Context) (map[string]VisitorStore, error), cfg retentionConfig) *retentionJob {
+	return &retentionJob{visitors: visitors, guestbooks: guestbooks, cfg: cfg, purged: make(map[string]int64)}
+}
+
+// Idle reports whether both rules are off.
+func (j *retentionJob) Idle() bool {
+	return j.cfg.MaxAge <= 0 && j.cfg.TrashPeriod <= 0
+}
+
+// run purges every Interval until ctx is done, starting right away.
+func (j *retentionJob) run(ctx context.Context) {
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		j.purge(ctx, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// purge removes the visitors that expired by now and logs its report.
+func (j *retentionJob) purge(ctx context.Context, now time.Time) *purgeReport {
+	report := &purgeReport{Started: now}
+	var trashedBefore, createdBefore time.Time
+	if j.cfg.TrashPeriod > 0 {
+		trashedBefore = now.Add(-j.cfg.TrashPeriod)
+	}
+	if j.cfg.MaxAge > 0 {
+		createdBefore = now.Add(-j.cfg.MaxAge)
+	}
+	ctx = withAuditInfo(ctx, auditInfo{Actor: "retention"})
+	guestbooks, err := j.guestbooks(ctx)
+	if err != nil {
+		log.Println("retention: can not list the guestbooks:", err)
+		report.Failures++
+	}
+	names := make([]string, 0, len(guestbooks))
+	for name := range guestbooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		j.purgeGuestbook(ctx, report, name, guestbooks[name], trashedBefore, createdBefore)
+	}
+	report.Finished = time.Now()
+
+	trash := 0
+	for _, p := range report.Purged {
+		if p.Reason == purgeTrash {
+			trash++
+		}
+		log.Printf("retention: purged visitor %s%s (%s, created %s, deleted %s)", guestbookPrefix(p.Guestbook), p.ID, p.Reason,
+			formatReportTime(p.Created), formatReportTime(p.Deleted))
+	}
+	if len(report.Purged) > 0 || report.Failures > 0 {
+		log.Printf("retention: purged %d visitors, %d from the trash and %d by age, with %d failures in %s",
+			len(report.Purged), trash, len(report.Purged)-trash, report.Failures, report.Finished.Sub(report.Started).Round(time.Millisecond))
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runs++
+	j.failures += int64(report.Failures)
+	j.purged[purgeTrash] += int64(trash)
+	j.purged[purgeAge] += int64(len(report.Purged) - trash)
+	j.last = report
+	return report
+}
+
+// purgeGuestbook purges the expired visitors of one guestbook, a batch
+// at a time, until a batch is not full or purged nothing.
+func (j *retentionJob) purgeGuestbook(ctx context.Context, report *purgeReport, name string, store VisitorStore, trashedBefore, createdBefore time.Time) {
+	for ctx.Err() == nil {
+		expired, err := store.Expired(ctx, trashedBefore, createdBefore, retentionBatch)
+		if err != nil {
+			log.Printf("retention: can not read the expired visitors of %s: %v", guestbookName(name), err)
+			report.Failures++
+			return
+		}
+		purged := 0
+		for i := range expired {
+			v := &expired[i]
+			reason := purgeAge
+			if !v.Deleted.IsZero() && !trashedBefore.IsZero() && v.Deleted.Before(trashedBefore) {
+				reason = purgeTrash
+			}
+			err := j.visitors.purge(ctx, store, v)
+			switch err {
+			case nil:
+				purged++
+				report.Purged = append(report.Purged, purgedVisitor{Guestbook: name, ID: v.ID, Reason: reason, Created: v.Created, Deleted: v.Deleted})
+			case errNoVisitor, errVisitorConflict:
+				//Purged or changed meanwhile, the next run sees it again.
+			default:
+				log.Printf("retention: can not purge visitor %s%s: %v", guestbookPrefix(name), v.ID, err)
+				report.Failures++
+			}
+		}
+		if len(expired) < retentionBatch || purged == 0 {
+			return
+		}
+	}
+}
+
+func guestbookName(name string) string {
+	if name == "" {
+		return "the guestbook"
+	}
+	return "tenant " + name
+}
+
+func guestbookPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + "/"
+}
+
+func formatReportTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeMetrics writes the job metrics in the Prometheus text format.
+func (j *retentionJob) writeMetrics(w io.Writer) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fmt.Fprintf(w, "# HELP retention_runs_total Runs of the retention job.\n# TYPE retention_runs_total counter\nretention_runs_total %d\n", j.runs)
+	fmt.Fprintf(w, "# HELP retention_purged_total Visitors purged by the retention job.\n# TYPE retention_purged_total counter\n")
+	for _, reason := range []string{purgeAge, purgeTrash} {
+		fmt.Fprintf(w, "retention_purged_total{reason=%q} %d\n", reason, j.purged[reason])
+	}
+	fmt.Fprintf(w, "# HELP retention_failures_total Visitors and guestbooks the retention job failed to purge.\n# TYPE retention_failures_total counter\nretention_failures_total %d\n", j.failures)
+	if j.last != nil {
+		fmt.Fprintf(w, "# HELP retention_last_run_timestamp_seconds When the last run of the retention job finished.\n# TYPE retention_last_run_timestamp_seconds gauge\nretention_last_run_timestamp_seconds %d\n", j.last.Finished.Unix())
+		fmt.Fprintf(w, "# HELP retention_last_run_purged Visitors purged by the last run of the retention job.\n# TYPE retention_last_run_purged gauge\nretention_last_run_purged %d\n", len(j.last.Purged))
+	}
+}
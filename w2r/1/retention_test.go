@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPurges(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	service := &visitorService{}
+	add := func(name string) *visitorResource {
+		t.Helper()
+		v, err := store.Add(ctx, Visitor{Name: name, Created: time.Now().UTC().Format(createdLayout)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	trashed, kept := add("Trashed"), add("Kept")
+	if err := service.Delete(ctx, store, trashed.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	guestbooks := func(context.Context) (map[string]VisitorStore, error) {
+		return map[string]VisitorStore{"": store}, nil
+	}
+	job := newRetentionJob(service, guestbooks, retentionConfig{MaxAge: 48 * time.Hour, TrashPeriod: 24 * time.Hour})
+
+	//Nothing has expired yet.
+	if report := job.purge(ctx, time.Now()); len(report.Purged) != 0 || report.Failures != 0 {
+		t.Fatalf("first run purged %+v with %d failures", report.Purged, report.Failures)
+	}
+	//After the trash period only the visitor in the trash expired.
+	report := job.purge(ctx, time.Now().Add(25*time.Hour))
+	if len(report.Purged) != 1 || report.Purged[0].ID != trashed.ID || report.Purged[0].Reason != purgeTrash || report.Failures != 0 {
+		t.Fatalf("run after the trash period purged %+v with %d failures", report.Purged, report.Failures)
+	}
+	if _, err := store.Get(ctx, kept.ID); err != nil {
+		t.Errorf("the visitor outside the trash was purged: %v", err)
+	}
+	//After the maximum age every visitor expired.
+	report = job.purge(ctx, time.Now().Add(49*time.Hour))
+	if len(report.Purged) != 1 || report.Purged[0].ID != kept.ID || report.Purged[0].Reason != purgeAge {
+		t.Fatalf("run after the maximum age purged %+v", report.Purged)
+	}
+
+	for _, v := range []*visitorResource{trashed, kept} {
+		records, err := store.AuditTrail(ctx, v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := records[len(records)-1]
+		if last.Action != auditPurge || last.Actor != "retention" || last.BaseRev == "" || len(last.Changes) == 0 {
+			t.Errorf("last audit record of %s: %+v, want a purge by retention", v.Name, last)
+		}
+	}
+
+	var metrics bytes.Buffer
+	job.writeMetrics(&metrics)
+	for _, want := range []string{"retention_runs_total 3", `retention_purged_total{reason="trash"} 1`, `retention_purged_total{reason="age"} 1`, "retention_failures_total 0"} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("metrics do not contain %s:\n%s", want, metrics.String())
+		}
+	}
+}
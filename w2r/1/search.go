@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// visitorFilter selects visitors for POST /api/v1/visitors/search. All
+// conditions that are set must hold; an empty filter matches every
+// visitor. Each store translates it into its own query language, so
+// clients never send database queries.
+type visitorFilter struct {
+	NamePrefix    string     // start of the name, ignoring case
+	CreatedAfter  *time.Time // inclusive
+	CreatedBefore *time.Time // exclusive
+	Tags          []string   // visitors with all of these tags
+	Locales       []string   // visitors with one of these locales
+}
+
+// visitorSearch is the body of a search request.
+type visitorSearch struct {
+	NamePrefix    string   `json:"name_prefix"`
+	CreatedAfter  string   `json:"created_after"`
+	CreatedBefore string   `json:"created_before"`
+	Tags          []string `json:"tags"`
+	Locales       []string `json:"locales"`
+	Limit         int      `json:"limit"`
+	Bookmark      string   `json:"bookmark"`
+}
+
+const (
+	maxSearchBody = 16 << 10
+	maxNamePrefix = 100
+	maxLocales    = 20
+	maxBookmark   = 2048
+)
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// parseVisitorSearch decodes and validates a search request. Unknown
+// fields are rejected, so that a misspelled condition does not silently
+// widen the search.
+func parseVisitorSearch(body []byte) (*visitorFilter, string, int, error) {
+	var req visitorSearch
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, "", 0, invalidSearch("invalid body: " + err.Error())
+	}
+	f := &visitorFilter{NamePrefix: strings.TrimSpace(req.NamePrefix)}
+	if utf8.RuneCountInString(f.NamePrefix) > maxNamePrefix {
+		return nil, "", 0, invalidSearch(fmt.Sprintf("name_prefix must be at most %d characters", maxNamePrefix))
+	}
+	var err error
+	if f.CreatedAfter, err = parseSearchTime("created_after", req.CreatedAfter); err != nil {
+		return nil, "", 0, err
+	}
+	if f.CreatedBefore, err = parseSearchTime("created_before", req.CreatedBefore); err != nil {
+		return nil, "", 0, err
+	}
+	if f.CreatedAfter != nil && f.CreatedBefore != nil && !f.CreatedAfter.Before(*f.CreatedBefore) {
+		return nil, "", 0, invalidSearch("created_after must be before created_before")
+	}
+	var ok bool
+	if f.Tags, ok = normalizeTags(req.Tags); !ok {
+		return nil, "", 0, errInvalidTags
+	}
+	if len(req.Locales) > maxLocales {
+		return nil, "", 0, invalidSearch(fmt.Sprintf("at most %d locales may be given", maxLocales))
+	}
+	for _, l := range req.Locales {
+		if !localePattern.MatchString(l) {
+			return nil, "", 0, invalidSearch(fmt.Sprintf("invalid locale %q", l))
+		}
+		f.Locales = append(f.Locales, l)
+	}
+	limit := req.Limit
+	switch {
+	case limit == 0:
+		limit = defaultPerPage
+	case limit < 0 || limit > maxPerPage:
+		return nil, "", 0, invalidSearch(fmt.Sprintf("limit must be between 1 and %d", maxPerPage))
+	}
+	if len(req.Bookmark) > maxBookmark {
+		return nil, "", 0, errInvalidBookmark
+	}
+	return f, req.Bookmark, limit, nil
+}
+
+// parseSearchTime accepts RFC 3339 times and dates, which stand for
+// midnight UTC.
+func parseSearchTime(field, s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", s); err != nil {
+			return nil, invalidSearch(field + " must be an RFC 3339 time or a date like 2026-10-19")
+		}
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+func invalidSearch(message string) *apiError {
+	return &apiError{http.StatusBadRequest, codeInvalidRequest, message}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseVisitorSearchRejects(t *testing.T) {
+	for _, body := range []string{
+		//Unknown fields, including raw database queries.
+		`{"selector": {"name": {"$gt": null}}}`,
+		`{"name": "Bob"}`,
+		`{"name_prefix": "B", "$or": [{"name": "Bob"}]}`,
+		//Operators in place of values.
+		`{"name_prefix": {"$regex": ".*"}}`,
+		`{"tags": {"$all": ["vip"]}}`,
+		`{"created_after": {"$gt": ""}}`,
+		`{"locales": [{"$ne": "de"}]}`,
+		`{"locales": ["$or"]}`,
+		`{"tags": ["$exists"]}`,
+		//Invalid values.
+		`{"created_after": "yesterday"}`,
+		`{"created_after": "2026-10-19", "created_before": "2026-10-01"}`,
+		`{"limit": -1}`,
+		`{"name_prefix": "` + strings.Repeat("a", maxNamePrefix+1) + `"}`,
+	} {
+		if _, _, _, err := parseVisitorSearch([]byte(body)); err == nil {
+			t.Errorf("%s was accepted", body)
+		} else if e, ok := err.(*apiError); !ok || e.Status != http.StatusBadRequest {
+			t.Errorf("%s: %v, want a 400 apiError", body, err)
+		}
+	}
+
+	f, _, limit, err := parseVisitorSearch([]byte(`{"name_prefix": " An ", "created_after": "2026-10-01", "tags": ["VIP"], "locales": ["de", "pt-BR"], "limit": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.NamePrefix != "An" || f.CreatedAfter == nil || f.CreatedBefore != nil || len(f.Tags) != 1 || f.Tags[0] != "vip" || len(f.Locales) != 2 || limit != 5 {
+		t.Errorf("filter %+v with limit %d", f, limit)
+	}
+}
+
+// selectorOperators returns the operators used anywhere in sel.
+func selectorOperators(sel interface{}, ops map[string]bool) {
+	switch sel := sel.(type) {
+	case map[string]interface{}:
+		for k, v := range sel {
+			if strings.HasPrefix(k, "$") {
+				ops[k] = true
+			}
+			selectorOperators(v, ops)
+		}
+	case []interface{}:
+		for _, v := range sel {
+			selectorOperators(v, ops)
+		}
+	}
+}
+
+func TestMangoSelectorQuotesValues(t *testing.T) {
+	f, _, _, err := parseVisitorSearch([]byte(`{"name_prefix": ".*|$or", "created_after": "2026-10-01", "created_before": "2026-10-19", "tags": ["vip"], "locales": ["de"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The selector is decoded again, as CouchDB would see it.
+	data, err := json.Marshal(mangoSelector(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sel map[string]interface{}
+	json.Unmarshal(data, &sel)
+
+	var fields []string
+	for k := range sel {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	if got := strings.Join(fields, " "); got != "created_at deleted_at locale name tags" {
+		t.Errorf("selector fields %s", got)
+	}
+	ops := make(map[string]bool)
+	selectorOperators(sel, ops)
+	for op := range ops {
+		switch op {
+		case "$regex", "$exists", "$gte", "$lt", "$all", "$in":
+		default:
+			t.Errorf("selector uses %s", op)
+		}
+	}
+	if regex := sel["name"].(map[string]interface{})["$regex"]; regex != `(?i)^\.\*\|\$or` {
+		t.Errorf("name prefix as %v, want it quoted", regex)
+	}
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	hs := newTestApp(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+	for _, name := range []string{"Anna", "Annabel", "Bob", ".*"} {
+		send(t, "POST", hs.URL+"/api/v1/visitors", `{"name": "`+name+`"}`)
+	}
+
+	for _, path := range []string{"/api/visitors/search", "/api/v1/visitors/search"} {
+		search := func(body string) (*http.Response, map[string]interface{}) {
+			t.Helper()
+			resp, err := http.Post(hs.URL+path, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var out map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&out)
+			return resp, out
+		}
+		names := func(out map[string]interface{}) string {
+			var names []string
+			for _, v := range out["visitors"].([]interface{}) {
+				v := v.(map[string]interface{})
+				if _, ok := v["_rev"]; ok {
+					t.Errorf("%s returned %v, want the v1 format", path, v)
+				}
+				names = append(names, v["name"].(string))
+			}
+			sort.Strings(names)
+			return strings.Join(names, " ")
+		}
+
+		resp, out := search(`{"name_prefix": "ann"}`)
+		if resp.StatusCode != http.StatusOK || names(out) != "Anna Annabel" {
+			t.Errorf("%s for ann: %s %v", path, resp.Status, out)
+		}
+		if resp.Header.Get("Deprecation") != "" || resp.Header.Get("Sunset") != "" {
+			t.Errorf("%s is deprecated: %v", path, resp.Header)
+		}
+		if _, out := search(`{"name_prefix": ".*"}`); names(out) != ".*" {
+			t.Errorf("%s for .*: %v, want only the visitor named .*", path, out)
+		}
+		//The OpenAPI validator rejects the body before the handler does.
+		if resp, out := search(`{"selector": {"name": {"$gt": null}}}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s with a selector: %s %v", path, resp.Status, out)
+		}
+	}
+}
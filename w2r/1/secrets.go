@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/timjacobi/go-couchdb"
+)
+
+// secretFromEnv returns the value of the variable name, or the content
+// of the file named by name_FILE, so that secrets can be mounted as
+// files instead of being passed in the environment.
+func secretFromEnv(name string) string {
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		return os.Getenv(name)
+	}
+	value, err := readSecret(file)
+	if err != nil {
+		log.Printf("Can not read %s_FILE: %v", name, err)
+	}
+	return value
+}
+
+func readSecret(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	return strings.TrimSpace(string(b)), err
+}
+
+// secretsReloadIntervalFromEnv returns how often mounted secrets are
+// checked for changes, SECRETS_RELOAD_INTERVAL.
+func secretsReloadIntervalFromEnv() time.Duration {
+	d := 10 * time.Second
+	if v := os.Getenv("SECRETS_RELOAD_INTERVAL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			log.Printf("ignoring invalid SECRETS_RELOAD_INTERVAL %q", v)
+		} else {
+			d = parsed
+		}
+	}
+	return d
+}
+
+// fileStamp identifies the current version of files by their sizes and
+// modification times. Stat follows symlinks, so the atomic updates of
+// Kubernetes secret volumes count as changes.
+func fileStamp(files ...string) (string, error) {
+	var b strings.Builder
+	for _, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// couchDrainTimeout is how long requests of a replaced client may run
+// before they are canceled. Changes feeds never end on their own, so
+// they are always canceled and reconnect with the new client.
+const couchDrainTimeout = 30 * time.Second
+
+// couchConn holds the CouchDB client in use. When the database URL
+// changes, a new client is checked and swapped in, and the old one is
+// drained.
+type couchConn struct {
+	rt      http.RoundTripper
+	checkRT http.RoundTripper // without retries and circuit breaker
+	checkDB string            // database the credentials must be able to read
+	current atomic.Pointer[couchClient]
+
+	rotations int64
+	failures  int64
+}
+
+// couchClient is one generation of the client. Its requests are tracked
+// so that it can be drained.
+type couchClient struct {
+	*couchdb.Client
+	rt       http.RoundTripper
+	ctx      context.Context // canceled when the drain times out
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+	url      string
+}
+
+// newCouchConn connects to rawurl through rt. Before a rotation, checkDB
+// is read through checkRT to make sure that the new credentials work,
+// without a failure counting against the client in use.
+func newCouchConn(rawurl string, rt, checkRT http.RoundTripper, checkDB string) (*couchConn, error) {
+	conn := &couchConn{rt: rt, checkRT: checkRT, checkDB: checkDB}
+	cl, err := conn.newClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	conn.current.Store(cl)
+	return conn, nil
+}
+
+func (conn *couchConn) newClient(rawurl string) (*couchClient, error) {
+	cl := &couchClient{rt: conn.rt, url: rawurl}
+	cl.ctx, cl.cancel = context.WithCancel(context.Background())
+	client, err := couchdb.NewClient(rawurl, cl)
+	if err != nil {
+		return nil, err
+	}
+	cl.Client = client
+	return cl, nil
+}
+
+// Client returns the client in use.
+func (conn *couchConn) Client() *couchdb.Client {
+	return conn.current.Load().Client
+}
+
+// DB returns a handle of the database name on the client in use.
+func (conn *couchConn) DB(name string) *couchdb.DB {
+	return conn.Client().DB(name)
+}
+
+// rotate switches to a client for rawurl once it answers a ping and can
+// read checkDB. On failure the current client stays in use.
+func (conn *couchConn) rotate(ctx context.Context, rawurl string) error {
+	check, err := couchdb.NewClient(rawurl, conn.checkRT)
+	if err == nil {
+		err = check.PingContext(ctx)
+	}
+	if err == nil {
+		//HEAD / works without credentials, so also read a database.
+		var result alldocsResult
+		err = check.DB(conn.checkDB).AllDocsContext(ctx, &result, couchdb.Options{"limit": 0})
+	}
+	if err != nil {
+		atomic.AddInt64(&conn.failures, 1)
+		return err
+	}
+	next, err := conn.newClient(rawurl)
+	if err != nil {
+		return err
+	}
+	old := conn.current.Swap(next)
+	atomic.AddInt64(&conn.rotations, 1)
+	log.Printf("Rotated the CouchDB credentials, now using %s", next.URL())
+	go old.drain(couchDrainTimeout)
+	return nil
+}
+
+// watch rotates the client whenever file changes, until ctx is done.
+func (conn *couchConn) watch(ctx context.Context, file string, interval time.Duration) {
+	last, _ := fileStamp(file)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		stamp, err := fileStamp(file)
+		if err != nil || stamp == last {
+			continue
+		}
+		//A file caught mid-update changes again, so a failed rotation is
+		//retried with the next version.
+		last = stamp
+		rawurl, err := readSecret(file)
+		if err == nil && rawurl == conn.current.Load().url {
+			continue
+		}
+		if err == nil {
+			checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err = conn.rotate(checkCtx, rawurl)
+			cancel()
+		}
+		if err != nil {
+			log.Printf("Can not rotate the CouchDB credentials from %s, keeping the current ones: %v", file, err)
+		}
+	}
+}
+
+// RoundTrip counts the request as in flight until its body is closed,
+// and cancels it if the drain times out.
+func (cl *couchClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	cl.inflight.Add(1)
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(cl.ctx, cancel)
+	done := func() {
+		stop()
+		cancel()
+		cl.inflight.Done()
+	}
+	resp, err := cl.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &drainingBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+// drainingBody ends a tracked request when it is closed.
+type drainingBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *drainingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// drain waits for the requests in flight and cancels those still running
+// after timeout.
+func (cl *couchClient) drain(timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		cl.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Println("Canceling the requests still using the previous CouchDB credentials")
+		cl.cancel()
+		<-drained
+	}
+	cl.cancel()
+	log.Println("Drained the previous CouchDB client")
+}
+
+// writeMetrics implements metricsSource.
+func (conn *couchConn) writeMetrics(w io.Writer) {
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"couchdb_credential_rotations_total", "counter", "Switches to a new CouchDB client after the URL changed.", atomic.LoadInt64(&conn.rotations)},
+		{"couchdb_credential_rotation_failures_total", "counter", "Changed CouchDB URLs that failed the connection check.", atomic.LoadInt64(&conn.failures)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
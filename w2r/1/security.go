@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cspReportPath receives Content-Security-Policy violation reports.
+const cspReportPath = "/api/csp-report"
+
+// defaultCSP is a strict nonce-based policy. {nonce} is replaced with the
+// per-request nonce and {report} with the report endpoint.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'nonce-{nonce}' 'strict-dynamic'; " +
+	"style-src 'self'; img-src 'self' data:; font-src 'self'; " +
+	"object-src 'none'; base-uri 'none'; form-action 'self'; " +
+	"frame-ancestors 'none'; report-uri {report}; report-to csp-endpoint"
+
+// SecurityConfig selects the security headers set on every response.
+// An empty string disables a header.
+type SecurityConfig struct {
+	CSP                   string
+	CSPReportOnly         bool
+	HSTSMaxAge            int // seconds, 0 disables HSTS
+	HSTSIncludeSubdomains bool
+	FrameOptions          string
+	ReferrerPolicy        string
+	ContentTypeOptions    string
+}
+
+// securityConfigFromEnv reads the SECURITY_* variables. Headers are on by
+// default; set a variable to "off" to disable its header.
+func securityConfigFromEnv() SecurityConfig {
+	cfg := SecurityConfig{
+		CSP:                   envOr("SECURITY_CSP", defaultCSP),
+		CSPReportOnly:         os.Getenv("SECURITY_CSP_REPORT_ONLY") == "true",
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubdomains: os.Getenv("SECURITY_HSTS_INCLUDE_SUBDOMAINS") == "true",
+		FrameOptions:          envOr("SECURITY_FRAME_OPTIONS", "DENY"),
+		ReferrerPolicy:        envOr("SECURITY_REFERRER_POLICY", "strict-origin-when-cross-origin"),
+		ContentTypeOptions:    envOr("SECURITY_CONTENT_TYPE_OPTIONS", "nosniff"),
+	}
+	if v := os.Getenv("SECURITY_HSTS_MAX_AGE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.HSTSMaxAge = n
+		} else if v == "off" {
+			cfg.HSTSMaxAge = 0
+		} else {
+			log.Printf("ignoring invalid SECURITY_HSTS_MAX_AGE %q", v)
+		}
+	}
+	return cfg
+}
+
+// envOr returns the value of the environment variable key, def if it is
+// unset, or "" if it is "off".
+func envOr(key, def string) string {
+	v := os.Getenv(key)
+	switch v {
+	case "":
+		return def
+	case "off":
+		return ""
+	}
+	return v
+}
+
+// securityHeaders sets the configured security headers. A fresh CSP nonce
+// is generated for every request and stored in the gin context under
+// "cspNonce" for the templates.
+func securityHeaders(cfg SecurityConfig) gin.HandlerFunc {
+	cspHeader := "Content-Security-Policy"
+	if cfg.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+	hsts := "max-age=" + strconv.Itoa(cfg.HSTSMaxAge)
+	if cfg.HSTSIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	return func(c *gin.Context) {
+		h := c.Writer.Header()
+		if cfg.CSP != "" {
+			nonce, err := newNonce()
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			c.Set("cspNonce", nonce)
+			policy := strings.Replace(cfg.CSP, "{nonce}", nonce, -1)
+			policy = strings.Replace(policy, "{report}", cspReportPath, -1)
+			h.Set(cspHeader, policy)
+			h.Set("Reporting-Endpoints", `csp-endpoint="`+cspReportPath+`"`)
+		}
+		if cfg.HSTSMaxAge > 0 && isTLS(c.Request) {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		if cfg.FrameOptions != "" {
+			h.Set("X-Frame-Options", cfg.FrameOptions)
+		}
+		if cfg.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+		if cfg.ContentTypeOptions != "" {
+			h.Set("X-Content-Type-Options", cfg.ContentTypeOptions)
+		}
+		c.Next()
+	}
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// isTLS reports whether the client connected over TLS, either to the app
+// itself or to a proxy in front of it, like the Cloud Foundry router.
+func isTLS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// cspNonce returns the nonce generated by securityHeaders for the request.
+func cspNonce(c *gin.Context) string {
+	v, _ := c.Get("cspNonce")
+	nonce, _ := v.(string)
+	return nonce
+}
+
+/**
+ * Endpoint for CSP violation reports.
+ * Accepts both the report-uri format ({"csp-report": {...}}) and the
+ * Reporting API format ([{"type": "csp-violation", "body": {...}}]).
+ */
+func cspReportHandler(c *gin.Context) {
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var legacy struct {
+		Report map[string]interface{} `json:"csp-report"`
+	}
+	var reports []struct {
+		Type string                 `json:"type"`
+		URL  string                 `json:"url"`
+		Body map[string]interface{} `json:"body"`
+	}
+	switch {
+	case json.Unmarshal(body, &legacy) == nil && legacy.Report != nil:
+		logCSPViolation(legacy.Report)
+	case json.Unmarshal(body, &reports) == nil:
+		for _, r := range reports {
+			if r.Type == "csp-violation" {
+				logCSPViolation(r.Body)
+			}
+		}
+	default:
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// logCSPViolation logs a report. Its fields are sent by the client, so
+// they are quoted to keep them from forging log lines.
+func logCSPViolation(report map[string]interface{}) {
+	field := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := report[k]; ok {
+				return fmt.Sprint(v)
+			}
+		}
+		return ""
+	}
+	log.Printf("CSP violation: document=%q directive=%q blocked=%q source=%q:%q",
+		field("document-uri", "documentURL"),
+		field("violated-directive", "effectiveDirective"),
+		field("blocked-uri", "blockedURL"),
+		field("source-file", "sourceFile"),
+		field("line-number", "lineNumber"))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/IBM-Cloud/get-started-go/visitorpb"
+)
+
+func TestCSPNonce(t *testing.T) {
+	hs := newTestApp(t, nil)
+
+	nonces := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", hs.URL+"/", nil)
+		req.Header.Set("Accept", "text/html")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		m := regexp.MustCompile(`script-src 'nonce-([A-Za-z0-9_-]+)'`).FindStringSubmatch(resp.Header.Get("Content-Security-Policy"))
+		if m == nil {
+			t.Fatalf("Content-Security-Policy %q has no nonce", resp.Header.Get("Content-Security-Policy"))
+		}
+		scripts := regexp.MustCompile(`<script [^>]*nonce="([^"]*)"`).FindAllStringSubmatch(string(body), -1)
+		if len(scripts) == 0 {
+			t.Fatal("the index page has no script with a nonce")
+		}
+		for _, s := range scripts {
+			if s[1] != m[1] {
+				t.Errorf("script nonce %q, header nonce %q", s[1], m[1])
+			}
+		}
+		nonces[m[1]] = true
+	}
+	if len(nonces) != 2 {
+		t.Error("two requests got the same nonce")
+	}
+}
+
+func TestHSTSOnlyOverTLS(t *testing.T) {
+	hs := newTestApp(t, nil)
+
+	for _, proto := range []string{"", "http", "https"} {
+		req, _ := http.NewRequest("GET", hs.URL+"/readyz", nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		hsts := resp.Header.Get("Strict-Transport-Security")
+		if want := proto == "https"; (hsts != "") != want {
+			t.Errorf("X-Forwarded-Proto %q: Strict-Transport-Security %q", proto, hsts)
+		}
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("X-Frame-Options") != "DENY" {
+			t.Errorf("X-Forwarded-Proto %q: headers %v", proto, resp.Header)
+		}
+	}
+}
+
+func TestCSPReport(t *testing.T) {
+	hs := newTestApp(t, nil)
+	var logged bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	tests := []struct {
+		contentType, body string
+		status            int
+	}{
+		{"application/csp-report", `{"csp-report": {"document-uri": "http://localhost/", "violated-directive": "script-src", "blocked-uri": "inline"}}`, http.StatusNoContent},
+		{"application/reports+json", `[{"type": "csp-violation", "body": {"documentURL": "http://localhost/", "effectiveDirective": "img-src", "blockedURL": "https://evil.example/x.png"}}]`, http.StatusNoContent},
+		{"application/csp-report", `{"csp-report": {"document-uri": "http://localhost/\nCSP violation: forged", "line-number": 12}}`, http.StatusNoContent},
+		{"application/csp-report", `not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(hs.URL+cspReportPath, tt.contentType, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("report %s: status %d, want %d", tt.body, resp.StatusCode, tt.status)
+		}
+	}
+	for _, want := range []string{`directive="script-src"`, `blocked="https://evil.example/x.png"`, `document="http://localhost/\nCSP violation: forged"`, `:"12"`} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log does not contain %q:\n%s", want, logged.String())
+		}
+	}
+}
+
+func TestNamesEscaped(t *testing.T) {
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	cfg := newTestRouterConfig(t, store)
+	hs := newTestApp(t, store)
+	name := `<script>alert("x")</script>`
+	escaped := html.EscapeString(name)
+
+	resp, err := http.Post(hs.URL+"/api/visitors", "application/json", strings.NewReader(`{"name": "<script>alert(\"x\")</script>"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Hello "+escaped {
+		t.Errorf("legacy create: %d %s", resp.StatusCode, body)
+	}
+
+	resp, err = http.Post(hs.URL+"/api/v1/visitors", "application/json", strings.NewReader(`{"name": "<script>alert(\"x\")</script>"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct{ Name, Greeting string }
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Name != escaped || created.Greeting != "Hello "+escaped {
+		t.Errorf("v1 create = %+v", created)
+	}
+
+	req, _ := http.NewRequest("GET", hs.URL+"/api/v1/visitors", nil)
+	req.Header.Set("Accept", mimeNDJSON)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for sc := bufio.NewScanner(resp.Body); sc.Scan(); lines++ {
+		var v struct{ Name string }
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil || v.Name != escaped {
+			t.Errorf("streamed %s", sc.Text())
+		}
+	}
+	resp.Body.Close()
+	if lines != 2 {
+		t.Errorf("streamed %d visitors, want 2", lines)
+	}
+
+	req, _ = http.NewRequest("GET", hs.URL+"/api/visitors", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []struct{ Doc struct{ Name string } }
+	err = json.NewDecoder(resp.Body).Decode(&rows)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("legacy list has %d rows, want 2", len(rows))
+	}
+	for _, row := range rows {
+		if row.Doc.Name != escaped {
+			t.Errorf("legacy list name %q, want %q", row.Doc.Name, escaped)
+		}
+	}
+
+	srv := &grpcVisitorServer{visitors: cfg.Visitors.visitors, store: store}
+	v, err := srv.Create(context.Background(), &visitorpb.CreateVisitorRequest{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != escaped || v.Greeting != "Hello "+escaped {
+		t.Errorf("gRPC Create = %+v", v)
+	}
+}
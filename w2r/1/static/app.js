@@ -0,0 +1,53 @@
+"use strict";
+
+//The welcome form works without JavaScript. When script is available it is
+//submitted in the background and only the visitor list is reloaded.
+(function() {
+    var form = document.getElementById("nameInput");
+    var response = document.getElementById("response");
+
+    //Retrieve the server-rendered visitor list
+    function getNames() {
+        var query = location.search ? location.search + "&" : "?";
+        var req = new XMLHttpRequest();
+        req.open("GET", location.pathname + query + "partial=visitors");
+        req.setRequestHeader("Accept", "text/html");
+        req.onload = function() {
+            if (req.status == 200) {
+                document.getElementById("visitors").outerHTML = req.responseText;
+            }
+        };
+        req.send();
+    }
+
+    if (!form) {
+        return;
+    }
+    form.addEventListener("submit", function(e) {
+        e.preventDefault();
+        var name = document.getElementById("user_name").value;
+        if (name.length == 0) {
+            return;
+        }
+        form.style.display = "none";
+        response.textContent = form.getAttribute("data-loading");
+        //POST request to API to create a new visitor entry in the database
+        var req = new XMLHttpRequest();
+        req.open("POST", form.getAttribute("action").replace(/api\/visitors$/, "api/v1/visitors"));
+        req.setRequestHeader("Content-Type", "application/json");
+        req.onload = function() {
+            var body = {};
+            try {
+                body = JSON.parse(req.responseText);
+            } catch (err) {}
+            //The API escapes the greeting, so it must not be escaped again
+            if (body.greeting) {
+                response.innerHTML = body.greeting;
+            } else {
+                response.textContent = body.error || "";
+            }
+            getNames();
+        };
+        req.send(JSON.stringify({name: name, lang: form.elements.lang.value}));
+    });
+})();
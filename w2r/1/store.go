@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+)
+
+// Storage backends, selected with the STORE_BACKEND environment variable.
+const (
+	storeCouchDB  = "couchdb"
+	storePostgres = "postgres"
+)
+
+var (
+	errStoreNotFound    = errors.New("store: visitor not found")
+	errStoreConflict    = errors.New("store: revision conflict")
+	errStoreBusy        = errors.New("store: write queue is full")
+	errStoreBadBookmark = errors.New("store: invalid bookmark")
+)
+
+// VisitorStore persists the visitors of one guestbook. Visitors are
+// ordered by ID, which is opaque to callers. Visitors in the trash, with
+// a Deleted time, are only returned by Get, Trash and Expired.
+type VisitorStore interface {
+	// Add stores a new visitor and returns it with its ID and revision.
+	Add(ctx context.Context, v Visitor) (*visitorResource, error)
+
+	// AddBatch stores several new visitors with one request. It returns
+	// the result of each visitor in order, or an error if none was stored.
+	AddBatch(ctx context.Context, visitors []Visitor) ([]addResult, error)
+
+	// Get returns a visitor, also one in the trash, or errStoreNotFound.
+	Get(ctx context.Context, id string) (*visitorResource, error)
+
+	// List returns a page of visitors, counting from 1, and the total
+	// number of visitors. perPage 0 returns all of them.
+	List(ctx context.Context, page, perPage int) ([]visitorResource, int, error)
+
+	// Scan returns up to limit visitors with an ID greater than after,
+	// and the after value of the next call, which is empty at the end.
+	// Unlike List, pages do not shift while visitors are added.
+	Scan(ctx context.Context, after string, limit int) ([]visitorResource, string, error)
+
+	// Search returns up to limit visitors whose name contains a word
+	// starting with each word of query, ignoring case.
+	Search(ctx context.Context, query string, limit int) ([]visitorResource, error)
+
+	// Find returns up to limit visitors that match f, continuing after
+	// the page that bookmark was returned with, and the bookmark of the
+	// next page, which is empty after the last one. It returns
+	// errStoreBadBookmark for a bookmark it did not issue.
+	Find(ctx context.Context, f *visitorFilter, bookmark string, limit int) ([]visitorResource, string, error)
+
+	// Update stores the name, locale, tags and deleted time of v if v.Rev
+	// is the current revision, and sets v.Rev to the new one. It returns
+	// errStoreNotFound or errStoreConflict otherwise.
+	Update(ctx context.Context, v *visitorResource) error
+
+	// Delete removes a visitor for good at revision rev, or at any
+	// revision if rev is empty.
+	Delete(ctx context.Context, id, rev string) error
+
+	// Trash returns up to limit visitors in the trash, longest deleted
+	// first, like Find.
+	Trash(ctx context.Context, bookmark string, limit int) ([]visitorResource, string, error)
+
+	// Expired returns up to limit visitors that were moved to the trash
+	// before trashedBefore or created before createdBefore, in or out of
+	// the trash. A zero time leaves its condition out.
+	Expired(ctx context.Context, trashedBefore, createdBefore time.Time, limit int) ([]visitorResource, error)
+
+	// Count returns the number of visitors out of the trash, which the
+	// tenant quotas limit.
+	Count(ctx context.Context) (int, error)
+
+	// Stats counts the visitors by locale.
+	Stats(ctx context.Context) (*visitorStats, error)
+
+	// UpdateSeq returns an opaque value that changes with every write.
+	UpdateSeq(ctx context.Context) (string, error)
+
+	// Watch calls fn for every change after since until ctx is done or
+	// fn returns an error. since is the Seq of an earlier change, "now"
+	// for new changes only, or empty for all changes. A visitor moved to
+	// the trash is reported as deleted.
+	Watch(ctx context.Context, since string, fn func(visitorChange) error) error
+
+	// The audit trail and the idempotency keys of a guestbook are kept
+	// next to its visitors.
+	auditStore
+	idempotencyStore
+}
+
+// auditStore keeps the audit trail of the visitors of a guestbook and
+// the revisions the database knows.
+type auditStore interface {
+	// AddAudit appends a record to the audit trail of a visitor.
+	AddAudit(ctx context.Context, rec *auditRecord) error
+
+	// AuditTrail returns the audit records of a visitor, oldest first.
+	AuditTrail(ctx context.Context, id string) ([]auditRecord, error)
+
+	// Revisions returns the revisions of a visitor that the store knows,
+	// newest first, including the deletion of a deleted visitor. It
+	// returns errStoreNotFound for a visitor that never existed.
+	Revisions(ctx context.Context, id string) ([]revisionInfo, error)
+
+	// GetRevision returns a visitor as of rev, or errStoreNotFound if the
+	// store does not keep that revision.
+	GetRevision(ctx context.Context, id, rev string) (*visitorResource, error)
+}
+
+// idempotencyStore keeps the records of the Idempotency-Key headers
+// sent to a guestbook, see idempotency.go.
+type idempotencyStore interface {
+	// ReserveKey stores rec unless a record with its key exists and has
+	// not expired. It returns that record then, and nil otherwise.
+	ReserveKey(ctx context.Context, rec *idempotencyRecord) (*idempotencyRecord, error)
+
+	// CompleteKey replaces a reserved record with rec, which holds the
+	// response to replay.
+	CompleteKey(ctx context.Context, rec *idempotencyRecord) error
+
+	// ReleaseKey removes a reserved record, so that its request can be
+	// retried.
+	ReleaseKey(ctx context.Context, rec *idempotencyRecord) error
+}
+
+// addResult is the outcome of storing one visitor of a batch.
+type addResult struct {
+	Visitor *visitorResource
+	Err     error
+}
+
+// visitorChange is a change reported by VisitorStore.Watch. Only the ID
+// of a deleted visitor is set.
+type visitorChange struct {
+	Seq     string
+	Deleted bool
+	Visitor visitorResource
+}
+
+// visitorStats summarizes the visitors of a guestbook. Locales maps
+// every locale to its number of visitors.
+type visitorStats struct {
+	Visitors int
+	Locales  map[string]int
+}
+
+// storeConfig holds the storage settings read from the environment.
+type storeConfig struct {
+	Backend     string
+	PostgresURL string
+}
+
+// storeConfigFromEnv selects the storage backend. STORE_BACKEND wins;
+// otherwise Postgres is used if DATABASE_URL or a bound PostgreSQL service
+// provides a URL and no Cloudant URL is configured.
+func storeConfigFromEnv(appEnv *cfenv.App, cloudantUrl string) storeConfig {
+	cfg := storeConfig{
+		Backend:     strings.ToLower(os.Getenv("STORE_BACKEND")),
+		PostgresURL: secretFromEnv("DATABASE_URL"),
+	}
+	if cfg.PostgresURL == "" && appEnv != nil {
+		cfg.PostgresURL = postgresServiceURL(appEnv)
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = storeCouchDB
+		if cfg.PostgresURL != "" && cloudantUrl == "" {
+			cfg.Backend = storePostgres
+		}
+	}
+	return cfg
+}
+
+// postgresServiceURL returns the connection URL of the first service
+// tagged postgresql. ElephantSQL provides it as uri, IBM Cloud Databases
+// for PostgreSQL under connection.postgres.composed.
+func postgresServiceURL(appEnv *cfenv.App) string {
+	services, _ := appEnv.Services.WithTag("postgresql")
+	if len(services) == 0 {
+		return ""
+	}
+	creds := services[0].Credentials
+	if uri, ok := creds["uri"].(string); ok {
+		return uri
+	}
+	conn, _ := creds["connection"].(map[string]interface{})
+	pg, _ := conn["postgres"].(map[string]interface{})
+	composed, _ := pg["composed"].([]interface{})
+	if len(composed) > 0 {
+		uri, _ := composed[0].(string)
+		return uri
+	}
+	return ""
+}
+
+// searchWords splits a search query or a name into lower case words.
+// Both backends match the same words, so punctuation never matches.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// The conformance tests run every case against each VisitorStore. The
+// CouchDB store uses the embedded server; the Postgres store runs when
+// TEST_DATABASE_URL points to a database that the tests may migrate,
+// for example postgres://localhost/visitors_test?sslmode=disable.
+
+// storeBackends open an empty guestbook of each backend.
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) VisitorStore
+}{
+	{storeCouchDB, func(t *testing.T) VisitorStore {
+		return newTestCouchStore(t, newTestCouch(t), "mydb")
+	}},
+	{storePostgres, func(t *testing.T) VisitorStore {
+		dsn := os.Getenv("TEST_DATABASE_URL")
+		if dsn == "" {
+			t.Skip("TEST_DATABASE_URL is not set")
+		}
+		//Every test gets its own guestbook, so nothing needs cleaning up.
+		b := make([]byte, 6)
+		rand.Read(b)
+		store, err := openPostgresStore(dsn, "test-"+hex.EncodeToString(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.db.Close() })
+		return store
+	}},
+}
+
+// forEachStore runs fn for every backend as a subtest.
+func forEachStore(t *testing.T, fn func(t *testing.T, store VisitorStore)) {
+	for _, b := range storeBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			fn(t, b.open(t))
+		})
+	}
+}
+
+// addVisitors stores a visitor for each name and returns them.
+func addVisitors(t *testing.T, store VisitorStore, names ...string) []*visitorResource {
+	t.Helper()
+	visitors := make([]*visitorResource, len(names))
+	for i, name := range names {
+		v, err := store.Add(context.Background(), Visitor{Name: name, Locale: "en", Created: time.Now().UTC().Format(createdLayout)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		visitors[i] = v
+	}
+	return visitors
+}
+
+// ids returns the sorted IDs of visitors.
+func ids(visitors []visitorResource) []string {
+	out := make([]string, len(visitors))
+	for i := range visitors {
+		out[i] = visitors[i].ID
+	}
+	sort.Strings(out)
+	return out
+}
+
+func resourceIDs(visitors []*visitorResource) []string {
+	out := make([]string, len(visitors))
+	for i, v := range visitors {
+		out[i] = v.ID
+	}
+	sort.Strings(out)
+	return out
+}
+
+func sameIDs(a, b []string) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func TestStoreCRUD(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		created := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+		v, err := store.Add(ctx, Visitor{Name: "Anna", Locale: "de", Created: created.Format(createdLayout), Tags: []string{"vip"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.ID == "" || v.Rev == "" {
+			t.Fatalf("Add = %+v", v)
+		}
+		got, err := store.Get(ctx, v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "Anna" || got.Locale != "de" || !got.Created.Equal(created) || len(got.Tags) != 1 || got.Rev != v.Rev {
+			t.Fatalf("Get = %+v", got)
+		}
+
+		stale := *got
+		got.Name, got.Tags = "Anna Maria", []string{"vip", "new"}
+		if err := store.Update(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Rev == stale.Rev {
+			t.Error("Update did not change the revision")
+		}
+		if err := store.Update(ctx, &stale); err != errStoreConflict {
+			t.Errorf("Update at a stale revision: got %v, want errStoreConflict", err)
+		}
+		again, err := store.Get(ctx, v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Name != "Anna Maria" || len(again.Tags) != 2 || again.Rev != got.Rev {
+			t.Errorf("Get after Update = %+v", again)
+		}
+
+		if err := store.Delete(ctx, v.ID, got.Rev); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get(ctx, v.ID); err != errStoreNotFound {
+			t.Errorf("Get after Delete: got %v, want errStoreNotFound", err)
+		}
+		missing := &visitorResource{ID: v.ID, Rev: got.Rev, Name: "Bob"}
+		if err := store.Update(ctx, missing); err != errStoreNotFound && err != errStoreConflict {
+			t.Errorf("Update of a deleted visitor: got %v, want errStoreNotFound or errStoreConflict", err)
+		}
+	})
+}
+
+func TestStoreAddBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		results, err := store.AddBatch(ctx, []Visitor{{Name: "Anna"}, {Name: "Bob"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("AddBatch returned %d results", len(results))
+		}
+		for i, name := range []string{"Anna", "Bob"} {
+			if results[i].Err != nil || results[i].Visitor.Name != name {
+				t.Errorf("result %d = %+v", i, results[i])
+				continue
+			}
+			if v, err := store.Get(ctx, results[i].Visitor.ID); err != nil || v.Name != name {
+				t.Errorf("Get(%s) = %+v, %v", results[i].Visitor.ID, v, err)
+			}
+		}
+	})
+}
+
+func TestStoreListPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		added := addVisitors(t, store, "A", "B", "C", "D", "E", "F", "G")
+		var listed []visitorResource
+		for page, want := range []int{3, 3, 1} {
+			visitors, total, err := store.List(ctx, page+1, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(visitors) != want || total != len(added) {
+				t.Errorf("page %d: %d visitors of %d, want %d of %d", page+1, len(visitors), total, want, len(added))
+			}
+			listed = append(listed, visitors...)
+		}
+		if got, want := ids(listed), resourceIDs(added); !sameIDs(got, want) {
+			t.Errorf("pages listed %v, want %v", got, want)
+		}
+		all, total, err := store.List(ctx, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != len(added) || total != len(added) {
+			t.Errorf("List without paging returned %d visitors of %d, want %d", len(all), total, len(added))
+		}
+		if n, err := store.Count(ctx); err != nil || n != len(added) {
+			t.Errorf("Count = %d, %v, want %d", n, err, len(added))
+		}
+	})
+}
+
+func TestStoreScan(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		added := addVisitors(t, store, "A", "B", "C", "D", "E")
+		var scanned []string
+		after := ""
+		for calls := 0; ; calls++ {
+			if calls > len(added) {
+				t.Fatal("Scan does not end")
+			}
+			page, next, err := store.Scan(ctx, after, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range page {
+				if len(scanned) > 0 && v.ID <= scanned[len(scanned)-1] {
+					t.Errorf("Scan returned %s after %s", v.ID, scanned[len(scanned)-1])
+				}
+				scanned = append(scanned, v.ID)
+			}
+			if next == "" {
+				break
+			}
+			after = next
+		}
+		if want := resourceIDs(added); !sameIDs(scanned, want) {
+			t.Errorf("Scan returned %v, want %v", scanned, want)
+		}
+	})
+}
+
+func TestStoreSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		added := addVisitors(t, store, "Anna Maria", "Marianne", "Bob O'Brien")
+		for _, tc := range []struct {
+			query string
+			want  []*visitorResource
+		}{
+			{"mar", added[:2]},
+			{"ANN mar", added[:1]},
+			{"o'brien", added[2:]},
+			{"brien", added[2:]},
+			{"xyz", nil},
+		} {
+			found, err := store.Search(ctx, tc.query, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := ids(found), resourceIDs(tc.want); !sameIDs(got, want) {
+				t.Errorf("Search(%q) = %v, want %v", tc.query, got, want)
+			}
+		}
+		if found, err := store.Search(ctx, "mar", 1); err != nil || len(found) != 1 {
+			t.Errorf("Search with limit 1 returned %d visitors, %v", len(found), err)
+		}
+	})
+}
+
+func TestStoreFind(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		day := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+		var want []string
+		for i, v := range []Visitor{
+			{Name: "Anna", Locale: "de", Tags: []string{"vip"}},
+			{Name: "Annabel", Locale: "en", Tags: []string{"vip"}},
+			{Name: "Anton", Locale: "de"},
+			{Name: "Bob", Locale: "de", Tags: []string{"vip"}},
+		} {
+			v.Created = day.Add(time.Duration(i) * time.Hour).Format(createdLayout)
+			r, err := store.Add(ctx, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i < 2 {
+				want = append(want, r.ID)
+			}
+		}
+		before := day.Add(3 * time.Hour)
+		f := &visitorFilter{NamePrefix: "an", Tags: []string{"vip"}, CreatedBefore: &before}
+		found, next, err := store.Find(ctx, f, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for next != "" {
+			var page []visitorResource
+			if page, next, err = store.Find(ctx, f, next, 1); err != nil {
+				t.Fatal(err)
+			}
+			found = append(found, page...)
+		}
+		sort.Strings(want)
+		if got := ids(found); !sameIDs(got, want) {
+			t.Errorf("Find = %v, want %v", got, want)
+		}
+		if _, _, err := store.Find(ctx, f, "not a bookmark", 1); err != errStoreBadBookmark {
+			t.Errorf("Find with an invalid bookmark: got %v, want errStoreBadBookmark", err)
+		}
+	})
+}
+
+func TestStoreTrash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		added := addVisitors(t, store, "Anna", "Bob", "Carl")
+		trashed := added[1]
+		trashed.Deleted = time.Now().UTC().Truncate(time.Millisecond)
+		if err := store.Update(ctx, trashed); err != nil {
+			t.Fatal(err)
+		}
+		active := []*visitorResource{added[0], added[2]}
+
+		//Pages and totals leave the trash out.
+		page, total, err := store.List(ctx, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids(page), resourceIDs(active); !sameIDs(got, want) || total != 2 {
+			t.Errorf("List = %v of %d, want %v of 2", got, total, want)
+		}
+		if scanned, _, err := store.Scan(ctx, "", 10); err != nil || !sameIDs(ids(scanned), resourceIDs(active)) {
+			t.Errorf("Scan = %v, %v", ids(scanned), err)
+		}
+		if found, err := store.Search(ctx, "bob", 10); err != nil || len(found) != 0 {
+			t.Errorf("Search found %v in the trash, %v", ids(found), err)
+		}
+		if n, err := store.Count(ctx); err != nil || n != 2 {
+			t.Errorf("Count = %d, %v, want 2", n, err)
+		}
+
+		v, err := store.Get(ctx, trashed.ID)
+		if err != nil || v.Deleted.IsZero() {
+			t.Fatalf("Get of a trashed visitor = %+v, %v", v, err)
+		}
+		trash, _, err := store.Trash(ctx, "", 10)
+		if err != nil || len(trash) != 1 || trash[0].ID != trashed.ID {
+			t.Errorf("Trash = %v, %v", ids(trash), err)
+		}
+
+		//Restoring lists the visitor again.
+		v.Deleted = time.Time{}
+		if err := store.Update(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		if _, total, err := store.List(ctx, 1, 10); err != nil || total != 3 {
+			t.Errorf("List after restoring: total %d, %v", total, err)
+		}
+		if n, err := store.Count(ctx); err != nil || n != 3 {
+			t.Errorf("Count after restoring = %d, %v, want 3", n, err)
+		}
+	})
+}
+
+func TestStoreStats(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		for _, v := range []Visitor{{Name: "Anna", Locale: "de"}, {Name: "Bob", Locale: "de"}, {Name: "Carl", Locale: "en"}} {
+			if _, err := store.Add(ctx, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err := store.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Visitors != 3 || stats.Locales["de"] != 2 || stats.Locales["en"] != 1 {
+			t.Errorf("Stats = %+v", stats)
+		}
+	})
+}
+
+func TestStoreWatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		seq, err := store.UpdateSeq(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := addVisitors(t, store, "Anna")[0]
+		if err := store.Delete(ctx, added.ID, added.Rev); err != nil {
+			t.Fatal(err)
+		}
+		//The changes after seq are the addition and the deletion, which
+		//may be reported together.
+		errDone := errors.New("done")
+		err = store.Watch(ctx, seq, func(change visitorChange) error {
+			if change.Visitor.ID != added.ID {
+				t.Errorf("unexpected change of %s", change.Visitor.ID)
+				return nil
+			}
+			if change.Deleted {
+				return errDone
+			}
+			return nil
+		})
+		if err != errDone {
+			t.Errorf("Watch did not report the deletion: %v", err)
+		}
+	})
+}
+
+func TestStoreAuditTrail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		v := addVisitors(t, store, "Anna")[0]
+		at := time.Now().UTC()
+		for i, action := range []string{auditCreate, auditUpdate} {
+			rec := &auditRecord{VisitorID: v.ID, Action: action, Rev: v.Rev, Actor: "test", At: at.Add(time.Duration(i) * time.Millisecond),
+				Changes: []fieldChange{{Field: "name", From: nil, To: "Anna"}}}
+			if err := store.AddAudit(ctx, rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trail, err := store.AuditTrail(ctx, v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trail) != 2 || trail[0].Action != auditCreate || trail[1].Action != auditUpdate || trail[0].Actor != "test" {
+			t.Fatalf("AuditTrail = %+v", trail)
+		}
+		if other, err := store.AuditTrail(ctx, "other"); err != nil || len(other) != 0 {
+			t.Errorf("AuditTrail of another visitor = %+v, %v", other, err)
+		}
+	})
+}
+
+func TestStoreIdempotencyKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store VisitorStore) {
+		ctx := context.Background()
+		rec := &idempotencyRecord{Key: "key-1", RequestHash: "h", Pending: true, Expires: time.Now().Add(time.Hour)}
+		if prev, err := store.ReserveKey(ctx, rec); err != nil || prev != nil {
+			t.Fatalf("ReserveKey of a new key = %+v, %v", prev, err)
+		}
+		prev, err := store.ReserveKey(ctx, &idempotencyRecord{Key: "key-1", RequestHash: "other", Pending: true, Expires: time.Now().Add(time.Hour)})
+		if err != nil || prev == nil || prev.RequestHash != "h" || !prev.Pending {
+			t.Fatalf("ReserveKey of a reserved key = %+v, %v", prev, err)
+		}
+		rec.Pending, rec.Status, rec.Body = false, 201, []byte(`{}`)
+		if err := store.CompleteKey(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		prev, err = store.ReserveKey(ctx, &idempotencyRecord{Key: "key-1", RequestHash: "h", Pending: true, Expires: time.Now().Add(time.Hour)})
+		if err != nil || prev == nil || prev.Pending || prev.Status != 201 || string(prev.Body) != `{}` {
+			t.Fatalf("ReserveKey of a completed key = %+v, %v", prev, err)
+		}
+
+		//A released key can be reserved again.
+		other := &idempotencyRecord{Key: "key-2", RequestHash: "h", Pending: true, Expires: time.Now().Add(time.Hour)}
+		if _, err := store.ReserveKey(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.ReleaseKey(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+		again := &idempotencyRecord{Key: "key-2", RequestHash: "h", Pending: true, Expires: time.Now().Add(time.Hour)}
+		if prev, err := store.ReserveKey(ctx, again); err != nil || prev != nil {
+			t.Errorf("ReserveKey of a released key = %+v, %v", prev, err)
+		}
+	})
+}
+
+func TestCouchStorePurgeKeys(t *testing.T) {
+	store := newTestCouchStore(t, newTestCouch(t), "mydb")
+	ctx := context.Background()
+	for _, rec := range []*idempotencyRecord{
+		{Key: "expired", RequestHash: "h", Expires: time.Now().Add(-time.Second)},
+		{Key: "live", RequestHash: "h", Expires: time.Now().Add(time.Hour)},
+	} {
+		if _, err := store.ReserveKey(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.purgeKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.getKey(ctx, "expired"); err != errStoreNotFound {
+		t.Errorf("expired key: got %v, want errStoreNotFound", err)
+	}
+	if _, err := store.getKey(ctx, "live"); err != nil {
+		t.Errorf("live key: %v", err)
+	}
+	//The checkpoints of changes processors are _local documents too.
+	if _, err := store.db().PutContext(ctx, "_local/changes-test", checkpointDoc{Seq: "1"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.purgeKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db().RevContext(ctx, "_local/changes-test"); err != nil {
+		t.Errorf("checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// suggestIndexFromEnv reports whether the single guestbook keeps an
+// in-memory index for GET /api/visitors/suggest, SUGGEST_INDEX.
+func suggestIndexFromEnv() bool {
+	switch v := strings.ToLower(os.Getenv("SUGGEST_INDEX")); v {
+	case "", "on", "true", "1":
+		return true
+	case "off", "false", "0":
+		return false
+	default:
+		log.Printf("ignoring invalid SUGGEST_INDEX %q", v)
+		return true
+	}
+}
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+	maxSuggestQuery    = 100
+	suggestScanPage    = 1000
+)
+
+// suggestEntry is an indexed visitor.
+type suggestEntry struct {
+	id, name, locale string
+	words            []string
+}
+
+// suggestion is a visitor matching a suggest query.
+type suggestion struct {
+	ID     string
+	Name   string
+	Locale string
+	Score  float64 // between 0 and 1, 1 for a name with all query words
+}
+
+// suggestIndex is an inverted index of visitor names for typeahead. Names
+// are split into words like searchWords does, and every word into
+// trigrams, so that misspelled queries still find their candidates
+// without a scan. It is built from a scan of the store and kept current
+// by the changes of the store.
+//
+// With CouchDB the changes come from the changes processor, which keeps
+// the checkpoint in the database; changes delivered during the build are
+// held in pending and applied after it. Other stores are followed with
+// Watch from seq, the update sequence at the start of the build, which
+// lets the feed resume after an error without building the index again.
+type suggestIndex struct {
+	mu       sync.RWMutex
+	visitors map[string]*suggestEntry  // by ID
+	words    map[string]map[string]int // word to the IDs of the visitors with it
+	grams    map[string]map[string]int // trigram to the words containing it
+	seq      string
+	pending  []visitorChange
+	ready    bool
+
+	builds, changes, feedErrors int64
+}
+
+func newSuggestIndex() *suggestIndex {
+	x := &suggestIndex{}
+	x.reset()
+	return x
+}
+
+func (x *suggestIndex) reset() {
+	x.visitors = make(map[string]*suggestEntry)
+	x.words = make(map[string]map[string]int)
+	x.grams = make(map[string]map[string]int)
+}
+
+// trigrams returns the trigrams of a word, which is padded with two
+// markers in front and one at the end. A word being typed is not padded
+// at the end, so that it only matches the start of longer words.
+func trigrams(word string, complete bool) []string {
+	runes := append([]rune("\x00\x00"), []rune(word)...)
+	if complete {
+		runes = append(runes, 0)
+	}
+	grams := make([]string, 0, len(runes)-2)
+	for i := 0; i+3 <= len(runes); i++ {
+		grams = append(grams, string(runes[i:i+3]))
+	}
+	return grams
+}
+
+// put adds or replaces a visitor. Visitors without a name are removed.
+func (x *suggestIndex) put(v *visitorResource) {
+	x.remove(v.ID)
+	if v.Name == "" {
+		return
+	}
+	e := &suggestEntry{id: v.ID, name: v.Name, locale: v.Locale, words: searchWords(v.Name)}
+	x.visitors[v.ID] = e
+	for _, w := range e.words {
+		ids := x.words[w]
+		if ids == nil {
+			ids = make(map[string]int)
+			x.words[w] = ids
+			for _, g := range trigrams(w, true) {
+				if x.grams[g] == nil {
+					x.grams[g] = make(map[string]int)
+				}
+				x.grams[g][w]++
+			}
+		}
+		ids[v.ID]++
+	}
+}
+
+// remove drops a visitor, and the words that only it had.
+func (x *suggestIndex) remove(id string) {
+	e, ok := x.visitors[id]
+	if !ok {
+		return
+	}
+	delete(x.visitors, id)
+	for _, w := range e.words {
+		ids := x.words[w]
+		if ids[id]--; ids[id] > 0 {
+			continue
+		}
+		delete(ids, id)
+		if len(ids) > 0 {
+			continue
+		}
+		delete(x.words, w)
+		for _, g := range trigrams(w, true) {
+			if x.grams[g][w]--; x.grams[g][w] <= 0 {
+				delete(x.grams[g], w)
+			}
+			if len(x.grams[g]) == 0 {
+				delete(x.grams, g)
+			}
+		}
+	}
+}
+
+// Ready reports whether the index has been built.
+func (x *suggestIndex) Ready() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.ready
+}
+
+// Suggest returns up to limit visitors whose names match every word of
+// query, best first. The last word may be incomplete. Words match
+// exactly, as a prefix, within a few typos, or by sharing most of their
+// trigrams, in descending order of score.
+func (x *suggestIndex) Suggest(query string, limit int) []suggestion {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	//Score the indexed words that share a trigram with each query word,
+	//then the visitors with a match for the first one.
+	scores := make([]map[string]float64, len(words))
+	for i, q := range words {
+		scores[i] = x.matchWord(q, i == len(words)-1)
+		if len(scores[i]) == 0 {
+			return nil
+		}
+	}
+	var results []suggestion
+	seen := make(map[string]bool)
+	for w := range scores[0] {
+		for id := range x.words[w] {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			e := x.visitors[id]
+			total := 0.0
+			for _, s := range scores {
+				best := 0.0
+				for _, vw := range e.words {
+					if s[vw] > best {
+						best = s[vw]
+					}
+				}
+				if best == 0 {
+					total = 0
+					break
+				}
+				total += best
+			}
+			if total > 0 {
+				results = append(results, suggestion{ID: id, Name: e.name, Locale: e.locale, Score: total / float64(len(words))})
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// matchWord scores the indexed words that match q. partial is set for
+// the word being typed, which also matches the start of longer words.
+func (x *suggestIndex) matchWord(q string, partial bool) map[string]float64 {
+	grams := trigrams(q, !partial)
+	shared := make(map[string]int)
+	for _, g := range grams {
+		for w := range x.grams[g] {
+			shared[w]++
+		}
+	}
+	n := utf8.RuneCountInString(q)
+	maxTypos := 0
+	switch {
+	case n >= 7:
+		maxTypos = 2
+	case n >= 3:
+		maxTypos = 1
+	}
+	scores := make(map[string]float64)
+	for w, common := range shared {
+		var score float64
+		switch {
+		case w == q:
+			score = 1
+		case partial && strings.HasPrefix(w, q):
+			score = 0.8 + 0.1*float64(n)/float64(utf8.RuneCountInString(w))
+		default:
+			d := editDistance(q, w)
+			if partial {
+				//A typo in what has been typed so far.
+				if p := editDistance(q, runePrefix(w, n)); p < d {
+					d = p
+				}
+			}
+			if d <= maxTypos {
+				score = 0.7 - 0.15*float64(d)
+				break
+			}
+			//Dice coefficient of the trigrams, for longer words with
+			//more typos.
+			dice := 2 * float64(common) / float64(len(grams)+len(trigrams(w, true)))
+			if dice >= 0.5 {
+				score = 0.4 * dice
+			}
+		}
+		if score > 0 {
+			scores[w] = score
+		}
+	}
+	return scores
+}
+
+func runePrefix(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// editDistance returns the number of insertions, deletions, substitutions
+// and transpositions of adjacent runes that turn a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// build replaces the index with a scan of store. The update sequence is
+// taken before the scan, so that the feed replays the writes made during
+// it, and the pending changes are applied on top.
+func (x *suggestIndex) build(ctx context.Context, store VisitorStore) error {
+	seq, err := store.UpdateSeq(ctx)
+	if err != nil {
+		return err
+	}
+	next := &suggestIndex{}
+	next.reset()
+	after := ""
+	for {
+		page, more, err := store.Scan(ctx, after, suggestScanPage)
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			next.put(&page[i])
+		}
+		if more == "" {
+			break
+		}
+		after = more
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.visitors, x.words, x.grams = next.visitors, next.words, next.grams
+	x.seq = seq
+	x.ready = true
+	x.builds++
+	for _, change := range x.pending {
+		x.applyLocked(change)
+	}
+	x.pending = nil
+	log.Printf("suggest index: built from %d visitors", len(x.visitors))
+	return nil
+}
+
+// apply updates the index for a change and advances seq.
+func (x *suggestIndex) apply(change visitorChange) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.applyLocked(change)
+	return nil
+}
+
+// applyLocked is apply for callers that hold x.mu.
+func (x *suggestIndex) applyLocked(change visitorChange) {
+	if change.Deleted {
+		x.remove(change.Visitor.ID)
+	} else {
+		x.put(&change.Visitor)
+	}
+	x.seq = change.Seq
+	x.changes++
+}
+
+// handleChange applies a change of a visitor delivered by the changes
+// processor of the CouchDB guestbook, or holds it until the index is
+// built.
+func (x *suggestIndex) handleChange(ctx context.Context, ev *changeEvent) error {
+	change, err := ev.visitorChange()
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.ready {
+		x.pending = append(x.pending, change)
+		return nil
+	}
+	x.applyLocked(change)
+	return nil
+}
+
+// run builds the index until ctx is done and, if watch is set, follows
+// the changes feed of store. When the feed fails, it resumes from seq;
+// when the build fails, it is retried. Both back off up to a minute.
+// Without watch, the changes processor keeps the index current.
+func (x *suggestIndex) run(ctx context.Context, store VisitorStore, watch bool) {
+	backoff := time.Second
+	for {
+		var err error
+		if !x.Ready() {
+			err = x.build(ctx, store)
+		}
+		if err == nil && !watch {
+			return
+		}
+		if err == nil {
+			x.mu.RLock()
+			since := x.seq
+			x.mu.RUnlock()
+			err = store.Watch(ctx, since, func(change visitorChange) error {
+				backoff = time.Second
+				return x.apply(change)
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("suggest index: changes feed stopped:", err)
+		x.mu.Lock()
+		x.feedErrors++
+		x.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// writeMetrics writes the index metrics in the Prometheus text format.
+func (x *suggestIndex) writeMetrics(w io.Writer) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ready := int64(0)
+	if x.ready {
+		ready = 1
+	}
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"suggest_index_builds_total", "counter", "Scans of the store that built the suggest index.", x.builds},
+		{"suggest_index_changes_total", "counter", "Changes applied to the suggest index.", x.changes},
+		{"suggest_index_feed_errors_total", "counter", "Failures of the build or the changes feed.", x.feedErrors},
+		{"suggest_index_ready", "gauge", "1 once the suggest index has been built.", ready},
+		{"suggest_index_visitors", "gauge", "Indexed visitors.", int64(len(x.visitors))},
+		{"suggest_index_words", "gauge", "Distinct indexed words.", int64(len(x.words))},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSuggestRoutes(t *testing.T) {
+	//Without validation, so that the handler sees the invalid requests.
+	cfg := newTestRouterConfig(t, newTestCouchStore(t, newTestCouch(t), "mydb"))
+	cfg.Validate = validateOff
+	hs := httptest.NewServer(newRouter(cfg))
+	defer hs.Close()
+	for _, name := range []string{"Anna", "Bob"} {
+		send(t, "POST", hs.URL+"/api/v1/visitors", `{"name": "`+name+`"}`)
+	}
+
+	for _, path := range []string{"/api/visitors/suggest", "/api/v1/visitors/suggest"} {
+		resp, err := http.Get(hs.URL + path + "?q=ann")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Suggestions []struct{ Name string } `json:"suggestions"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(out.Suggestions) != 1 || out.Suggestions[0].Name != "Anna" {
+			t.Errorf("%s?q=ann: %s %+v, want Anna", path, resp.Status, out)
+		}
+
+		//Errors are in the v1 format, without deprecation.
+		resp = send(t, "GET", hs.URL+path+"?q="+strings.Repeat("a", maxSuggestQuery+1), "")
+		if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("API-Version") != "v1" || resp.Header.Get("Deprecation") != "" || resp.Header.Get("Sunset") != "" {
+			t.Errorf("%s with a long q: %s, headers %v", path, resp.Status, resp.Header)
+		}
+	}
+}
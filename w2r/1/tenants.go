@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/timjacobi/go-couchdb"
+)
+
+// Tenant resolution modes, selected with the TENANT_MODE environment variable.
+// When TENANT_MODE is empty the app runs as a single guestbook backed by dbName.
+const (
+	tenantModeNone   = ""
+	tenantModeHost   = "host"
+	tenantModePath   = "path"
+	tenantModeHeader = "header"
+)
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,62}$`)
+
+var (
+	errTenantNotFound  = errors.New("tenant not found")
+	errTenantExists    = errors.New("tenant already exists")
+	errTenantName      = errors.New("tenant names must match " + tenantNamePattern.String())
+	errTenantSuspended = errors.New("tenant suspended")
+)
+
+// Tenant is the registry record of a single guestbook.
+// Records are stored in the registry database, keyed by tenant name.
+type Tenant struct {
+	Name      string    `json:"_id"`
+	Rev       string    `json:"_rev,omitempty"`
+	DB        string    `json:"db"`
+	Suspended bool      `json:"suspended"`
+	Quota     int       `json:"quota"` // maximum number of documents, 0 means unlimited
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TenantConfig holds the settings read from the environment.
+type TenantConfig struct {
+	Mode         string
+	Header       string
+	Domain       string
+	DBPrefix     string
+	RegistryDB   string
+	DefaultQuota int
+	AdminToken   string
+}
+
+func tenantConfigFromEnv() TenantConfig {
+	cfg := TenantConfig{
+		Mode:       strings.ToLower(os.Getenv("TENANT_MODE")),
+		Header:     os.Getenv("TENANT_HEADER"),
+		Domain:     strings.ToLower(os.Getenv("TENANT_DOMAIN")),
+		DBPrefix:   os.Getenv("TENANT_DB_PREFIX"),
+		RegistryDB: os.Getenv("TENANT_REGISTRY_DB"),
+		AdminToken: secretFromEnv("ADMIN_TOKEN"),
+	}
+	if cfg.Header == "" {
+		cfg.Header = "X-Tenant-ID"
+	}
+	if cfg.DBPrefix == "" {
+		cfg.DBPrefix = "tenant_"
+	}
+	if cfg.RegistryDB == "" {
+		cfg.RegistryDB = "tenants"
+	}
+	if quota := os.Getenv("TENANT_DEFAULT_QUOTA"); quota != "" {
+		n, err := strconv.Atoi(quota)
+		if err != nil || n < 0 {
+			log.Printf("ignoring invalid TENANT_DEFAULT_QUOTA %q", quota)
+		} else {
+			cfg.DefaultQuota = n
+		}
+	}
+	return cfg
+}
+
+// tenantRegistry maps tenant names to their databases.
+// Records are cached in memory; a tenant's database is created with
+// EnsureDB the first time the tenant is used.
+type tenantRegistry struct {
+	cfg  TenantConfig
+	conn *couchConn
+
+	mu      sync.RWMutex
+	cache   map[string]cachedTenant
+	ensured map[string]bool
+}
+
+// cachedTenant is a registry record together with the time it was loaded,
+// so that changes made by other instances are picked up after tenantCacheTTL.
+type cachedTenant struct {
+	*Tenant
+	loaded time.Time
+}
+
+const tenantCacheTTL = 30 * time.Second
+
+func newTenantRegistry(conn *couchConn, cfg TenantConfig) *tenantRegistry {
+	return &tenantRegistry{
+		cfg:     cfg,
+		conn:    conn,
+		cache:   make(map[string]cachedTenant),
+		ensured: make(map[string]bool),
+	}
+}
+
+// init makes sure the registry database exists.
+func (tr *tenantRegistry) init(ctx context.Context) error {
+	_, err := tr.conn.Client().EnsureDBContext(ctx, tr.cfg.RegistryDB)
+	return err
+}
+
+// Get returns the tenant record with the given name.
+func (tr *tenantRegistry) Get(ctx context.Context, name string) (*Tenant, error) {
+	tr.mu.RLock()
+	ct, ok := tr.cache[name]
+	tr.mu.RUnlock()
+	if ok && time.Since(ct.loaded) < tenantCacheTTL {
+		return ct.Tenant, nil
+	}
+	return tr.load(ctx, name)
+}
+
+// load reads the tenant record from the registry database and caches it.
+func (tr *tenantRegistry) load(ctx context.Context, name string) (*Tenant, error) {
+	t := new(Tenant)
+	if err := tr.conn.DB(tr.cfg.RegistryDB).GetContext(ctx, name, t, nil); err != nil {
+		if couchdb.NotFound(err) {
+			tr.forget(name)
+			return nil, errTenantNotFound
+		}
+		return nil, err
+	}
+	tr.store(t)
+	return t, nil
+}
+
+// List returns all tenant records.
+func (tr *tenantRegistry) List(ctx context.Context) ([]*Tenant, error) {
+	var result struct {
+		Rows []struct {
+			Doc *Tenant `json:"doc"`
+		} `json:"rows"`
+	}
+	if err := tr.conn.DB(tr.cfg.RegistryDB).AllDocsContext(ctx, &result, couchdb.Options{"include_docs": true}); err != nil {
+		return nil, err
+	}
+	tenants := make([]*Tenant, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		if row.Doc != nil && !strings.HasPrefix(row.Doc.Name, "_design/") {
+			tenants = append(tenants, row.Doc)
+		}
+	}
+	return tenants, nil
+}
+
+// Create registers a new tenant and creates its database. The record is
+// written first, so that a name that is taken never touches the database
+// of the existing tenant; it is removed again if the database can not be
+// created.
+func (tr *tenantRegistry) Create(ctx context.Context, name string, quota int) (*Tenant, error) {
+	if !tenantNamePattern.MatchString(name) {
+		return nil, errTenantName
+	}
+	t := &Tenant{
+		Name:      name,
+		DB:        tr.cfg.DBPrefix + name,
+		Quota:     quota,
+		CreatedAt: time.Now().UTC(),
+	}
+	rev, err := tr.conn.DB(tr.cfg.RegistryDB).PutContext(ctx, t.Name, t, "")
+	if err != nil {
+		if couchdb.Conflict(err) {
+			return nil, errTenantExists
+		}
+		return nil, err
+	}
+	t.Rev = rev
+	if _, err := tr.conn.Client().EnsureDBContext(ctx, t.DB); err != nil {
+		if _, derr := tr.conn.DB(tr.cfg.RegistryDB).DeleteContext(ctx, t.Name, t.Rev); derr != nil {
+			log.Printf("Can not remove the record of tenant %s: %v", t.Name, derr)
+		}
+		return nil, err
+	}
+	tr.store(t)
+	tr.mu.Lock()
+	tr.ensured[name] = true
+	tr.mu.Unlock()
+	return t, nil
+}
+
+// Update applies fn to a copy of the tenant record and stores the result.
+func (tr *tenantRegistry) Update(ctx context.Context, name string, fn func(t *Tenant)) (*Tenant, error) {
+	cur, err := tr.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	t := *cur
+	fn(&t)
+	rev, err := tr.conn.DB(tr.cfg.RegistryDB).PutContext(ctx, t.Name, &t, t.Rev)
+	if err != nil {
+		if couchdb.Conflict(err) {
+			tr.forget(name)
+		}
+		return nil, err
+	}
+	t.Rev = rev
+	tr.store(&t)
+	return &t, nil
+}
+
+// Delete drops the tenant's database and its audit database, and
+// removes its registry record.
+func (tr *tenantRegistry) Delete(ctx context.Context, name string) error {
+	t, err := tr.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, db := range []string{t.DB, t.DB + auditDBSuffix} {
+		if err := tr.conn.Client().DeleteDBContext(ctx, db); err != nil && !couchdb.NotFound(err) {
+			return err
+		}
+	}
+	if _, err := tr.conn.DB(tr.cfg.RegistryDB).DeleteContext(ctx, t.Name, t.Rev); err != nil {
+		return err
+	}
+	tr.forget(name)
+	return nil
+}
+
+func (tr *tenantRegistry) store(t *Tenant) {
+	tr.mu.Lock()
+	tr.cache[t.Name] = cachedTenant{t, time.Now()}
+	tr.mu.Unlock()
+}
+
+func (tr *tenantRegistry) forget(name string) {
+	tr.mu.Lock()
+	delete(tr.cache, name)
+	delete(tr.ensured, name)
+	tr.mu.Unlock()
+}
+
+// Open returns the database of the tenant, creating it on first use.
+func (tr *tenantRegistry) Open(ctx context.Context, t *Tenant) (*couchdb.DB, error) {
+	tr.mu.RLock()
+	ok := tr.ensured[t.Name]
+	tr.mu.RUnlock()
+	if ok {
+		return tr.conn.Client().DB(t.DB), nil
+	}
+	//t may come from the cache after another instance deleted the
+	//tenant. Check the registry first, or EnsureDB would bring the
+	//database of the deleted tenant back.
+	if _, err := tr.load(ctx, t.Name); err != nil {
+		return nil, err
+	}
+	db, err := tr.conn.Client().EnsureDBContext(ctx, t.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureVisitorIndexes(ctx, db); err != nil {
+		log.Printf("Can not create the visitor search indexes of tenant %s: %v", t.Name, err)
+	}
+	tr.mu.Lock()
+	tr.ensured[t.Name] = true
+	tr.mu.Unlock()
+	return db, nil
+}
+
+// resolve extracts the tenant name from the request.
+func (tr *tenantRegistry) resolve(c *gin.Context) string {
+	switch tr.cfg.Mode {
+	case tenantModeHost:
+		host := c.Request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if tr.cfg.Domain != "" {
+			if !strings.HasSuffix(host, "."+tr.cfg.Domain) {
+				return ""
+			}
+			return strings.TrimSuffix(host, "."+tr.cfg.Domain)
+		}
+		if i := strings.IndexByte(host, '.'); i > 0 {
+			return host[:i]
+		}
+		return ""
+	case tenantModePath:
+		return c.Param("tenant")
+	case tenantModeHeader:
+		return c.Request.Header.Get(tr.cfg.Header)
+	}
+	return ""
+}
+
+// Resolve returns the record and the visitor store of an active tenant.
+// It returns errTenantNotFound for unknown or invalid names and
+// errTenantSuspended for suspended tenants.
+func (tr *tenantRegistry) Resolve(ctx context.Context, name string) (*Tenant, VisitorStore, error) {
+	if name == "" || !tenantNamePattern.MatchString(name) {
+		return nil, nil, errTenantNotFound
+	}
+	t, err := tr.Get(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Suspended {
+		return nil, nil, errTenantSuspended
+	}
+	if _, err := tr.Open(ctx, t); err != nil {
+		return nil, nil, err
+	}
+	return t, newCouchStore(tr.conn.Client(), t.DB), nil
+}
+
+// middleware resolves the tenant of a request and stores the tenant record
+// and its visitor store in the gin context under "tenant" and "store".
+func (tr *tenantRegistry) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := tr.resolve(c)
+		t, store, err := tr.Resolve(c.Request.Context(), name)
+		switch {
+		case err == errTenantNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown tenant"})
+			c.Abort()
+			return
+		case err == errTenantSuspended:
+			c.JSON(http.StatusForbidden, gin.H{"error": "tenant suspended"})
+			c.Abort()
+			return
+		case err != nil:
+			log.Printf("tenant %s: %v", name, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unable to load tenant"})
+			c.Abort()
+			return
+		}
+		c.Set("tenant", t)
+		c.Set("store", store)
+		c.Next()
+	}
+}
+
+// checkQuota reports whether the tenant may store another visitor.
+// A nil tenant has no quota. The quota is best-effort: the count and the
+// insert are separate requests, so concurrent creations, also on other
+// instances, can exceed it by as many visitors as run at the same time.
+func checkQuota(ctx context.Context, t *Tenant, store VisitorStore) (bool, error) {
+	if t == nil || t.Quota == 0 {
+		return true, nil
+	}
+	n, err := store.Count(ctx)
+	if err != nil {
+		return false, err
+	}
+	return n < t.Quota, nil
+}
+
+// requireAdmin guards the admin endpoints with the ADMIN_TOKEN bearer token.
+func requireAdmin(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.Request.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "admin token required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerTenantAdmin adds the tenant management endpoints.
+func registerTenantAdmin(r *gin.Engine, tr *tenantRegistry) {
+	if tr.cfg.AdminToken == "" {
+		log.Println("ADMIN_TOKEN is not set, tenant admin endpoints are disabled")
+		return
+	}
+	admin := r.Group("/admin/tenants", requireAdmin(tr.cfg.AdminToken))
+
+	/**
+	 * GET /admin/tenants
+	 * Lists all tenants.
+	 */
+	admin.GET("", func(c *gin.Context) {
+		tenants, err := tr.List(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to list tenants"})
+			return
+		}
+		c.JSON(200, tenants)
+	})
+
+	/**
+	 * POST /admin/tenants
+	 * { "name": "acme", "quota": 1000 }
+	 * Registers a tenant and creates its database.
+	 */
+	admin.POST("", func(c *gin.Context) {
+		var req struct {
+			Name  string `json:"name"`
+			Quota *int   `json:"quota"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		quota := tr.cfg.DefaultQuota
+		if req.Quota != nil {
+			quota = *req.Quota
+		}
+		if quota < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quota must not be negative"})
+			return
+		}
+		t, err := tr.Create(c.Request.Context(), req.Name, quota)
+		switch {
+		case err == errTenantName:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case err == errTenantExists:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			log.Printf("create tenant %s: %v", req.Name, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to create tenant"})
+		default:
+			c.JSON(http.StatusCreated, t)
+		}
+	})
+
+	/**
+	 * PATCH /admin/tenants/:name
+	 * { "quota": 500 }
+	 * Changes the document quota of a tenant.
+	 */
+	admin.PATCH("/:name", func(c *gin.Context) {
+		var req struct {
+			Quota *int `json:"quota"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Quota == nil || *req.Quota < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quota must be a non-negative number"})
+			return
+		}
+		updateTenant(c, tr, func(t *Tenant) { t.Quota = *req.Quota })
+	})
+
+	// POST /admin/tenants/:name/suspend and /resume toggle access to a tenant.
+	admin.POST("/:name/suspend", func(c *gin.Context) {
+		updateTenant(c, tr, func(t *Tenant) { t.Suspended = true })
+	})
+	admin.POST("/:name/resume", func(c *gin.Context) {
+		updateTenant(c, tr, func(t *Tenant) { t.Suspended = false })
+	})
+
+	/**
+	 * DELETE /admin/tenants/:name
+	 * Deletes a tenant together with its database.
+	 */
+	admin.DELETE("/:name", func(c *gin.Context) {
+		err := tr.Delete(c.Request.Context(), c.Param("name"))
+		switch {
+		case err == errTenantNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			log.Printf("delete tenant %s: %v", c.Param("name"), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to delete tenant"})
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	})
+}
+
+func updateTenant(c *gin.Context, tr *tenantRegistry, fn func(t *Tenant)) {
+	t, err := tr.Update(c.Request.Context(), c.Param("name"), fn)
+	switch {
+	case err == errTenantNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case couchdb.Conflict(err):
+		c.JSON(http.StatusConflict, gin.H{"error": "tenant was modified concurrently, retry"})
+	case err != nil:
+		log.Printf("update tenant %s: %v", c.Param("name"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to update tenant"})
+	default:
+		c.JSON(200, t)
+	}
+}
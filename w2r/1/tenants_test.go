@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/timjacobi/go-couchdb"
+)
+
+// newTestTenants returns a registry in header mode with its databases
+// in client.
+func newTestTenants(t *testing.T, client *couchdb.Client, prefix string) *tenantRegistry {
+	t.Helper()
+	conn, err := newCouchConn(client.URL(), http.DefaultTransport, http.DefaultTransport, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants := newTenantRegistry(conn, TenantConfig{Mode: tenantModeHeader, DBPrefix: prefix, RegistryDB: "tenants"})
+	if err := tenants.init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return tenants
+}
+
+// dbNames returns the databases of client.
+func dbNames(t *testing.T, client *couchdb.Client) []string {
+	t.Helper()
+	dbs, err := client.AllDBsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbs
+}
+
+func TestTenantCreate(t *testing.T) {
+	client := newTestCouch(t)
+	tenants := newTestTenants(t, client, "tenant_")
+	ctx := context.Background()
+	if _, err := tenants.Create(ctx, "acme", 10); err != nil {
+		t.Fatal(err)
+	}
+	_, store, err := tenants.Resolve(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addVisitors(t, store, "Anna")
+
+	//A second tenant of the same name leaves the first one alone.
+	if _, err := tenants.Create(ctx, "acme", 0); err != errTenantExists {
+		t.Fatalf("Create of a taken name: got %v, want errTenantExists", err)
+	}
+	if n, err := store.Count(ctx); err != nil || n != 1 {
+		t.Errorf("Count after the second Create = %d, %v; want 1", n, err)
+	}
+	if got, err := tenants.Get(ctx, "acme"); err != nil || got.Quota != 10 {
+		t.Errorf("Get = %+v, %v", got, err)
+	}
+}
+
+func TestTenantCreateRemovesRecordWithoutDB(t *testing.T) {
+	client := newTestCouch(t)
+	//CouchDB does not allow upper case database names.
+	tenants := newTestTenants(t, client, "Tenant_")
+	ctx := context.Background()
+	if _, err := tenants.Create(ctx, "acme", 0); err == nil {
+		t.Fatal("Create succeeded with an invalid database name")
+	}
+	list, err := tenants.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("List = %+v, want no tenants", list)
+	}
+}
+
+func TestTenantCreateLeavesNoOrphanDB(t *testing.T) {
+	client := newTestCouch(t)
+	tenants := newTestTenants(t, client, "tenant_")
+	ctx := context.Background()
+	//Without the registry database the record can not be written.
+	if err := client.DeleteDBContext(ctx, "tenants"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenants.Create(ctx, "acme", 0); err == nil {
+		t.Fatal("Create succeeded without a registry")
+	}
+	if dbs := dbNames(t, client); len(dbs) != 0 {
+		t.Errorf("databases %v are left after the failed Create", dbs)
+	}
+}
+
+func TestTenantDeletedByAnotherInstance(t *testing.T) {
+	client := newTestCouch(t)
+	tenants := newTestTenants(t, client, "tenant_")
+	other := newTestTenants(t, client, "tenant_")
+	ctx := context.Background()
+	if _, err := other.Create(ctx, "acme", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenants.Get(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Delete(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	//The record is still cached, but the database is not created again.
+	if _, _, err := tenants.Resolve(ctx, "acme"); err != errTenantNotFound {
+		t.Errorf("Resolve of a deleted tenant: got %v, want errTenantNotFound", err)
+	}
+	for _, db := range dbNames(t, client) {
+		if db != "tenants" {
+			t.Errorf("database %s of the deleted tenant was created again", db)
+		}
+	}
+}
+
+func TestTenantDeleteDropsAuditDB(t *testing.T) {
+	client := newTestCouch(t)
+	tenants := newTestTenants(t, client, "tenant_")
+	ctx := context.Background()
+	tenant, err := tenants.Create(ctx, "acme", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, store, err := tenants.Resolve(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := addVisitors(t, store, "Anna")[0]
+	if err := store.AddAudit(ctx, &auditRecord{VisitorID: v.ID, Action: auditCreate, Rev: v.Rev, Actor: "test", At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DB(tenant.DB+auditDBSuffix).RevContext(ctx, "_design/audit"); err != nil {
+		t.Fatalf("audit database: %v", err)
+	}
+
+	if err := tenants.Delete(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range dbNames(t, client) {
+		if db != "tenants" {
+			t.Errorf("database %s is left after deleting the tenant", db)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How the server asks for client certificates.
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional" // verified when the client sends one
+	clientAuthRequire  = "require"
+)
+
+// serverTLSConfig holds the HTTPS settings read from the environment.
+// The server speaks plain HTTP unless CertFile is set.
+type serverTLSConfig struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ClientAuth     string
+	ReloadInterval time.Duration // how often the files are checked for changes
+}
+
+func serverTLSConfigFromEnv() serverTLSConfig {
+	cfg := serverTLSConfig{
+		CertFile:       os.Getenv("TLS_CERT_FILE"),
+		KeyFile:        os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+		ClientAuth:     clientAuthNone,
+		ReloadInterval: 10 * time.Second,
+	}
+	if cfg.ClientCAFile != "" {
+		cfg.ClientAuth = clientAuthRequire
+	}
+	if v := strings.ToLower(os.Getenv("TLS_CLIENT_AUTH")); v != "" {
+		switch v {
+		case clientAuthNone, clientAuthOptional, clientAuthRequire:
+			cfg.ClientAuth = v
+		default:
+			log.Printf("ignoring invalid TLS_CLIENT_AUTH %q", v)
+		}
+	}
+	if v := os.Getenv("TLS_RELOAD_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring invalid TLS_RELOAD_INTERVAL %q", v)
+		} else {
+			cfg.ReloadInterval = d
+		}
+	}
+	return cfg
+}
+
+// certReloader serves the certificate and client CAs of the files in
+// its config and reloads them when the files change, so that renewed
+// certificates are picked up without a restart. If a reload fails the
+// previous files stay in use.
+type certReloader struct {
+	cfg serverTLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	stamp     string // sizes and modification times of the loaded files
+
+	reloads  int64
+	failures int64
+}
+
+// newCertReloader loads the files of cfg and starts watching them.
+func newCertReloader(cfg serverTLSConfig) (*certReloader, error) {
+	if cfg.KeyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE needs TLS_KEY_FILE")
+	}
+	if cfg.ClientAuth != clientAuthNone && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH=%s needs TLS_CLIENT_CA_FILE", cfg.ClientAuth)
+	}
+	r := &certReloader{cfg: cfg}
+	stamp, err := fileStamp(r.files()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(stamp); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (r *certReloader) load(stamp string) error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		if pool, err = loadCertPool(r.cfg.ClientCAFile, nil); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.cert, r.clientCAs, r.stamp = &cert, pool, stamp
+	r.mu.Unlock()
+	return nil
+}
+
+// watch reloads the files whenever their stamp changes.
+func (r *certReloader) watch() {
+	for range time.Tick(r.cfg.ReloadInterval) {
+		stamp, err := fileStamp(r.files()...)
+		r.mu.RLock()
+		changed := err == nil && stamp != r.stamp
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		//Files are often replaced one by one, so a failed load is retried
+		//on the next tick.
+		if err := r.load(stamp); err != nil {
+			atomic.AddInt64(&r.failures, 1)
+			log.Println("Can not reload the TLS certificate, keeping the previous one:", err)
+			continue
+		}
+		atomic.AddInt64(&r.reloads, 1)
+		log.Println("Reloaded the TLS certificate from", r.cfg.CertFile)
+	}
+}
+
+// tlsConfig returns the server configuration. Every handshake uses the
+// files loaded last.
+func (r *certReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch r.cfg.ClientAuth {
+	case clientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.clientCAs,
+				ClientAuth:   clientAuth,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// writeMetrics implements metricsSource.
+func (r *certReloader) writeMetrics(w io.Writer) {
+	r.mu.RLock()
+	expiry := r.cert.Leaf.NotAfter.Unix()
+	r.mu.RUnlock()
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"tls_certificate_expiry_timestamp_seconds", "gauge", "When the served certificate expires.", expiry},
+		{"tls_certificate_reloads_total", "counter", "Reloads of changed certificate files.", atomic.LoadInt64(&r.reloads)},
+		{"tls_certificate_reload_failures_total", "counter", "Changed certificate files that could not be loaded.", atomic.LoadInt64(&r.failures)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+// loadCertPool reads the PEM certificates of file, or pem if file is
+// empty, into a new pool.
+func loadCertPool(file string, pem []byte) (*x509.CertPool, error) {
+	if file != "" {
+		var err error
+		if pem, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		if file == "" {
+			file = "CA bundle"
+		}
+		return nil, fmt.Errorf("%s: no PEM certificates found", file)
+	}
+	return pool, nil
+}
+
+// pemCredential returns a PEM value of a service binding, which may be
+// base64 encoded like the certificate_base64 fields of IBM Cloud
+// Databases.
+func pemCredential(v interface{}) []byte {
+	s, _ := v.(string)
+	if s == "" {
+		return nil
+	}
+	if strings.Contains(s, "-----BEGIN") {
+		return []byte(s)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	return decoded
+}
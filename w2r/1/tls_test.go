@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new self-signed certificate for name and its key
+// to certFile and keyFile, with the modification time at.
+func writeCert(t *testing.T, certFile, keyFile, name string, at time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName connects to a TLS listener with config and returns the
+// common name of the certificate it presents.
+func servedName(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "first", start)
+
+	r, err := newCertReloader(serverTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientAuth: clientAuthNone, ReloadInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := r.tlsConfig()
+	if name := servedName(t, config); name != "first" {
+		t.Fatalf("serving %q, want first", name)
+	}
+
+	writeCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	waitFor(t, func() bool { return atomic.LoadInt64(&r.reloads) == 1 })
+	if name := servedName(t, config); name != "second" {
+		t.Errorf("serving %q after the files changed, want second", name)
+	}
+
+	//A broken certificate is not loaded.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&r.failures) > 0 })
+	if name := servedName(t, config); name != "second" {
+		t.Errorf("serving %q after a broken reload, want second", name)
+	}
+}
+
+func TestCertReloaderConfig(t *testing.T) {
+	if _, err := newCertReloader(serverTLSConfig{CertFile: "tls.crt"}); err == nil {
+		t.Error("a certificate without a key was accepted")
+	}
+	if _, err := newCertReloader(serverTLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientAuth: clientAuthRequire}); err == nil {
+		t.Error("client authentication without client CAs was accepted")
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
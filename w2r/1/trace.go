@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Where finished spans are sent.
+const (
+	traceExporterNone   = "none"
+	traceExporterStdout = "stdout" // one JSON object per line
+	traceExporterOTLP   = "otlp"   // OTLP/HTTP with JSON encoding
+)
+
+// traceConfig holds the tracing settings read from the environment.
+type traceConfig struct {
+	Exporter    string
+	Endpoint    string  // OTLP/HTTP traces URL
+	SampleRatio float64 // share of new traces that are recorded
+	ServiceName string
+}
+
+func traceConfigFromEnv() traceConfig {
+	cfg := traceConfig{
+		Exporter:    traceExporterNone,
+		Endpoint:    "http://localhost:4318/v1/traces",
+		SampleRatio: 1,
+		ServiceName: envOr("OTEL_SERVICE_NAME", "get-started-go"),
+	}
+	if v := strings.ToLower(os.Getenv("TRACE_EXPORTER")); v != "" {
+		switch v {
+		case traceExporterNone, traceExporterStdout, traceExporterOTLP:
+			cfg.Exporter = v
+		default:
+			log.Printf("ignoring invalid TRACE_EXPORTER %q", v)
+		}
+	}
+	if v := os.Getenv("TRACE_ENDPOINT"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Printf("ignoring invalid TRACE_ENDPOINT %q", v)
+		} else {
+			cfg.Endpoint = v
+		}
+	}
+	if v := os.Getenv("TRACE_SAMPLE_RATIO"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			log.Printf("ignoring invalid TRACE_SAMPLE_RATIO %q", v)
+		} else {
+			cfg.SampleRatio = r
+		}
+	}
+	return cfg
+}
+
+// Kinds of spans, numbered as in OTLP.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+// spanContext identifies a span across processes, see
+// https://www.w3.org/TR/trace-context/.
+type spanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// parseTraceparent parses a traceparent header. Versions after 00 are
+// read as far as version 00 defines them.
+func parseTraceparent(h string) (spanContext, bool) {
+	var sc spanContext
+	h = strings.TrimSpace(h)
+	if len(h) < 55 || (len(h) > 55 && h[55] != '-') || h[2] != '-' || h[35] != '-' || h[52] != '-' {
+		return sc, false
+	}
+	version, err := hex.DecodeString(h[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(h) != 55) || strings.ToLower(h) != h {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(h[53:55])
+	if err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(h[3:35])); err != nil || sc.TraceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(h[36:52])); err != nil || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// traceparent formats sc as a version 00 traceparent header.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// span is a timed operation of a trace. Spans that are not sampled are
+// propagated but not recorded.
+type span struct {
+	tracer *tracer
+	sc     spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]interface{}
+	errMsg string
+	failed bool
+}
+
+// SetAttr sets an attribute with a string, integer, float or bool value.
+func (s *span) SetAttr(key string, value interface{}) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *span) SetError(msg string) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	s.failed, s.errMsg = true, msg
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.
+func (s *span) End() {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if !ended {
+		s.tracer.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the current span of ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// spanExporter sends finished spans to a backend.
+type spanExporter interface {
+	export(ctx context.Context, spans []*span) error
+}
+
+// tracer starts spans and exports the sampled ones in batches, so that
+// requests never wait for the backend. Spans are dropped while the queue
+// is full.
+type tracer struct {
+	cfg      traceConfig
+	exporter spanExporter
+	queue    chan *span
+	done     chan struct{} // closed when the exporter loop has stopped
+
+	mu     sync.RWMutex // held for reading while sending to queue
+	closed bool
+
+	exported int64
+	dropped  int64
+	failed   int64
+}
+
+// Limits of the span queue and of one export.
+const (
+	traceQueueSize  = 2048
+	traceBatchSize  = 512
+	traceBatchDelay = 5 * time.Second
+)
+
+// newTracer returns a tracer for cfg, or nil if tracing is off.
+func newTracer(cfg traceConfig) *tracer {
+	var exporter spanExporter
+	switch cfg.Exporter {
+	case traceExporterStdout:
+		exporter = &stdoutExporter{w: os.Stdout}
+	case traceExporterOTLP:
+		exporter = &otlpExporter{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return nil
+	}
+	t := &tracer{
+		cfg:      cfg,
+		exporter: exporter,
+		queue:    make(chan *span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	log.Printf("Tracing to %s, sampling %g of new traces", cfg.Exporter, cfg.SampleRatio)
+	return t
+}
+
+// start begins a span that is a child of the span in ctx, or of remote
+// if the context has none. New traces are sampled by SampleRatio, child
+// spans follow their parent.
+func (t *tracer) start(ctx context.Context, name string, kind int, remote *spanContext) (context.Context, *span) {
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.sc, s.parent = parent.sc, parent.sc.SpanID
+	} else if remote != nil {
+		s.sc, s.parent = *remote, remote.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = t.sample(s.sc.TraceID)
+	}
+	rand.Read(s.sc.SpanID[:])
+	if s.sc.Sampled {
+		s.attrs = make(map[string]interface{})
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample decides on a new trace from the random low half of its ID, like
+// the TraceIdRatioBased sampler of OpenTelemetry.
+func (t *tracer) sample(id [16]byte) bool {
+	if t.cfg.SampleRatio >= 1 {
+		return true
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(t.cfg.SampleRatio*(1<<63))
+}
+
+func (t *tracer) enqueue(s *span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		atomic.AddInt64(&t.dropped, 1)
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// run exports a batch once it is full or its first span waited for
+// traceBatchDelay, until the queue is closed and drained.
+func (t *tracer) run() {
+	defer close(t.done)
+	for first := range t.queue {
+		batch := []*span{first}
+		timer := time.NewTimer(traceBatchDelay)
+	collect:
+		for len(batch) < traceBatchSize {
+			select {
+			case s, ok := <-t.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, s)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		t.flush(batch)
+	}
+}
+
+func (t *tracer) flush(batch []*span) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := t.exporter.export(ctx, batch); err != nil {
+		atomic.AddInt64(&t.failed, int64(len(batch)))
+		log.Printf("Can not export %d spans: %v", len(batch), err)
+		return
+	}
+	atomic.AddInt64(&t.exported, int64(len(batch)))
+}
+
+// Shutdown exports the queued spans and waits until they are sent or ctx
+// is done.
+func (t *tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeMetrics implements metricsSource.
+func (t *tracer) writeMetrics(w io.Writer) {
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"trace_spans_exported_total", "counter", "Spans sent to TRACE_EXPORTER.", atomic.LoadInt64(&t.exported)},
+		{"trace_spans_failed_total", "counter", "Spans lost because the export failed.", atomic.LoadInt64(&t.failed)},
+		{"trace_spans_dropped_total", "counter", "Spans dropped because the export queue was full.", atomic.LoadInt64(&t.dropped)},
+		{"trace_queue_length", "gauge", "Spans waiting for export.", int64(len(t.queue))},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+// tracing starts a server span for every request. The traceparent and
+// tracestate headers of the request are honored, and the trace ID is
+// returned in the traceresponse header.
+func tracing(t *tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var remote *spanContext
+		if sc, ok := parseTraceparent(c.Request.Header.Get("traceparent")); ok {
+			sc.TraceState = c.Request.Header.Get("tracestate")
+			remote = &sc
+		}
+		ctx, s := t.start(c.Request.Context(), c.Request.Method, spanKindServer, remote)
+		defer s.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Header("traceresponse", s.sc.traceparent())
+		c.Next()
+
+		//The route is only known once the router matched the request.
+		status := c.Writer.Status()
+		if route := routeOf(c, status); route != "" {
+			s.name = c.Request.Method + " " + route
+			s.SetAttr("http.route", route)
+		}
+		s.SetAttr("http.request.method", c.Request.Method)
+		s.SetAttr("url.path", c.Request.URL.Path)
+		s.SetAttr("http.response.status_code", status)
+		s.SetAttr("user_agent.original", c.Request.UserAgent())
+		if status >= 500 {
+			s.SetError(http.StatusText(status))
+		}
+	}
+}
+
+// routeOf rebuilds the route pattern of the request from its parameters,
+// since this version of gin does not report it. Unmatched requests have
+// no route.
+func routeOf(c *gin.Context, status int) string {
+	if len(c.Params) == 0 {
+		if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+			return ""
+		}
+		return c.Request.URL.Path
+	}
+	segments := strings.Split(c.Request.URL.Path, "/")
+	for _, p := range c.Params {
+		for i, seg := range segments {
+			if seg == p.Value && seg != "" {
+				segments[i] = ":" + p.Key
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// tracingTransport starts a client span for every CouchDB request and
+// forwards it in the traceparent header. The span covers retries and
+// ends with the response headers, so a changes feed is not timed.
+type tracingTransport struct {
+	tracer *tracer
+	base   http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, s := t.tracer.start(req.Context(), "couchdb "+req.Method, spanKindClient, nil)
+	defer s.End()
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", s.sc.traceparent())
+	if s.sc.TraceState != "" {
+		req.Header.Set("tracestate", s.sc.TraceState)
+	}
+	s.SetAttr("db.system", "couchdb")
+	s.SetAttr("http.request.method", req.Method)
+	s.SetAttr("server.address", req.URL.Host)
+	s.SetAttr("url.path", req.URL.Path)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		s.SetError(err.Error())
+		return resp, err
+	}
+	s.SetAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		s.SetError(http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// stdoutExporter writes spans as JSON lines, for development.
+type stdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *stdoutExporter) export(ctx context.Context, spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		line := map[string]interface{}{
+			"trace_id":    hex.EncodeToString(s.sc.TraceID[:]),
+			"span_id":     hex.EncodeToString(s.sc.SpanID[:]),
+			"name":        s.name,
+			"start":       s.start.UTC().Format(time.RFC3339Nano),
+			"duration_ms": float64(s.end.Sub(s.start).Microseconds()) / 1000,
+			"attributes":  s.attrs,
+		}
+		if s.parent != [8]byte{} {
+			line["parent_span_id"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.failed {
+			line["error"] = s.errMsg
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter posts spans to an OpenTelemetry collector using OTLP/HTTP
+// with the JSON encoding.
+type otlpExporter struct {
+	cfg    traceConfig
+	client *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, spans []*span) error {
+	body, err := json.Marshal(otlpRequest(e.cfg.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector responded " + resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the JSON mapping of
+// OTLP, which writes IDs in hex and 64-bit integers as strings.
+func otlpRequest(service string, spans []*span) map[string]interface{} {
+	out := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		o := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.sc.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.sc.TraceState != "" {
+			o["traceState"] = s.sc.TraceState
+		}
+		if s.failed {
+			o["status"] = map[string]interface{}{"code": 2, "message": s.errMsg}
+		}
+		out[i] = o
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/IBM-Cloud/get-started-go"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timjacobi/go-couchdb"
+)
+
+// otlpSpan is a span as the collector receives it.
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	TraceState   string `json:"traceState"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Start        string `json:"startTimeUnixNano"`
+	End          string `json:"endTimeUnixNano"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+	service string
+}
+
+// attr returns the value of an attribute in its JSON mapping.
+func (s *otlpSpan) attr(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// testCollector records the spans exported to it.
+type testCollector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		service := ""
+		for _, a := range rs.Resource.Attributes {
+			if a.Key == "service.name" {
+				service = a.Value.StringValue
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				s.service = service
+				c.spans = append(c.spans, s)
+			}
+		}
+	}
+	w.Write([]byte("{}"))
+}
+
+// headerRecorder records the traceparent headers of the requests it
+// forwards.
+type headerRecorder struct {
+	mu      sync.Mutex
+	headers []string
+}
+
+func (h *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	h.headers = append(h.headers, req.Header.Get("traceparent"))
+	h.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTracingExportsSpans(t *testing.T) {
+	collector := &testCollector{}
+	hs := httptest.NewServer(collector)
+	defer hs.Close()
+	tracer := newTracer(traceConfig{Exporter: traceExporterOTLP, Endpoint: hs.URL + "/v1/traces", SampleRatio: 1, ServiceName: "test"})
+
+	recorder := &headerRecorder{}
+	client, err := couchdb.NewClient(newTestCouch(t).URL(), &tracingTransport{tracer: tracer, base: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestCouchStore(t, client, "mydb")
+	v, err := store.Add(context.Background(), Visitor{Name: "Anna"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestRouterConfig(t, store)
+	cfg.Tracer = tracer
+	app := httptest.NewServer(newRouter(cfg))
+	defer app.Close()
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parent  = "00f067aa0ba902b7"
+	)
+	recorder.mu.Lock()
+	recorder.headers = nil
+	recorder.mu.Unlock()
+	req, _ := http.NewRequest(http.MethodGet, app.URL+"/api/v1/visitors/"+v.ID, nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parent+"-01")
+	req.Header.Set("tracestate", "vendor=value")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET the visitor: %s", resp.Status)
+	}
+	tr := resp.Header.Get("traceresponse")
+	if !strings.HasPrefix(tr, "00-"+traceID+"-") || !strings.HasSuffix(tr, "-01") {
+		t.Errorf("traceresponse %q is not of trace %s", tr, traceID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	var server *otlpSpan
+	var clients []*otlpSpan
+	for i := range collector.spans {
+		s := &collector.spans[i]
+		if s.TraceID != traceID {
+			continue
+		}
+		switch s.Kind {
+		case spanKindServer:
+			server = s
+		case spanKindClient:
+			clients = append(clients, s)
+		}
+	}
+	if server == nil {
+		t.Fatalf("no server span of trace %s among %d spans", traceID, len(collector.spans))
+	}
+	if server.Name != "GET /api/v1/visitors/:id" || server.ParentSpanID != parent || server.TraceState != "vendor=value" || server.service != "test" {
+		t.Errorf("server span = %+v", *server)
+	}
+	if tr != "00-"+traceID+"-"+server.SpanID+"-01" {
+		t.Errorf("traceresponse %q does not name the server span %s", tr, server.SpanID)
+	}
+	if server.attr("http.route") != "/api/v1/visitors/:id" || server.attr("http.response.status_code") != "200" || server.attr("http.request.method") != "GET" {
+		t.Errorf("server span attributes = %+v", server.Attributes)
+	}
+	if server.Start == "" || server.End < server.Start || server.Status.Code != 0 {
+		t.Errorf("server span times %s to %s, status %d", server.Start, server.End, server.Status.Code)
+	}
+
+	//The database requests are children of the server span, and the
+	//database gets their span in the traceparent header.
+	if len(clients) == 0 {
+		t.Fatal("no database span in the trace")
+	}
+	propagated := make(map[string]bool)
+	for _, h := range recorder.headers {
+		propagated[h] = true
+	}
+	for _, s := range clients {
+		if s.ParentSpanID != server.SpanID || !strings.HasPrefix(s.Name, "couchdb ") || s.attr("db.system") != "couchdb" {
+			t.Errorf("database span = %+v", *s)
+		}
+		if h := "00-" + traceID + "-" + s.SpanID + "-01"; !propagated[h] {
+			t.Errorf("traceparent %s was not sent to the database, got %v", h, recorder.headers)
+		}
+	}
+}
+
+func TestTraceCollectorStub(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(collectTraces))
+	defer hs.Close()
+	tracer := &tracer{cfg: traceConfig{ServiceName: "test"}}
+	_, s := tracer.start(context.Background(), "GET /", spanKindServer, nil)
+	s.end = s.start.Add(time.Millisecond)
+	body, err := json.Marshal(otlpRequest("test", []*span{s}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method, contentType string
+		status              int
+	}{
+		{http.MethodPost, "application/json", http.StatusOK},
+		{http.MethodPost, "application/x-protobuf", http.StatusUnsupportedMediaType},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tc.method, hs.URL+"/v1/traces", strings.NewReader(string(body)))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s with %q: %s, want %d", tc.method, tc.contentType, resp.Status, tc.status)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var traceCollectorAddr = flag.String("trace-collector", os.Getenv("TRACE_COLLECTOR_ADDR"), "run a stub OTLP/HTTP collector on `addr` that logs the spans it receives, and export spans to it")
+
+// startTraceCollector serves a stub collector on addr and returns the
+// traces URL to export to. It accepts the JSON encoding only, which is
+// what otlpExporter sends.
+func startTraceCollector(addr string) (string, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/traces", collectTraces)
+	go func() {
+		log.Println("trace collector stub:", http.Serve(lis, mux))
+	}()
+	url := "http://" + lis.Addr().String() + "/v1/traces"
+	log.Printf("Exporting spans to the trace collector stub at %s", url)
+	return url, nil
+}
+
+// collectTraces logs one line per span of an ExportTraceServiceRequest.
+func collectTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "only the JSON encoding is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Start        string `json:"startTimeUnixNano"`
+					End          string `json:"endTimeUnixNano"`
+					Status       struct {
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				start, _ := strconv.ParseInt(s.Start, 10, 64)
+				end, _ := strconv.ParseInt(s.End, 10, 64)
+				log.Printf("span %s trace=%s span=%s parent=%s %.3fms %s", s.Name, s.TraceID, s.SpanID, s.ParentSpanID, float64(end-start)/1e6, s.Status.Message)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+	flashCookie    = "greeting"
+)
+
+// loadTemplates parses the HTML templates in dir of fsys, with asset
+// references rewritten to their fingerprinted names.
+func loadTemplates(fsys fs.FS, dir string, assets *assetStore) (*template.Template, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	t := template.New("")
+	for _, file := range files {
+		src, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New(path.Base(file)).Parse(string(assets.RewriteHTML(src))); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// indexPage is the data of the index.tmpl and visitors.tmpl templates.
+type indexPage struct {
+	Catalog  *catalog
+	Lang     string
+	Base     string // path of the index page, ends with "/"
+	Nonce    string // CSP nonce for script elements
+	Greeting string
+
+	Visitors []Visitor
+	Total    int
+	Page     int
+	Pages    int
+	PerPage  int
+	Prev     int
+	Next     int
+}
+
+// T renders a message of the page's language with the page as data.
+func (p *indexPage) T(key string) (string, error) {
+	return p.Catalog.T(key, p)
+}
+
+// pageParams reads the page and per_page query parameters.
+// ok is false if the request did not ask for a page.
+func pageParams(c *gin.Context) (page, perPage int, ok bool) {
+	page, perPage = 1, defaultPerPage
+	if v, err := strconv.Atoi(c.Query("page")); err == nil && v > 0 {
+		page, ok = v, true
+	}
+	if v, err := strconv.Atoi(c.Query("per_page")); err == nil && v > 0 {
+		perPage, ok = v, true
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return page, perPage, ok
+}
+
+// namedVisitors returns the visitors to show on a page, skipping
+// documents without a name such as design documents.
+func namedVisitors(list []visitorResource) []Visitor {
+	visitors := make([]Visitor, 0, len(list))
+	for _, v := range list {
+		if v.Name == "" {
+			continue
+		}
+		visitors = append(visitors, Visitor{Name: v.Name, Locale: v.Locale})
+	}
+	return visitors
+}
+
+// negotiate returns the offered MIME type that best matches the Accept
+// header. Unlike gin's NegotiateFormat, wildcards and a missing header
+// select the first offer.
+func negotiate(c *gin.Context, offered ...string) string {
+	if f := c.NegotiateFormat(offered...); f != "" {
+		return f
+	}
+	return offered[0]
+}
+
+// basePath returns the path of the index page that a route belongs to,
+// so that redirects keep the tenant path prefix.
+func basePath(c *gin.Context, route string) string {
+	return strings.TrimSuffix(c.Request.URL.Path, route)
+}
+
+// setFlash stores the greeting for the page the client is redirected to.
+func setFlash(c *gin.Context, base, greeting string) {
+	c.SetCookie(flashCookie, greeting, 60, base, "", false, true)
+}
+
+// takeFlash returns and clears the greeting stored by setFlash.
+func takeFlash(c *gin.Context, base string) string {
+	v, err := c.Cookie(flashCookie)
+	if err != nil || v == "" {
+		return ""
+	}
+	c.SetCookie(flashCookie, "", -1, base, "", false, true)
+	return v
+}
+
+// wantsJSON reports whether the client asked for the JSON representation
+// of a page, either with the Accept header or by requesting an API version.
+// HTML is preferred unless preferJSON is set.
+func wantsJSON(c *gin.Context, preferJSON bool) bool {
+	c.Header("Vary", "Accept, Accept-Language")
+	if _, ok := requestedAPIVersion(c); ok {
+		return true
+	}
+	offers := []string{gin.MIMEHTML, gin.MIMEJSON}
+	if preferJSON {
+		offers = []string{gin.MIMEJSON, gin.MIMEHTML}
+	}
+	return negotiate(c, offers...) == gin.MIMEJSON
+}
+
+// renderVisitors renders the index page, or only the visitor list
+// fragment if the request asks for ?partial=visitors.
+func renderVisitors(c *gin.Context, messages *i18nBundle, store VisitorStore, route string) {
+	page, perPage, _ := pageParams(c)
+	lang := messages.Negotiate(c.Query("lang"), c.Request.Header.Get("Accept-Language"))
+	base := basePath(c, route)
+	p := &indexPage{Catalog: messages.Catalog(lang), Lang: lang, Base: base, Nonce: cspNonce(c)}
+	p.Greeting = takeFlash(c, base)
+	var visitors []visitorResource
+	var total int
+	if store != nil {
+		var err error
+		if visitors, total, err = store.List(c.Request.Context(), page, perPage); err != nil {
+			log.Println(err)
+			c.String(http.StatusInternalServerError, "unable to fetch docs")
+			return
+		}
+	}
+	p.Visitors = namedVisitors(visitors)
+	p.Total, p.Page, p.PerPage = total, page, perPage
+	p.Pages = (p.Total + perPage - 1) / perPage
+	if page > 1 {
+		p.Prev = page - 1
+	}
+	if page < p.Pages {
+		p.Next = page + 1
+	}
+	c.Header("Content-Language", lang)
+	if c.Query("partial") == "visitors" {
+		c.HTML(200, "visitors.tmpl", p)
+		return
+	}
+	c.HTML(200, "index.tmpl", p)
+}
@@ -0,0 +1,413 @@
+// Code generated by protoc-gen-go.
+// source: visitor.proto
+// DO NOT EDIT!
+
+/*
+Package visitorpb is a generated protocol buffer package.
+
+It is generated from these files:
+	visitor.proto
+
+It has these top-level messages:
+	Visitor
+	CreateVisitorRequest
+	GetVisitorRequest
+	ListVisitorsRequest
+	WatchVisitorsRequest
+	VisitorEvent
+*/
+package visitorpb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type VisitorEvent_Type int32
+
+const (
+	VisitorEvent_CHANGED VisitorEvent_Type = 0
+	VisitorEvent_DELETED VisitorEvent_Type = 1
+)
+
+var VisitorEvent_Type_name = map[int32]string{
+	0: "CHANGED",
+	1: "DELETED",
+}
+var VisitorEvent_Type_value = map[string]int32{
+	"CHANGED": 0,
+	"DELETED": 1,
+}
+
+func (x VisitorEvent_Type) String() string {
+	return proto.EnumName(VisitorEvent_Type_name, int32(x))
+}
+func (VisitorEvent_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{5, 0} }
+
+// Visitor is a visitor of the guestbook. The name and the greeting are
+// HTML-escaped by the server.
+type Visitor struct {
+	Id     string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Name   string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Locale string `protobuf:"bytes,3,opt,name=locale" json:"locale,omitempty"`
+	// greeting is only set by Create.
+	Greeting string `protobuf:"bytes,4,opt,name=greeting" json:"greeting,omitempty"`
+}
+
+func (m *Visitor) Reset()                    { *m = Visitor{} }
+func (m *Visitor) String() string            { return proto.CompactTextString(m) }
+func (*Visitor) ProtoMessage()               {}
+func (*Visitor) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+type CreateVisitorRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	// lang selects the language of the greeting, the default language is
+	// used if it is empty.
+	Lang string `protobuf:"bytes,2,opt,name=lang" json:"lang,omitempty"`
+}
+
+func (m *CreateVisitorRequest) Reset()                    { *m = CreateVisitorRequest{} }
+func (m *CreateVisitorRequest) String() string            { return proto.CompactTextString(m) }
+func (*CreateVisitorRequest) ProtoMessage()               {}
+func (*CreateVisitorRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+type GetVisitorRequest struct {
+	Id string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+}
+
+func (m *GetVisitorRequest) Reset()                    { *m = GetVisitorRequest{} }
+func (m *GetVisitorRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetVisitorRequest) ProtoMessage()               {}
+func (*GetVisitorRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+type ListVisitorsRequest struct {
+	// page_size is the number of visitors read from the database at a time,
+	// at most 100.
+	PageSize int32 `protobuf:"varint,1,opt,name=page_size,json=pageSize" json:"page_size,omitempty"`
+}
+
+func (m *ListVisitorsRequest) Reset()                    { *m = ListVisitorsRequest{} }
+func (m *ListVisitorsRequest) String() string            { return proto.CompactTextString(m) }
+func (*ListVisitorsRequest) ProtoMessage()               {}
+func (*ListVisitorsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+type WatchVisitorsRequest struct {
+	// since is the update sequence to start after. Changes made before the
+	// call are skipped if it is empty.
+	Since string `protobuf:"bytes,1,opt,name=since" json:"since,omitempty"`
+}
+
+func (m *WatchVisitorsRequest) Reset()                    { *m = WatchVisitorsRequest{} }
+func (m *WatchVisitorsRequest) String() string            { return proto.CompactTextString(m) }
+func (*WatchVisitorsRequest) ProtoMessage()               {}
+func (*WatchVisitorsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+type VisitorEvent struct {
+	Type VisitorEvent_Type `protobuf:"varint,1,opt,name=type,enum=visitors.v1.VisitorEvent_Type" json:"type,omitempty"`
+	// visitor only carries the id for DELETED events.
+	Visitor *Visitor `protobuf:"bytes,2,opt,name=visitor" json:"visitor,omitempty"`
+	// seq is the update sequence of the change; pass it as since to resume.
+	Seq string `protobuf:"bytes,3,opt,name=seq" json:"seq,omitempty"`
+}
+
+func (m *VisitorEvent) Reset()                    { *m = VisitorEvent{} }
+func (m *VisitorEvent) String() string            { return proto.CompactTextString(m) }
+func (*VisitorEvent) ProtoMessage()               {}
+func (*VisitorEvent) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *VisitorEvent) GetVisitor() *Visitor {
+	if m != nil {
+		return m.Visitor
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Visitor)(nil), "visitors.v1.Visitor")
+	proto.RegisterType((*CreateVisitorRequest)(nil), "visitors.v1.CreateVisitorRequest")
+	proto.RegisterType((*GetVisitorRequest)(nil), "visitors.v1.GetVisitorRequest")
+	proto.RegisterType((*ListVisitorsRequest)(nil), "visitors.v1.ListVisitorsRequest")
+	proto.RegisterType((*WatchVisitorsRequest)(nil), "visitors.v1.WatchVisitorsRequest")
+	proto.RegisterType((*VisitorEvent)(nil), "visitors.v1.VisitorEvent")
+	proto.RegisterEnum("visitors.v1.VisitorEvent_Type", VisitorEvent_Type_name, VisitorEvent_Type_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for VisitorService service
+
+type VisitorServiceClient interface {
+	// Create greets and stores a visitor.
+	Create(ctx context.Context, in *CreateVisitorRequest, opts ...grpc.CallOption) (*Visitor, error)
+	// Get returns a single visitor.
+	Get(ctx context.Context, in *GetVisitorRequest, opts ...grpc.CallOption) (*Visitor, error)
+	// List streams all visitors.
+	List(ctx context.Context, in *ListVisitorsRequest, opts ...grpc.CallOption) (VisitorService_ListClient, error)
+	// Watch streams changes to visitors, read from the CouchDB changes feed.
+	Watch(ctx context.Context, in *WatchVisitorsRequest, opts ...grpc.CallOption) (VisitorService_WatchClient, error)
+}
+
+type visitorServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewVisitorServiceClient(cc *grpc.ClientConn) VisitorServiceClient {
+	return &visitorServiceClient{cc}
+}
+
+func (c *visitorServiceClient) Create(ctx context.Context, in *CreateVisitorRequest, opts ...grpc.CallOption) (*Visitor, error) {
+	out := new(Visitor)
+	err := grpc.Invoke(ctx, "/visitors.v1.VisitorService/Create", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *visitorServiceClient) Get(ctx context.Context, in *GetVisitorRequest, opts ...grpc.CallOption) (*Visitor, error) {
+	out := new(Visitor)
+	err := grpc.Invoke(ctx, "/visitors.v1.VisitorService/Get", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *visitorServiceClient) List(ctx context.Context, in *ListVisitorsRequest, opts ...grpc.CallOption) (VisitorService_ListClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_VisitorService_serviceDesc.Streams[0], c.cc, "/visitors.v1.VisitorService/List", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &visitorServiceListClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type VisitorService_ListClient interface {
+	Recv() (*Visitor, error)
+	grpc.ClientStream
+}
+
+type visitorServiceListClient struct {
+	grpc.ClientStream
+}
+
+func (x *visitorServiceListClient) Recv() (*Visitor, error) {
+	m := new(Visitor)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *visitorServiceClient) Watch(ctx context.Context, in *WatchVisitorsRequest, opts ...grpc.CallOption) (VisitorService_WatchClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_VisitorService_serviceDesc.Streams[1], c.cc, "/visitors.v1.VisitorService/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &visitorServiceWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type VisitorService_WatchClient interface {
+	Recv() (*VisitorEvent, error)
+	grpc.ClientStream
+}
+
+type visitorServiceWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *visitorServiceWatchClient) Recv() (*VisitorEvent, error) {
+	m := new(VisitorEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for VisitorService service
+
+type VisitorServiceServer interface {
+	// Create greets and stores a visitor.
+	Create(context.Context, *CreateVisitorRequest) (*Visitor, error)
+	// Get returns a single visitor.
+	Get(context.Context, *GetVisitorRequest) (*Visitor, error)
+	// List streams all visitors.
+	List(*ListVisitorsRequest, VisitorService_ListServer) error
+	// Watch streams changes to visitors, read from the CouchDB changes feed.
+	Watch(*WatchVisitorsRequest, VisitorService_WatchServer) error
+}
+
+func RegisterVisitorServiceServer(s *grpc.Server, srv VisitorServiceServer) {
+	s.RegisterService(&_VisitorService_serviceDesc, srv)
+}
+
+func _VisitorService_Create_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateVisitorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VisitorServiceServer).Create(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/visitors.v1.VisitorService/Create",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VisitorServiceServer).Create(ctx, req.(*CreateVisitorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VisitorService_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetVisitorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VisitorServiceServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/visitors.v1.VisitorService/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VisitorServiceServer).Get(ctx, req.(*GetVisitorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VisitorService_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListVisitorsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VisitorServiceServer).List(m, &visitorServiceListServer{stream})
+}
+
+type VisitorService_ListServer interface {
+	Send(*Visitor) error
+	grpc.ServerStream
+}
+
+type visitorServiceListServer struct {
+	grpc.ServerStream
+}
+
+func (x *visitorServiceListServer) Send(m *Visitor) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _VisitorService_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchVisitorsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VisitorServiceServer).Watch(m, &visitorServiceWatchServer{stream})
+}
+
+type VisitorService_WatchServer interface {
+	Send(*VisitorEvent) error
+	grpc.ServerStream
+}
+
+type visitorServiceWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *visitorServiceWatchServer) Send(m *VisitorEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _VisitorService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "visitors.v1.VisitorService",
+	HandlerType: (*VisitorServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Create",
+			Handler:    _VisitorService_Create_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _VisitorService_Get_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "List",
+			Handler:       _VisitorService_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _VisitorService_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "visitor.proto",
+}
+
+func init() { proto.RegisterFile("visitor.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 385 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x53, 0x4f, 0xef, 0xd2, 0x40,
+	0x10, 0xb5, 0xa5, 0xc0, 0x8f, 0xa9, 0x12, 0x1c, 0x1b, 0x53, 0x31, 0x31, 0x58, 0x2f, 0x1e, 0x4c,
+	0xf3, 0xb3, 0x1e, 0x4d, 0x8c, 0x08, 0x4d, 0x3d, 0x10, 0x0f, 0x85, 0x68, 0xe2, 0xc5, 0x94, 0x32,
+	0xa9, 0x9b, 0x60, 0x5b, 0xba, 0x6b, 0x13, 0xf8, 0x2a, 0xde, 0xfd, 0x9c, 0xa6, 0xdb, 0x2d, 0x81,
+	0x5a, 0x6e, 0xf3, 0x66, 0xde, 0x9b, 0x3f, 0xfb, 0xb2, 0xf0, 0xa8, 0x64, 0x9c, 0x89, 0xac, 0x70,
+	0xf3, 0x22, 0x13, 0x19, 0x9a, 0x0a, 0x72, 0xb7, 0x7c, 0xeb, 0x44, 0x30, 0xfc, 0x5a, 0x43, 0x1c,
+	0x83, 0xce, 0x76, 0xb6, 0x36, 0xd3, 0x5e, 0x8f, 0x42, 0x9d, 0xed, 0x10, 0xc1, 0x48, 0xa3, 0x5f,
+	0x64, 0xeb, 0x32, 0x23, 0x63, 0x7c, 0x0a, 0x83, 0x7d, 0x16, 0x47, 0x7b, 0xb2, 0x7b, 0x32, 0xab,
+	0x10, 0x4e, 0xe1, 0x2e, 0x29, 0x88, 0x04, 0x4b, 0x13, 0xdb, 0x90, 0x95, 0x33, 0x76, 0x3e, 0x80,
+	0xb5, 0x28, 0x28, 0x12, 0xa4, 0x06, 0x85, 0x74, 0xf8, 0x4d, 0x5c, 0x9c, 0xfb, 0x6b, 0x17, 0xfd,
+	0x11, 0x8c, 0x7d, 0x94, 0x26, 0xcd, 0xcc, 0x2a, 0x76, 0x5e, 0xc1, 0xe3, 0x80, 0x44, 0x4b, 0xdc,
+	0x5a, 0xd6, 0xf1, 0xe0, 0xc9, 0x8a, 0xf1, 0x86, 0xc5, 0x1b, 0xda, 0x73, 0x18, 0xe5, 0x51, 0x42,
+	0x3f, 0x38, 0x3b, 0xd5, 0x83, 0xfa, 0xe1, 0x5d, 0x95, 0x58, 0xb3, 0x13, 0x39, 0x6f, 0xc0, 0xfa,
+	0x16, 0x89, 0xf8, 0x67, 0x5b, 0x64, 0x41, 0x9f, 0xb3, 0x34, 0x6e, 0x36, 0xab, 0x81, 0xf3, 0x57,
+	0x83, 0x87, 0x8a, 0xe9, 0x97, 0x94, 0x0a, 0xf4, 0xc0, 0x10, 0xc7, 0xbc, 0x66, 0x8d, 0xbd, 0x17,
+	0xee, 0xc5, 0xb3, 0xba, 0x97, 0x44, 0x77, 0x73, 0xcc, 0x29, 0x94, 0x5c, 0x74, 0x61, 0xa8, 0x68,
+	0xf2, 0x44, 0xd3, 0xb3, 0xba, 0x64, 0x61, 0x43, 0xc2, 0x09, 0xf4, 0x38, 0x1d, 0xd4, 0x63, 0x57,
+	0xa1, 0x33, 0x03, 0xa3, 0xea, 0x87, 0x26, 0x0c, 0x17, 0x9f, 0xe7, 0x5f, 0x02, 0x7f, 0x39, 0x79,
+	0x50, 0x81, 0xa5, 0xbf, 0xf2, 0x37, 0xfe, 0x72, 0xa2, 0x79, 0x7f, 0x74, 0x18, 0xab, 0x46, 0x6b,
+	0x2a, 0x4a, 0x16, 0x13, 0xce, 0x61, 0x50, 0x5b, 0x80, 0x2f, 0xaf, 0xe6, 0x75, 0xf9, 0x32, 0xed,
+	0x5c, 0x09, 0xdf, 0x43, 0x2f, 0x20, 0x81, 0xd7, 0x67, 0xfe, 0xe7, 0xcb, 0x0d, 0xf1, 0x47, 0x30,
+	0x2a, 0x77, 0x70, 0x76, 0x55, 0xed, 0x30, 0xac, 0x5b, 0x7f, 0xaf, 0x61, 0x00, 0x7d, 0xe9, 0x55,
+	0xeb, 0x80, 0x2e, 0xff, 0xa6, 0xcf, 0x6e, 0x5a, 0x71, 0xaf, 0x7d, 0x32, 0xbf, 0x8f, 0x54, 0x35,
+	0xdf, 0x6e, 0x07, 0xf2, 0x47, 0xbc, 0xfb, 0x37, 0x00, 0x8e, 0x7b, 0xed, 0x03, 0x22, 0x03, 0x00,
+	0x00,
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// visitorResource is the transport independent model of a visitor that
+// the HTTP and gRPC handlers work with. Each apiVersion decides how it is
+// represented over HTTP.
+type visitorResource struct {
+	ID       string
+	Rev      string
+	Name     string
+	Locale   string
+	Created  time.Time // zero for visitors stored before it was recorded
+	Tags     []string
+	Deleted  time.Time // when the visitor was moved to the trash, zero otherwise
+	Greeting string    // only set for a visitor that was just created
+}
+
+// visitorList is one page of visitors.
+type visitorList struct {
+	Visitors []visitorResource
+	Total    int
+	Page     int
+	PerPage  int  // 0 if all visitors were requested
+	Offline  bool // no database is configured
+}
+
+// apiError is an error of the visitor service. Code is a stable, machine
+// readable identifier; Message is meant for humans. Status is the HTTP
+// status that the REST API responds with.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Error codes of the visitor service.
+const (
+	codeInvalidRequest = "invalid_request"
+	codeNotFound       = "not_found"
+	codeConflict       = "conflict"
+	codePrecondition   = "precondition_failed"
+	codeQuotaExceeded  = "quota_exceeded"
+	codeKeyReused      = "idempotency_key_reused"
+	codeUnavailable    = "unavailable"
+	codeInternal       = "internal"
+)
+
+var (
+	errNameRequired    = &apiError{http.StatusBadRequest, codeInvalidRequest, "name is required"}
+	errInvalidTags     = &apiError{http.StatusBadRequest, codeInvalidRequest, "tags must be at most 10 words of up to 32 letters, digits, - or _"}
+	errInvalidBookmark = &apiError{http.StatusBadRequest, codeInvalidRequest, "invalid bookmark"}
+	errNoDatabase      = &apiError{http.StatusServiceUnavailable, codeUnavailable, "no database configured"}
+	errVisitorConflict = &apiError{http.StatusConflict, codeConflict, "visitor was modified concurrently, retry"}
+	errNoVisitor       = &apiError{http.StatusNotFound, codeNotFound, "visitor not found"}
+	errNotInTrash      = &apiError{http.StatusNotFound, codeNotFound, "visitor is not in the trash"}
+	errStaleVisitor    = &apiError{http.StatusPreconditionFailed, codePrecondition, "visitor does not match If-Match"}
+	errQuotaExceeded   = &apiError{http.StatusForbidden, codeQuotaExceeded, "document quota exceeded"}
+	errWritesBusy      = &apiError{http.StatusServiceUnavailable, codeUnavailable, "too many visitors are waiting to be stored, retry"}
+	errDatabaseDown    = &apiError{http.StatusServiceUnavailable, codeUnavailable, "database is unavailable, retry later"}
+	errDatabaseTimeout = &apiError{http.StatusGatewayTimeout, codeUnavailable, "database did not respond in time"}
+	errKeyReused       = &apiError{http.StatusUnprocessableEntity, codeKeyReused, "Idempotency-Key was used for a different request"}
+	errKeyInProgress   = &apiError{http.StatusConflict, codeConflict, "a request with this Idempotency-Key is in progress, retry"}
+)
+
+// internalError logs err and hides it behind a generic message.
+func internalError(err error, message string) *apiError {
+	log.Println(err)
+	return &apiError{http.StatusInternalServerError, codeInternal, message}
+}
+
+// asAPIError converts any error returned by visitorService to an apiError.
+func asAPIError(err error) *apiError {
+	if e, ok := err.(*apiError); ok {
+		return e
+	}
+	return internalError(err, "internal error")
+}
+
+// storeError converts the errors of a VisitorStore. message describes
+// the failed operation for other errors, which are logged.
+func storeError(err error, message string) error {
+	switch err {
+	case errStoreNotFound:
+		return errNoVisitor
+	case errStoreConflict:
+		return errVisitorConflict
+	case errStoreBusy:
+		return errWritesBusy
+	case errStoreBadBookmark:
+		return errInvalidBookmark
+	}
+	switch {
+	case errors.Is(err, errBreakerOpen):
+		return errDatabaseDown
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		//The deadline of the request passed or the client went away.
+		return errDatabaseTimeout
+	}
+	return internalError(err, message)
+}
+
+// visitorService implements the visitor operations shared by the REST
+// API and the gRPC service. Every method takes the store of the current
+// tenant; a nil store means that no database is configured.
+type visitorService struct {
+	messages *i18nBundle
+}
+
+// Create greets and stores a visitor. lang overrides the negotiation of
+// acceptLanguage. tenant is nil when the app does not run in tenant mode.
+func (s *visitorService) Create(ctx context.Context, store VisitorStore, tenant *Tenant, name string, tags []string, lang, acceptLanguage string) (*visitorResource, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, errNameRequired
+	}
+	tags, ok := normalizeTags(tags)
+	if !ok {
+		return nil, errInvalidTags
+	}
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	lang = s.messages.Negotiate(lang, acceptLanguage)
+	visitor := Visitor{Name: name, Locale: lang, Created: time.Now().UTC().Format(createdLayout), Tags: tags}
+	greeting, err := s.messages.Catalog(lang).T("greeting", visitor)
+	if err != nil {
+		return nil, internalError(err, "unable to render greeting")
+	}
+	ok, err = checkQuota(ctx, tenant, store)
+	if err != nil {
+		return nil, storeError(err, "unable to check quota")
+	}
+	if !ok {
+		return nil, errQuotaExceeded
+	}
+	v, err := store.Add(ctx, visitor)
+	if err != nil {
+		return nil, storeError(err, "unable to store visitor")
+	}
+	s.audit(ctx, store, auditCreate, v.ID, v.Rev, "", nil, v)
+	v.Greeting = greeting
+	return v, nil
+}
+
+// Get returns a single visitor. Visitors in the trash are not found.
+func (s *visitorService) Get(ctx context.Context, store VisitorStore, id string) (*visitorResource, error) {
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	return s.get(ctx, store, id)
+}
+
+// get is Get for a store that is set.
+func (s *visitorService) get(ctx context.Context, store VisitorStore, id string) (*visitorResource, error) {
+	v, err := store.Get(ctx, id)
+	if err != nil {
+		return nil, storeError(err, "unable to fetch visitor")
+	}
+	if !v.Deleted.IsZero() {
+		return nil, errNoVisitor
+	}
+	return v, nil
+}
+
+// List returns one page of visitors. perPage 0 returns all of them.
+// Without a store the list is empty and marked as offline.
+func (s *visitorService) List(ctx context.Context, store VisitorStore, page, perPage int) (*visitorList, error) {
+	if store == nil {
+		return &visitorList{Offline: true}, nil
+	}
+	visitors, total, err := store.List(ctx, page, perPage)
+	if err != nil {
+		return nil, storeError(err, "unable to fetch docs")
+	}
+	return &visitorList{Visitors: visitors, Total: total, Page: page, PerPage: perPage}, nil
+}
+
+// Scan returns up to limit visitors after the given ID and the ID to
+// continue with, which is empty after the last visitor.
+func (s *visitorService) Scan(ctx context.Context, store VisitorStore, after string, limit int) ([]visitorResource, string, error) {
+	if store == nil {
+		return nil, "", errNoDatabase
+	}
+	visitors, next, err := store.Scan(ctx, after, limit)
+	if err != nil {
+		return nil, "", storeError(err, "unable to fetch docs")
+	}
+	return visitors, next, nil
+}
+
+// Search returns the first perPage visitors whose names match query.
+func (s *visitorService) Search(ctx context.Context, store VisitorStore, query string, perPage int) (*visitorList, error) {
+	if store == nil {
+		return &visitorList{Offline: true}, nil
+	}
+	visitors, err := store.Search(ctx, query, perPage)
+	if err != nil {
+		return nil, storeError(err, "unable to search visitors")
+	}
+	return &visitorList{Visitors: visitors, Total: len(visitors), Page: 1, PerPage: perPage}, nil
+}
+
+// Find returns up to limit visitors that match f, after the page that
+// bookmark came with, and the bookmark of the next page.
+func (s *visitorService) Find(ctx context.Context, store VisitorStore, f *visitorFilter, bookmark string, limit int) ([]visitorResource, string, error) {
+	if store == nil {
+		return nil, "", errNoDatabase
+	}
+	visitors, next, err := store.Find(ctx, f, bookmark, limit)
+	if err != nil {
+		return nil, "", storeError(err, "unable to search visitors")
+	}
+	return visitors, next, nil
+}
+
+// Stats counts the visitors by locale.
+func (s *visitorService) Stats(ctx context.Context, store VisitorStore) (*visitorStats, error) {
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		return nil, storeError(err, "unable to count visitors")
+	}
+	return stats, nil
+}
+
+// Update renames a visitor. An empty locale keeps the current one.
+// ifMatch is the If-Match header of the request; the update fails with
+// errStaleVisitor unless it lists the ETag of the current revision.
+func (s *visitorService) Update(ctx context.Context, store VisitorStore, id, name, locale, ifMatch string) (*visitorResource, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, errNameRequired
+	}
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	v, err := s.get(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" && !strongETagMatches(ifMatch, revETag(v.Rev)) {
+		return nil, errStaleVisitor
+	}
+	before := *v
+	v.Name = name
+	if locale != "" {
+		v.Locale = s.messages.Negotiate(locale, "")
+	}
+	if err := store.Update(ctx, v); err != nil {
+		return nil, preconditionError(storeError(err, "unable to update visitor"), ifMatch)
+	}
+	s.audit(ctx, store, auditUpdate, id, v.Rev, before.Rev, &before, v)
+	return v, nil
+}
+
+// Delete moves a visitor to the trash by setting its deleted_at time,
+// which hides it from Get and the lists until it is restored or purged.
+// ifMatch works like for Update.
+func (s *visitorService) Delete(ctx context.Context, store VisitorStore, id, ifMatch string) error {
+	if store == nil {
+		return errNoDatabase
+	}
+	v, err := s.get(ctx, store, id)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !strongETagMatches(ifMatch, revETag(v.Rev)) {
+		return errStaleVisitor
+	}
+	before := *v
+	v.Deleted = time.Now().UTC()
+	if err := store.Update(ctx, v); err != nil {
+		return preconditionError(storeError(err, "unable to delete visitor"), ifMatch)
+	}
+	s.audit(ctx, store, auditDelete, id, v.Rev, before.Rev, &before, v)
+	return nil
+}
+
+// Trash returns up to limit visitors in the trash, longest deleted
+// first, after the page that bookmark came with, and the bookmark of
+// the next page.
+func (s *visitorService) Trash(ctx context.Context, store VisitorStore, bookmark string, limit int) ([]visitorResource, string, error) {
+	if store == nil {
+		return nil, "", errNoDatabase
+	}
+	visitors, next, err := store.Trash(ctx, bookmark, limit)
+	if err != nil {
+		return nil, "", storeError(err, "unable to list the trash")
+	}
+	return visitors, next, nil
+}
+
+// trashed returns a visitor in the trash.
+func (s *visitorService) trashed(ctx context.Context, store VisitorStore, id string) (*visitorResource, error) {
+	v, err := store.Get(ctx, id)
+	if err == errStoreNotFound || err == nil && v.Deleted.IsZero() {
+		return nil, errNotInTrash
+	} else if err != nil {
+		return nil, storeError(err, "unable to fetch visitor")
+	}
+	return v, nil
+}
+
+// Undelete takes a visitor out of the trash. ifMatch works like for
+// Update.
+func (s *visitorService) Undelete(ctx context.Context, store VisitorStore, id, ifMatch string) (*visitorResource, error) {
+	if store == nil {
+		return nil, errNoDatabase
+	}
+	v, err := s.trashed(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" && !strongETagMatches(ifMatch, revETag(v.Rev)) {
+		return nil, errStaleVisitor
+	}
+	before := *v
+	v.Deleted = time.Time{}
+	if err := store.Update(ctx, v); err != nil {
+		return nil, preconditionError(storeError(err, "unable to restore visitor"), ifMatch)
+	}
+	s.audit(ctx, store, auditRestore, id, v.Rev, before.Rev, &before, v)
+	return v, nil
+}
+
+// Purge removes a visitor from the trash for good. ifMatch works like
+// for Update.
+func (s *visitorService) Purge(ctx context.Context, store VisitorStore, id, ifMatch string) error {
+	if store == nil {
+		return errNoDatabase
+	}
+	v, err := s.trashed(ctx, store, id)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !strongETagMatches(ifMatch, revETag(v.Rev)) {
+		return errStaleVisitor
+	}
+	return preconditionError(s.purge(ctx, store, v), ifMatch)
+}
+
+// purge deletes the document of v at its revision. The audit record
+// keeps every field of v, so that its history stays complete.
+func (s *visitorService) purge(ctx context.Context, store VisitorStore, v *visitorResource) error {
+	if err := store.Delete(ctx, v.ID, v.Rev); err != nil {
+		return storeError(err, "unable to purge visitor")
+	}
+	s.audit(ctx, store, auditPurge, v.ID, "", v.Rev, v, nil)
+	return nil
+}
+
+// preconditionError reports a write that lost a race with another one
+// as errStaleVisitor if the client asked for a revision with If-Match.
+func preconditionError(err error, ifMatch string) error {
+	if err == errVisitorConflict && ifMatch != "" {
+		return errStaleVisitor
+	}
+	return err
+}
+
+// UpdateSeq returns the update sequence of the store, from which the
+// ETags of lists are derived.
+func (s *visitorService) UpdateSeq(ctx context.Context, store VisitorStore) (string, error) {
+	if store == nil {
+		return "", errNoDatabase
+	}
+	seq, err := store.UpdateSeq(ctx)
+	if err != nil {
+		return "", storeError(err, "unable to read update sequence")
+	}
+	return seq, nil
+}
+
+// visitorFromDoc converts a CouchDB document to a visitorResource.
+func visitorFromDoc(doc map[string]interface{}) visitorResource {
+	var v visitorResource
+	v.ID, _ = doc["_id"].(string)
+	v.Rev, _ = doc["_rev"].(string)
+	v.Name, _ = doc["name"].(string)
+	v.Locale, _ = doc["locale"].(string)
+	if created, ok := doc["created_at"].(string); ok {
+		v.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	tags, _ := doc["tags"].([]interface{})
+	for _, t := range tags {
+		if t, ok := t.(string); ok {
+			v.Tags = append(v.Tags, t)
+		}
+	}
+	if deleted, ok := doc["deleted_at"].(string); ok {
+		v.Deleted, _ = time.Parse(time.RFC3339, deleted)
+	}
+	return v
+}
+
+// resource returns the visitorResource of v once it is stored.
+func (v Visitor) resource(id, rev string) *visitorResource {
+	created, _ := time.Parse(time.RFC3339, v.Created)
+	return &visitorResource{ID: id, Rev: rev, Name: v.Name, Locale: v.Locale, Created: created, Tags: v.Tags}
+}
+
+// createdLayout formats creation times with a fixed number of digits.
+// They are stored in UTC, so that CouchDB can compare them as strings.
+const createdLayout = "2006-01-02T15:04:05.000Z07:00"
+
+const maxTags = 10
+
+var tagPattern = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{Nd}][\p{Ll}\p{Lo}\p{Nd}_-]{0,31}$`)
+
+// normalizeTags lower-cases tags and drops duplicates. It reports false
+// if there are more than maxTags or one of them is not a word.
+func normalizeTags(tags []string) ([]string, bool) {
+	if len(tags) > maxTags {
+		return nil, false
+	}
+	var out []string
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !tagPattern.MatchString(t) {
+			return nil, false
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out, true
+}